@@ -1,19 +1,58 @@
 // Example is a binary that loads the droplogger and packetlogger for testing
 // and development of Rhine and or mods for it.
+//
+// Options are read from the JSON config file specified by the -config flag,
+// which is generated with the default options if it doesn't exist. Flags that
+// are explicitly set override the values in the config file.
+//
+// The cert subcommand regenerates the CA, e.g., `example cert -key-type ecdsa`,
+// its flags default to the CA options of the config file.
+//
+// The stats subcommand prints the drop rates estimated from the recorded
+// battles, e.g., `example stats -stage main_01-07`. The export subcommand
+// exports the recorded history to CSV or XLSX, e.g.,
+// `example export -format xlsx -o history.xlsx`.
+//
+// The bundle subcommand packages a user's packet logs, gamestate, redacted
+// config and gamedata version into a session bundle for bug reports, e.g.,
+// `example bundle -user GL_12345678 -o bundle.zip`, which the import
+// subcommand extracts, e.g., `example import -o bundle bundle.zip`. The diff
+// subcommand compares two bundles or session snapshots, e.g.,
+// `example diff before.zip after.zip`. The query subcommand prints the logged
+// packets matching a query as JSON lines, e.g.,
+// `example query -op 'S/*' -path playerDataDelta.modified.status.ap -changed`.
+//
+// The doctor subcommand checks the config, the CA, the listen ports, the
+// connectivity to the game servers and the gamedata cache, printing how to
+// fix each problem found, e.g., `example doctor`.
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	_ "github.com/kyoukaya/rhine/mods/baseefficiency"
 	_ "github.com/kyoukaya/rhine/mods/droplogger"
 	_ "github.com/kyoukaya/rhine/mods/packetlogger"
+	_ "github.com/kyoukaya/rhine/mods/sanitynotifier"
 
+	"github.com/kyoukaya/rhine/packetlog"
 	"github.com/kyoukaya/rhine/proxy"
+	"github.com/kyoukaya/rhine/replay"
+	"github.com/kyoukaya/rhine/utils"
 )
 
 var env string
 
+var configPath = flag.String("config", "config.json", "JSON config file to load options from")
 var logPath = flag.String("log-path", "logs/proxy.log", "file to output the log to")
 var silent = flag.Bool("silent", false, "don't print anything to stdout")
 var filter = flag.Bool("filter", false, "enable the host filter")
@@ -22,24 +61,355 @@ var verboseGoProxy = flag.Bool("v-goproxy", false, "print verbose goproxy messag
 var host = flag.String("host", ":8080", "hostname:port")
 var disableCertStore = flag.Bool("disable-cert-store", false, "disables the built in certstore, reduces memory usage but increases HTTP latency and CPU usage")
 var noUnknownJSON = flag.Bool("no-unk-json", false, "disallows unknown fields when unmarshalling json in the gamestate module")
+var worker = flag.Bool("worker", false, "run the modules as the worker of a front proxy started with the same config")
+var exportCA = flag.String("export-ca", "", "export the CA in every format to the given directory and exit")
+var exportPassword = flag.String("export-password", "", "password of the PKCS#12 archive written by -export-ca, which is skipped if empty")
+var dryRun = flag.Bool("dry-run", false, "log the changes modules would make to packets but forward them unmodified")
+var safeMode = flag.Bool("safe-mode", false, "start with every module disabled except those listed by -safe-mode-modules")
+var safeModeModules = flag.String("safe-mode-modules", "", "comma separated names of the modules to load in safe mode")
+var clientCert = flag.String("client-cert", "", "mint a client certificate with the given name for the admin listener and exit")
+
+func loadOptions() *proxy.Options {
+	options, err := proxy.LoadOptions(*configPath)
+	if os.IsNotExist(err) {
+		options = &proxy.Options{
+			LogPath: *logPath,
+			Address: *host,
+			Modules: []string{},
+		}
+		if err := proxy.SaveOptions(*configPath, options); err != nil {
+			log.Println(err)
+		}
+	} else if err != nil {
+		log.Fatalln(err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "log-path":
+			options.LogPath = *logPath
+		case "silent":
+			options.LogDisableStdOut = *silent
+		case "filter":
+			options.EnableHostFilter = *filter
+		case "v":
+			options.Verbose = *verbose
+		case "v-goproxy":
+			options.VerboseGoProxy = *verboseGoProxy
+		case "host":
+			options.Address = *host
+		case "disable-cert-store":
+			options.DisableCertStore = *disableCertStore
+		case "no-unk-json":
+			options.NoUnknownJSON = *noUnknownJSON
+		case "dry-run":
+			options.DryRun = *dryRun
+		case "safe-mode":
+			options.SafeMode = *safeMode
+		case "safe-mode-modules":
+			options.SafeModeModules = nil
+			for _, name := range strings.Split(*safeModeModules, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					options.SafeModeModules = append(options.SafeModeModules, name)
+				}
+			}
+		}
+	})
+	return options
+}
+
+// generateCA implements the cert subcommand.
+func generateCA(args []string) {
+	ca := loadOptions().CA
+	flags := flag.NewFlagSet("cert", flag.ExitOnError)
+	flags.StringVar(&ca.KeyType, "key-type", ca.KeyType, "key type of the CA, rsa or ecdsa")
+	flags.IntVar(&ca.KeySize, "key-size", ca.KeySize, "RSA key size in bits, or ECDSA curve size (256, 384 or 521)")
+	flags.IntVar(&ca.ValidityDays, "validity-days", ca.ValidityDays, "days the CA is valid for")
+	flags.StringVar(&ca.CommonName, "cn", ca.CommonName, "common name of the CA")
+	flags.StringVar(&ca.Organization, "org", ca.Organization, "organization of the CA")
+	flags.StringVar(&ca.OrganizationalUnit, "ou", ca.OrganizationalUnit, "organizational unit of the CA")
+	flags.StringVar(&ca.Country, "country", ca.Country, "country of the CA")
+	flags.StringVar(&ca.KeyStorage, "key-storage", ca.KeyStorage, "where to store the CA key, file, encrypted or keychain")
+	flags.Parse(args)
+	if err := proxy.GenerateCA(&ca); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("CA's key and cert saved in '%s'.", utils.BinDir)
+	log.Printf("Copy and register the created 'cert.pem' with your client.")
+}
+
+// printDropStats implements the stats subcommand.
+func printDropStats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	user := flags.String("user", "", "only include the runs of a region_UID, e.g., GL_12345678")
+	stage := flags.String("stage", "", "only print the drop rates of a stage ID, e.g., main_01-07")
+	flags.Parse(args)
+	store, err := proxy.OpenStore(loadOptions())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	stats, err := proxy.LoadDropStats(store, *user, *stage)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(stats) == 0 {
+		log.Println("No drops recorded.")
+	}
+	for i := range stats {
+		fmt.Println(proxy.FormatDropStats(&stats[i]))
+	}
+}
+
+// exportHistory implements the export subcommand.
+func exportHistory(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", proxy.ExportCSV, "format to export to, csv or xlsx")
+	dataset := flags.String("dataset", "", "dataset to export, one of "+strings.Join(proxy.HistoryDatasets, ", ")+
+		", required for csv and every dataset if empty for xlsx")
+	user := flags.String("user", "", "only export the history of a region_UID, e.g., GL_12345678")
+	out := flags.String("o", "", "file to write to, stdout if empty")
+	flags.Parse(args)
+	store, err := proxy.OpenStore(loadOptions())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	err = proxy.ExportHistory(w, store, *format, *dataset, *user)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// exportBundle implements the bundle subcommand.
+func exportBundle(args []string) {
+	flags := flag.NewFlagSet("bundle", flag.ExitOnError)
+	user := flags.String("user", "", "region_UID of the user to bundle, e.g., GL_12345678")
+	out := flags.String("o", "", "file to write the bundle to, defaults to {user}.zip")
+	flags.Parse(args)
+	if *user == "" {
+		log.Fatalln("-user is required")
+	}
+	if *out == "" {
+		*out = *user + ".zip"
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	manifest, err := proxy.ExportBundle(f, loadOptions(), *user)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(*out)
+		log.Fatalln(err)
+	}
+	log.Printf("Bundled %d packet logs of %s to %s, gamestate included: %t", len(manifest.Logs), *user, *out, manifest.Session)
+}
+
+// importBundle implements the import subcommand.
+func importBundle(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	out := flags.String("o", "", "directory to extract the bundle to, defaults to the bundle's name without extension")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalln("Usage: import [-o dir] bundle.zip")
+	}
+	path := flags.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	manifest, err := proxy.ImportBundle(path, *out)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Extracted the bundle of %s created at %s to %s", manifest.User, manifest.Created.Format(time.RFC3339), *out)
+	if manifest.Session {
+		log.Printf("POST session.json to /session on the admin listener to resume the user.")
+	}
+}
+
+// diffSessions implements the diff subcommand.
+func diffSessions(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the differences as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatalln("Usage: diff [-json] before.zip after.zip")
+	}
+	diff, err := proxy.DiffSessions(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		_ = enc.Encode(diff)
+		return
+	}
+	fmt.Print(diff.Format())
+}
+
+// stringsFlag is a flag which may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// queryPackets implements the query subcommand.
+func queryPackets(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	values := url.Values{}
+	var users, ops stringsFlag
+	flags.Var(&users, "user", "region_UID whose packets to query, e.g., GL_12345678, may be repeated")
+	flags.Var(&ops, "op", "op to query, e.g., S/quest/battleFinish or S/quest/*, may be repeated")
+	from := flags.String("from", "", "only query packets logged from this RFC 3339 time")
+	to := flags.String("to", "", "only query packets logged until this RFC 3339 time")
+	contains := flags.String("contains", "", "only query packets whose body contains this substring")
+	path := flags.String("path", "", "gjson path of the value of each packet to print, e.g., playerDataDelta.modified.status.ap")
+	changed := flags.Bool("changed", false, "only print the packets whose value changed")
+	flags.Parse(args)
+	values["user"], values["op"] = users, ops
+	values.Set("from", *from)
+	values.Set("to", *to)
+	values.Set("contains", *contains)
+	values.Set("path", *path)
+	values.Set("changed", strconv.FormatBool(*changed))
+	q, err := proxy.ParsePacketQuery(values)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	err = packetlog.Run(packetlog.Dir(), q, func(r *packetlog.Result) bool {
+		return enc.Encode(r) == nil
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// replayRecording implements the replay subcommand, dispatching a recording of
+// Options.RecordPath to the configured modules without serving the proxy.
+func replayRecording(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	var users stringsFlag
+	flags.Var(&users, "user", "region_UID whose packets to replay, e.g., GL_12345678, may be repeated")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalln("usage: replay [-user GL_12345678] recording.jsonl")
+	}
+	src, err := replay.NewSource(flags.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer src.Close()
+	src.Users = users
+	options := loadOptions()
+	options.RecordPath = ""
+	rhine := proxy.NewProxy(options)
+	n, err := rhine.Replay(src)
+	rhine.Stop()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Replayed %d packets", n)
+}
+
+// runDoctor implements the doctor subcommand, exiting with 1 if a check failed.
+func runDoctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	flags.Parse(args)
+	ok := true
+	for _, check := range proxy.Doctor(*configPath) {
+		if check.OK {
+			fmt.Printf("[ OK ] %s\n", check.Name)
+			continue
+		}
+		ok = false
+		fmt.Printf("[FAIL] %s: %s\n       %s\n", check.Name, check.Problem, check.Fix)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "cert" {
+		generateCA(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "stats" {
+		printDropStats(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "export" {
+		exportHistory(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "bundle" {
+		exportBundle(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "import" {
+		importBundle(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "diff" {
+		diffSessions(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "query" {
+		queryPackets(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "replay" {
+		replayRecording(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "doctor" {
+		runDoctor(flag.Args()[1:])
+		return
+	}
+	if *exportCA != "" {
+		paths, err := proxy.ExportCA(*exportCA, *exportPassword, &loadOptions().CA)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, path := range paths {
+			log.Printf("CA exported to %s", path)
+		}
+		return
+	}
+	if *clientCert != "" {
+		certPath, keyPath := *clientCert+".pem", *clientCert+"-key.pem"
+		if err := proxy.GenerateClientCert(*clientCert, certPath, keyPath, &loadOptions().CA); err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("Client certificate saved to %s and %s", certPath, keyPath)
+		return
+	}
 	logFlags := log.Llongfile | log.Ltime
 	if env == "release" {
 		logFlags = log.Lshortfile | log.Ltime
 	}
-	options := &proxy.Options{
-		LogPath:          *logPath,
-		LogDisableStdOut: *silent,
-		EnableHostFilter: *filter,
-		LoggerFlags:      logFlags,
-		Verbose:          *verbose,
-		VerboseGoProxy:   *verboseGoProxy,
-		Address:          *host,
-		DisableCertStore: *disableCertStore,
-		NoUnknownJSON:    *noUnknownJSON,
-	}
+	options := loadOptions()
+	options.LoggerFlags = logFlags
 	rhine := proxy.NewProxy(options)
-	rhine.Start()
+	if *worker {
+		rhine.StartWorker()
+	} else {
+		rhine.Start()
+	}
 }
@@ -3,9 +3,9 @@ Package rhine provides a modular framework to interact with the game traffic of
 Arknights.
 
 Modules can only be registered at compile time with imports.
-Each module should register itself by calling proxy.RegisterMod at program start up, either in the init() function or otherwise.
+Each module should register itself by calling proxy.RegisterInitFunc at program start up, either in the init() function or otherwise.
 The initFunc provided will be called when a user authenticates with the game server to set up an instance of the module for that user.
-While the ShutdownCb return value allows a module to clean up after itself when shutting down gracefully.
+While the callback registered with OnShutdown allows a module to clean up after itself when shutting down gracefully.
 Here's an example:
 
 	package yourmodule
@@ -25,15 +25,20 @@ Here's an example:
 
 	func (modState) cleanUp(shuttingDown bool) {}
 
-	func initFunc(d *proxy.Dispatch) ([]*proxy.PacketHook, proxy.ShutdownCb) {
-		mod := modState{}
-		return []*proxy.PacketHook{
-			proxy.NewPacketHook(modName, "S/quest/battleStart", 0, mod.handle),
-		}, mod.cleanUp
+	func initFunc(mod *proxy.RhineModule) {
+		state := modState{}
+
+		mod.OnShutdown(state.cleanUp)
+		mod.Hook("S/quest/battleStart", 0, state.handle)
 	}
 
 	func init() {
-		proxy.RegisterMod(modName, initFunc)
+		proxy.RegisterInitFunc(modName, initFunc)
 	}
+
+The module API is versioned by proxy.APIVersion. Modules written against the
+previous major version, which returned their hooks from the init function and
+registered with proxy.RegisterMod, are still supported through an adapter but a
+deprecation warning is logged for each of them when the proxy is created.
 */
 package rhine
@@ -0,0 +1,209 @@
+// Package events provides a simple topic based event bus which Rhine and its
+// modules use to publish and subscribe to events that are not tied to a single
+// packet, e.g., gamedata updates or domain events derived from game traffic.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/metrics"
+	"github.com/kyoukaya/rhine/queue"
+)
+
+// Wildcard is the topic which receives every event published on a Bus.
+const Wildcard = "*"
+
+const inheritPolicy = -1
+
+// Event is a single event published on a Bus. UID and Region are left as their
+// zero values for events which are not associated with a particular user.
+type Event struct {
+	Topic   string
+	UID     int
+	Region  string
+	Time    time.Time
+	Payload interface{}
+	// Origin identifies the instance which published the event if it was
+	// received from another instance, empty for local events.
+	Origin string
+}
+
+var droppedEvents = metrics.NewCounter("rhine_events_dropped_total",
+	"Number of events dropped because of full listeners.")
+
+// Bus dispatches published events to subscribers of the event's topic and of
+// the Wildcard topic. What happens when a listener's chan is full is decided
+// by the bus' policy, by default the event is dropped for that listener
+// without blocking the publisher.
+type Bus struct {
+	mutex   sync.RWMutex
+	subs    map[string][]*Subscription
+	log     log.Logger
+	policy  queue.Policy
+	dropped uint64
+}
+
+// Subscription is a listener attached to a Bus.
+type Subscription struct {
+	topic    string
+	listener chan Event
+	filter   func(Event) bool
+	bus      *Bus
+	// policy overrides the bus' policy unless it is inheritPolicy, accessed
+	// atomically.
+	policy int32
+}
+
+// Default is the process wide Bus used by packages which are not tied to a
+// particular proxy instance, such as gamedata.
+var Default = NewBus(nil)
+
+// NewBus returns a new Bus, warnings about dropped events are sent to the
+// logger if it is not nil.
+func NewBus(logger log.Logger) *Bus {
+	return &Bus{
+		subs: make(map[string][]*Subscription),
+		log:  logger,
+	}
+}
+
+// SetLogger sets the logger which the Bus reports dropped events to.
+func (b *Bus) SetLogger(logger log.Logger) {
+	b.mutex.Lock()
+	b.log = logger
+	b.mutex.Unlock()
+}
+
+// SetPolicy sets the policy used when a listener's chan is full for
+// subscriptions which don't set their own. queue.Block blocks the publisher
+// until the listener has room, queue.DropOldest discards the oldest event in
+// the listener's chan, which requires the chan to be buffered.
+func (b *Bus) SetPolicy(policy queue.Policy) {
+	b.mutex.Lock()
+	b.policy = policy
+	b.mutex.Unlock()
+}
+
+// Subscribe attaches listener to the topic, the Wildcard topic may be used to
+// receive all events.
+func (b *Bus) Subscribe(topic string, listener chan Event) *Subscription {
+	return b.SubscribeFilter(topic, listener, nil)
+}
+
+// SubscribeFilter attaches listener to the topic, only delivering events for
+// which filter returns true. A nil filter accepts all events.
+func (b *Bus) SubscribeFilter(topic string, listener chan Event, filter func(Event) bool) *Subscription {
+	sub := &Subscription{
+		topic:    topic,
+		listener: listener,
+		filter:   filter,
+		bus:      b,
+		policy:   inheritPolicy,
+	}
+	b.mutex.Lock()
+	b.subs[topic] = append(b.subs[topic], sub)
+	b.mutex.Unlock()
+	return sub
+}
+
+// Publish delivers the event to all matching subscribers, the Time field is
+// set to the current time if it is zero.
+func (b *Bus) Publish(evt Event) {
+	if evt.Time.IsZero() {
+		evt.Time = time.Now()
+	}
+	// Unhook replaces the slice of subscriptions, so the slices taken here can
+	// be iterated over without holding the lock, which would otherwise deadlock
+	// a blocked publisher with a listener unhooking itself.
+	b.mutex.RLock()
+	subs, wildcard := b.subs[evt.Topic], b.subs[Wildcard]
+	policy, logger := b.policy, b.log
+	b.mutex.RUnlock()
+	b.deliver(subs, evt, policy, logger)
+	if evt.Topic != Wildcard {
+		b.deliver(wildcard, evt, policy, logger)
+	}
+}
+
+func (b *Bus) deliver(subs []*Subscription, evt Event, policy queue.Policy, logger log.Logger) {
+	for _, sub := range subs {
+		if sub.filter != nil && !sub.filter(evt) {
+			continue
+		}
+		p := policy
+		if custom := atomic.LoadInt32(&sub.policy); custom != inheritPolicy {
+			p = queue.Policy(custom)
+		}
+		if !send(sub.listener, evt, p) {
+			atomic.AddUint64(&b.dropped, 1)
+			droppedEvents.Inc()
+			if logger != nil {
+				logger.Warnf("events: %s event dropped for a listener of %s", evt.Topic, sub.topic)
+			}
+		}
+	}
+}
+
+// send delivers evt to listener according to the policy, returning false if
+// an event was dropped.
+func send(listener chan Event, evt Event, policy queue.Policy) bool {
+	switch {
+	case policy == queue.Block:
+		listener <- evt
+		return true
+	case policy == queue.DropOldest && cap(listener) > 0:
+		delivered := true
+		for {
+			select {
+			case listener <- evt:
+				return delivered
+			default:
+			}
+			select {
+			case <-listener:
+				delivered = false
+			default:
+			}
+		}
+	}
+	select {
+	case listener <- evt:
+		return true
+	default:
+		return false
+	}
+}
+
+// Dropped returns the number of events dropped because of full listeners.
+func (b *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// SetPolicy overrides the bus' policy for the subscription, it returns the
+// subscription for chaining.
+func (sub *Subscription) SetPolicy(policy queue.Policy) *Subscription {
+	atomic.StoreInt32(&sub.policy, int32(policy))
+	return sub
+}
+
+// Unhook detaches the subscription from its Bus. Fails silently if called on a
+// nil or already unhooked subscription. Events published concurrently may still
+// be sent to the listener after Unhook returns, so it must not be closed.
+func (sub *Subscription) Unhook() {
+	if sub == nil {
+		return
+	}
+	b := sub.bus
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	subs := b.subs[sub.topic]
+	for i, s := range subs {
+		if s == sub {
+			b.subs[sub.topic] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
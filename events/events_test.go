@@ -0,0 +1,72 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/kyoukaya/rhine/queue"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	bus := NewBus(nil)
+	topicChan := make(chan Event, 1)
+	wildChan := make(chan Event, 2)
+	sub := bus.Subscribe("test", topicChan)
+	bus.Subscribe(Wildcard, wildChan)
+	bus.Publish(Event{Topic: "test", Payload: 1})
+	bus.Publish(Event{Topic: "other"})
+	evt := <-topicChan
+	if evt.Payload.(int) != 1 || evt.Time.IsZero() {
+		t.Fatalf("Unexpected event %#v", evt)
+	}
+	if len(wildChan) != 2 {
+		t.Fatal("Wildcard listener should receive all events")
+	}
+	sub.Unhook()
+	bus.Publish(Event{Topic: "test"})
+	if len(topicChan) != 0 {
+		t.Fatal("Received event after unhooking")
+	}
+}
+
+func TestDropped(t *testing.T) {
+	bus := NewBus(nil)
+	listener := make(chan Event)
+	bus.SubscribeFilter("test", listener, func(evt Event) bool { return evt.UID == 1 })
+	bus.Publish(Event{Topic: "test", UID: 2})
+	if bus.Dropped() != 0 {
+		t.Fatal("Filtered event should not count as dropped")
+	}
+	bus.Publish(Event{Topic: "test", UID: 1})
+	if bus.Dropped() != 1 {
+		t.Fatal("Expected event to be dropped on a full listener")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	bus := NewBus(nil)
+	oldest := make(chan Event, 2)
+	newest := make(chan Event, 2)
+	bus.Subscribe("test", oldest).SetPolicy(queue.DropOldest)
+	bus.Subscribe("test", newest)
+	for i := 0; i < 3; i++ {
+		bus.Publish(Event{Topic: "test", Payload: i})
+	}
+	if evt := <-oldest; evt.Payload.(int) != 1 {
+		t.Fatalf("DropOldest should have dropped the first event, got %v", evt.Payload)
+	}
+	if evt := <-newest; evt.Payload.(int) != 0 {
+		t.Fatalf("DropNewest should have kept the first event, got %v", evt.Payload)
+	}
+	if bus.Dropped() != 2 {
+		t.Fatalf("Expected 2 dropped events, got %d", bus.Dropped())
+	}
+
+	bus = NewBus(nil)
+	bus.SetPolicy(queue.Block)
+	blocking := make(chan Event)
+	bus.Subscribe("test", blocking)
+	go bus.Publish(Event{Topic: "test", Payload: 1})
+	if evt := <-blocking; evt.Payload.(int) != 1 || bus.Dropped() != 0 {
+		t.Fatal("Block should wait for the listener")
+	}
+}
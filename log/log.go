@@ -8,6 +8,9 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kyoukaya/rhine/utils"
 
@@ -31,12 +34,43 @@ type Log struct {
 	fileLogger   *stdLog.Logger
 	stdOutLogger *stdLog.Logger
 	verbose      bool
+	// module is set on the loggers returned by WithModule, which share the
+	// subscribers of the logger they were derived from.
+	module      string
+	subscribers *subscribers
+	// extraLogger is set on the loggers returned by WithOutput.
+	extraLogger *stdLog.Logger
 }
 
-// New sets up and returns a new instance of Logger.
+// Entry is a line logged by a Log, see Log.Subscribe.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Level is "INFO", "VERB" or "WARN".
+	Level string `json:"level"`
+	// Module is the name of the module which logged the line, empty for the
+	// proxy's own lines.
+	Module  string `json:"module,omitempty"`
+	Message string `json:"message"`
+}
+
+type subscribers struct {
+	mutex sync.Mutex
+	next  int
+	fns   map[int]func(*Entry)
+}
+
+// New sets up and returns a new instance of Logger, panicking if Open fails.
 func New(stdOut, verbose bool, filePath string, flags int) Logger {
+	logger, err := Open(stdOut, verbose, filePath, flags)
+	utils.Check(err)
+	return logger
+}
+
+// Open sets up and returns a new instance of Logger, or an error if the log
+// file could not be created.
+func Open(stdOut, verbose bool, filePath string, flags int) (Logger, error) {
 	// Support for colored stdout output on windows.
-	logger := &Log{verbose: verbose}
+	logger := &Log{verbose: verbose, subscribers: &subscribers{fns: make(map[int]func(*Entry))}}
 	var output io.Writer
 	if runtime.GOOS == "windows" {
 		output = colorable.NewColorableStdout()
@@ -47,7 +81,7 @@ func New(stdOut, verbose bool, filePath string, flags int) Logger {
 		logger.stdOutLogger = stdLog.New(output, "", flags)
 	}
 	if filePath == "/dev/null" {
-		return logger
+		return logger, nil
 	}
 	if filePath == "" {
 		filePath = utils.BinDir + "/logs/proxy.log"
@@ -55,25 +89,93 @@ func New(stdOut, verbose bool, filePath string, flags int) Logger {
 		filePath = utils.BinDir + "/" + filePath
 	}
 	dir := path.Dir(filePath)
-	err := os.MkdirAll(dir, 0755)
-	utils.Check(err)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
 	f, err := os.Create(filePath)
-	utils.Check(err)
+	if err != nil {
+		return nil, err
+	}
 	logger.fileLogger = stdLog.New(f, "", flags)
-	return logger
+	return logger, nil
 }
 
 // Flush all buffers associated with the standard logger, if any.
 func (log *Log) Flush() {}
 
+// WithModule returns a logger writing to the same outputs, whose entries are
+// attributed to the module.
+func (log *Log) WithModule(module string) *Log {
+	l := *log
+	l.module = module
+	return &l
+}
+
+// WithOutput returns a logger writing to the same outputs and to w, e.g., a
+// file of the lines concerning a single user. Errors writing to w are
+// ignored.
+func (log *Log) WithOutput(w io.Writer) *Log {
+	flags := stdLog.Ltime
+	if log.fileLogger != nil {
+		flags = log.fileLogger.Flags()
+	} else if log.stdOutLogger != nil {
+		flags = log.stdOutLogger.Flags()
+	}
+	l := *log
+	l.extraLogger = stdLog.New(w, "", flags)
+	return &l
+}
+
+// Subscribe calls fn with every entry logged by the logger and the loggers
+// derived from it with WithModule until unsubscribe is called. fn is called
+// synchronously and must not block.
+func (log *Log) Subscribe(fn func(*Entry)) (unsubscribe func()) {
+	subs := log.subscribers
+	subs.mutex.Lock()
+	id := subs.next
+	subs.next++
+	subs.fns[id] = fn
+	subs.mutex.Unlock()
+	return func() {
+		subs.mutex.Lock()
+		delete(subs.fns, id)
+		subs.mutex.Unlock()
+	}
+}
+
+func (log *Log) publish(prefix, str string) {
+	subs := log.subscribers
+	if subs == nil {
+		return
+	}
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+	if len(subs.fns) == 0 {
+		return
+	}
+	entry := &Entry{
+		Time:    time.Now(),
+		Level:   strings.TrimSpace(prefix),
+		Module:  log.module,
+		Message: strings.TrimSuffix(str, "\n"),
+	}
+	for _, fn := range subs.fns {
+		fn(entry)
+	}
+}
+
 func (log *Log) output(calldepth int, color func(interface{}) aurora.Value, prefix, str string) {
 	if log == nil {
 		return
 	}
 	calldepth++
+	log.publish(prefix, str)
 	if log.fileLogger != nil {
 		utils.Check(log.fileLogger.Output(calldepth, prefix+str))
 	}
+	if log.extraLogger != nil {
+		_ = log.extraLogger.Output(calldepth, prefix+str)
+	}
 	if log.stdOutLogger != nil {
 		if color != nil {
 			prefix = color(prefix).String()
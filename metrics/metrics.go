@@ -0,0 +1,240 @@
+// Package metrics provides counters and gauges which Rhine and its modules use
+// to expose their internals, e.g., the number of items dropped by slow
+// consumers. Metrics can be written in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	name, help string
+	value      uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.value, n) }
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.value) }
+
+// Gauge is a value which may go up and down.
+type Gauge struct {
+	name, help string
+	value      int64
+}
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(v int64) { atomic.StoreInt64(&g.value, v) }
+
+// Add adds n to the gauge, n may be negative.
+func (g *Gauge) Add(n int64) { atomic.AddInt64(&g.value, n) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 { return atomic.LoadInt64(&g.value) }
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+func (c *Counter) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+	return err
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.Value())
+	return err
+}
+
+// GaugeVec is a gauge partitioned by the values of its labels, e.g., a gauge
+// per user.
+type GaugeVec struct {
+	name, help string
+	labels     []string
+	mutex      sync.Mutex
+	gauges     map[string]*Gauge
+}
+
+// labelPairs formats the labels of a series, e.g., `{user="GL_1"}`.
+func (v *GaugeVec) labelPairs(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range v.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// With returns the gauge of the label values, which are given in the order of
+// the labels the GaugeVec was registered with.
+func (v *GaugeVec) With(values ...string) *Gauge {
+	pairs := v.labelPairs(values)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	g, ok := v.gauges[pairs]
+	if !ok {
+		g = &Gauge{name: v.name + pairs}
+		v.gauges[pairs] = g
+	}
+	return g
+}
+
+// Delete removes the gauge of the label values.
+func (v *GaugeVec) Delete(values ...string) {
+	pairs := v.labelPairs(values)
+	v.mutex.Lock()
+	delete(v.gauges, pairs)
+	v.mutex.Unlock()
+}
+
+// Reset removes every gauge.
+func (v *GaugeVec) Reset() {
+	v.mutex.Lock()
+	v.gauges = make(map[string]*Gauge)
+	v.mutex.Unlock()
+}
+
+func (v *GaugeVec) write(w io.Writer) error {
+	v.mutex.Lock()
+	series := make([]string, 0, len(v.gauges))
+	for pairs := range v.gauges {
+		series = append(series, pairs)
+	}
+	sort.Strings(series)
+	values := make([]int64, len(series))
+	for i, pairs := range series {
+		values[i] = v.gauges[pairs].Value()
+	}
+	v.mutex.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", v.name, v.help, v.name); err != nil {
+		return err
+	}
+	for i, pairs := range series {
+		if _, err := fmt.Fprintf(w, "%s%s %d\n", v.name, pairs, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registry is a named collection of metrics.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]metric
+}
+
+// Default is the registry used by Rhine's packages.
+var Default = NewRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Counter returns the counter registered under name, registering a new counter
+// if there isn't one. Panics if name is registered as a different type.
+func (r *Registry) Counter(name, help string) *Counter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		return m.(*Counter)
+	}
+	c := &Counter{name: name, help: help}
+	r.metrics[name] = c
+	return c
+}
+
+// Gauge returns the gauge registered under name, registering a new gauge if
+// there isn't one. Panics if name is registered as a different type.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		return m.(*Gauge)
+	}
+	g := &Gauge{name: name, help: help}
+	r.metrics[name] = g
+	return g
+}
+
+// GaugeVec returns the gauge vector registered under name, registering a new
+// one with the labels if there isn't one. Panics if name is registered as a
+// different type.
+func (r *Registry) GaugeVec(name, help string, labels ...string) *GaugeVec {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		return m.(*GaugeVec)
+	}
+	v := &GaugeVec{name: name, help: help, labels: labels, gauges: make(map[string]*Gauge)}
+	r.metrics[name] = v
+	return v
+}
+
+// WriteText writes every metric in the registry to w in the Prometheus text
+// format, ordered by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mutex.Unlock()
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the registry's metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = r.WriteText(w)
+}
+
+// NewCounter returns the counter registered under name in the Default registry.
+func NewCounter(name, help string) *Counter {
+	return Default.Counter(name, help)
+}
+
+// NewGauge returns the gauge registered under name in the Default registry.
+func NewGauge(name, help string) *Gauge {
+	return Default.Gauge(name, help)
+}
+
+// NewGaugeVec returns the gauge vector registered under name in the Default
+// registry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.GaugeVec(name, help, labels...)
+}
@@ -0,0 +1,75 @@
+// Package baseefficiency computes the production efficiency of a user's base
+// from the gamestate and the base skills in the gamedata, flagging operators
+// which are likely assigned suboptimally. A proxy.BaseReport is published on
+// proxy.TopicBaseReport after each login and periodically thereafter.
+package baseefficiency
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kyoukaya/rhine/proxy"
+	"github.com/kyoukaya/rhine/scheduler"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	modName = "Base Efficiency"
+	// reportInterval is the interval between reports while the user is
+	// connected.
+	reportInterval = time.Hour
+	reportJob      = "report"
+)
+
+type modState struct {
+	gameData *gamedata.GameData
+	*proxy.RhineModule
+}
+
+func (mod *modState) report() {
+	table, err := mod.gameData.GetBuildingInfo()
+	if err != nil {
+		mod.Warnln(err)
+		return
+	}
+	report, err := proxy.ComputeBaseReport(fmt.Sprintf("%s_%d", mod.Region, mod.UID), mod.GetGameState(), table)
+	if err != nil {
+		mod.Warnln(err)
+		return
+	}
+	for _, flag := range report.Flags {
+		if flag.Alternative != "" {
+			mod.Verbosef("%s: %s in %s, %s, consider %s", modName, flag.CharID, flag.SlotID, flag.Reason, flag.Alternative)
+		} else {
+			mod.Verbosef("%s: %s in %s, %s", modName, flag.CharID, flag.SlotID, flag.Reason)
+		}
+	}
+	mod.Publish(proxy.TopicBaseReport, report)
+}
+
+func (mod *modState) syncDataHandler(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+	// GetGameState blocks until the sync data has been parsed.
+	go mod.report()
+	return data
+}
+
+func initFunc(mod *proxy.RhineModule) {
+	gd, err := mod.GameData()
+	if err != nil {
+		mod.Warnln(err)
+		return
+	}
+	state := &modState{gameData: gd, RhineModule: mod}
+	s := mod.Scheduler()
+	s.Handle(reportJob, func(*scheduler.Job) { state.report() })
+	if err := s.Every(reportJob, reportJob, reportInterval, nil); err != nil {
+		mod.Warnln(err)
+	}
+	mod.Hook("S/account/syncData", 0, state.syncDataHandler)
+}
+
+func init() {
+	proxy.RegisterOptionalInitFunc(modName, initFunc)
+}
@@ -13,13 +13,13 @@ import (
 	"time"
 
 	"github.com/kyoukaya/rhine/proxy"
+	"github.com/kyoukaya/rhine/proxy/semantic"
 	"github.com/kyoukaya/rhine/utils"
 	"github.com/kyoukaya/rhine/utils/gamedata"
 	"github.com/kyoukaya/rhine/utils/gamedata/itemtable"
 	"github.com/kyoukaya/rhine/utils/gamedata/stagetable"
 
 	"github.com/elazarl/goproxy"
-	"github.com/tidwall/gjson"
 )
 
 const modName = "Drop Logger"
@@ -27,9 +27,7 @@ const modName = "Drop Logger"
 type modState struct {
 	fileLogger  *log.Logger
 	mutex       sync.Mutex
-	currStage   string
 	stageStartT *time.Time
-	isPractice  bool
 
 	*proxy.RhineModule
 	gd         *gamedata.GameData
@@ -37,6 +35,12 @@ type modState struct {
 	stageTable *stagetable.StageTable
 }
 
+type reward struct {
+	ID    string `json:"id"`
+	Count int64  `json:"count"`
+	Type  string `json:"type"`
+}
+
 type logEntry struct {
 	Ts      time.Time `json:"ts"`
 	Rating  bool      `json:"ra"` // is 3star
@@ -56,53 +60,36 @@ func (mod *modState) logDrops(rewards []reward, is3Star bool) {
 	mod.fileLogger.Println(string(b))
 }
 
-func (mod *modState) battleFinishHandler(_ string, data []byte, _ *goproxy.ProxyCtx) []byte {
+// OnBattleFinished logs the drops of completed battles, leaving out LMD.
+func (mod *modState) OnBattleFinished(battle *semantic.BattleFinished) {
 	mod.mutex.Lock()
-	go mod.battleFinish(data)
-	return data
-}
-
-func (mod *modState) battleFinish(data []byte) {
 	defer mod.mutex.Unlock()
-	if raw := gjson.GetBytes(data, "alert").Raw; raw != "" && raw != "[]" {
-		mod.Warnf("Unexpected value when '[]' expected: %s", raw)
-	}
-	battle, err := unmarshalBattleFinish(data)
-	if err != nil {
-		mod.Warnln(err)
-	}
-	if mod.isPractice || battle.ExpScale == 0 {
+	if battle.Practice || !battle.Completed {
 		return
 	}
 	var rewards []reward
-	for _, r := range [][]reward{battle.Rewards, battle.UnusualRewards, battle.AdditionalRewards, battle.FurnitureRewards} {
-		for _, x := range r {
-			// Don't log gold or items with 0 count
-			if x.Count > 0 && x.ID != "4001" {
-				rewards = append(rewards, x)
-			}
-		}
-	}
 	sbuilder := strings.Builder{}
-	for _, reward := range rewards {
-		if reward.Count > 0 {
-			sbuilder.WriteString("\"")
-			sbuilder.WriteString(mod.itemTable.Items[reward.ID].Name)
-			sbuilder.WriteString("\"x")
-			sbuilder.WriteString(strconv.Itoa(int(reward.Count)))
-			sbuilder.WriteString(" ")
+	for _, drop := range battle.Drops {
+		if drop.ID == "4001" {
+			continue
 		}
+		rewards = append(rewards, reward{ID: drop.ID, Count: drop.Count, Type: drop.Type})
+		sbuilder.WriteString("\"")
+		sbuilder.WriteString(mod.itemTable.Items[drop.ID].Name)
+		sbuilder.WriteString("\"x")
+		sbuilder.WriteString(strconv.Itoa(int(drop.Count)))
+		sbuilder.WriteString(" ")
 	}
-	mod.logDrops(rewards, battle.ExpScale == 1.2)
+	mod.logDrops(rewards, battle.ThreeStar())
 	dropStr := strings.TrimRight(sbuilder.String(), " ")
 	mod.Printf("Stage %s completed in %ds, drops: %s",
-		mod.stageTable.Stages[mod.currStage].Code,
+		mod.stageTable.Stages[battle.StageID].Code,
 		int(time.Since(*mod.stageStartT).Seconds()),
 		dropStr,
 	)
 }
 
-func (mod *modState) battleStartRoutine(data []byte) {
+func (mod *modState) battleStartRoutine() {
 	defer mod.mutex.Unlock()
 	if mod.stageTable == nil || mod.itemTable == nil {
 		var err error
@@ -115,16 +102,13 @@ func (mod *modState) battleStartRoutine(data []byte) {
 			mod.Warnln(err)
 		}
 	}
-	mod.isPractice = gjson.GetBytes(data, "usePracticeTicket").Bool()
-	mod.currStage = gjson.GetBytes(data, "stageId").String()
 }
 
 func (mod *modState) battleStartHandler(op string, data []byte, ctx *goproxy.ProxyCtx) []byte {
-	reqCtx := proxy.GetRequestContext(ctx)
 	t := time.Now()
-	mod.stageStartT = &t
 	mod.mutex.Lock()
-	go mod.battleStartRoutine(reqCtx.RequestData)
+	mod.stageStartT = &t
+	go mod.battleStartRoutine()
 	return data
 }
 
@@ -132,22 +116,25 @@ func initFunc(mod *proxy.RhineModule) {
 	dir := fmt.Sprintf("%s/logs/%s/", utils.BinDir, modName)
 	err := os.MkdirAll(dir, 0755)
 	utils.Check(err)
-	f, err := os.OpenFile(fmt.Sprintf("%s%s_%s.log", dir, mod.Region, strconv.Itoa(mod.UID)),
+	f, err := os.OpenFile(dir+mod.Key+".log",
 		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
 	utils.Check(err)
 	defer f.Close()
 	fileLogger := log.New(f, "", 0)
-	gd, err := gamedata.New(mod.Region, mod.Logger)
-	utils.Check(err)
-	state := modState{
+	gd, err := mod.GameData()
+	if err != nil {
+		mod.Warnln(err)
+		return
+	}
+	state := &modState{
 		fileLogger:  fileLogger,
 		gd:          gd,
 		RhineModule: mod,
 	}
-	mod.Hook("S/quest/battleFinish", 0, state.battleFinishHandler)
+	mod.Bind(state)
 	mod.Hook("S/quest/battleStart", 0, state.battleStartHandler)
 }
 
 func init() {
-	proxy.RegisterInitFunc(modName, initFunc)
+	proxy.RegisterOptionalInitFunc(modName, initFunc)
 }
@@ -1,19 +1,20 @@
 // Package packetlogger logs all packets into a log file at
-// "logs/Packet Logger/{region}_{UID}/{TIMESTAMP}.log".
+// "logs/Packet Logger/{region}_{UID}/{TIMESTAMP}.log", which is created when
+// the first packet is logged, or into the packet storage configured by the
+// proxy, see proxy.PacketStorageOptions. Only the packets of users matching the proxy's
+// capture filter are logged, see proxy.CaptureFilter.
 // Warning, these can take up quite a lot of space over time and does not
-// automatically rotate old logs.
+// automatically rotate old logs. The logs can be read with the packetlog
+// package.
 package packetlogger
 
 import (
-	"bufio"
 	"fmt"
-	"log"
-	"os"
-	"strconv"
+	"sync"
 	"time"
 
+	"github.com/kyoukaya/rhine/packetlog"
 	"github.com/kyoukaya/rhine/proxy"
-	"github.com/kyoukaya/rhine/utils"
 
 	"github.com/elazarl/goproxy"
 )
@@ -21,37 +22,59 @@ import (
 const modName = "Packet Logger"
 
 type rawPacketLoggerState struct {
-	fileLogger *log.Logger
-	buffer     *bufio.Writer
+	mutex  sync.Mutex
+	writer packetlog.PacketWriter
 	*proxy.RhineModule
 }
 
+// logger returns the writer of the packet log, creating the log if needed.
+func (state *rawPacketLoggerState) logger() (packetlog.PacketWriter, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.writer != nil {
+		return state.writer, nil
+	}
+	rUID := fmt.Sprintf("%s_%d", state.Region, state.UID)
+	writer, err := state.PacketStorage().Create(rUID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	state.writer = writer
+	return state.writer, nil
+}
+
 func (state *rawPacketLoggerState) handle(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
-	go state.fileLogger.Printf("[%s] %s\n", op, string(data))
+	if !state.Captured() {
+		return data
+	}
+	logger, err := state.logger()
+	if err != nil {
+		state.Warnf("%s: %s", modName, err)
+		return data
+	}
+	go logger.WritePacket(time.Now(), op, data)
 	return data
 }
 
 func (state *rawPacketLoggerState) Shutdown(bool) {
 	state.Printf("Shutting down packetLogger for %d\n", state.UID)
-	state.buffer.Flush()
+	state.mutex.Lock()
+	if state.writer != nil {
+		if err := state.writer.Close(); err != nil {
+			state.Warnf("%s: %s", modName, err)
+		}
+		state.writer = nil
+	}
+	state.mutex.Unlock()
 }
 
 func initFunc(mod *proxy.RhineModule) {
-	dir := fmt.Sprintf("%s/logs/%s/%s_%s/", utils.BinDir, modName, mod.Region, strconv.Itoa(mod.UID))
-	err := os.MkdirAll(dir, 0755)
-	utils.Check(err)
-	now := time.Now()
-	f, err := os.Create(fmt.Sprintf("%s%s.log", dir, now.Format("2006-01-02_15.04.05")))
-	utils.Check(err)
-	buffer := bufio.NewWriter(f)
-	logger := log.New(buffer, "", log.Ltime)
-	state := &rawPacketLoggerState{logger, buffer, mod}
-
+	state := &rawPacketLoggerState{RhineModule: mod}
 	mod.OnShutdown(state.Shutdown)
 	mod.Hook("*", 0, state.handle)
 }
 
 // Register hooks with dispatch
 func init() {
-	proxy.RegisterInitFunc(modName, initFunc)
+	proxy.RegisterOptionalInitFunc(modName, initFunc)
 }
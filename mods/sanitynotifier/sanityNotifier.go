@@ -0,0 +1,113 @@
+// Package sanitynotifier tracks the sanity of a user and notifies the user via
+// the attached logger and the proxy's notifier when their sanity is about to
+// reach, or has reached its cap.
+package sanitynotifier
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/proxy"
+	"github.com/kyoukaya/rhine/proxy/gamestate"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	modName = "Sanity Notifier"
+	// warnAhead is how long before the sanity cap is reached the user is warned.
+	warnAhead = 30 * time.Minute
+)
+
+type modState struct {
+	mutex     sync.Mutex
+	warnTimer *time.Timer
+	fullTimer *time.Timer
+	events    chan gamestate.StateEvent
+	done      chan struct{}
+	*proxy.RhineModule
+}
+
+// reschedule recomputes the time at which sanity would be capped and resets
+// the timers accordingly.
+func (mod *modState) reschedule() {
+	current, _, full, err := mod.Sanity()
+	if err != nil {
+		mod.Warnln(err)
+		return
+	}
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	mod.stopTimers()
+	select {
+	case <-mod.done:
+		// Shut down while the state was being read.
+		return
+	default:
+	}
+	untilFull := time.Until(full)
+	if untilFull <= 0 {
+		return
+	}
+	mod.Verbosef("%s: sanity %d, capped in %s", modName, current, untilFull.Round(time.Second))
+	if untilFull > warnAhead {
+		mod.warnTimer = time.AfterFunc(untilFull-warnAhead, func() {
+			mod.Printf("%s: sanity will be capped in %s", modName, warnAhead)
+			mod.Notify("Sanity almost capped", "Sanity will be capped in "+warnAhead.String(), notify.Normal)
+		})
+	}
+	mod.fullTimer = time.AfterFunc(untilFull, func() {
+		mod.Printf("%s: sanity is capped!", modName)
+		mod.Notify("Sanity capped", "Sanity is capped!", notify.Critical)
+	})
+}
+
+func (mod *modState) stopTimers() {
+	if mod.warnTimer != nil {
+		mod.warnTimer.Stop()
+	}
+	if mod.fullTimer != nil {
+		mod.fullTimer.Stop()
+	}
+}
+
+func (mod *modState) listen() {
+	for {
+		select {
+		case <-mod.events:
+			mod.reschedule()
+		case <-mod.done:
+			return
+		}
+	}
+}
+
+func (mod *modState) syncDataHandler(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+	// StateGet blocks until the sync data has been parsed.
+	go mod.reschedule()
+	return data
+}
+
+func (mod *modState) shutdown(bool) {
+	close(mod.done)
+	mod.mutex.Lock()
+	mod.stopTimers()
+	mod.mutex.Unlock()
+}
+
+func initFunc(mod *proxy.RhineModule) {
+	state := &modState{
+		events:      make(chan gamestate.StateEvent, 8),
+		done:        make(chan struct{}),
+		RhineModule: mod,
+	}
+	go state.listen()
+	mod.OnShutdown(state.shutdown)
+	mod.StateHook("status.ap", state.events, true)
+	mod.Hook("S/account/syncData", 0, state.syncDataHandler)
+}
+
+func init() {
+	proxy.RegisterOptionalInitFunc(modName, initFunc)
+}
@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Desktop is a Backend showing notifications on the desktop of the machine
+// running Rhine, using notify-send (libnotify) on Linux and BSDs, osascript
+// on macOS, and a PowerShell toast on Windows.
+type Desktop struct {
+	// AppName is shown as the source of the notification where supported.
+	AppName string
+}
+
+// NewDesktop returns a Desktop backend.
+func NewDesktop() *Desktop {
+	return &Desktop{AppName: "Rhine"}
+}
+
+// Name implements Backend.
+func (d *Desktop) Name() string { return "desktop" }
+
+// Send implements Backend.
+func (d *Desktop) Send(n *Notification) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := "display notification " + appleScriptQuote(n.Body) +
+			" with title " + appleScriptQuote(d.AppName) +
+			" subtitle " + appleScriptQuote(n.Title)
+		if n.Urgency == Critical {
+			script += ` sound name "default"`
+		}
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			windowsToastScript(d.AppName, n.Title, n.Body))
+	case "linux", "freebsd", "openbsd", "netbsd", "dragonfly":
+		cmd = exec.Command("notify-send", "-a", d.AppName, "-u", n.Urgency.String(), "--", n.Title, n.Body)
+	default:
+		return errors.New("Desktop notifications are not supported on " + runtime.GOOS)
+	}
+	return run(cmd)
+}
+
+func appleScriptQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func powershellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;").Replace(s)
+}
+
+// powershellAppID is the AppUserModelID of PowerShell, which is registered by
+// its Start menu shortcut. Toasts of IDs without one are silently dropped.
+const powershellAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// windowsToastScript builds a PowerShell script which shows a toast through the
+// WinRT notification API, attributed to appName as it's shown as PowerShell's.
+func windowsToastScript(appName, title, body string) string {
+	toast := "<toast><visual><binding template=\"ToastGeneric\"><text>" + xmlEscape(title) +
+		"</text><text>" + xmlEscape(body) + "</text><text placement=\"attribution\">" + xmlEscape(appName) +
+		"</text></binding></visual></toast>"
+	return strings.Join([]string{
+		"[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null",
+		"[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null",
+		"$xml = New-Object Windows.Data.Xml.Dom.XmlDocument",
+		"$xml.LoadXml(" + powershellQuote(toast) + ")",
+		"$toast = [Windows.UI.Notifications.ToastNotification]::new($xml)",
+		"[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(" + powershellQuote(powershellAppID) + ").Show($toast)",
+	}, "; ")
+}
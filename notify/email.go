@@ -0,0 +1,240 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+const (
+	defaultSubjectTemplate = "[Rhine] {{.Title}}"
+	defaultBodyTemplate    = "{{.Body}}\n\n{{if .UID}}{{.Region}}_{{.UID}} {{end}}{{.Time.Format \"2006-01-02 15:04:05\"}}\n"
+	digestSubjectTemplate  = "[Rhine] {{len .}} notifications"
+)
+
+// EmailOptions configures the Email backend.
+type EmailOptions struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"` // Defaults to 587, port 465 uses implicit TLS.
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// SubjectTemplate and BodyTemplate are text/template templates executed
+	// with a *Notification.
+	SubjectTemplate string `json:"subjectTemplate"`
+	BodyTemplate    string `json:"bodyTemplate"`
+	// DigestInterval batches notifications which aren't Critical into a single
+	// email sent at most once per interval, e.g., "30m". Disabled if empty.
+	DigestInterval string `json:"digestInterval"`
+}
+
+// Email is a Backend sending notifications by email over SMTP.
+type Email struct {
+	opts     EmailOptions
+	subject  *template.Template
+	body     *template.Template
+	interval time.Duration
+	log      log.Logger
+
+	mutex   sync.Mutex
+	pending []*Notification
+	timer   *time.Timer
+	// send is swapped out in tests.
+	send func(subject, body string) error
+}
+
+// NewEmail returns an Email backend, the templates and digest interval are
+// validated on creation. Digests which fail to send are logged to the logger and
+// retried after the digest interval.
+func NewEmail(opts EmailOptions, logger log.Logger) (*Email, error) {
+	if opts.Host == "" || opts.From == "" || len(opts.To) == 0 {
+		return nil, errors.New("Email notifications require a host, from and to address")
+	}
+	if opts.Port == 0 {
+		opts.Port = 587
+	}
+	if opts.SubjectTemplate == "" {
+		opts.SubjectTemplate = defaultSubjectTemplate
+	}
+	if opts.BodyTemplate == "" {
+		opts.BodyTemplate = defaultBodyTemplate
+	}
+	e := &Email{opts: opts, log: logger}
+	var err error
+	if e.subject, err = template.New("subject").Parse(opts.SubjectTemplate); err != nil {
+		return nil, err
+	}
+	if e.body, err = template.New("body").Parse(opts.BodyTemplate); err != nil {
+		return nil, err
+	}
+	if opts.DigestInterval != "" {
+		if e.interval, err = time.ParseDuration(opts.DigestInterval); err != nil {
+			return nil, err
+		}
+	}
+	e.send = e.sendMail
+	return e, nil
+}
+
+// Name implements Backend.
+func (e *Email) Name() string { return "email" }
+
+// Send implements Backend. Notifications are batched into a digest if a digest
+// interval is configured, unless they are Critical.
+func (e *Email) Send(n *Notification) error {
+	if e.interval <= 0 || n.Urgency == Critical {
+		subject, body, err := e.render(n)
+		if err != nil {
+			return err
+		}
+		return e.send(subject, body)
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.pending = append(e.pending, n)
+	if e.timer == nil {
+		e.timer = time.AfterFunc(e.interval, e.flushDigest)
+	}
+	return nil
+}
+
+func (e *Email) flushDigest() {
+	if err := e.Flush(); err != nil {
+		e.log.Warnf("notify: email failed to send digest: %s", err)
+	}
+}
+
+// Flush sends the pending digest immediately, if any. The notifications are
+// queued again for the next digest if it could not be sent.
+func (e *Email) Flush() error {
+	e.mutex.Lock()
+	pending := e.pending
+	e.pending = nil
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	subject := &bytes.Buffer{}
+	if err := template.Must(template.New("digest").Parse(digestSubjectTemplate)).Execute(subject, pending); err != nil {
+		return err
+	}
+	body := &bytes.Buffer{}
+	for i, n := range pending {
+		s, b, err := e.render(n)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			body.WriteString("\n----\n\n")
+		}
+		body.WriteString(s + "\n\n" + b)
+	}
+	if err := e.send(subject.String(), body.String()); err != nil {
+		e.mutex.Lock()
+		e.pending = append(pending, e.pending...)
+		if e.timer == nil {
+			e.timer = time.AfterFunc(e.interval, e.flushDigest)
+		}
+		e.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close sends any pending digest, which is discarded if it could not be sent.
+func (e *Email) Close() error {
+	err := e.Flush()
+	e.mutex.Lock()
+	e.pending = nil
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.mutex.Unlock()
+	return err
+}
+
+func (e *Email) render(n *Notification) (string, string, error) {
+	subject := &bytes.Buffer{}
+	if err := e.subject.Execute(subject, n); err != nil {
+		return "", "", err
+	}
+	body := &bytes.Buffer{}
+	if err := e.body.Execute(body, n); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), body.String(), nil
+}
+
+func (e *Email) message(subject, body string) []byte {
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", e.opts.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(e.opts.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", strings.Replace(subject, "\n", " ", -1))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return msg.Bytes()
+}
+
+func (e *Email) sendMail(subject, body string) error {
+	addr := net.JoinHostPort(e.opts.Host, strconv.Itoa(e.opts.Port))
+	var auth smtp.Auth
+	if e.opts.Username != "" {
+		auth = smtp.PlainAuth("", e.opts.Username, e.opts.Password, e.opts.Host)
+	}
+	msg := e.message(subject, body)
+	if e.opts.Port != 465 {
+		// SendMail upgrades the connection with STARTTLS if the server supports it.
+		return smtp.SendMail(addr, auth, e.opts.From, e.opts.To, msg)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: e.opts.Host})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, e.opts.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.opts.From); err != nil {
+		return err
+	}
+	for _, to := range e.opts.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,64 @@
+package notify
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+func TestEmailDigest(t *testing.T) {
+	e, err := NewEmail(EmailOptions{
+		Host:           "localhost",
+		From:           "rhine@localhost",
+		To:             []string{"user@localhost"},
+		DigestInterval: "1h",
+	}, log.New(false, false, "/dev/null", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects, bodies []string
+	e.send = func(subject, body string) error {
+		subjects = append(subjects, subject)
+		bodies = append(bodies, body)
+		return nil
+	}
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(e.Send(&Notification{Title: "a", Body: "first", Urgency: Normal}))
+	check(e.Send(&Notification{Title: "b", Body: "second", Urgency: Low}))
+	if len(subjects) != 0 {
+		t.Fatal("Non critical notifications should be batched")
+	}
+	check(e.Send(&Notification{Title: "c", Body: "urgent", Urgency: Critical}))
+	if len(subjects) != 1 || subjects[0] != "[Rhine] c" {
+		t.Fatalf("Critical notifications should be sent immediately, got %v", subjects)
+	}
+	check(e.Flush())
+	if len(subjects) != 2 || subjects[1] != "[Rhine] 2 notifications" {
+		t.Fatalf("Unexpected digest subject %v", subjects)
+	}
+	if !strings.Contains(bodies[1], "first") || !strings.Contains(bodies[1], "second") {
+		t.Fatalf("Digest missing notifications: %s", bodies[1])
+	}
+
+	// A digest which fails to send is queued again with later notifications.
+	fail := errors.New("unavailable")
+	send := e.send
+	e.send = func(subject, body string) error { return fail }
+	check(e.Send(&Notification{Title: "d", Body: "third", Urgency: Normal}))
+	if err := e.Flush(); err != fail {
+		t.Fatalf("Expected the send error, got %v", err)
+	}
+	e.send = send
+	check(e.Send(&Notification{Title: "e", Body: "fourth", Urgency: Normal}))
+	check(e.Flush())
+	if len(subjects) != 3 || subjects[2] != "[Rhine] 2 notifications" || !strings.Contains(bodies[2], "third") {
+		t.Fatalf("Expected the failed digest to be retried, got %v", subjects)
+	}
+	check(e.Close())
+}
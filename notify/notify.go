@@ -0,0 +1,172 @@
+// Package notify provides a notification subsystem which delivers notifications
+// from modules to one or more backends, such as desktop notifications.
+package notify
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/metrics"
+	"github.com/kyoukaya/rhine/queue"
+)
+
+// Urgency is the importance of a notification, backends may use it to decide
+// how prominently to display a notification or to filter notifications.
+type Urgency int
+
+// Urgency levels.
+const (
+	Low Urgency = iota
+	Normal
+	Critical
+)
+
+func (u Urgency) String() string {
+	switch u {
+	case Low:
+		return "low"
+	case Critical:
+		return "critical"
+	}
+	return "normal"
+}
+
+// ParseUrgency returns the Urgency named by s, as returned by Urgency.String.
+func ParseUrgency(s string) (Urgency, error) {
+	for _, u := range []Urgency{Low, Normal, Critical} {
+		if s == u.String() {
+			return u, nil
+		}
+	}
+	return Normal, errors.New("Unknown urgency " + s)
+}
+
+// Notification is a single notification. UID and Region are set if the
+// notification was sent on behalf of a user.
+type Notification struct {
+	Title   string
+	Body    string
+	Urgency Urgency
+	UID     int
+	Region  string
+	Time    time.Time
+}
+
+// Backend delivers notifications.
+type Backend interface {
+	// Name identifies the backend in logs.
+	Name() string
+	// Send delivers the notification, it may block.
+	Send(n *Notification) error
+}
+
+var droppedNotifications = metrics.NewCounter("rhine_notifications_dropped_total",
+	"Number of notifications dropped because a backend could not keep up.")
+
+// DefaultQueueSize is the number of notifications which may be pending
+// delivery for each backend.
+const DefaultQueueSize = 64
+
+// Notifier sends notifications to all of its backends. Each backend has a
+// bounded queue of pending notifications which is delivered in order, what
+// happens when a queue is full is decided by the notifier's policy.
+type Notifier struct {
+	mutex     sync.RWMutex
+	backends  []Backend
+	queues    []*queue.Queue
+	wg        sync.WaitGroup
+	queueSize int
+	policy    queue.Policy
+	log       log.Logger
+}
+
+// New returns a Notifier without any backends, delivery errors are logged to the
+// logger.
+func New(logger log.Logger) *Notifier {
+	return &Notifier{log: logger, queueSize: DefaultQueueSize}
+}
+
+// SetQueue sets the size and policy of the queues of backends added afterwards.
+func (n *Notifier) SetQueue(size int, policy queue.Policy) {
+	n.mutex.Lock()
+	n.queueSize, n.policy = size, policy
+	n.mutex.Unlock()
+}
+
+// Add adds a backend to the notifier.
+func (n *Notifier) Add(b Backend) {
+	n.mutex.Lock()
+	q := queue.New(n.queueSize, n.policy, droppedNotifications)
+	n.backends = append(n.backends, b)
+	n.queues = append(n.queues, q)
+	n.mutex.Unlock()
+	n.wg.Add(1)
+	go n.deliver(b, q)
+}
+
+func (n *Notifier) deliver(b Backend, q *queue.Queue) {
+	defer n.wg.Done()
+	for {
+		v, ok := q.Pop()
+		if !ok {
+			return
+		}
+		notification := v.(*Notification)
+		if err := b.Send(notification); err != nil {
+			n.log.Warnf("notify: %s failed to send %q: %s", b.Name(), notification.Title, err)
+		}
+	}
+}
+
+// Backends returns the names of the notifier's backends.
+func (n *Notifier) Backends() []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	ret := make([]string, len(n.backends))
+	for i, b := range n.backends {
+		ret[i] = b.Name()
+	}
+	return ret
+}
+
+// Notify sends a notification which isn't associated with any user.
+func (n *Notifier) Notify(title, body string, urgency Urgency) {
+	n.Send(&Notification{Title: title, Body: body, Urgency: urgency})
+}
+
+// Send queues the notification for delivery to every backend, without blocking
+// the caller unless the notifier's policy is queue.Block. The Time field is set
+// to the current time if it is zero.
+func (n *Notifier) Send(notification *Notification) {
+	if notification.Time.IsZero() {
+		notification.Time = time.Now()
+	}
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	for i, q := range n.queues {
+		if !q.Push(notification) {
+			n.log.Warnf("notify: dropped a notification queued for %s", n.backends[i].Name())
+		}
+	}
+}
+
+// Close delivers the notifications still queued and closes every backend which
+// implements io.Closer, e.g., to flush digests.
+func (n *Notifier) Close() {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	for _, q := range n.queues {
+		q.Close()
+	}
+	n.wg.Wait()
+	for _, b := range n.backends {
+		if closer, ok := b.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				n.log.Warnf("notify: failed to close %s: %s", b.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/outbound"
+)
+
+// NtfyOptions configures the Ntfy backend.
+type NtfyOptions struct {
+	// Server defaults to https://ntfy.sh.
+	Server string `json:"server"`
+	Topic  string `json:"topic"`
+	// Token is an optional access token for protected topics.
+	Token string `json:"token"`
+}
+
+// GotifyOptions configures the Gotify backend.
+type GotifyOptions struct {
+	Server string `json:"server"`
+	// Token is the application token messages are sent with.
+	Token string `json:"token"`
+}
+
+var pushClient = outbound.Default.Client(30 * time.Second)
+
+// Ntfy is a Backend publishing notifications to a ntfy topic.
+type Ntfy struct {
+	opts NtfyOptions
+}
+
+// NewNtfy returns a Ntfy backend.
+func NewNtfy(opts NtfyOptions) (*Ntfy, error) {
+	if opts.Topic == "" {
+		return nil, errors.New("ntfy notifications require a topic")
+	}
+	if opts.Server == "" {
+		opts.Server = "https://ntfy.sh"
+	}
+	opts.Server = strings.TrimSuffix(opts.Server, "/")
+	return &Ntfy{opts}, nil
+}
+
+// Name implements Backend.
+func (n *Ntfy) Name() string { return "ntfy" }
+
+// Send implements Backend.
+func (n *Ntfy) Send(notification *Notification) error {
+	req, err := http.NewRequest("POST", n.opts.Server+"/"+n.opts.Topic, strings.NewReader(notification.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", notification.Title)
+	req.Header.Set("Priority", ntfyPriority(notification.Urgency))
+	if notification.UID != 0 {
+		req.Header.Set("Tags", fmt.Sprintf("%s_%d", notification.Region, notification.UID))
+	}
+	if n.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.opts.Token)
+	}
+	return doPush(req)
+}
+
+func ntfyPriority(u Urgency) string {
+	switch u {
+	case Low:
+		return "low"
+	case Critical:
+		return "urgent"
+	default:
+		return "default"
+	}
+}
+
+// Gotify is a Backend sending notifications to a Gotify server.
+type Gotify struct {
+	opts GotifyOptions
+}
+
+// NewGotify returns a Gotify backend.
+func NewGotify(opts GotifyOptions) (*Gotify, error) {
+	if opts.Server == "" || opts.Token == "" {
+		return nil, errors.New("Gotify notifications require a server and application token")
+	}
+	opts.Server = strings.TrimSuffix(opts.Server, "/")
+	return &Gotify{opts}, nil
+}
+
+// Name implements Backend.
+func (g *Gotify) Name() string { return "gotify" }
+
+// Send implements Backend.
+func (g *Gotify) Send(n *Notification) error {
+	body := n.Body
+	if n.UID != 0 {
+		body += fmt.Sprintf("\n(%s_%d)", n.Region, n.UID)
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"title":    n.Title,
+		"message":  body,
+		"priority": gotifyPriority(n.Urgency),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", g.opts.Server+"/message", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.opts.Token)
+	return doPush(req)
+}
+
+func gotifyPriority(u Urgency) int {
+	switch u {
+	case Low:
+		return 2
+	case Critical:
+		return 8
+	default:
+		return 5
+	}
+}
+
+// doPush sends the request, returning an error if the server did not respond
+// with a 2xx status.
+func doPush(req *http.Request) error {
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Host, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPushBackends(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	n := &Notification{Title: "Sanity capped", Body: "Sanity is capped!", Urgency: Critical, UID: 1, Region: "GL"}
+
+	ntfy, err := NewNtfy(NtfyOptions{Server: server.URL + "/", Topic: "rhine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ntfy.Send(n); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Path != "/rhine" || got.Header.Get("Title") != n.Title ||
+		got.Header.Get("Priority") != "urgent" || string(body) != n.Body {
+		t.Fatalf("Unexpected ntfy request %s %v %q", got.URL.Path, got.Header, body)
+	}
+
+	gotify, err := NewGotify(GotifyOptions{Server: server.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gotify.Send(n); err != nil {
+		t.Fatal(err)
+	}
+	var msg struct {
+		Title    string `json:"title"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.Path != "/message" || got.Header.Get("X-Gotify-Key") != "token" ||
+		msg.Title != n.Title || msg.Priority != 8 {
+		t.Fatalf("Unexpected gotify request %s %v %q", got.URL.Path, got.Header, body)
+	}
+}
@@ -0,0 +1,122 @@
+package notify
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// SoundOptions configures the Sound backend.
+type SoundOptions struct {
+	// File is played for each notification if it is set, WAV files are the
+	// most portable, only WAV files are supported on Windows.
+	File string `json:"file"`
+	// Speak reads the title of each notification aloud using the OS' text to
+	// speech, after playing File.
+	Speak bool `json:"speak"`
+	// MinUrgency is the lowest urgency which is alerted, "normal" by default.
+	MinUrgency string `json:"minUrgency"`
+}
+
+// Sound is a Backend alerting audibly on the machine running Rhine by playing
+// a sound file and/or speaking the notification. Alerts are played one at a
+// time.
+type Sound struct {
+	opts       SoundOptions
+	minUrgency Urgency
+	mutex      sync.Mutex
+}
+
+// NewSound returns a Sound backend.
+func NewSound(opts SoundOptions) (*Sound, error) {
+	if opts.File == "" && !opts.Speak {
+		return nil, errors.New("Sound alerts require a sound file or text to speech to be enabled")
+	}
+	if opts.MinUrgency == "" {
+		opts.MinUrgency = Normal.String()
+	}
+	minUrgency, err := ParseUrgency(opts.MinUrgency)
+	if err != nil {
+		return nil, err
+	}
+	return &Sound{opts: opts, minUrgency: minUrgency}, nil
+}
+
+// Name implements Backend.
+func (s *Sound) Name() string { return "sound" }
+
+// Send implements Backend.
+func (s *Sound) Send(n *Notification) error {
+	if n.Urgency < s.minUrgency {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.opts.File != "" {
+		if err := run(playCommand(s.opts.File)); err != nil {
+			return err
+		}
+	}
+	if s.opts.Speak {
+		return run(speakCommand(n.Title))
+	}
+	return nil
+}
+
+// playCommand returns a command playing the sound file at path.
+func playCommand(path string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("afplay", path)
+	case "windows":
+		return exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"(New-Object Media.SoundPlayer "+powershellQuote(path)+").PlaySync()")
+	}
+	for _, player := range []string{"paplay", "aplay", "ffplay"} {
+		if _, err := exec.LookPath(player); err != nil {
+			continue
+		}
+		if player == "ffplay" {
+			return exec.Command(player, "-nodisp", "-autoexit", "-loglevel", "quiet", path)
+		}
+		return exec.Command(player, path)
+	}
+	return nil
+}
+
+// speakCommand returns a command speaking text through the OS' text to speech.
+// Text is passed after "--" so that it's never parsed as an option.
+func speakCommand(text string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("say", "--", text)
+	case "windows":
+		return exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Speech; "+
+				"(New-Object System.Speech.Synthesis.SpeechSynthesizer).Speak("+powershellQuote(text)+")")
+	}
+	for _, speaker := range []string{"spd-say", "espeak-ng", "espeak"} {
+		if _, err := exec.LookPath(speaker); err != nil {
+			continue
+		}
+		if speaker == "spd-say" {
+			// spd-say returns immediately unless told to wait.
+			return exec.Command(speaker, "-w", "--", text)
+		}
+		return exec.Command(speaker, "--", text)
+	}
+	return nil
+}
+
+func run(cmd *exec.Cmd) error {
+	if cmd == nil {
+		return errors.New("No sound player or text to speech program found on " + runtime.GOOS)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return errors.New(err.Error() + ": " + strings.TrimSpace(string(out)))
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/outbound"
+)
+
+// telegramAPI is the base URL of the Telegram bot API.
+var telegramAPI = "https://api.telegram.org/bot"
+
+// TelegramOptions configures the Telegram backend.
+type TelegramOptions struct {
+	Token  string `json:"token"`
+	ChatID int64  `json:"chatId"`
+	// Commands enables responding to commands sent by ChatID to the bot.
+	Commands bool `json:"commands"`
+}
+
+// CommandFunc answers a bot command, args contains the text after the command.
+type CommandFunc func(args string) string
+
+type telegramCommand struct {
+	description string
+	fn          CommandFunc
+}
+
+// Telegram is a Backend sending notifications through a Telegram bot, which
+// can optionally respond to commands from the configured chat.
+type Telegram struct {
+	opts     TelegramOptions
+	client   *http.Client
+	log      log.Logger
+	mutex    sync.RWMutex
+	commands map[string]telegramCommand
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTelegram returns a Telegram backend, Start must be called for the bot to
+// respond to commands.
+func NewTelegram(opts TelegramOptions, logger log.Logger) (*Telegram, error) {
+	if opts.Token == "" || opts.ChatID == 0 {
+		return nil, errors.New("Telegram notifications require a bot token and chat ID")
+	}
+	t := &Telegram{
+		opts:     opts,
+		client:   outbound.Default.Client(90 * time.Second),
+		log:      logger,
+		commands: make(map[string]telegramCommand),
+		stop:     make(chan struct{}),
+	}
+	t.HandleCommand("help", "lists the available commands", t.help)
+	return t, nil
+}
+
+// Name implements Backend.
+func (t *Telegram) Name() string { return "telegram" }
+
+// Send implements Backend.
+func (t *Telegram) Send(n *Notification) error {
+	text := n.Title
+	if n.Body != "" {
+		text += "\n" + n.Body
+	}
+	if n.UID != 0 {
+		text += fmt.Sprintf("\n(%s_%d)", n.Region, n.UID)
+	}
+	return t.sendMessage(t.opts.ChatID, text, n.Urgency == Low)
+}
+
+// HandleCommand registers a command which is answered when "/name args" is sent
+// to the bot by the configured chat.
+func (t *Telegram) HandleCommand(name, description string, fn CommandFunc) {
+	t.mutex.Lock()
+	t.commands[name] = telegramCommand{description, fn}
+	t.mutex.Unlock()
+}
+
+// Start begins polling for commands if they are enabled.
+func (t *Telegram) Start() {
+	if t.opts.Commands {
+		go t.poll()
+	}
+}
+
+// Close stops polling for commands.
+func (t *Telegram) Close() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	return nil
+}
+
+func (t *Telegram) help(string) string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	names := make([]string, 0, len(t.commands))
+	for name := range t.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = "/" + name + " - " + t.commands[name].description
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t *Telegram) call(method string, params interface{}, result interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(telegramAPI+t.opts.Token+"/"+method, "application/json", bytes.NewReader(b))
+	if err != nil {
+		// The URL of the error contains the bot's token, which mustn't be logged.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("telegram %s: %s", method, err)
+	}
+	defer resp.Body.Close()
+	var r struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if !r.OK {
+		return fmt.Errorf("telegram %s: %s", method, r.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+func (t *Telegram) sendMessage(chatID int64, text string, silent bool) error {
+	return t.call("sendMessage", map[string]interface{}{
+		"chat_id":              chatID,
+		"text":                 text,
+		"disable_notification": silent,
+	}, nil)
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// poll long polls for updates, answering commands from the configured chat.
+func (t *Telegram) poll() {
+	var offset int64
+	backoff := time.Second
+	for {
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+		var updates []telegramUpdate
+		err := t.call("getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         60,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			t.log.Warnf("notify: telegram failed to get updates: %s", err)
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message == nil || update.Message.Chat.ID != t.opts.ChatID {
+				continue
+			}
+			t.answer(update.Message.Text)
+		}
+	}
+}
+
+func (t *Telegram) answer(text string) {
+	if !strings.HasPrefix(text, "/") {
+		return
+	}
+	fields := strings.SplitN(strings.TrimPrefix(text, "/"), " ", 2)
+	// Commands may be addressed to the bot with "/command@botname".
+	name := strings.SplitN(fields[0], "@", 2)[0]
+	args := ""
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+	t.mutex.RLock()
+	cmd, ok := t.commands[name]
+	t.mutex.RUnlock()
+	reply := "Unknown command, try /help"
+	if ok {
+		reply = cmd.fn(args)
+	}
+	if reply == "" {
+		reply = "Nothing to report."
+	}
+	if err := t.sendMessage(t.opts.ChatID, reply, false); err != nil {
+		t.log.Warnf("notify: telegram failed to answer %s: %s", name, err)
+	}
+}
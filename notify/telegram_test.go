@@ -0,0 +1,23 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTelegramErrorRedactsToken(t *testing.T) {
+	api := telegramAPI
+	defer func() { telegramAPI = api }()
+	telegramAPI = "http://127.0.0.1:0/bot"
+	bot, err := NewTelegram(TelegramOptions{Token: "123:secret", ChatID: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bot.Send(&Notification{Title: "Sanity capped"})
+	if err == nil {
+		t.Fatal("Expected sending to an unreachable API to fail")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Fatalf("Expected the error not to contain the token, got %q", err)
+	}
+}
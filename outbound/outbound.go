@@ -0,0 +1,166 @@
+// Package outbound schedules the requests Rhine and its modules send to
+// external services, e.g., notification backends and uploaders, so that the
+// modules of every user reacting to the same login sync don't all hit a
+// service at once. Requests to each host are limited to a budget per interval
+// and delayed by a random jitter.
+package outbound
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+var throttled = metrics.NewCounter("rhine_outbound_throttled_total", "Number of outbound requests delayed by the budget of their host.")
+
+// Budget is the number of requests allowed to a host per interval.
+type Budget struct {
+	Requests int
+	Interval time.Duration
+}
+
+// Scheduler delays outbound requests to keep within the budget of their host.
+// The zero value doesn't delay requests.
+type Scheduler struct {
+	mutex   sync.Mutex
+	budget  Budget
+	hosts   map[string]Budget
+	jitter  time.Duration
+	buckets map[string]*bucket
+	rand    *rand.Rand
+}
+
+// bucket is the token bucket of a host, refilled with the budget's requests
+// over its interval.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Default is the Scheduler of the official modules and notification backends,
+// configured by the proxy's options.
+var Default = &Scheduler{}
+
+// New returns a Scheduler allowing budget to every host, and delaying every
+// request by up to jitter.
+func New(budget Budget, jitter time.Duration) *Scheduler {
+	s := &Scheduler{}
+	s.Configure(budget, nil, jitter)
+	return s
+}
+
+// Configure replaces the budget of every host, overridden for the hosts of
+// hosts, and the jitter. A budget of zero or less requests doesn't limit the
+// host. Configuring the same budgets again keeps the requests already counted
+// against them.
+func (s *Scheduler) Configure(budget Budget, hosts map[string]Budget, jitter time.Duration) {
+	lower := make(map[string]Budget, len(hosts))
+	for host, b := range hosts {
+		lower[strings.ToLower(host)] = b
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.buckets != nil && s.budget == budget && s.jitter == jitter && reflect.DeepEqual(s.hosts, lower) {
+		return
+	}
+	s.budget = budget
+	s.hosts = lower
+	s.jitter = jitter
+	s.buckets = make(map[string]*bucket)
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
+// reserve takes a request from the budget of host, returning how long the
+// request must wait for it, jitter included.
+func (s *Scheduler) reserve(host string) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var delay time.Duration
+	if s.jitter > 0 {
+		delay = time.Duration(s.rand.Int63n(int64(s.jitter)))
+	}
+	budget, ok := s.hosts[host]
+	if !ok {
+		budget = s.budget
+	}
+	if budget.Requests <= 0 || budget.Interval <= 0 {
+		return delay
+	}
+	now := time.Now()
+	b := s.buckets[host]
+	if b == nil {
+		b = &bucket{tokens: float64(budget.Requests), last: now}
+		s.buckets[host] = b
+	}
+	perToken := budget.Interval / time.Duration(budget.Requests)
+	b.tokens += float64(now.Sub(b.last)) / float64(perToken)
+	if max := float64(budget.Requests); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	// Tokens go negative for the requests waiting on the budget, which are
+	// then spaced by perToken.
+	b.tokens--
+	if b.tokens < 0 {
+		throttled.Inc()
+		if wait := time.Duration(-b.tokens * float64(perToken)); wait > delay {
+			delay = wait
+		}
+	}
+	return delay
+}
+
+// Wait blocks until a request to host fits in its budget, returning early
+// with the context's error if it's done first.
+func (s *Scheduler) Wait(ctx context.Context, host string) error {
+	delay := s.reserve(strings.ToLower(host))
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Transport returns a RoundTripper sending the requests through base, or
+// http.DefaultTransport if it's nil, once they fit in their host's budget.
+func (s *Scheduler) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{s, base}
+}
+
+// Client returns an HTTP client whose requests are scheduled by s.
+func (s *Scheduler) Client(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: s.Transport(nil)}
+}
+
+type transport struct {
+	scheduler *Scheduler
+	base      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.scheduler.Wait(req.Context(), req.URL.Hostname()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,64 @@
+package outbound
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	s := New(Budget{Requests: 2, Interval: 200 * time.Millisecond}, 0)
+	s.Configure(s.budget, map[string]Budget{"unlimited.example": {}}, 0)
+	if d := s.reserve("a.example"); d != 0 {
+		t.Fatalf("Expected the first request to be sent at once, delayed %s", d)
+	}
+	s.reserve("a.example")
+	if d := s.reserve("a.example"); d < 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("Expected the third request to wait for the budget, delayed %s", d)
+	}
+	if d := s.reserve("a.example"); d < 150*time.Millisecond {
+		t.Fatalf("Expected waiting requests to be spaced, delayed %s", d)
+	}
+	if d := s.reserve("b.example"); d != 0 {
+		t.Fatalf("Expected hosts to have budgets of their own, delayed %s", d)
+	}
+	for i := 0; i < 5; i++ {
+		if d := s.reserve("unlimited.example"); d != 0 {
+			t.Fatalf("Expected hosts with an empty budget not to be limited, delayed %s", d)
+		}
+	}
+
+	// Configuring the same budgets keeps the requests counted.
+	s.Configure(s.budget, map[string]Budget{"Unlimited.example": {}}, 0)
+	if d := s.reserve("a.example"); d == 0 {
+		t.Fatal("Expected the budget to be kept")
+	}
+
+	jittered := New(Budget{}, 50*time.Millisecond)
+	for i := 0; i < 20; i++ {
+		if d := jittered.reserve("a.example"); d < 0 || d >= 50*time.Millisecond {
+			t.Fatalf("Expected a jitter below 50ms, got %s", d)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	s := New(Budget{Requests: 1, Interval: time.Hour}, 0)
+	client := s.Client(time.Second)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := client.Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("Expected the request over budget to be cancelled with its context")
+	}
+}
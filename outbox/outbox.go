@@ -0,0 +1,324 @@
+// Package outbox provides a durable outbox for the payloads modules deliver
+// to external services, e.g., drop uploads and webhooks. Messages are
+// persisted in a storage.Store until they are delivered, and retried with an
+// exponential backoff, across restarts, while the network or the destination
+// is down.
+package outbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+const (
+	// MinBackoff is the delay before the first retry, doubled after each
+	// failed attempt up to MaxBackoff.
+	MinBackoff = 30 * time.Second
+	MaxBackoff = time.Hour
+	// MaxAttempts is the number of attempts after which a message is dropped.
+	MaxAttempts = 20
+	// HTTPHandler is the handler of the messages enqueued with EnqueueHTTP.
+	HTTPHandler = "http"
+)
+
+// ErrStopped is returned when enqueuing a message on a stopped Outbox.
+var ErrStopped = errors.New("Outbox is stopped")
+
+// Message is a payload waiting to be delivered.
+type Message struct {
+	ID       string          `json:"id"`
+	Handler  string          `json:"handler"`
+	Payload  json.RawMessage `json:"payload"`
+	Created  time.Time       `json:"created"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+	// LastError is the error of the last failed attempt.
+	LastError string `json:"lastError,omitempty"`
+
+	timer *time.Timer
+}
+
+// DeliverFunc delivers a message, which is retried if it returns an error.
+type DeliverFunc func(msg *Message) error
+
+// Outbox delivers the messages of a single owner, messages are stored under a
+// prefix in the store so multiple outboxes can share one store.
+type Outbox struct {
+	mutex    sync.Mutex
+	store    storage.Store
+	prefix   string
+	handlers map[string]DeliverFunc
+	messages map[string]*Message
+	stopped  bool
+	log      log.Logger
+}
+
+var lastID int64
+
+// New returns an Outbox persisting its messages in the store under the
+// prefix. Messages previously persisted under the prefix are loaded, and are
+// delivered once their handler is registered. client sends the messages
+// enqueued with EnqueueHTTP, http.DefaultClient if nil.
+func New(store storage.Store, prefix string, client *http.Client, logger log.Logger) *Outbox {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	o := &Outbox{
+		store:    store,
+		prefix:   prefix,
+		handlers: make(map[string]DeliverFunc),
+		messages: make(map[string]*Message),
+		log:      logger,
+	}
+	o.load()
+	o.Handle(HTTPHandler, httpDeliverer(client))
+	return o
+}
+
+func (o *Outbox) load() {
+	keys, err := o.store.Keys(o.prefix)
+	if err != nil {
+		o.log.Warnf("outbox: failed to list messages: %s", err)
+		return
+	}
+	for _, key := range keys {
+		b, err := o.store.Get(key)
+		if err != nil {
+			o.log.Warnf("outbox: failed to load %s: %s", key, err)
+			continue
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(b, msg); err != nil {
+			o.log.Warnf("outbox: failed to load %s: %s", key, err)
+			continue
+		}
+		o.messages[msg.ID] = msg
+	}
+}
+
+// Handle registers the function delivering the messages with the handler
+// name, arming any persisted messages for the handler. Messages which were due
+// while Rhine was not running are delivered immediately.
+func (o *Outbox) Handle(handler string, fn DeliverFunc) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.handlers[handler] = fn
+	for _, msg := range o.messages {
+		if msg.Handler == handler && msg.timer == nil {
+			o.arm(msg)
+		}
+	}
+}
+
+// Enqueue persists a message for the handler and delivers it as soon as the
+// handler is registered, returning the message's ID.
+func (o *Outbox) Enqueue(handler string, payload []byte) (string, error) {
+	now := time.Now()
+	msg := &Message{
+		ID:      fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddInt64(&lastID, 1)),
+		Handler: handler,
+		Payload: payload,
+		Created: now,
+		Next:    now,
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.stopped {
+		return "", ErrStopped
+	}
+	if err := o.persist(msg); err != nil {
+		return "", err
+	}
+	o.messages[msg.ID] = msg
+	if _, ok := o.handlers[handler]; ok {
+		o.arm(msg)
+	}
+	return msg.ID, nil
+}
+
+// Request is the payload of a message enqueued with EnqueueHTTP.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// EnqueueHTTP enqueues an HTTP request, delivered once the destination
+// answers it with a 2xx status.
+func (o *Outbox) EnqueueHTTP(req *Request) (string, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	return o.Enqueue(HTTPHandler, payload)
+}
+
+// httpDeliverer returns the DeliverFunc sending Requests with client.
+func httpDeliverer(client *http.Client) DeliverFunc {
+	return func(msg *Message) error {
+		r := &Request{}
+		if err := json.Unmarshal(msg.Payload, r); err != nil {
+			return err
+		}
+		req, err := http.NewRequest(r.Method, r.URL, bytes.NewReader(r.Body))
+		if err != nil {
+			return err
+		}
+		for k, v := range r.Header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("%s %s: %s %s", r.Method, req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+		}
+		return nil
+	}
+}
+
+// Cancel removes the message with the ID, if any.
+func (o *Outbox) Cancel(id string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if msg, ok := o.messages[id]; ok {
+		if msg.timer != nil {
+			msg.timer.Stop()
+		}
+		delete(o.messages, id)
+		o.remove(msg)
+	}
+}
+
+// Pending returns copies of the messages waiting to be delivered.
+func (o *Outbox) Pending() []Message {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	ret := make([]Message, 0, len(o.messages))
+	for _, msg := range o.messages {
+		m := *msg
+		m.timer = nil
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// Stop disarms all messages without removing them from the store.
+func (o *Outbox) Stop() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.stopped = true
+	for _, msg := range o.messages {
+		if msg.timer != nil {
+			msg.timer.Stop()
+			msg.timer = nil
+		}
+	}
+}
+
+// Unhook stops the outbox, allowing it to be used as a proxy.Hooker.
+func (o *Outbox) Unhook() {
+	o.Stop()
+}
+
+// arm starts the message's timer, must be called with the mutex held.
+func (o *Outbox) arm(msg *Message) {
+	if o.stopped {
+		return
+	}
+	msg.timer = time.AfterFunc(time.Until(msg.Next), func() { o.deliver(msg) })
+}
+
+// backoff returns the delay before retrying a message which failed attempts
+// times.
+func backoff(attempts int) time.Duration {
+	d := MinBackoff
+	for i := 1; i < attempts && d < MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+	return d
+}
+
+func (o *Outbox) deliver(msg *Message) {
+	o.mutex.Lock()
+	if o.stopped || o.messages[msg.ID] != msg {
+		o.mutex.Unlock()
+		return
+	}
+	fn := o.handlers[msg.Handler]
+	o.mutex.Unlock()
+	err := o.call(fn, msg)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.messages[msg.ID] != msg {
+		// Cancelled while it was delivered.
+		return
+	}
+	if err == nil {
+		delete(o.messages, msg.ID)
+		o.remove(msg)
+		return
+	}
+	msg.Attempts++
+	msg.LastError = err.Error()
+	if msg.Attempts >= MaxAttempts {
+		o.log.Warnf("outbox: dropping %s after %d attempts: %s", msg.ID, msg.Attempts, err)
+		delete(o.messages, msg.ID)
+		o.remove(msg)
+		return
+	}
+	msg.Next = time.Now().Add(backoff(msg.Attempts))
+	o.log.Verbosef("outbox: failed to deliver %s, retrying at %s: %s", msg.ID, msg.Next.Format(time.RFC3339), err)
+	if err := o.persist(msg); err != nil {
+		o.log.Warnf("outbox: failed to persist %s: %s", msg.ID, err)
+	}
+	msg.timer = nil
+	if !o.stopped {
+		o.arm(msg)
+	}
+}
+
+// call delivers the message, recovering from panics.
+func (o *Outbox) call(fn DeliverFunc, msg *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			o.log.Warnf("Recovered from panic while delivering %s:\n%+v", msg.ID, r)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(msg)
+}
+
+func (o *Outbox) persist(msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return o.store.Put(o.prefix+msg.ID, b)
+}
+
+func (o *Outbox) remove(msg *Message) {
+	if err := o.store.Delete(o.prefix + msg.ID); err != nil {
+		o.log.Warnf("outbox: failed to remove %s: %s", msg.ID, err)
+	}
+}
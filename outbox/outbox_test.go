@@ -0,0 +1,75 @@
+package outbox
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/storage"
+)
+
+type logShim struct{ t *testing.T }
+
+func (l logShim) Flush()                              {}
+func (l logShim) Println(i ...interface{})            { l.t.Log(i...) }
+func (l logShim) Printf(s string, i ...interface{})   { l.t.Logf(s, i...) }
+func (l logShim) Verboseln(i ...interface{})          { l.t.Log(i...) }
+func (l logShim) Verbosef(s string, i ...interface{}) { l.t.Logf(s, i...) }
+func (l logShim) Warnln(i ...interface{})             { l.t.Error(i...) }
+func (l logShim) Warnf(s string, i ...interface{})    { l.t.Errorf(s, i...) }
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: MinBackoff, 2: 2 * MinBackoff, 4: 8 * MinBackoff, 10: MaxBackoff} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("%d attempts: expected %s, got %s", attempts, want, got)
+		}
+	}
+}
+
+func TestRetryAcrossRestarts(t *testing.T) {
+	var calls int32
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	store := storage.NewMemoryStore()
+	o := New(store, "outbox/", nil, logShim{t})
+	id, err := o.EnqueueHTTP(&Request{Method: "POST", URL: server.URL, Body: []byte(`{"drops":1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(o.Pending()) == 1 && o.Pending()[0].Attempts == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pending := o.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" || time.Until(pending[0].Next) < MinBackoff/2 {
+		t.Fatalf("Expected the failed message to be retried later, got %+v", pending)
+	}
+	o.Stop()
+
+	// The message is loaded again after a restart.
+	o = New(store, "outbox/", nil, logShim{t})
+	defer o.Stop()
+	msg := o.messages[id]
+	if msg == nil || msg.Attempts != 1 {
+		t.Fatalf("Expected the message to be persisted, got %+v", o.Pending())
+	}
+	o.deliver(msg)
+	if len(o.Pending()) != 0 || body != `{"drops":1}` {
+		t.Fatalf("Expected the message to be delivered, got %+v and %q", o.Pending(), body)
+	}
+	if keys, _ := store.Keys("outbox/"); len(keys) != 0 {
+		t.Fatalf("Expected the delivered message to be removed from the store, got %v", keys)
+	}
+}
@@ -0,0 +1,84 @@
+package packetlog
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// gzipExt is the extension appended to the names of compressed logs.
+const gzipExt = ".gz"
+
+// Logs returns the paths of the packet logs in dir, compressed or not, ordered
+// by the time they were created.
+func Logs(dir string) ([]string, error) {
+	logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := filepath.Glob(filepath.Join(dir, "*.log"+gzipExt))
+	if err != nil {
+		return nil, err
+	}
+	logs = append(logs, compressed...)
+	sort.Strings(logs)
+	return logs, nil
+}
+
+// Compress compresses the packet log at path with gzip, replacing it and its
+// index, and returns the path of the compressed log, which keeps the log's
+// modification time. The log must no longer be written to.
+func Compress(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	dst := path + gzipExt
+	tmp := dst + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	w := gzip.NewWriter(f)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	// The index's offsets are those of the decompressed log, which stay valid.
+	os.Rename(IndexPath(path), IndexPath(dst))
+	src.Close()
+	return dst, os.Remove(path)
+}
+
+func gunzip(r io.Reader) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
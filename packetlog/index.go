@@ -0,0 +1,131 @@
+package packetlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// IndexEntry locates a packet in a packet log.
+type IndexEntry struct {
+	Time   time.Time
+	Op     string
+	Offset int64
+	Size   int64
+}
+
+// Index lists the packets of a packet log in order, letting tools look up the
+// packets of an op or time range without parsing their bodies again.
+type Index struct {
+	Entries []IndexEntry
+}
+
+// BuildIndex indexes the packets returned by r, which should be a reader of
+// the whole log.
+func BuildIndex(r *Reader) (*Index, error) {
+	idx := &Index{}
+	err := r.ForEach(func(p *Packet) bool {
+		idx.Entries = append(idx.Entries, IndexEntry{Time: p.Time, Op: p.Op, Offset: p.Offset, Size: p.Size})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Ops returns the number of packets of each op.
+func (idx *Index) Ops() map[string]int {
+	ret := make(map[string]int)
+	for _, e := range idx.Entries {
+		ret[e.Op]++
+	}
+	return ret
+}
+
+// Select returns the entries whose op and time match the filter, the filter's
+// Contains field is ignored as the index doesn't include bodies.
+func (idx *Index) Select(f *Filter) []IndexEntry {
+	var ret []IndexEntry
+	for _, e := range idx.Entries {
+		p := Packet{Time: e.Time, Op: e.Op}
+		if f == nil || (&Filter{Ops: f.Ops, From: f.From, To: f.To}).Match(&p) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// ReadPacket reads the packet of an index entry from the log it was built from.
+func ReadPacket(r io.ReaderAt, e IndexEntry) (*Packet, error) {
+	p, err := NewReader(io.NewSectionReader(r, e.Offset, e.Size), time.Time{}).read()
+	if err != nil {
+		return nil, err
+	}
+	p.Time, p.Offset = e.Time, e.Offset
+	return p, nil
+}
+
+// indexHeader is the first line of index files, followed by a line per entry
+// with its offset, size, Unix time in nanoseconds and op.
+const indexHeader = "rhine packet log index v1\n"
+
+// IndexPath returns the path of the index file of the packet log at path.
+func IndexPath(path string) string {
+	return path + ".idx"
+}
+
+// end returns the offset the index covers the log up to.
+func (idx *Index) end() int64 {
+	if len(idx.Entries) == 0 {
+		return 0
+	}
+	last := idx.Entries[len(idx.Entries)-1]
+	return last.Offset + last.Size
+}
+
+// Save writes the index to path, replacing the file atomically.
+func (idx *Index) Save(path string) error {
+	var b bytes.Buffer
+	b.WriteString(indexHeader)
+	for _, e := range idx.Entries {
+		fmt.Fprintf(&b, "%d %d %d %s\n", e.Offset, e.Size, e.Time.UnixNano(), e.Op)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadIndex reads an index saved by Save.
+func LoadIndex(path string) (*Index, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(indexHeader)) {
+		return nil, errors.New("not a packet log index")
+	}
+	idx := &Index{}
+	for _, line := range strings.Split(string(b[len(indexHeader):]), "\n") {
+		if line == "" {
+			continue
+		}
+		var (
+			e    IndexEntry
+			nano int64
+		)
+		if _, err := fmt.Sscanf(line, "%d %d %d %s", &e.Offset, &e.Size, &nano, &e.Op); err != nil {
+			return nil, fmt.Errorf("malformed index entry %q: %s", line, err)
+		}
+		e.Time = time.Unix(0, nano)
+		idx.Entries = append(idx.Entries, e)
+	}
+	return idx, nil
+}
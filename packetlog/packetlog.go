@@ -0,0 +1,375 @@
+// Package packetlog reads and writes the packet logs of the Packet Logger
+// module, so that external tools and tests can consume Rhine captures.
+//
+// A packet log is a text file named after the time it was created, e.g.,
+// "2006-01-02_15.04.05.log", with a line per packet in the form
+// "15:04:05 [op] body". The time of each packet is the local time of day, its
+// date is derived from the file name, rolling over to the next day whenever
+// the time of day goes backwards.
+//
+// Indexes of the op, time and offset of each packet of a log are saved
+// alongside it, e.g., "2006-01-02_15.04.05.log.idx", so that queries only read
+// the packets they match.
+//
+// Archived logs may be compressed with gzip, e.g.,
+// "2006-01-02_15.04.05.log.gz", which is transparent to readers.
+package packetlog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/utils"
+)
+
+const (
+	// FileLayout is the time layout of the names of packet logs, without the
+	// ".log" extension.
+	FileLayout = "2006-01-02_15.04.05"
+	// TimeLayout is the time layout of the time of day prefixing each packet.
+	TimeLayout = "15:04:05"
+)
+
+// Dir returns the directory the Packet Logger writes the logs of every user
+// to, in a directory per user.
+func Dir() string {
+	return filepath.Join(utils.BinDir, "logs", "Packet Logger")
+}
+
+// UserDir returns the directory the Packet Logger writes the logs of a user to,
+// rUID being the user's region and UID, e.g., "GL_1234".
+func UserDir(rUID string) string {
+	return filepath.Join(Dir(), rUID)
+}
+
+// FileName returns the name of a packet log created at t.
+func FileName(t time.Time) string {
+	return t.Format(FileLayout) + ".log"
+}
+
+// FileTime returns the time a packet log was created at from its name, which
+// may be a path.
+func FileTime(name string) (time.Time, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), gzipExt), ".log")
+	return time.ParseInLocation(FileLayout, base, time.Local)
+}
+
+// Packet is a packet read from a packet log.
+type Packet struct {
+	Time time.Time
+	Op   string
+	Data []byte
+	// Offset is the position of the packet in the log and Size the number of
+	// bytes it spans, including the trailing newline.
+	Offset int64
+	Size   int64
+}
+
+// Writer writes packets to a packet log. It is safe for concurrent use.
+type Writer struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewWriter returns a writer of packets to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WritePacket writes a packet received at t.
+func (w *Writer) WritePacket(t time.Time, op string, data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := fmt.Fprintf(w.w, "%s [%s] ", t.Format(TimeLayout), op); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.w.Write([]byte{'\n'})
+	return err
+}
+
+// Filter selects the packets returned by a Reader. The zero value matches
+// every packet.
+type Filter struct {
+	// Ops are the ops to match, every op if empty. An op ending with "*"
+	// matches the ops starting with the rest of it, e.g., "S/quest/*".
+	Ops []string
+	// From and To bound the time of the packets, unbounded if zero.
+	From, To time.Time
+	// Contains is a substring the packet's body must contain.
+	Contains string
+}
+
+// Match reports whether the packet matches the filter.
+func (f *Filter) Match(p *Packet) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Ops) > 0 && !matchOp(f.Ops, p.Op) {
+		return false
+	}
+	if !f.From.IsZero() && p.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && p.Time.After(f.To) {
+		return false
+	}
+	return f.Contains == "" || bytes.Contains(p.Data, []byte(f.Contains))
+}
+
+func matchOp(ops []string, op string) bool {
+	for _, pattern := range ops {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(op, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if pattern == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader iterates over the packets of a packet log.
+type Reader struct {
+	r      *bufio.Reader
+	filter *Filter
+	day    time.Time
+	last   time.Duration
+	offset int64
+	// next is the header line read ahead while looking for the end of the
+	// previous packet's body.
+	next    []byte
+	nextErr error
+}
+
+// NewReader returns a reader of the packet log read from r, start being the
+// time the log was created at, see FileTime. The packets have no date if start
+// is zero.
+func NewReader(r io.Reader, start time.Time) *Reader {
+	return &Reader{
+		r:    bufio.NewReader(r),
+		day:  time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location()),
+		last: sinceMidnight(start),
+	}
+}
+
+// SetFilter skips the packets not matching f on Next.
+func (r *Reader) SetFilter(f *Filter) {
+	r.filter = f
+}
+
+// Next returns the next packet matching the filter, or io.EOF once the log is
+// exhausted.
+func (r *Reader) Next() (*Packet, error) {
+	for {
+		p, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		if r.filter.Match(p) {
+			return p, nil
+		}
+	}
+}
+
+// ForEach calls fn with every packet matching the filter until fn returns
+// false.
+func (r *Reader) ForEach(fn func(p *Packet) bool) error {
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !fn(p) {
+			return nil
+		}
+	}
+}
+
+// read returns the next packet. Lines which aren't prefixed with a time and an
+// op are parts of the previous packet's body, whose body contained newlines.
+func (r *Reader) read() (*Packet, error) {
+	line, err := r.line()
+	for err == nil && parseHeader(line) == nil {
+		// Skip anything preceding the first packet.
+		r.offset += int64(len(line))
+		line, err = r.line()
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	h := parseHeader(line)
+	if h == nil {
+		return nil, io.EOF
+	}
+	p := &Packet{Op: h.op, Offset: r.offset, Time: r.time(h.sinceMidnight)}
+	data := append([]byte(nil), line[h.bodyStart:]...)
+	size := int64(len(line))
+	for err == nil {
+		line, err = r.line()
+		if len(line) == 0 {
+			break
+		}
+		if parseHeader(line) != nil {
+			r.next, r.nextErr = line, err
+			break
+		}
+		data = append(data, line...)
+		size += int64(len(line))
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	p.Data = bytes.TrimSuffix(data, []byte{'\n'})
+	p.Size = size
+	r.offset += size
+	return p, nil
+}
+
+// line returns the next line including its newline.
+func (r *Reader) line() ([]byte, error) {
+	if r.next != nil {
+		line, err := r.next, r.nextErr
+		r.next, r.nextErr = nil, nil
+		return line, err
+	}
+	return r.r.ReadBytes('\n')
+}
+
+// time returns the time of a packet logged at the time of day, rolling over to
+// the next day if it's earlier than the previous packet's.
+func (r *Reader) time(d time.Duration) time.Time {
+	if d < r.last {
+		r.day = r.day.AddDate(0, 0, 1)
+	}
+	r.last = d
+	return r.day.Add(d)
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+}
+
+type header struct {
+	sinceMidnight time.Duration
+	op            string
+	bodyStart     int
+}
+
+// parseHeader parses the "15:04:05 [op] " prefix of a packet's line, returning
+// nil if the line has none.
+func parseHeader(line []byte) *header {
+	const prefix = len(TimeLayout) + len(" [")
+	if len(line) < prefix || line[len(TimeLayout)] != ' ' || line[len(TimeLayout)+1] != '[' {
+		return nil
+	}
+	t, err := time.Parse(TimeLayout, string(line[:len(TimeLayout)]))
+	if err != nil {
+		return nil
+	}
+	end := bytes.Index(line[prefix:], []byte("] "))
+	if end < 0 {
+		return nil
+	}
+	return &header{
+		sinceMidnight: sinceMidnight(t),
+		op:            string(line[prefix : prefix+end]),
+		bodyStart:     prefix + end + len("] "),
+	}
+}
+
+// File is an open packet log.
+type File struct {
+	r    io.ReaderAt
+	size int64
+	// c is nil if the log was decompressed into memory.
+	c     io.Closer
+	path  string
+	start time.Time
+}
+
+// Open opens the packet log at path, whose name must be the time it was
+// created at, see FileName. Compressed logs are decompressed into memory.
+func Open(path string) (*File, error) {
+	start, err := FileTime(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not named after its creation time: %s", path, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, gzipExt) {
+		defer f.Close()
+		b, err := gunzip(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return &File{bytes.NewReader(b), int64(len(b)), nil, path, start}, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &File{f, info.Size(), f, path, start}, nil
+}
+
+// Start returns the time the log was created at.
+func (f *File) Start() time.Time { return f.start }
+
+// Reader returns a reader of the log's packets from the start of the file.
+func (f *File) Reader() *Reader {
+	return NewReader(io.NewSectionReader(f.r, 0, 1<<62), f.start)
+}
+
+// Index returns the index of the log's packets, loaded from the index file
+// saved alongside the log, see IndexPath, if it's up to date with the log.
+// Otherwise the log is indexed and the index file saved, failing to save it
+// isn't an error.
+func (f *File) Index() (*Index, error) {
+	size := f.size
+	if file, ok := f.r.(*os.File); ok {
+		// The log may have grown since it was opened.
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size()
+	}
+	if idx, err := LoadIndex(IndexPath(f.path)); err == nil && idx.end() == size {
+		return idx, nil
+	}
+	idx, err := BuildIndex(f.Reader())
+	if err != nil {
+		return nil, err
+	}
+	_ = idx.Save(IndexPath(f.path))
+	return idx, nil
+}
+
+// ReadPacket reads the packet of an index entry.
+func (f *File) ReadPacket(e IndexEntry) (*Packet, error) {
+	return ReadPacket(f.r, e)
+}
+
+// Close closes the log.
+func (f *File) Close() error {
+	if f.c == nil {
+		return nil
+	}
+	return f.c.Close()
+}
@@ -0,0 +1,203 @@
+package packetlog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	start := time.Date(2020, 1, 2, 23, 59, 58, 0, time.Local)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	_ = w.WritePacket(start, "S/account/syncData", []byte(`{"user":{}}`))
+	_ = w.WritePacket(start.Add(time.Second), "C/quest/battleStart", []byte("line\nbreak"))
+	_ = w.WritePacket(start.Add(3*time.Second), "S/quest/battleStart", []byte(`{}`))
+
+	r := NewReader(bytes.NewReader(buf.Bytes()), start)
+	var got []*Packet
+	if err := r.ForEach(func(p *Packet) bool { got = append(got, p); return true }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 packets, got %d", len(got))
+	}
+	if string(got[1].Data) != "line\nbreak" {
+		t.Fatalf("Expected the body's newline to be kept, got %q", got[1].Data)
+	}
+	if want := start.Add(3 * time.Second); !got[2].Time.Equal(want) {
+		t.Fatalf("Expected the date to roll over to %s, got %s", want, got[2].Time)
+	}
+	if end := got[2].Offset + got[2].Size; end != int64(buf.Len()) {
+		t.Fatalf("Expected the last packet to end at %d, got %d", buf.Len(), end)
+	}
+
+	r = NewReader(bytes.NewReader(buf.Bytes()), start)
+	r.SetFilter(&Filter{Ops: []string{"S/*"}, Contains: "user"})
+	p, err := r.Next()
+	if err != nil || p.Op != "S/account/syncData" {
+		t.Fatalf("Unexpected filtered packet %+v, %v", p, err)
+	}
+	if _, err := r.Next(); err == nil {
+		t.Fatal("Expected a single packet to match the filter")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packetlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	path := filepath.Join(dir, FileName(start))
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i, op := range []string{"C/quest/battleStart", "S/quest/battleStart", "S/quest/battleFinish"} {
+		_ = w.WritePacket(start.Add(time.Duration(i)*time.Minute), op, []byte(op))
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !f.Start().Equal(start) {
+		t.Fatalf("Expected the log to start at %s, got %s", start, f.Start())
+	}
+	idx, err := f.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := idx.Select(&Filter{Ops: []string{"S/*"}, From: start.Add(time.Minute + time.Second)})
+	if len(entries) != 1 || entries[0].Op != "S/quest/battleFinish" {
+		t.Fatalf("Unexpected entries %+v", entries)
+	}
+	p, err := f.ReadPacket(entries[0])
+	if err != nil || string(p.Data) != "S/quest/battleFinish" || !p.Time.Equal(entries[0].Time) {
+		t.Fatalf("Unexpected packet %+v, %v", p, err)
+	}
+
+	saved, err := LoadIndex(IndexPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Entries) != 3 || !saved.Entries[2].Time.Equal(idx.Entries[2].Time) || saved.Entries[2].Op != idx.Entries[2].Op {
+		t.Fatalf("Unexpected saved index %+v", saved.Entries)
+	}
+	logFile, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = NewWriter(logFile).WritePacket(start.Add(time.Hour), "S/account/syncData", []byte("{}"))
+	logFile.Close()
+	if idx, err = f.Index(); err != nil || len(idx.Entries) != 4 {
+		t.Fatalf("Expected the stale index to be rebuilt, got %+v, %v", idx, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	root, err := ioutil.TempDir("", "packetlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	for _, user := range []string{"GL_1", "GL_2"} {
+		if err := os.Mkdir(filepath.Join(root, user), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		for i, ap := range []string{"10", "10", "20"} {
+			body := `{"playerDataDelta":{"modified":{"status":{"ap":` + ap + `}}}}`
+			_ = w.WritePacket(start.Add(time.Duration(i)*time.Minute), "S/quest/battleStart", []byte(body))
+		}
+		_ = w.WritePacket(start.Add(time.Hour), "S/account/syncData", []byte("not json"))
+		if err := ioutil.WriteFile(filepath.Join(root, user, FileName(start)), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	q := &Query{Users: []string{"GL_2"}, Path: "playerDataDelta.modified.status.ap", Changed: true}
+	err = Run(root, q, func(r *Result) bool {
+		got = append(got, r.User+" "+string(r.Value))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"GL_2 10", "GL_2 20"}; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+
+	var results []*Result
+	q = &Query{Filter: Filter{Ops: []string{"S/account/syncData"}}}
+	if err := Run(root, q, func(r *Result) bool { results = append(results, r); return true }); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || string(results[0].Value) != `"not json"` {
+		t.Fatalf("Expected the bodies which aren't JSON to be quoted, got %+v", results)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packetlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	path := filepath.Join(dir, FileName(start))
+	var buf bytes.Buffer
+	_ = NewWriter(&buf).WritePacket(start, "S/account/syncData", []byte(`{"user":{}}`))
+	_ = NewWriter(&buf).WritePacket(start.Add(time.Second), "S/quest/battleStart", []byte(`{}`))
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := filepath.Join(dir, FileName(start.Add(time.Hour)))
+	if err := ioutil.WriteFile(later, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed, err := Compress(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected the uncompressed log to be removed")
+	}
+	logs, err := Logs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0] != compressed || logs[1] != later {
+		t.Fatalf("Unexpected logs %q", logs)
+	}
+	f, err := Open(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !f.Start().Equal(start) {
+		t.Fatalf("Expected the log to start at %s, got %s", start, f.Start())
+	}
+	idx, err := f.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(idx.Entries))
+	}
+	p, err := f.ReadPacket(idx.Entries[1])
+	if err != nil || p.Op != "S/quest/battleStart" || string(p.Data) != "{}" {
+		t.Fatalf("Unexpected packet %+v, %v", p, err)
+	}
+}
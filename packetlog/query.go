@@ -0,0 +1,122 @@
+package packetlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Query selects packets across the packet logs of every user.
+type Query struct {
+	Filter
+	// Users are the region_UIDs whose logs are queried, every user if empty.
+	Users []string
+	// Path is a gjson path, see https://github.com/tidwall/gjson, selecting
+	// the value of each packet's body to return, e.g.,
+	// "playerDataDelta.modified.status.ap". Packets without the value are
+	// skipped. The whole body is returned if empty.
+	Path string
+	// Changed only returns the packets whose value differs from the previous
+	// one returned for the user, answering when a value changed.
+	Changed bool
+}
+
+// Result is a packet matching a query.
+type Result struct {
+	User  string          `json:"user"`
+	Time  time.Time       `json:"time"`
+	Op    string          `json:"op"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Run calls fn with the packets matching the query in the logs under root, the
+// directory containing a directory of logs per user, see UserDir, until fn
+// returns false. The results of a user are ordered by time.
+func Run(root string, q *Query, fn func(r *Result) bool) error {
+	users := q.Users
+	if len(users) == 0 {
+		dirs, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				users = append(users, dir.Name())
+			}
+		}
+	}
+	for _, user := range users {
+		more, err := runUser(filepath.Join(root, user), user, q, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// runUser runs the query over a user's logs, returning false once fn did. The
+// packets are looked up in the index of each log, see File.Index.
+func runUser(dir, user string, q *Query, fn func(r *Result) bool) (bool, error) {
+	logs, err := Logs(dir)
+	if err != nil {
+		return false, err
+	}
+	var last string
+	for _, path := range logs {
+		f, err := Open(path)
+		if err != nil {
+			// Not a packet log.
+			continue
+		}
+		if !q.To.IsZero() && f.Start().After(q.To) {
+			f.Close()
+			break
+		}
+		idx, err := f.Index()
+		if err != nil {
+			f.Close()
+			return false, err
+		}
+		for _, e := range idx.Select(&q.Filter) {
+			p, err := f.ReadPacket(e)
+			if err != nil {
+				f.Close()
+				return false, err
+			}
+			if q.Contains != "" && !q.Match(p) {
+				continue
+			}
+			value, ok := q.value(p)
+			if !ok || (q.Changed && string(value) == last) {
+				continue
+			}
+			last = string(value)
+			if !fn(&Result{User: user, Time: p.Time, Op: p.Op, Value: value}) {
+				f.Close()
+				return false, nil
+			}
+		}
+		f.Close()
+	}
+	return true, nil
+}
+
+// value returns the value of the packet selected by the query's path, the body
+// as a JSON string if it isn't JSON. ok is false if the body has no such value.
+func (q *Query) value(p *Packet) (value json.RawMessage, ok bool) {
+	if q.Path != "" {
+		res := gjson.GetBytes(p.Data, q.Path)
+		return json.RawMessage(res.Raw), res.Exists()
+	}
+	if json.Valid(p.Data) {
+		return p.Data, true
+	}
+	value, _ = json.Marshal(string(p.Data))
+	return value, true
+}
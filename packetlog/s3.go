@@ -0,0 +1,247 @@
+package packetlog
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Options configures an S3Storage.
+type S3Options struct {
+	// Endpoint is the URL of the S3 compatible service, e.g.,
+	// "https://s3.eu-west-1.amazonaws.com" or "http://127.0.0.1:9000" for
+	// MinIO. Buckets are addressed by path.
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	// Region the requests are signed for, defaults to "us-east-1".
+	Region string `json:"region"`
+	// Prefix is prepended to the keys of the logs, which are otherwise the
+	// user followed by the log's file name, e.g.,
+	// "GL_1234/2020-01-02_15-04-05.log".
+	Prefix string `json:"prefix"`
+	// AccessKey and SecretKey default to the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables, keeping the credentials out
+	// of config files.
+	AccessKey string `json:"-"`
+	SecretKey string `json:"-"`
+	// SpoolDir keeps the logs which failed to upload until they are uploaded
+	// along with the next log. Defaults to "rhine-s3-spool" in the temporary
+	// directory.
+	SpoolDir string `json:"spoolDir"`
+}
+
+// S3Storage is a Storage uploading each log as an object to an S3 compatible
+// object store once it's closed. Until then, the log is written to a
+// temporary file.
+type S3Storage struct {
+	options S3Options
+	client  *http.Client
+	// spoolMutex keeps concurrent closes from uploading a spooled log twice.
+	spoolMutex sync.Mutex
+}
+
+// NewS3Storage returns an S3Storage uploading logs with client, or
+// http.DefaultClient if nil.
+func NewS3Storage(options S3Options, client *http.Client) (*S3Storage, error) {
+	if options.Endpoint == "" || options.Bucket == "" {
+		return nil, fmt.Errorf("the endpoint and bucket of the object store are required")
+	}
+	if _, err := url.Parse(options.Endpoint); err != nil {
+		return nil, err
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	if options.AccessKey == "" {
+		options.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if options.SecretKey == "" {
+		options.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if options.SpoolDir == "" {
+		options.SpoolDir = filepath.Join(os.TempDir(), "rhine-s3-spool")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3Storage{options: options, client: client}, nil
+}
+
+type s3Writer struct {
+	*fileWriter
+	s   *S3Storage
+	key string
+}
+
+// Close uploads the log, moving it to the spool directory if the upload fails,
+// and retries uploading the logs spooled before.
+func (w *s3Writer) Close() error {
+	name := w.file.Name()
+	if err := w.fileWriter.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	err := w.s.upload(w.key, name)
+	if err != nil {
+		err = w.s.spool(w.key, name, err)
+	}
+	w.s.uploadSpooled()
+	return err
+}
+
+// upload uploads the file at name as the object key, removing the file once
+// it's uploaded.
+func (s *S3Storage) upload(key, name string) error {
+	body, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := s.PutObject(key, body); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// spool moves the log at name, which failed to upload with err, to the spool
+// directory.
+func (s *S3Storage) spool(key, name string, err error) error {
+	if mkErr := os.MkdirAll(s.options.SpoolDir, 0755); mkErr != nil {
+		return fmt.Errorf("%s, kept the log at %s", err, name)
+	}
+	spooled := filepath.Join(s.options.SpoolDir, url.PathEscape(key))
+	if renameErr := os.Rename(name, spooled); renameErr != nil {
+		return fmt.Errorf("%s, kept the log at %s", err, name)
+	}
+	return fmt.Errorf("%s, spooled the log to %s", err, spooled)
+}
+
+// uploadSpooled uploads the logs of the spool directory, leaving those which
+// fail to upload for the next attempt.
+func (s *S3Storage) uploadSpooled() {
+	s.spoolMutex.Lock()
+	defer s.spoolMutex.Unlock()
+	files, err := ioutil.ReadDir(s.options.SpoolDir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		key, err := url.PathUnescape(fi.Name())
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if err := s.upload(key, filepath.Join(s.options.SpoolDir, fi.Name())); err != nil {
+			return
+		}
+	}
+}
+
+// Create implements Storage.
+func (s *S3Storage) Create(rUID string, start time.Time) (PacketWriter, error) {
+	f, err := ioutil.TempFile("", "rhine-packets-")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	f.Close()
+	w, err := createFile(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &s3Writer{fileWriter: w, s: s, key: rUID + "/" + FileName(start)}, nil
+}
+
+// PutObject uploads body as the object key, prefixed by the configured
+// prefix.
+func (s *S3Storage) PutObject(key string, body []byte) error {
+	key = s.options.Prefix + key
+	u, _ := url.Parse(s.options.Endpoint)
+	u.Path = "/" + s.options.Bucket + "/" + key
+	u.RawPath = "/" + s3Escape(s.options.Bucket, false) + "/" + s3Escape(key, true)
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	s.sign(req, body, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("uploading %s: %s: %s", key, resp.Status, msg)
+	}
+	return nil
+}
+
+// sign signs req with AWS Signature Version 4.
+func (s *S3Storage) sign(req *http.Request, body []byte, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.options.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.options.SecretKey), date)
+	for _, part := range []string{s.options.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.options.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes s as S3 expects in canonical requests, leaving only the
+// unreserved characters and, if keepSlash, slashes.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
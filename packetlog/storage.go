@@ -0,0 +1,131 @@
+package packetlog
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// PacketWriter writes the packets of a log. Implementations must be safe for
+// concurrent use.
+type PacketWriter interface {
+	WritePacket(t time.Time, op string, data []byte) error
+	// Close persists the packets written and releases the log.
+	Close() error
+}
+
+// Storage persists packet logs, letting deployments choose where the Packet
+// Logger keeps them. Implementations must be safe for concurrent use.
+type Storage interface {
+	// Create returns a writer of a new log of the user identified by rUID,
+	// e.g., "GL_1234", created at start.
+	Create(rUID string, start time.Time) (PacketWriter, error)
+}
+
+// FileStorage is a Storage keeping each log as a file named after its
+// creation time in a directory per user, the layout read by Logs and Open.
+type FileStorage struct {
+	dir string
+}
+
+// NewFileStorage returns a FileStorage keeping logs under dir, see Dir for the
+// directory of the Packet Logger.
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{dir: dir}
+}
+
+// fileWriter is a Writer buffering the packets written to a file.
+type fileWriter struct {
+	*Writer
+	buffer *bufio.Writer
+	file   *os.File
+}
+
+func (w *fileWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	err := w.buffer.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Create implements Storage.
+func (s *FileStorage) Create(rUID string, start time.Time) (PacketWriter, error) {
+	dir := filepath.Join(s.dir, rUID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return createFile(filepath.Join(dir, FileName(start)))
+}
+
+func createFile(path string) (*fileWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buffer := bufio.NewWriter(f)
+	return &fileWriter{Writer: NewWriter(buffer), buffer: buffer, file: f}, nil
+}
+
+// validTable matches the table names accepted by NewSQLStorage, which can't be
+// passed as query arguments.
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStorage is a Storage keeping packets as rows of a table, with the user,
+// the creation time of their log, their time and op, and their body. Times are
+// stored as Unix nanoseconds. The queries are written for SQLite, the driver
+// of the database must be registered by the binary.
+type SQLStorage struct {
+	db     *sql.DB
+	insert string
+}
+
+// NewSQLStorage returns a SQLStorage keeping packets in table, creating it if
+// it doesn't exist.
+func NewSQLStorage(db *sql.DB, table string) (*SQLStorage, error) {
+	if !validTable.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		user TEXT NOT NULL,
+		log INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		op TEXT NOT NULL,
+		data BLOB NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS ` + table + `_user_time ON ` + table + ` (user, time)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStorage{
+		db:     db,
+		insert: `INSERT INTO ` + table + ` (user, log, time, op, data) VALUES (?, ?, ?, ?, ?)`,
+	}, nil
+}
+
+type sqlWriter struct {
+	s     *SQLStorage
+	rUID  string
+	start int64
+}
+
+func (w *sqlWriter) WritePacket(t time.Time, op string, data []byte) error {
+	_, err := w.s.db.Exec(w.s.insert, w.rUID, w.start, t.UnixNano(), op, data)
+	return err
+}
+
+func (w *sqlWriter) Close() error { return nil }
+
+// Create implements Storage.
+func (s *SQLStorage) Create(rUID string, start time.Time) (PacketWriter, error) {
+	return &sqlWriter{s: s, rUID: rUID, start: start.UnixNano()}, nil
+}
@@ -0,0 +1,118 @@
+package packetlog
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	w, err := NewFileStorage(dir).Create("GL_1", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.WritePacket(start, "S/account/syncData", []byte(`{"user":{}}`))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := Logs(dir + "/GL_1")
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("Expected a log, got %v %v", logs, err)
+	}
+	f, err := Open(logs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := f.Reader().Next()
+	if err != nil || p.Op != "S/account/syncData" {
+		t.Fatalf("Expected the written packet, got %+v %v", p, err)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	spool, err := ioutil.TempDir("", "rhine-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+	var path, auth, body string
+	var uploads []string
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		path = r.URL.EscapedPath()
+		auth = r.Header.Get("Authorization")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		uploads = append(uploads, path)
+	}))
+	defer server.Close()
+	s, err := NewS3Storage(S3Options{
+		Endpoint:  server.URL,
+		Bucket:    "rhine",
+		Prefix:    "packets/",
+		AccessKey: "key",
+		SecretKey: "secret",
+		SpoolDir:  spool,
+	}, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	w, err := s.Create("GL_1", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.WritePacket(start, "S/account/syncData", []byte(`{"user":{}}`))
+	if path != "" {
+		t.Fatal("Expected the log to be uploaded once closed")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/rhine/packets/GL_1/" + FileName(start); path != want {
+		t.Fatalf("Expected the log to be uploaded to %s, got %s", want, path)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/20") {
+		t.Fatalf("Expected the upload to be signed, got %q", auth)
+	}
+	if !strings.Contains(body, `[S/account/syncData] {"user":{}}`) {
+		t.Fatalf("Unexpected log %q", body)
+	}
+
+	// Logs which fail to upload are spooled and uploaded with the next log.
+	failing = true
+	w, _ = s.Create("GL_1", start.Add(time.Hour))
+	if err := w.Close(); err == nil {
+		t.Fatal("Expected the failed upload to be reported")
+	}
+	if files, _ := ioutil.ReadDir(spool); len(files) != 1 {
+		t.Fatalf("Expected the log to be spooled, got %d files", len(files))
+	}
+	failing = false
+	uploads = nil
+	w, _ = s.Create("GL_1", start.Add(2*time.Hour))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 2 || uploads[1] != "/rhine/packets/GL_1/"+FileName(start.Add(time.Hour)) {
+		t.Fatalf("Expected the spooled log to be uploaded, got %v", uploads)
+	}
+	if files, _ := ioutil.ReadDir(spool); len(files) != 0 {
+		t.Fatalf("Expected the spool to be emptied, got %d files", len(files))
+	}
+}
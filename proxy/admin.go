@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kyoukaya/rhine/utils"
+
+	"github.com/elazarl/goproxy"
+)
+
+// AdminOptions configures the admin listener, which serves Rhine's API over
+// HTTPS with a certificate signed by Rhine's CA.
+type AdminOptions struct {
+	// Address to listen on, e.g., "127.0.0.1:8081". Disabled if empty.
+	Address string `json:"address"`
+	// RequireClientCert only accepts clients presenting a certificate signed by
+	// Rhine's CA, see GenerateClientCert.
+	RequireClientCert bool `json:"requireClientCert"`
+	// Token is the operator's bearer token required by every endpoint,
+	// generated and printed at startup if empty. Clients which cannot set
+	// headers, such as browser WebSockets, may pass it in the "token" query
+	// parameter instead.
+	Token string `json:"token"`
+	// Tokens grants additional tokens a role, e.g., {"abc": "viewer"}.
+	Tokens map[string]Role `json:"tokens"`
+}
+
+// Role is the level of access granted to an admin token.
+type Role string
+
+const (
+	// RoleViewer may only make GET and HEAD requests.
+	RoleViewer Role = "viewer"
+	// RoleOperator may make any request, e.g., to toggle modules or inject packets.
+	RoleOperator Role = "operator"
+)
+
+type roleKey struct{}
+
+// AdminRole returns the role of the token which authenticated an admin request.
+func AdminRole(r *http.Request) Role {
+	role, _ := r.Context().Value(roleKey{}).(Role)
+	return role
+}
+
+// newAdminMux returns the mux of the admin listener with the built in endpoints.
+func (p *Proxy) newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	mux.HandleFunc("/users", p.handleUsers)
+	mux.HandleFunc("/users/modules", p.handleModules)
+	mux.HandleFunc("/users/overview", p.handleOverview)
+	mux.HandleFunc("/users/recent", p.handleRecent)
+	mux.HandleFunc("/stats", p.handleStats)
+	mux.HandleFunc("/dashboard", p.handleDashboard)
+	mux.HandleFunc("/clients", p.handleClients)
+	mux.HandleFunc("/tunnels", p.handleTunnels)
+	mux.HandleFunc("/tunnels/unconfigured", p.handleUnconfigured)
+	mux.HandleFunc("/rtt", p.handleRTT)
+	mux.HandleFunc("/hooks/disabled", p.handleBreaker)
+	mux.HandleFunc("/logs", p.handleLogs)
+	mux.HandleFunc("/capture", p.handleCapture)
+	mux.HandleFunc("/packets", p.handlePackets)
+	mux.HandleFunc("/dropstats", p.handleDropStats)
+	mux.HandleFunc("/export", p.handleExport)
+	mux.HandleFunc("/gacha", p.handleGacha)
+	mux.HandleFunc("/base", p.handleBase)
+	mux.HandleFunc("/support", p.handleSupport)
+	mux.HandleFunc("/session", p.handleSession)
+	mux.HandleFunc("/state", p.handleStateAt)
+	mux.HandleFunc("/stream", p.handleStream)
+	mux.HandleFunc("/ca", p.handleCA)
+	mux.HandleFunc("/pairing", p.handlePairing)
+	mux.HandleFunc("/ca.mobileconfig", p.handleMobileConfig)
+	return mux
+}
+
+// HandleAdmin registers a handler on the admin listener, see http.ServeMux.
+// Requests other than GET and HEAD only reach handler if made by an operator,
+// use AdminRole for finer grained checks.
+func (p *Proxy) HandleAdmin(pattern string, handler http.Handler) {
+	p.admin.Handle(pattern, handler)
+}
+
+// handleUsers lists the region_UID of each connected user.
+func (p *Proxy) handleUsers(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	users := make([]string, 0, len(p.dispatches))
+	for rUID := range p.dispatches {
+		users = append(users, rUID)
+	}
+	p.mutex.Unlock()
+	sort.Strings(users)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(users)
+}
+
+// requireToken wraps next, rejecting requests which do not carry one of the
+// tokens or which require a role above the token's.
+func requireToken(tokens map[string]Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		var role Role
+		for token, tokenRole := range tokens {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+				role = tokenRole
+			}
+		}
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rhine"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if role != RoleOperator && r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, role)))
+	})
+}
+
+// adminTokens returns the roles of the admin tokens, with unknown roles
+// downgraded to viewers.
+func (p *Proxy) adminTokens(token string) map[string]Role {
+	tokens := map[string]Role{token: RoleOperator}
+	for t, role := range p.options.Admin.Tokens {
+		if t == "" || t == token {
+			continue
+		}
+		if role != RoleViewer && role != RoleOperator {
+			p.Warnf("Unknown admin role %q, treating it as %q", role, RoleViewer)
+			role = RoleViewer
+		}
+		tokens[t] = role
+	}
+	return tokens
+}
+
+// generateToken returns a random hex encoded token.
+func generateToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// adminTLSConfig returns the TLS config of the admin listener, its certificate
+// is signed by Rhine's CA for localhost and the machine's outbound addresses.
+func (p *Proxy) adminTLSConfig() (*tls.Config, error) {
+	hosts := append([]string{"localhost", "127.0.0.1", "::1"}, utils.GetOutboundIPs()...)
+	if host, _, err := net.SplitHostPort(p.options.Admin.Address); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	cert, _, _, err := utils.SignCert(&goproxy.GoproxyCa, "Rhine admin", hosts, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if p.options.Admin.RequireClientCert {
+		pool := x509.NewCertPool()
+		pool.AddCert(goproxy.GoproxyCa.Leaf)
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// serveAdmin serves the admin listener if it is configured.
+func (p *Proxy) serveAdmin() {
+	address := p.options.Admin.Address
+	if address == "" {
+		return
+	}
+	config, err := p.adminTLSConfig()
+	if err != nil {
+		p.Warnf("Admin listener disabled: %s", err)
+		return
+	}
+	token := p.options.Admin.Token
+	if token == "" {
+		if token, err = generateToken(); err != nil {
+			p.Warnf("Admin listener disabled: %s", err)
+			return
+		}
+		p.Printf("admin token: %s", token)
+	}
+	l, err := tls.Listen("tcp", address, config)
+	if err != nil {
+		p.Warnf("Admin listener disabled: %s", err)
+		return
+	}
+	p.closeOnShutdown(l)
+	p.Printf("admin server listening on https://%s", l.Addr())
+	if err := p.serveHTTP(l, requireToken(p.adminTokens(token), p.admin)); err != nil {
+		p.Warnln(err)
+	}
+}
+
+// GenerateClientCert mints a client certificate for the admin listener signed
+// by Rhine's CA, which is loaded as configured by ca and generated if it doesn't
+// exist. Relative paths are resolved against utils.BinDir.
+func GenerateClientCert(commonName, certPath, keyPath string, ca *utils.CAOptions) error {
+	if err := loadCA(ca, nil); err != nil {
+		return err
+	}
+	return utils.GenerateClientCert(commonName, configPath(certPath), configPath(keyPath))
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kyoukaya/rhine/utils"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestAdminClientCert(t *testing.T) {
+	p := newTestProxy()
+	p.admin = p.newAdminMux()
+	p.options.Admin.RequireClientCert = true
+	config, err := p.adminTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(p.admin)
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(goproxy.GoproxyCa.Leaf)
+	get := func(certs []tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		resp, err := client.Get(server.URL + "/users")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(nil); err == nil {
+		t.Fatal("Expected clients without a certificate to be rejected")
+	}
+	cert, _, _, err := utils.SignCert(&goproxy.GoproxyCa, "test", nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get([]tls.Certificate{*cert}); err != nil {
+		t.Fatalf("Expected a client certificate signed by the CA to be accepted: %s", err)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	p := newTestProxy()
+	p.admin = p.newAdminMux()
+	p.options.Admin.Tokens = map[string]Role{"view": RoleViewer, "bogus": "admin"}
+	var role Role
+	p.HandleAdmin("/modules", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role = AdminRole(r)
+	}))
+	handler := requireToken(p.adminTokens("secret"), p.admin)
+	for _, test := range []struct {
+		method, target, auth string
+		code                 int
+		role                 Role
+	}{
+		{"GET", "/users", "", http.StatusUnauthorized, ""},
+		{"GET", "/users", "Bearer wrong", http.StatusUnauthorized, ""},
+		{"GET", "/users", "Bearer secret", http.StatusOK, ""},
+		{"GET", "/users?token=secret", "", http.StatusOK, ""},
+		{"GET", "/users?token=wrong", "", http.StatusUnauthorized, ""},
+		{"GET", "/modules", "Bearer view", http.StatusOK, RoleViewer},
+		{"POST", "/modules", "Bearer view", http.StatusForbidden, ""},
+		{"POST", "/modules", "Bearer bogus", http.StatusForbidden, ""},
+		{"POST", "/modules", "Bearer secret", http.StatusOK, RoleOperator},
+	} {
+		role = ""
+		req := httptest.NewRequest(test.method, test.target, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s %s %q: expected %d, got %d", test.method, test.target, test.auth, test.code, w.Code)
+		}
+		if role != test.role {
+			t.Errorf("%s %s %q: expected role %q, got %q", test.method, test.target, test.auth, test.role, role)
+		}
+	}
+}
+
+func TestAdminCA(t *testing.T) {
+	p := newTestProxy()
+	p.admin = p.newAdminMux()
+	p.options.Admin.Tokens = map[string]Role{"view": RoleViewer}
+	handler := requireToken(p.adminTokens("secret"), p.admin)
+	for _, test := range []struct {
+		method, target, token, body string
+		code                        int
+		contentType                 string
+	}{
+		{"GET", "/ca", "view", "", http.StatusOK, "application/x-pem-file"},
+		{"GET", "/ca?format=der", "view", "", http.StatusOK, "application/x-x509-ca-cert"},
+		{"GET", "/ca?format=android", "view", "", http.StatusOK, "application/x-pem-file"},
+		{"GET", "/ca?format=bogus", "view", "", http.StatusBadRequest, ""},
+		{"GET", "/ca?format=p12", "secret", "", http.StatusMethodNotAllowed, ""},
+		{"POST", "/ca?format=p12", "view", "password=pw", http.StatusForbidden, ""},
+		{"POST", "/ca?format=p12", "secret", "", http.StatusBadRequest, ""},
+		{"POST", "/ca?format=p12", "secret", "password=pw", http.StatusOK, "application/x-pkcs12"},
+	} {
+		req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.target, test.code, w.Code)
+		}
+		if test.contentType != "" && w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s %s: unexpected content type %q", test.method, test.target, w.Header().Get("Content-Type"))
+		}
+	}
+}
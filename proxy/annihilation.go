@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils/servertime"
+)
+
+const (
+	// defaultAnnihilationLead is how long before the weekly reset users are
+	// reminded of annihilation by default.
+	defaultAnnihilationLead = 24 * time.Hour
+	// annihilationRetry is the interval at which a due reminder waits for the
+	// user's gamestate to be loaded.
+	annihilationRetry = 10 * time.Second
+)
+
+// annihilationPrefix is the key prefix of the weekly reset each user was last
+// reminded of, saved under "annihilation/{region_UID}".
+const annihilationPrefix = "annihilation/"
+
+// AnnihilationOptions configures the reminder sent to users who haven't earned
+// the weekly orundum cap of annihilation before the weekly reset.
+type AnnihilationOptions struct {
+	// DisableReminder stops reminding users of annihilation.
+	DisableReminder bool `json:"disableReminder"`
+	// RemindBefore is how long before the weekly reset users are reminded,
+	// parsed by time.ParseDuration, e.g., "6h". Defaults to 24h.
+	RemindBefore string `json:"remindBefore"`
+}
+
+// lead returns how long before the weekly reset users are reminded, or 0 if
+// the reminder is disabled.
+func (options *AnnihilationOptions) lead(logger log.Logger) time.Duration {
+	if options.DisableReminder {
+		return 0
+	}
+	if options.RemindBefore == "" {
+		return defaultAnnihilationLead
+	}
+	lead, err := time.ParseDuration(options.RemindBefore)
+	if err != nil || lead <= 0 {
+		logger.Warnf("Invalid annihilation.remindBefore %q, defaulting to %s", options.RemindBefore, defaultAnnihilationLead)
+		return defaultAnnihilationLead
+	}
+	return lead
+}
+
+// runAnnihilationReminder reminds the user of annihilation lead before each
+// weekly reset of their region until the dispatch is stopped.
+func (d *dispatch) runAnnihilationReminder(lead time.Duration) {
+	for {
+		reset, err := servertime.NextWeeklyReset(d.region, time.Now())
+		if err != nil {
+			d.Warnf("Not reminding %s_%d of annihilation: %s", d.region, d.uid, err)
+			return
+		}
+		timer := time.NewTimer(time.Until(reset.Add(-lead)))
+		for due := false; !due || !d.state.IsLoaded(); {
+			select {
+			case <-d.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				due = true
+				timer.Reset(annihilationRetry)
+			}
+		}
+		timer.Stop()
+		d.remindAnnihilation(reset)
+		timer = time.NewTimer(time.Until(reset))
+		select {
+		case <-d.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// remindAnnihilation notifies the user if they haven't reached the weekly cap
+// of annihilation before the reset, once per reset.
+func (d *dispatch) remindAnnihilation(reset time.Time) {
+	rUID := fmt.Sprintf("%s_%d", d.region, d.uid)
+	key := annihilationPrefix + rUID
+	week := reset.UTC().Format(time.RFC3339)
+	if b, err := d.store.Get(key); err == nil && string(b) == week {
+		return
+	} else if err != nil && err != storage.ErrNotFound {
+		d.Warnf("Failed to load the annihilation reminder of %s: %s", rUID, err)
+	}
+	earned, max, err := d.state.Annihilation()
+	if err != nil {
+		d.Warnf("Failed to get the annihilation progress of %s: %s", rUID, err)
+		return
+	}
+	if earned < max {
+		d.notifier.Send(&notify.Notification{
+			Title: "Annihilation",
+			Body: fmt.Sprintf("%d/%d orundum earned from annihilation this week, the weekly reset is in %s.",
+				earned, max, time.Until(reset).Round(time.Minute)),
+			UID:    d.uid,
+			Region: d.region,
+		})
+	}
+	if err := d.store.Put(key, []byte(week)); err != nil {
+		d.Warnf("Failed to save the annihilation reminder of %s: %s", rUID, err)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestAnnihilationReminder(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	d.store = storage.NewMemoryStore()
+	sent := make(chanBackend, 4)
+	d.notifier = notify.New(log.New(false, false, "/dev/null", 0))
+	d.notifier.Add(sent)
+	if err := d.state.Restore([]byte(`{"dungeon": {"campaigns": {"campaignCurrentFee": 1200, "campaignTotalFee": 1800}}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	reset := time.Now().Add(6 * time.Hour)
+	d.remindAnnihilation(reset)
+	d.remindAnnihilation(reset)
+	select {
+	case n := <-sent:
+		if !strings.HasPrefix(n.Body, "1200/1800 orundum") || n.UID != 1 || n.Region != "GL" {
+			t.Fatalf("Unexpected notification %+v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a reminder")
+	}
+
+	d.state.GetStateRef().Dungeon.Campaigns.CampaignCurrentFee = 1800
+	d.remindAnnihilation(reset.Add(7 * 24 * time.Hour))
+	select {
+	case n := <-sent:
+		t.Fatalf("Unexpected notification %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	options := &AnnihilationOptions{RemindBefore: "6h"}
+	if lead := options.lead(p.Logger); lead != 6*time.Hour {
+		t.Fatalf("Unexpected lead %s", lead)
+	}
+	options.DisableReminder = true
+	if lead := options.lead(p.Logger); lead != 0 {
+		t.Fatalf("Expected the reminder to be disabled, got %s", lead)
+	}
+}
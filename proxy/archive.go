@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/outbound"
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+const (
+	defaultArchiveInterval = 24 * time.Hour
+	// archivedPrefix prefixes the keys of the store recording the captures
+	// already archived, followed by the user and the log's file name.
+	archivedPrefix = "archive/captures/"
+)
+
+// ArchiveOptions configures uploading the packet logs and gamestate
+// snapshots of users to an S3 compatible object store, for keeping long
+// histories off the proxy's host. Disabled unless the endpoint and bucket are
+// set.
+//
+// Objects are named after their class first, so lifecycle rules can move or
+// expire each class by prefix:
+// "captures/<region>_<UID>/<log file name>" for packet logs and
+// "snapshots/<region>_<UID>/<YYYY>/<MM>/<time>.json" for snapshots, which are
+// Sessions that can be imported with ImportSession.
+type ArchiveOptions struct {
+	S3 packetlog.S3Options `json:"s3"`
+	// Interval is the time between archivals, e.g., "6h". Defaults to 24h.
+	Interval string `json:"interval"`
+	// DisableCaptures stops archiving the packet logs, which are archived
+	// once rotated, i.e., once a newer log of the user exists. Archive them
+	// before retention.captures prunes them by keeping maxAge above Interval.
+	DisableCaptures bool `json:"disableCaptures"`
+	// DisableSnapshots stops archiving the gamestate of the connected users.
+	DisableSnapshots bool `json:"disableSnapshots"`
+}
+
+// objectStore is the part of packetlog.S3Storage used by the archiver.
+type objectStore interface {
+	PutObject(key string, body []byte) error
+}
+
+// archiver uploads captures and snapshots to an object store.
+type archiver struct {
+	options *ArchiveOptions
+	objects objectStore
+	store   storage.Store
+	// sessions returns the sessions of the connected users to snapshot.
+	sessions func() []*Session
+	log.Logger
+}
+
+// archivedName is the name a capture is recorded as archived under, which
+// doesn't change once it's compressed.
+func archivedName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".gz")
+}
+
+// archiveCaptures uploads the rotated packet logs which haven't been
+// archived yet.
+func (a *archiver) archiveCaptures() {
+	files, err := captureFiles(packetlog.Dir())
+	if err != nil {
+		a.Warnf("Failed to list captures to archive: %s", err)
+		return
+	}
+	n := 0
+	for _, f := range files {
+		if f.keep {
+			continue
+		}
+		rUID := filepath.Base(filepath.Dir(f.path))
+		key := archivedPrefix + rUID + "/" + archivedName(f.path)
+		if _, err := a.store.Get(key); err == nil {
+			continue
+		} else if err != storage.ErrNotFound {
+			a.Warnf("Failed to check whether %s is archived: %s", f.path, err)
+			continue
+		}
+		body, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			a.Warnf("Failed to archive %s: %s", f.path, err)
+			continue
+		}
+		if err := a.objects.PutObject("captures/"+rUID+"/"+filepath.Base(f.path), body); err != nil {
+			a.Warnf("Failed to archive %s: %s", f.path, err)
+			continue
+		}
+		if err := a.store.Put(key, []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+			a.Warnf("Failed to record %s as archived: %s", f.path, err)
+		}
+		n++
+	}
+	if n > 0 {
+		a.Printf("Archived %d captures", n)
+	}
+}
+
+// archiveSnapshots uploads the gamestate of the connected users.
+func (a *archiver) archiveSnapshots(now time.Time) {
+	now = now.UTC()
+	n := 0
+	for _, session := range a.sessions() {
+		rUID := session.Region + "_" + session.UID
+		body, err := json.Marshal(session)
+		if err != nil {
+			a.Warnf("Failed to archive the snapshot of %s: %s", rUID, err)
+			continue
+		}
+		key := "snapshots/" + rUID + "/" + now.Format("2006/01/2006-01-02T15-04-05Z") + ".json"
+		if err := a.objects.PutObject(key, body); err != nil {
+			a.Warnf("Failed to archive the snapshot of %s: %s", rUID, err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		a.Printf("Archived %d snapshots", n)
+	}
+}
+
+func (a *archiver) archive(now time.Time) {
+	if !a.options.DisableCaptures {
+		a.archiveCaptures()
+	}
+	if !a.options.DisableSnapshots {
+		a.archiveSnapshots(now)
+	}
+}
+
+// sessions returns the sessions of the connected users whose gamestate is
+// loaded.
+func (p *Proxy) sessions() []*Session {
+	p.mutex.Lock()
+	rUIDs := make([]string, 0, len(p.dispatches))
+	for rUID := range p.dispatches {
+		rUIDs = append(rUIDs, rUID)
+	}
+	p.mutex.Unlock()
+	sort.Strings(rUIDs)
+	var ret []*Session
+	for _, rUID := range rUIDs {
+		if session, err := p.ExportSession(rUID); err == nil {
+			ret = append(ret, session)
+		}
+	}
+	return ret
+}
+
+// startArchive archives on start and at every interval until the proxy is
+// shut down.
+func (p *Proxy) startArchive() {
+	options := &p.options.Archive
+	if options.S3.Endpoint == "" && options.S3.Bucket == "" {
+		return
+	}
+	objects, err := packetlog.NewS3Storage(options.S3, outbound.Default.Client(0))
+	if err != nil {
+		p.Warnf("Archive disabled: %s", err)
+		return
+	}
+	interval := parseDuration("archive.interval", options.Interval, p.Logger)
+	if interval <= 0 {
+		interval = defaultArchiveInterval
+	}
+	a := &archiver{
+		options:  options,
+		objects:  objects,
+		store:    p.store,
+		sessions: p.sessions,
+		Logger:   p.Logger,
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			a.archive(time.Now())
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+type memoryObjects map[string][]byte
+
+func (m memoryObjects) PutObject(key string, body []byte) error {
+	m[key] = body
+	return nil
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := utils.BinDir
+	defer func() { utils.BinDir = binDir }()
+	utils.BinDir = dir
+
+	captures := packetlog.UserDir("GL_1")
+	if err := os.MkdirAll(captures, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"2020-01-01_00.00.00.log", "2020-01-02_00.00.00.log"} {
+		if err := ioutil.WriteFile(filepath.Join(captures, name), []byte("packets"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects := memoryObjects{}
+	a := &archiver{
+		options:  &ArchiveOptions{},
+		objects:  objects,
+		store:    storage.NewMemoryStore(),
+		sessions: func() []*Session { return []*Session{{UID: "1", Region: "GL", State: []byte("{}")}} },
+		Logger:   log.New(false, false, "/dev/null", 0),
+	}
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	a.archive(now)
+	var keys []string
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	want := []string{
+		"captures/GL_1/2020-01-01_00.00.00.log",
+		"snapshots/GL_1/2020/01/2020-01-02T10-00-00Z.json",
+	}
+	if len(keys) != len(want) || keys[0] != want[0] || keys[1] != want[1] {
+		t.Fatalf("Expected objects %v, got %v", want, keys)
+	}
+
+	// Compressing an archived capture doesn't archive it again.
+	delete(objects, want[0])
+	if _, err := packetlog.Compress(filepath.Join(captures, "2020-01-01_00.00.00.log")); err != nil {
+		t.Fatal(err)
+	}
+	a.archiveCaptures()
+	if len(objects) != 1 {
+		t.Fatalf("Expected archived captures to be skipped, got %v", objects)
+	}
+}
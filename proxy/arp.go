@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var macMatcher = regexp.MustCompile(`(?i)\b([0-9a-f]{1,2}[:-]){5}[0-9a-f]{1,2}\b`)
+
+// normalizeMAC formats a MAC address as lower case, colon separated octets,
+// returning an empty string if mac isn't one.
+func normalizeMAC(mac string) string {
+	hw, err := net.ParseMAC(strings.Replace(mac, "-", ":", -1))
+	if err != nil || len(hw) != 6 {
+		// net.ParseMAC doesn't accept the unpadded octets of macOS' arp.
+		parts := strings.FieldsFunc(mac, func(r rune) bool { return r == ':' || r == '-' })
+		if len(parts) != 6 {
+			return ""
+		}
+		for i, part := range parts {
+			if len(part) == 1 {
+				parts[i] = "0" + part
+			}
+		}
+		if hw, err = net.ParseMAC(strings.Join(parts, ":")); err != nil {
+			return ""
+		}
+	}
+	return hw.String()
+}
+
+// lookupMAC returns the MAC address of a host on the local network from the
+// ARP cache, or an empty string if it isn't cached.
+func lookupMAC(ip string) string {
+	if runtime.GOOS == "linux" {
+		f, err := os.Open("/proc/net/arp")
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// IP address, HW type, Flags, HW address, Mask, Device
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 4 && fields[0] == ip {
+				if mac := normalizeMAC(fields[3]); mac != "00:00:00:00:00:00" {
+					return mac
+				}
+			}
+		}
+		return ""
+	}
+	args := []string{"-n", ip}
+	if runtime.GOOS == "windows" {
+		args = []string{"-a", ip}
+	}
+	out, err := exec.Command("arp", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return normalizeMAC(macMatcher.FindString(string(out)))
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/queue"
+)
+
+// BackpressureOptions configures what happens when a consumer can't keep up.
+// Policies are "dropNewest" (default), "dropOldest" or "block", see
+// queue.Policy. Dropped items are counted in the metrics package's Default
+// registry.
+type BackpressureOptions struct {
+	// EventPolicy applies to event bus listeners whose chan is full.
+	EventPolicy string `json:"eventPolicy"`
+	// NotificationPolicy applies to notification backends with a full queue.
+	NotificationPolicy string `json:"notificationPolicy"`
+	// NotificationQueueSize defaults to notify.DefaultQueueSize.
+	NotificationQueueSize int `json:"notificationQueueSize"`
+}
+
+func parsePolicy(s string, logger log.Logger) queue.Policy {
+	policy, err := queue.ParsePolicy(s)
+	if err != nil {
+		logger.Warnf("%s, using %s", err, policy)
+	}
+	return policy
+}
+
+func (options *BackpressureOptions) applyEvents(bus *events.Bus, logger log.Logger) {
+	bus.SetPolicy(parsePolicy(options.EventPolicy, logger))
+}
+
+func (options *BackpressureOptions) applyNotifier(notifier *notify.Notifier, logger log.Logger) {
+	size := options.NotificationQueueSize
+	if size <= 0 {
+		size = notify.DefaultQueueSize
+	}
+	notifier.SetQueue(size, parsePolicy(options.NotificationPolicy, logger))
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/kyoukaya/rhine/proxy/gamestate/statestruct"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+	"github.com/kyoukaya/rhine/utils/gamedata/buildingtable"
+)
+
+// TopicBaseReport is the topic of the BaseReport events published by the Base
+// Efficiency module.
+const TopicBaseReport = "proxy/baseReport"
+
+const (
+	// moraleUnit is the ap of a single point of an operator's morale.
+	moraleUnit = 360000
+	// lowMorale is the morale below which working operators are flagged.
+	lowMorale = 6
+	// restedMorale is the morale from which resting operators are suggested as
+	// replacements.
+	restedMorale = 12
+)
+
+// Room types of the base which operators don't work in.
+const (
+	roomDormitory = "DORMITORY"
+	roomElevator  = "ELEVATOR"
+	roomCorridor  = "CORRIDOR"
+)
+
+// errNoBase is returned by ComputeBaseReport if the gamestate has no base.
+var errNoBase = errors.New("base not loaded")
+
+// BaseRoom is a room of a user's base and the operators working in it.
+type BaseRoom struct {
+	SlotID   string `json:"slotId"`
+	RoomType string `json:"roomType"`
+	Level    int64  `json:"level"`
+	// Speed is the production speed of a factory or trading post, 1 without
+	// any buffs, as computed by the server. It's 0 for other rooms.
+	Speed float64 `json:"speed,omitempty"`
+	// Operators are the charIds of the operators assigned to the room.
+	Operators []string `json:"operators"`
+	// Buffs are the names of the operators' base skills which apply to the
+	// room.
+	Buffs []string `json:"buffs,omitempty"`
+}
+
+// BaseFlag is a shift assignment which is likely suboptimal.
+type BaseFlag struct {
+	SlotID string `json:"slotId"`
+	CharID string `json:"charId"`
+	Reason string `json:"reason"`
+	// Alternative is the charId of a rested operator with a skill for the
+	// room, if any.
+	Alternative string `json:"alternative,omitempty"`
+}
+
+// BaseReport is the production efficiency of a user's base as of the last
+// sync.
+type BaseReport struct {
+	User  string     `json:"user"`
+	Rooms []BaseRoom `json:"rooms"`
+	// Manufacture and Trading are the average speeds of the factories and
+	// trading posts, 0 if the user has none.
+	Manufacture float64    `json:"manufacture"`
+	Trading     float64    `json:"trading"`
+	Flags       []BaseFlag `json:"flags,omitempty"`
+}
+
+// ComputeBaseReport computes the efficiency of the base in the gamestate,
+// looking up the base skills of operators in the building table. Operators
+// working without a skill for their room or with low morale are flagged.
+func ComputeBaseReport(user string, state *statestruct.User, table *buildingtable.BuildingData) (*BaseReport, error) {
+	building := state.Building
+	if building == nil || building.Rooms == nil || state.Troop == nil {
+		return nil, errNoBase
+	}
+	// roomBuffs returns the skills of an operator which apply to the room type.
+	roomBuffs := func(instID, roomType string) []string {
+		char, ok := state.Troop.Chars[instID]
+		if !ok {
+			return nil
+		}
+		var ret []string
+		for _, id := range table.ActiveBuffs(char.CharID, char.EvolvePhase, char.Level) {
+			if buff := table.Buffs[id]; buff.RoomType == roomType {
+				ret = append(ret, buff.BuffName)
+			}
+		}
+		return ret
+	}
+
+	var resting []string
+	for instID, char := range building.Chars {
+		slot, ok := building.RoomSlots[char.RoomSlotID]
+		if (!ok || slot.RoomID == roomDormitory) && char.Ap >= restedMorale*moraleUnit {
+			resting = append(resting, instID)
+		}
+	}
+	sortInstIDs(resting)
+	suggested := make(map[string]bool)
+
+	slotIDs := make([]string, 0, len(building.RoomSlots))
+	for slotID := range building.RoomSlots {
+		slotIDs = append(slotIDs, slotID)
+	}
+	sort.Strings(slotIDs)
+	report := &BaseReport{User: user}
+	var manufacture, trading []float64
+	for _, slotID := range slotIDs {
+		slot := building.RoomSlots[slotID]
+		switch slot.RoomID {
+		case roomDormitory, roomElevator, roomCorridor:
+			continue
+		}
+		room := BaseRoom{SlotID: slotID, RoomType: slot.RoomID, Level: slot.Level}
+		if info, ok := building.Rooms.Manufacture[slotID]; ok {
+			room.Speed = info.Buff.Speed
+			manufacture = append(manufacture, room.Speed)
+		} else if info, ok := building.Rooms.Trading[slotID]; ok {
+			room.Speed = info.Buff.Speed
+			trading = append(trading, room.Speed)
+		}
+		for _, id := range slot.CharInstIDS {
+			if id <= 0 {
+				continue
+			}
+			instID := strconv.FormatInt(id, 10)
+			charID := building.Chars[instID].CharID
+			room.Operators = append(room.Operators, charID)
+			buffs := roomBuffs(instID, slot.RoomID)
+			room.Buffs = append(room.Buffs, buffs...)
+			if morale := building.Chars[instID].Ap / moraleUnit; morale < lowMorale {
+				report.Flags = append(report.Flags, BaseFlag{SlotID: slotID, CharID: charID,
+					Reason: fmt.Sprintf("morale %d", morale)})
+			}
+			if len(buffs) > 0 {
+				continue
+			}
+			flag := BaseFlag{SlotID: slotID, CharID: charID, Reason: "no skill for " + slot.RoomID}
+			for _, candidate := range resting {
+				if !suggested[candidate] && len(roomBuffs(candidate, slot.RoomID)) > 0 {
+					suggested[candidate] = true
+					flag.Alternative = building.Chars[candidate].CharID
+					break
+				}
+			}
+			report.Flags = append(report.Flags, flag)
+		}
+		report.Rooms = append(report.Rooms, room)
+	}
+	report.Manufacture = average(manufacture)
+	report.Trading = average(trading)
+	return report, nil
+}
+
+// sortInstIDs sorts charInstIds numerically.
+func sortInstIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.ParseInt(ids[i], 10, 64)
+		b, _ := strconv.ParseInt(ids[j], 10, 64)
+		return a < b
+	})
+}
+
+func average(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// BaseReports returns the base reports of the connected users whose gamestate
+// is loaded, ordered by region_UID. user limits the reports to a region_UID's.
+func (p *Proxy) BaseReports(user string) ([]*BaseReport, error) {
+	p.mutex.Lock()
+	dispatches := make(map[string]*dispatch, len(p.dispatches))
+	for rUID, d := range p.dispatches {
+		if user == "" || rUID == user {
+			dispatches[rUID] = d
+		}
+	}
+	p.mutex.Unlock()
+	rUIDs := make([]string, 0, len(dispatches))
+	for rUID := range dispatches {
+		rUIDs = append(rUIDs, rUID)
+	}
+	sort.Strings(rUIDs)
+	handles := make(map[string]*gamedata.GameData)
+	defer func() {
+		for _, gd := range handles {
+			gd.Close()
+		}
+	}()
+	var reports []*BaseReport
+	for _, rUID := range rUIDs {
+		d := dispatches[rUID]
+		if d.state == nil || !d.state.IsLoaded() {
+			continue
+		}
+		table := p.buildingTable
+		if table == nil {
+			gd := handles[d.region]
+			if gd == nil {
+				var err error
+				if gd, err = gamedata.New(d.region, p.Logger); err != nil {
+					return nil, err
+				}
+				handles[d.region] = gd
+			}
+			var err error
+			if table, err = gd.GetBuildingInfo(); err != nil {
+				return nil, err
+			}
+		}
+		report, err := ComputeBaseReport(rUID, d.state.GetStateRef(), table)
+		if err == errNoBase {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// handleBase serves the base reports for the optional "user" query parameter.
+func (p *Proxy) handleBase(w http.ResponseWriter, r *http.Request) {
+	reports, err := p.BaseReports(r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(reports)
+}
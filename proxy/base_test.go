@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/kyoukaya/rhine/utils/gamedata/buildingtable"
+)
+
+const testBuildingData = `{
+	"chars": {
+		"char_a": {"charId": "char_a", "buffChar": [{"buffData": [
+			{"buffId": "manu_1", "cond": {"phase": 0, "level": 1}},
+			{"buffId": "manu_2", "cond": {"phase": "PHASE_2", "level": 1}}]}]},
+		"char_b": {"charId": "char_b", "buffChar": [{"buffData": [
+			{"buffId": "trade_1", "cond": {"phase": 1, "level": 1}}]}]},
+		"char_c": {"charId": "char_c", "buffChar": [{"buffData": [
+			{"buffId": "trade_1", "cond": {"phase": 0, "level": 30}}]}]}
+	},
+	"buffs": {
+		"manu_1": {"buffId": "manu_1", "buffName": "Standardization α", "roomType": "MANUFACTURE"},
+		"manu_2": {"buffId": "manu_2", "buffName": "Standardization β", "roomType": "MANUFACTURE"},
+		"trade_1": {"buffId": "trade_1", "buffName": "Negotiation", "roomType": "TRADING"}
+	}
+}`
+
+func TestBaseReport(t *testing.T) {
+	table, err := buildingtable.Unmarshal([]byte(testBuildingData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy()
+	p.buildingTable = &table
+	state := `{
+		"troop": {"chars": {
+			"1": {"instId": 1, "charId": "char_a", "evolvePhase": 2, "level": 1},
+			"2": {"instId": 2, "charId": "char_b", "evolvePhase": 0, "level": 50},
+			"3": {"instId": 3, "charId": "char_c", "evolvePhase": 0, "level": 30}
+		}},
+		"building": {
+			"chars": {
+				"1": {"charId": "char_a", "roomSlotId": "slot_1", "ap": 1800000},
+				"2": {"charId": "char_b", "roomSlotId": "slot_2", "ap": 8640000},
+				"3": {"charId": "char_c", "roomSlotId": "slot_3", "ap": 8640000}
+			},
+			"roomSlots": {
+				"slot_1": {"level": 3, "roomId": "MANUFACTURE", "charInstIds": [1, -1, -1]},
+				"slot_2": {"level": 2, "roomId": "TRADING", "charInstIds": [2, -1, -1]},
+				"slot_3": {"level": 1, "roomId": "DORMITORY", "charInstIds": [3, -1, -1, -1, -1]}
+			},
+			"rooms": {
+				"MANUFACTURE": {"slot_1": {"buff": {"speed": 1.35}}},
+				"TRADING": {"slot_2": {"buff": {"speed": 1.05}}}
+			}
+		}
+	}`
+	if err := p.getUser("1", "GL").state.Restore([]byte(state)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.handleBase(w, httptest.NewRequest("GET", "/base?user=GL_1", nil))
+	var reports []*BaseReport
+	if err := json.NewDecoder(w.Body).Decode(&reports); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*BaseReport{{
+		User: "GL_1",
+		Rooms: []BaseRoom{
+			{SlotID: "slot_1", RoomType: "MANUFACTURE", Level: 3, Speed: 1.35,
+				Operators: []string{"char_a"}, Buffs: []string{"Standardization β"}},
+			{SlotID: "slot_2", RoomType: "TRADING", Level: 2, Speed: 1.05, Operators: []string{"char_b"}},
+		},
+		Manufacture: 1.35,
+		Trading:     1.05,
+		Flags: []BaseFlag{
+			{SlotID: "slot_1", CharID: "char_a", Reason: "morale 5"},
+			{SlotID: "slot_2", CharID: "char_b", Reason: "no skill for TRADING", Alternative: "char_c"},
+		},
+	}}
+	if !reflect.DeepEqual(reports, expected) {
+		b, _ := json.Marshal(reports)
+		t.Fatalf("Unexpected reports %s", b)
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxBodyPrealloc caps the buffer preallocated from a Content-Length header so
+// a bogus header can't make us allocate an arbitrary amount of memory up front.
+const maxBodyPrealloc = 32 << 20
+
+// readBody reads body into a single buffer, sized from contentLength when it is
+// known so that the body isn't copied while the buffer grows. The returned
+// buffer is shared by the core handlers and every hook dispatched for the
+// packet, and is never written to after it is read.
+func readBody(body io.ReadCloser, contentLength int64) ([]byte, error) {
+	defer body.Close()
+	if contentLength < 0 || contentLength > maxBodyPrealloc {
+		return ioutil.ReadAll(body)
+	}
+	// One extra byte lets ReadFrom observe EOF without growing the buffer.
+	buf := bytes.NewBuffer(make([]byte, 0, contentLength+1))
+	_, err := buf.ReadFrom(body)
+	return buf.Bytes(), err
+}
+
+// sameBuffer reports whether a and b are the same slice of the same backing
+// array, i.e., no hook replaced the body of the packet.
+func sameBuffer(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
+
+// setBody replaces the body of a packet, the headers are updated to match.
+func setBody(body *io.ReadCloser, contentLength *int64, header http.Header, data []byte) {
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	*contentLength = int64(len(data))
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+	}
+}
+
+// applyBody sets the data returned by the hooks as the body of the packet the
+// data was dispatched from. The packet isn't touched if no hook changed the
+// data, in which case it still reads from the buffer read by readBody.
+func applyBody(op string, orig, data []byte, req *http.Request, resp *http.Response) {
+	if sameBuffer(orig, data) {
+		return
+	}
+	if strings.HasPrefix(op, "S/") {
+		if resp != nil {
+			setBody(&resp.Body, &resp.ContentLength, resp.Header, data)
+		}
+	} else if req != nil {
+		setBody(&req.Body, &req.ContentLength, req.Header, data)
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerTimeout  = time.Second
+)
+
+// HookBreakerOptions configures the circuit breaker which disables the hooks
+// of a module on an op for every user after they fail repeatedly, e.g., once a
+// game update breaks the module.
+type HookBreakerOptions struct {
+	// Disable keeps failing hooks enabled.
+	Disable bool `json:"disable"`
+	// Failures is the number of consecutive failures after which a hook is
+	// disabled, defaults to 5.
+	Failures int `json:"failures"`
+	// Timeout is the duration above which a hook's run counts as a failure,
+	// e.g., "500ms". Defaults to 1s.
+	Timeout string `json:"timeout"`
+}
+
+// TrippedHook is a module's hook on an op disabled by the circuit breaker.
+type TrippedHook struct {
+	Module string    `json:"module"`
+	Op     string    `json:"op"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// hookKey identifies the hooks of a module on an op, across users.
+type hookKey struct {
+	module, op string
+}
+
+// hookBreaker counts the consecutive failures of hooks shared by every
+// dispatch, disabling the hooks which fail too often until reset.
+type hookBreaker struct {
+	mutex    sync.Mutex
+	failures map[hookKey]int
+	tripped  map[hookKey]*TrippedHook
+	limit    int
+	timeout  time.Duration
+	notifier *notify.Notifier
+	log.Logger
+}
+
+func newHookBreaker(options *HookBreakerOptions, notifier *notify.Notifier, logger log.Logger) *hookBreaker {
+	if options.Disable {
+		return nil
+	}
+	b := &hookBreaker{
+		failures: make(map[hookKey]int),
+		tripped:  make(map[hookKey]*TrippedHook),
+		limit:    options.Failures,
+		timeout:  parseDuration("hookBreaker.timeout", options.Timeout, logger),
+		notifier: notifier,
+		Logger:   logger,
+	}
+	if b.limit <= 0 {
+		b.limit = defaultBreakerFailures
+	}
+	if b.timeout <= 0 {
+		b.timeout = defaultBreakerTimeout
+	}
+	return b
+}
+
+// open reports whether the hooks of the module on the op are disabled.
+func (b *hookBreaker) open(module, op string) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.tripped[hookKey{module, op}] != nil
+}
+
+// record records a run of a hook, which failed if err is set or if it took
+// longer than the timeout.
+func (b *hookBreaker) record(module, op string, took time.Duration, err interface{}) {
+	if b == nil {
+		return
+	}
+	key := hookKey{module, op}
+	var reason string
+	switch {
+	case err != nil:
+		reason = fmt.Sprintf("panicked: %v", err)
+	case took > b.timeout:
+		reason = fmt.Sprintf("took %s", took.Round(time.Millisecond))
+	}
+	b.mutex.Lock()
+	if reason == "" {
+		delete(b.failures, key)
+		b.mutex.Unlock()
+		return
+	}
+	b.failures[key]++
+	if b.failures[key] < b.limit || b.tripped[key] != nil {
+		b.mutex.Unlock()
+		return
+	}
+	delete(b.failures, key)
+	b.tripped[key] = &TrippedHook{Module: module, Op: op, Reason: reason, Time: time.Now()}
+	b.mutex.Unlock()
+
+	msg := fmt.Sprintf("%s's hook on %s was disabled for every user after failing %d times in a row, last %s.",
+		module, op, b.limit, reason)
+	b.Warnln(msg)
+	b.notifier.Send(&notify.Notification{Title: "Hook disabled", Body: msg, Urgency: notify.Critical})
+}
+
+// reset re-enables the hooks of the module on the op, returning false if they
+// weren't disabled.
+func (b *hookBreaker) reset(module, op string) bool {
+	if b == nil {
+		return false
+	}
+	key := hookKey{module, op}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tripped[key] == nil {
+		return false
+	}
+	delete(b.tripped, key)
+	delete(b.failures, key)
+	b.Printf("%s's hook on %s was re-enabled", module, op)
+	return true
+}
+
+// list returns the disabled hooks ordered by module and op.
+func (b *hookBreaker) list() []TrippedHook {
+	ret := []TrippedHook{}
+	if b == nil {
+		return ret
+	}
+	b.mutex.Lock()
+	for _, hook := range b.tripped {
+		ret = append(ret, *hook)
+	}
+	b.mutex.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Module != ret[j].Module {
+			return ret[i].Module < ret[j].Module
+		}
+		return ret[i].Op < ret[j].Op
+	})
+	return ret
+}
+
+// TrippedHooks returns the hooks disabled by the circuit breaker, see
+// HookBreakerOptions.
+func (p *Proxy) TrippedHooks() []TrippedHook {
+	return p.breaker.list()
+}
+
+// ResetHook re-enables a module's hooks on an op disabled by the circuit
+// breaker, returning false if they weren't disabled.
+func (p *Proxy) ResetHook(module, op string) bool {
+	return p.breaker.reset(module, op)
+}
+
+// handleBreaker lists the hooks disabled by the circuit breaker on GET, and
+// re-enables a module's hooks on an op given by the "module" and "op" query
+// parameters on DELETE.
+func (p *Proxy) handleBreaker(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.TrippedHooks())
+	case "DELETE":
+		query := r.URL.Query()
+		if !p.ResetHook(query.Get("module"), query.Get("op")) {
+			http.Error(w, "hook not disabled", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/kyoukaya/rhine/notify"
+)
+
+func TestHookBreaker(t *testing.T) {
+	p := newTestProxy()
+	p.breaker = newHookBreaker(&HookBreakerOptions{Failures: 3}, notify.New(p.Logger), p.Logger)
+	d := p.getUser("1", "GL")
+	d.breaker = p.breaker
+	calls := 0
+	hook := &PacketHook{
+		target: "S/quest/battleStart",
+		mod:    &RhineModule{name: "broken"},
+		handler: func(op string, data []byte, ctx *goproxy.ProxyCtx) []byte {
+			calls++
+			panic("broken hook")
+		},
+	}
+	data := []byte("{}")
+	for i := 0; i < 5; i++ {
+		if got, _ := d.hookWrapper(hook, hook.target, data, nil); !bytes.Equal(got, data) {
+			t.Fatalf("Expected the packet to be left unchanged, got %s", got)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("Expected the hook to be disabled after 3 failures, called %d times", calls)
+	}
+
+	mux := p.newAdminMux()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/hooks/disabled", nil))
+	var tripped []TrippedHook
+	if err := json.Unmarshal(w.Body.Bytes(), &tripped); err != nil {
+		t.Fatal(err)
+	}
+	if len(tripped) != 1 || tripped[0].Module != "broken" || tripped[0].Op != hook.target {
+		t.Fatalf("Unexpected disabled hooks %+v", tripped)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/hooks/disabled?module=broken&op=S/quest/battleStart", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", w.Code)
+	}
+	d.hookWrapper(hook, hook.target, data, nil)
+	if calls != 4 {
+		t.Fatal("Expected the hook to run once re-enabled")
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/hooks/disabled?module=broken&op=S/quest/battleStart", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a hook which isn't disabled, got %d", w.Code)
+	}
+}
@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/proxy/gamestate"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+)
+
+// Files of a session bundle.
+const (
+	bundleManifest = "manifest.json"
+	bundleConfig   = "config.json"
+	bundleSession  = "session.json"
+	bundleLogs     = "logs/"
+)
+
+// redactedKeys are the config fields replaced in session bundles, as they hold
+// credentials or contact details.
+var redactedKeys = map[string]bool{
+	"token":    true,
+	"tokens":   true,
+	"password": true,
+	"username": true,
+	"chatId":   true,
+	"to":       true,
+	"dsn":      true,
+}
+
+// BundleManifest describes the contents of a session bundle, a zip archive of
+// a user's packet logs, gamestate, redacted config and gamedata version for
+// bug reports and analysis on another machine.
+type BundleManifest struct {
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	// Logs are the names of the user's packet logs in the bundle.
+	Logs []string `json:"logs"`
+	// Session is set if the bundle includes the user's gamestate as a Session,
+	// which can be imported with ImportSession or POSTed to /session on the
+	// admin listener.
+	Session bool `json:"session"`
+	// Gamedata are the etags of the gamedata files the proxy had downloaded.
+	Gamedata map[string]string `json:"gamedata"`
+}
+
+// ExportBundle writes a session bundle of the user to w, rUID being the user's
+// region and UID, e.g., "GL_1234". The gamestate is the one shared in the store
+// if Options.ShareState is set, otherwise it's replayed from the packet logs.
+func ExportBundle(w io.Writer, options *Options, rUID string) (*BundleManifest, error) {
+	sep := strings.Index(rUID, "_")
+	if sep < 0 || !newRegions(options.GameHosts).known(rUID[:sep]) {
+		return nil, fmt.Errorf("invalid user %q, expected region_UID", rUID)
+	}
+	logs, err := packetlog.Logs(packetlog.UserDir(rUID))
+	if err != nil {
+		return nil, err
+	}
+	state, err := bundledState(options, rUID, logs)
+	if err != nil {
+		return nil, err
+	}
+	config, err := redactOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BundleManifest{
+		User:     rUID,
+		Created:  time.Now(),
+		Logs:     []string{},
+		Session:  state != nil,
+		Gamedata: gamedata.Versions(),
+	}
+	archive := zip.NewWriter(w)
+	for _, logPath := range logs {
+		name := filepath.Base(logPath)
+		if err := zipFile(archive, bundleLogs+name, logPath); err != nil {
+			return nil, err
+		}
+		manifest.Logs = append(manifest.Logs, name)
+	}
+	if state != nil {
+		session, err := json.Marshal(&Session{UID: rUID[sep+1:], Region: rUID[:sep], State: state})
+		if err != nil {
+			return nil, err
+		}
+		if err := zipBytes(archive, bundleSession, session); err != nil {
+			return nil, err
+		}
+	}
+	if err := zipBytes(archive, bundleConfig, config); err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := zipBytes(archive, bundleManifest, b); err != nil {
+		return nil, err
+	}
+	return manifest, archive.Close()
+}
+
+// bundledState returns the user's shared gamestate, or the state replayed from
+// the packet logs, nil if neither exists.
+func bundledState(options *Options, rUID string, logs []string) ([]byte, error) {
+	if options.ShareState {
+		store, err := OpenStore(options)
+		if err != nil {
+			return nil, err
+		}
+		state, err := store.Get(stateKey(rUID) + "state")
+		if err == nil {
+			return state, nil
+		} else if err != storage.ErrNotFound {
+			return nil, err
+		}
+	}
+	return replayState(rUID[:strings.Index(rUID, "_")], logs)
+}
+
+// replayState rebuilds the gamestate from the packets of the logs, nil if the
+// logs don't include the user's sync.
+func replayState(region string, logs []string) ([]byte, error) {
+	state, handle := gamestate.New(log.New(false, false, "/dev/null", 0), region, false)
+	for _, logPath := range logs {
+		f, err := packetlog.Open(logPath)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Reader().ForEach(func(p *packetlog.Packet) bool {
+			handle(p.Op, p.Data, nil)
+			return true
+		})
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !state.IsLoaded() {
+		return nil, nil
+	}
+	return state.Snapshot()
+}
+
+// redactOptions returns the options as JSON with the redactedKeys fields
+// replaced.
+func redactOptions(options *Options) ([]byte, error) {
+	b, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	var config interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	redact(config)
+	return json.MarshalIndent(config, "", "\t")
+}
+
+func redact(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if redactedKeys[k] && field != nil && field != "" {
+				v[k] = "<redacted>"
+				continue
+			}
+			redact(field)
+		}
+	case []interface{}:
+		for _, e := range v {
+			redact(e)
+		}
+	}
+}
+
+func zipBytes(archive *zip.Writer, name string, b []byte) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func zipFile(archive *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// maxBundleBytes limits the size of the files extracted from a session bundle,
+// which may be crafted to decompress to much more than its own size.
+const maxBundleBytes = 4 << 30
+
+// bundleEntryPath returns where the file of a session bundle named name is
+// extracted to in dir, failing if it would be outside of dir.
+func bundleEntryPath(dir, name string) (string, error) {
+	cleaned := path.Clean(name)
+	invalid := strings.Contains(name, "\\") || path.IsAbs(cleaned) || filepath.IsAbs(name) ||
+		filepath.VolumeName(name) != ""
+	for _, elem := range strings.Split(cleaned, "/") {
+		invalid = invalid || elem == ".."
+	}
+	if invalid {
+		return "", fmt.Errorf("invalid file %q in bundle", name)
+	}
+	dst := filepath.Join(dir, filepath.FromSlash(cleaned))
+	if rel, err := filepath.Rel(dir, dst); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file %q in bundle", name)
+	}
+	return dst, nil
+}
+
+// ImportBundle extracts the session bundle at bundlePath into dir, the packet
+// logs into its "logs" subdirectory, where they can be read with the packetlog
+// package, and the user's session into "session.json" if the bundle has one.
+func ImportBundle(bundlePath, dir string) (*BundleManifest, error) {
+	archive, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	var manifest *BundleManifest
+	var remaining int64 = maxBundleBytes
+	for _, f := range archive.File {
+		dst, err := bundleEntryPath(dir, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+		n, err := extractBundleFile(f, dst, remaining)
+		if err != nil {
+			return nil, err
+		}
+		remaining -= n
+		if path.Clean(f.Name) == bundleManifest {
+			b, err := ioutil.ReadFile(dst)
+			if err != nil {
+				return nil, err
+			}
+			manifest = &BundleManifest{}
+			if err := json.Unmarshal(b, manifest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("not a session bundle, manifest missing")
+	}
+	return manifest, nil
+}
+
+// extractBundleFile writes the file of a bundle to dst, failing if it's larger
+// than limit bytes. Returns the size of the file.
+func extractBundleFile(f *zip.File, dst string, limit int64) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, io.LimitReader(rc, limit+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("bundle is larger than %d bytes once extracted", int64(maxBundleBytes))
+	}
+	return n, err
+}
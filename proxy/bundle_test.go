@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+func TestBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := utils.BinDir
+	defer func() { utils.BinDir = binDir }()
+	utils.BinDir = dir
+
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	logDir := packetlog.UserDir("GL_1")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_ = packetlog.NewWriter(&buf).WritePacket(start, "S/account/syncData", []byte(`{"user":{"status":{"nickName":"Doctor"}}}`))
+	if err := ioutil.WriteFile(filepath.Join(logDir, packetlog.FileName(start)), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &Options{Admin: AdminOptions{Token: "secret"}}
+	var bundle bytes.Buffer
+	manifest, err := ExportBundle(&bundle, options, "GL_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Logs) != 1 || !manifest.Session {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+	bundlePath := filepath.Join(dir, "bundle.zip")
+	if err := ioutil.WriteFile(bundlePath, bundle.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "imported")
+	if _, err := ImportBundle(bundlePath, out); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ioutil.ReadFile(filepath.Join(out, bundleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(config), "secret") {
+		t.Fatal("Expected the admin token to be redacted")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(out, bundleSession))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &Session{}
+	if err := json.Unmarshal(b, session); err != nil {
+		t.Fatal(err)
+	}
+	if session.UID != "1" || session.Region != "GL" || !strings.Contains(string(session.State), "Doctor") {
+		t.Fatalf("Unexpected session %s", b)
+	}
+	f, err := packetlog.Open(filepath.Join(out, "logs", manifest.Logs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if p, err := f.Reader().Next(); err != nil || p.Op != "S/account/syncData" {
+		t.Fatalf("Unexpected packet %+v, %v", p, err)
+	}
+}
+
+func TestBundleEntryPath(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "bundle")
+	for _, name := range []string{"../evil", "logs/../../evil", `..\evil`, `logs\..\..\evil`, "/etc/passwd", "a/../.."} {
+		if _, err := bundleEntryPath(dir, name); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+	if dst, err := bundleEntryPath(dir, "logs/GL_1/2020-01-02.log"); err != nil || dst != filepath.Join(dir, "logs", "GL_1", "2020-01-02.log") {
+		t.Errorf("Unexpected path %q: %v", dst, err)
+	}
+}
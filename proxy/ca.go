@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/kyoukaya/rhine/utils"
+
+	"github.com/elazarl/goproxy"
+)
+
+// caContentTypes are the content types of the formats the CA is served in.
+var caContentTypes = map[string]string{
+	utils.FormatPEM:     "application/x-pem-file",
+	utils.FormatDER:     "application/x-x509-ca-cert",
+	utils.FormatAndroid: "application/x-pem-file",
+	utils.FormatPKCS12:  "application/x-pkcs12",
+}
+
+// ExportCA writes the CA, loaded as configured by ca, to dir in every format
+// of utils.ExportFormats, returning the paths written. The PKCS#12 archive
+// contains the CA's private key and is only written if password is set.
+// Relative paths are resolved against utils.BinDir.
+func ExportCA(dir, password string, ca *utils.CAOptions) ([]string, error) {
+	if err := loadCA(ca, nil); err != nil {
+		return nil, err
+	}
+	dir = configPath(dir)
+	var paths []string
+	for _, format := range utils.ExportFormats {
+		if format == utils.FormatPKCS12 && password == "" {
+			continue
+		}
+		name, data, err := utils.ExportCA(&goproxy.GoproxyCa, format, password)
+		if err != nil {
+			return paths, err
+		}
+		perm := os.FileMode(0644)
+		if format == utils.FormatPKCS12 {
+			perm = 0600
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, perm); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// handleCA serves the CA's certificate in the format of the "format" query
+// parameter, PEM by default. The PKCS#12 archive contains the CA's private key
+// and is only served on POST, to operators, encrypted with the "password" form
+// value. The CA is the one named by the "ca" query parameter, or else the
+// device CA of the requesting client if it has one, see Options.DeviceCAs.
+func (p *Proxy) handleCA(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = utils.FormatPEM
+	}
+	if _, ok := caContentTypes[format]; !ok {
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+		return
+	}
+	var password string
+	if format == utils.FormatPKCS12 {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if AdminRole(r) != RoleOperator {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if password = r.PostFormValue("password"); password == "" {
+			http.Error(w, "password required", http.StatusBadRequest)
+			return
+		}
+	}
+	ca, ok := p.caFor(r)
+	if !ok {
+		http.Error(w, "unknown CA", http.StatusNotFound)
+		return
+	}
+	name, data, err := utils.ExportCA(ca, format, password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", caContentTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	_, _ = w.Write(data)
+}
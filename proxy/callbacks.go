@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+)
+
+// LoginCompletedHandler is implemented by values passed to Bind which want to be
+// called back with semantic.LoginCompleted events.
+type LoginCompletedHandler interface {
+	OnLoginCompleted(*semantic.LoginCompleted)
+}
+
+// BattleFinishedHandler is implemented by values passed to Bind which want to be
+// called back with semantic.BattleFinished events.
+type BattleFinishedHandler interface {
+	OnBattleFinished(*semantic.BattleFinished)
+}
+
+// RecruitFinishedHandler is implemented by values passed to Bind which want to be
+// called back with semantic.RecruitFinished events.
+type RecruitFinishedHandler interface {
+	OnRecruitFinished(*semantic.RecruitFinished)
+}
+
+// GachaPullHandler is implemented by values passed to Bind which want to be
+// called back with semantic.GachaPulled events.
+type GachaPullHandler interface {
+	OnGachaPull(*semantic.GachaPulled)
+}
+
+// SanityChangedHandler is implemented by values passed to Bind which want to be
+// called back with semantic.SanityChanged events.
+type SanityChangedHandler interface {
+	OnSanityChanged(*semantic.SanityChanged)
+}
+
+// MissionDoneHandler is implemented by values passed to Bind which want to be
+// called back with semantic.MissionDone events.
+type MissionDoneHandler interface {
+	OnMissionDone(*semantic.MissionDone)
+}
+
+// SupportsSyncedHandler is implemented by values passed to Bind which want to
+// be called back with semantic.SupportsSynced events.
+type SupportsSyncedHandler interface {
+	OnSupportsSynced(*semantic.SupportsSynced)
+}
+
+// OperatorProgressedHandler is implemented by values passed to Bind which want
+// to be called back with semantic.OperatorProgressed events.
+type OperatorProgressedHandler interface {
+	OnOperatorProgressed(*semantic.OperatorProgressed)
+}
+
+// ContentEndingHandler is implemented by values passed to Bind which want to be
+// called back with semantic.ContentEnding events.
+type ContentEndingHandler interface {
+	OnContentEnding(*semantic.ContentEnding)
+}
+
+// DailyResetHandler is implemented by values passed to Bind which want to be
+// called back with semantic.DailyReset events.
+type DailyResetHandler interface {
+	OnDailyReset(*semantic.DailyReset)
+}
+
+// WeeklyResetHandler is implemented by values passed to Bind which want to be
+// called back with semantic.WeeklyReset events.
+type WeeklyResetHandler interface {
+	OnWeeklyReset(*semantic.WeeklyReset)
+}
+
+// ConnOpenedHandler is implemented by values passed to Bind which want to be
+// called back with ConnOpened events. Like the other connection handlers, it's
+// only called for connections from the device the module's user logged in
+// from, including connections tunneled to hosts which aren't intercepted.
+type ConnOpenedHandler interface {
+	OnConnOpened(*ConnOpened)
+}
+
+// TLSSessionHandler is implemented by values passed to Bind which want to be
+// called back with TLSSession events, i.e., when a client issues a CONNECT.
+type TLSSessionHandler interface {
+	OnTLSSession(*TLSSession)
+}
+
+// ConnClosedHandler is implemented by values passed to Bind which want to be
+// called back with ConnClosed events, with the bytes transferred over the
+// connection and its duration.
+type ConnClosedHandler interface {
+	OnConnClosed(*ConnClosed)
+}
+
+// WSMessageHandler is implemented by values passed to Bind which want to be
+// called back with the WSMessage events of the user's device, which are only
+// published if Options.EnableWebSocket is set.
+type WSMessageHandler interface {
+	OnWSMessage(*WSMessage)
+}
+
+// SessionConflictHandler is implemented by values passed to Bind which want to
+// be called back with SessionConflict events.
+type SessionConflictHandler interface {
+	OnSessionConflict(*SessionConflict)
+}
+
+// callbackQueueSize is the size of the chan buffering events for a bound value.
+const callbackQueueSize = 32
+
+// binding never closes its listener, which publishers may still hold after
+// the subscriptions are unhooked, done stops the callback goroutine instead.
+type binding struct {
+	subs     []Hooker
+	listener chan events.Event
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Bind inspects v for the *Handler interfaces in this package and subscribes
+// it to the corresponding events of the module's user, as a friendlier
+// alternative to registering hooks manually. Callbacks are called serially
+// from a separate goroutine in the order the events were published. The
+// returned Hooker unsubscribes v from all of the events, which is also done
+// automatically when the module is shut down.
+func (m *RhineModule) Bind(v interface{}) Hooker {
+	b := &binding{listener: make(chan events.Event, callbackQueueSize), done: make(chan struct{})}
+	if _, ok := v.(LoginCompletedHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicLoginCompleted, b.listener))
+	}
+	if _, ok := v.(BattleFinishedHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicBattleFinished, b.listener))
+	}
+	if _, ok := v.(RecruitFinishedHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicRecruitFinished, b.listener))
+	}
+	if _, ok := v.(GachaPullHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicGachaPulled, b.listener))
+	}
+	if _, ok := v.(SanityChangedHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicSanityChanged, b.listener))
+	}
+	if _, ok := v.(MissionDoneHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicMissionDone, b.listener))
+	}
+	if _, ok := v.(SupportsSyncedHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicSupportsSynced, b.listener))
+	}
+	if _, ok := v.(OperatorProgressedHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicOperatorProgressed, b.listener))
+	}
+	if _, ok := v.(ContentEndingHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicContentEnding, b.listener))
+	}
+	if _, ok := v.(DailyResetHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicDailyReset, b.listener))
+	}
+	if _, ok := v.(WeeklyResetHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(semantic.TopicWeeklyReset, b.listener))
+	}
+	if _, ok := v.(SessionConflictHandler); ok {
+		b.subs = append(b.subs, m.Subscribe(TopicSessionConflict, b.listener))
+	}
+	if _, ok := v.(ConnOpenedHandler); ok {
+		b.subs = append(b.subs, m.subscribeConn(TopicConnOpened, b.listener))
+	}
+	if _, ok := v.(TLSSessionHandler); ok {
+		b.subs = append(b.subs, m.subscribeConn(TopicTLSSession, b.listener))
+	}
+	if _, ok := v.(ConnClosedHandler); ok {
+		b.subs = append(b.subs, m.subscribeConn(TopicConnClosed, b.listener))
+	}
+	if _, ok := v.(WSMessageHandler); ok {
+		b.subs = append(b.subs, m.subscribeConn(TopicWSMessage, b.listener))
+	}
+	if len(b.subs) == 0 {
+		m.Warnf("%s: Bind called with %T which implements no handler interfaces", m.name, v)
+		return b
+	}
+	go m.runCallbacks(v, b)
+	m.hookers = append(m.hookers, b)
+	return b
+}
+
+func (m *RhineModule) runCallbacks(v interface{}, b *binding) {
+	for {
+		select {
+		case evt := <-b.listener:
+			m.callback(v, evt)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// callback calls the handler of v for the event, recovering from panics so the
+// other callbacks are unaffected.
+func (m *RhineModule) callback(v interface{}, evt events.Event) {
+	defer func() {
+		if err := recover(); err != nil {
+			m.Warnf("Recovered from panic while executing %s's %s callback:\n%+v", m.name, evt.Topic, err)
+		}
+	}()
+	switch payload := evt.Payload.(type) {
+	case *semantic.LoginCompleted:
+		v.(LoginCompletedHandler).OnLoginCompleted(payload)
+	case *semantic.BattleFinished:
+		v.(BattleFinishedHandler).OnBattleFinished(payload)
+	case *semantic.RecruitFinished:
+		v.(RecruitFinishedHandler).OnRecruitFinished(payload)
+	case *semantic.GachaPulled:
+		v.(GachaPullHandler).OnGachaPull(payload)
+	case *semantic.SanityChanged:
+		v.(SanityChangedHandler).OnSanityChanged(payload)
+	case *semantic.MissionDone:
+		v.(MissionDoneHandler).OnMissionDone(payload)
+	case *semantic.SupportsSynced:
+		v.(SupportsSyncedHandler).OnSupportsSynced(payload)
+	case *semantic.OperatorProgressed:
+		v.(OperatorProgressedHandler).OnOperatorProgressed(payload)
+	case *semantic.ContentEnding:
+		v.(ContentEndingHandler).OnContentEnding(payload)
+	case *semantic.DailyReset:
+		v.(DailyResetHandler).OnDailyReset(payload)
+	case *semantic.WeeklyReset:
+		v.(WeeklyResetHandler).OnWeeklyReset(payload)
+	case *SessionConflict:
+		v.(SessionConflictHandler).OnSessionConflict(payload)
+	case *ConnOpened:
+		v.(ConnOpenedHandler).OnConnOpened(payload)
+	case *TLSSession:
+		v.(TLSSessionHandler).OnTLSSession(payload)
+	case *ConnClosed:
+		v.(ConnClosedHandler).OnConnClosed(payload)
+	case *WSMessage:
+		v.(WSMessageHandler).OnWSMessage(payload)
+	}
+}
+
+// Unhook unsubscribes the bound value from all of its events.
+func (b *binding) Unhook() {
+	if b == nil || b.subs == nil {
+		return
+	}
+	b.once.Do(func() {
+		for _, sub := range b.subs {
+			sub.Unhook()
+		}
+		close(b.done)
+	})
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CaptureFilter scopes packet capture to some clients and users, e.g., to
+// debug a single device on a busy proxy. Every user is captured if both
+// fields are empty, otherwise users matching either are.
+type CaptureFilter struct {
+	// Clients are the IP addresses, MAC addresses or names in
+	// Options.Devices of the clients to capture.
+	Clients []string `json:"clients"`
+	// Users are the UIDs of the users to capture, optionally prefixed with the
+	// region, e.g., "GL_12345678".
+	Users []string `json:"users"`
+}
+
+// captureFilter is the CaptureFilter in effect, which may be changed through
+// the admin API.
+type captureFilter struct {
+	mutex   sync.RWMutex
+	filter  CaptureFilter
+	clients *clientTracker
+}
+
+func newCaptureFilter(filter CaptureFilter, clients *clientTracker) *captureFilter {
+	return &captureFilter{filter: filter, clients: clients}
+}
+
+func (f *captureFilter) get() CaptureFilter {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.filter
+}
+
+func (f *captureFilter) set(filter CaptureFilter) {
+	f.mutex.Lock()
+	f.filter = filter
+	f.mutex.Unlock()
+}
+
+// match reports whether the user logged in from the client should be
+// captured, client may be nil.
+func (f *captureFilter) match(uid int, region string, client *ClientInfo) bool {
+	if f == nil {
+		return true
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if len(f.filter.Clients) == 0 && len(f.filter.Users) == 0 {
+		return true
+	}
+	id := strconv.Itoa(uid)
+	for _, user := range f.filter.Users {
+		if user == id || strings.EqualFold(user, region+"_"+id) {
+			return true
+		}
+	}
+	if client == nil {
+		return false
+	}
+	names := f.clients.identities(client.IP)
+	for _, c := range f.filter.Clients {
+		if mac := normalizeMAC(c); mac != "" {
+			c = mac
+		}
+		for _, name := range names {
+			if c == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identities returns the IP, MAC address and name of the client at ip.
+func (t *clientTracker) identities(ip string) []string {
+	ret := []string{ip}
+	if t == nil {
+		return ret
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	client := t.clients[ip]
+	if client == nil {
+		client = &Client{IP: ip}
+	}
+	if client.MAC != "" {
+		ret = append(ret, client.MAC)
+	}
+	if name := t.name(client); name != ip {
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// Captured reports whether packets of the module's user should be captured
+// according to Options.Capture. Modules capturing packets, such as the packet
+// logger, should check it for every packet as it can be changed at runtime.
+func (m *RhineModule) Captured() bool {
+	return m.dispatch.capture.match(m.dispatch.uid, m.dispatch.region, m.dispatch.clientInfo())
+}
+
+// handleCapture returns the capture filter on GET and replaces it with the
+// one in the body on PUT.
+func (p *Proxy) handleCapture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.capture.get())
+	case "PUT":
+		filter := CaptureFilter{}
+		if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.capture.set(filter)
+		p.Printf("Capture filter set to clients %v and users %v", filter.Clients, filter.Users)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
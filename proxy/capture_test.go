@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaptureFilter(t *testing.T) {
+	clients := newClientTracker(map[string]string{"10.0.0.3": "Tablet"})
+	clients.lookupMAC = func(ip string) string { return "aa:bb:cc:dd:ee:ff" }
+	clients.seen("10.0.0.2:5000", "")
+	f := newCaptureFilter(CaptureFilter{}, clients)
+	phone := &ClientInfo{IP: "10.0.0.2"}
+	tablet := &ClientInfo{IP: "10.0.0.3"}
+	if !f.match(1, "GL", nil) {
+		t.Fatal("Expected every user to be captured without a filter")
+	}
+	for _, test := range []struct {
+		filter CaptureFilter
+		uid    int
+		client *ClientInfo
+		want   bool
+	}{
+		{CaptureFilter{Users: []string{"1"}}, 1, nil, true},
+		{CaptureFilter{Users: []string{"gl_1"}}, 1, nil, true},
+		{CaptureFilter{Users: []string{"JP_1"}}, 1, nil, false},
+		{CaptureFilter{Clients: []string{"10.0.0.2"}}, 1, phone, true},
+		{CaptureFilter{Clients: []string{"AA-BB-CC-DD-EE-FF"}}, 1, phone, true},
+		{CaptureFilter{Clients: []string{"Tablet"}}, 1, tablet, true},
+		{CaptureFilter{Clients: []string{"Tablet"}}, 1, phone, false},
+		{CaptureFilter{Clients: []string{"Tablet"}}, 1, nil, false},
+	} {
+		f.set(test.filter)
+		if got := f.match(test.uid, "GL", test.client); got != test.want {
+			t.Errorf("%+v, %+v: expected %t", test.filter, test.client, test.want)
+		}
+	}
+}
+
+func TestAdminCapture(t *testing.T) {
+	p := newTestProxy()
+	p.capture = newCaptureFilter(CaptureFilter{}, nil)
+	mux := p.newAdminMux()
+	req := httptest.NewRequest("PUT", "/capture", strings.NewReader(`{"users":["GL_1"]}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/capture", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != `{"clients":null,"users":["GL_1"]}` {
+		t.Fatalf("Unexpected filter %s", body)
+	}
+	if p.capture.match(2, "GL", nil) {
+		t.Fatal("Expected other users not to be captured")
+	}
+}
@@ -55,3 +55,10 @@ func (store *certStore) getCert(hostname string) *tls.Certificate {
 	}
 	return cert.(*tls.Certificate)
 }
+
+// purge drops every cached certificate.
+func (store *certStore) purge() {
+	store.mutex.Lock()
+	store.lru.Clear()
+	store.mutex.Unlock()
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// clientExpiry is how long a client is listed after it was last seen.
+	clientExpiry = 24 * time.Hour
+	// macRetryInterval is how often the MAC address of a client missing from
+	// the ARP cache is looked up again.
+	macRetryInterval = 5 * time.Minute
+)
+
+// Client is a device which sent traffic through the proxy, identified by its
+// IP address.
+type Client struct {
+	IP string `json:"ip"`
+	// Name is the client's name in Options.Devices, if any.
+	Name string `json:"name,omitempty"`
+	// MAC is the client's MAC address if it's on the local network.
+	MAC       string    `json:"mac,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// UserAgent is the last user agent the client sent.
+	UserAgent string `json:"userAgent,omitempty"`
+	// Users are the region_UID of the users seen playing from the client.
+	Users []string `json:"users,omitempty"`
+	// Requests counts the HTTP requests and CONNECTs made by the client.
+	Requests uint64 `json:"requests"`
+	// OpenConns is the number of connections the client has open.
+	OpenConns int `json:"openConns"`
+	// BytesIn is the number of bytes received from the client and BytesOut
+	// the number sent to it.
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+
+	macCheckedAt time.Time
+}
+
+// clientTracker records the clients of the proxy.
+type clientTracker struct {
+	mutex   sync.Mutex
+	clients map[string]*Client
+	// names maps IPs and normalized MAC addresses to device names.
+	names     map[string]string
+	lookupMAC func(ip string) string
+}
+
+func newClientTracker(devices map[string]string) *clientTracker {
+	t := &clientTracker{
+		clients:   make(map[string]*Client),
+		names:     make(map[string]string, len(devices)),
+		lookupMAC: lookupMAC,
+	}
+	for addr, name := range devices {
+		if mac := normalizeMAC(addr); mac != "" {
+			addr = mac
+		}
+		t.names[addr] = name
+	}
+	return t
+}
+
+// name returns the name of the client, its IP if it has none. Must be called
+// with the mutex held.
+func (t *clientTracker) name(client *Client) string {
+	if name, ok := t.names[client.IP]; ok {
+		return name
+	}
+	if name, ok := t.names[client.MAC]; ok && client.MAC != "" {
+		return name
+	}
+	return client.IP
+}
+
+// device returns the name of the client at remoteAddr, its IP if it has none.
+func (t *clientTracker) device(remoteAddr string) string {
+	ip := clientIP(remoteAddr)
+	if t == nil {
+		return ip
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if client := t.clients[ip]; client != nil {
+		return t.name(client)
+	}
+	return t.name(&Client{IP: ip})
+}
+
+// clientIP returns the IP of a remote address.
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// seen records a request from the client at remoteAddr.
+func (t *clientTracker) seen(remoteAddr, userAgent string) {
+	if t == nil || remoteAddr == "" {
+		return
+	}
+	ip := clientIP(remoteAddr)
+	now := time.Now()
+	t.mutex.Lock()
+	client := t.clients[ip]
+	if client == nil {
+		client = &Client{IP: ip, FirstSeen: now}
+		t.clients[ip] = client
+	}
+	client.LastSeen = now
+	client.Requests++
+	if userAgent != "" {
+		client.UserAgent = userAgent
+	}
+	checkMAC := client.MAC == "" && now.Sub(client.macCheckedAt) > macRetryInterval
+	if checkMAC {
+		client.macCheckedAt = now
+	}
+	t.mutex.Unlock()
+	if checkMAC {
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.IsLoopback() {
+			return
+		}
+		if mac := t.lookupMAC(ip); mac != "" {
+			t.mutex.Lock()
+			client.MAC = mac
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// transferred adds the bytes transferred over a closed connection to the
+// client's.
+func (t *clientTracker) transferred(remoteAddr string, bytesIn, bytesOut uint64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if client := t.clients[clientIP(remoteAddr)]; client != nil {
+		client.BytesIn += bytesIn
+		client.BytesOut += bytesOut
+	}
+}
+
+// user maps the user to the client at remoteAddr, returning true if the user
+// wasn't mapped to it yet.
+func (t *clientTracker) user(remoteAddr, rUID string) bool {
+	if t == nil || remoteAddr == "" {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	client := t.clients[clientIP(remoteAddr)]
+	if client == nil {
+		return false
+	}
+	for _, user := range client.Users {
+		if user == rUID {
+			return false
+		}
+	}
+	client.Users = append(client.Users, rUID)
+	sort.Strings(client.Users)
+	return true
+}
+
+// list returns copies of the clients seen within clientExpiry, the most
+// recently seen first, forgetting the others.
+func (t *clientTracker) list() []Client {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ret := make([]Client, 0, len(t.clients))
+	for ip, client := range t.clients {
+		if time.Since(client.LastSeen) > clientExpiry {
+			delete(t.clients, ip)
+			continue
+		}
+		c := *client
+		c.Users = append([]string(nil), client.Users...)
+		if name := t.name(client); name != client.IP {
+			c.Name = name
+		}
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].LastSeen.After(ret[j].LastSeen) })
+	return ret
+}
+
+// openConns sums the open connections of each client IP into a Client.
+func (l *connListener) openConns() map[string]*Client {
+	ret := make(map[string]*Client)
+	if l == nil {
+		return ret
+	}
+	l.mutex.Lock()
+	for addr, conn := range l.conns {
+		ip := clientIP(addr)
+		c := ret[ip]
+		if c == nil {
+			c = &Client{}
+			ret[ip] = c
+		}
+		c.OpenConns++
+		c.BytesIn += atomic.LoadUint64(&conn.bytesIn)
+		c.BytesOut += atomic.LoadUint64(&conn.bytesOut)
+	}
+	l.mutex.Unlock()
+	return ret
+}
+
+// Clients returns the devices which sent traffic through the proxy in the last
+// 24 hours, the most recently seen first. Byte counts include the open
+// connections of the clients.
+func (p *Proxy) Clients() []Client {
+	clients := p.clients.list()
+	open := p.listener.openConns()
+	for i := range clients {
+		if c := open[clients[i].IP]; c != nil {
+			clients[i].OpenConns = c.OpenConns
+			clients[i].BytesIn += c.BytesIn
+			clients[i].BytesOut += c.BytesOut
+		}
+	}
+	return clients
+}
+
+// mapClientUser maps the user to the client at remoteAddr, logging the first
+// time the user is seen playing from the client.
+func (p *Proxy) mapClientUser(remoteAddr, rUID string) {
+	if p.clients.user(remoteAddr, rUID) {
+		p.Printf("%s is playing from %s", rUID, p.clients.device(remoteAddr))
+	}
+}
+
+// DeviceName returns the name of the client at remoteAddr in Options.Devices,
+// or its IP if it has none.
+func (p *Proxy) DeviceName(remoteAddr string) string {
+	return p.clients.device(remoteAddr)
+}
+
+// handleClients lists the clients of the proxy.
+func (p *Proxy) handleClients(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.Clients())
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestClients(t *testing.T) {
+	p := newTestProxy()
+	p.clients = newClientTracker(map[string]string{"10.0.0.3": "Tablet", "AA-BB-CC-DD-EE-FF": "Phone"})
+	p.clients.lookupMAC = func(ip string) string {
+		if ip == "10.0.0.2" {
+			return "aa:bb:cc:dd:ee:ff"
+		}
+		return ""
+	}
+	send := func(remoteAddr, userAgent, path, uid, body string) {
+		req := httptest.NewRequest("POST", "https://gs.arknights.global:8443"+path, bytes.NewReader([]byte(body)))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", userAgent)
+		if uid != "" {
+			req.Header.Set("uid", uid)
+		}
+		p.HandleReq(req, &goproxy.ProxyCtx{Req: req})
+	}
+	send("10.0.0.2:5000", "Phone", "/account/login", "", `{"uid":"2"}`)
+	send("10.0.0.3:6000", "Tablet", "/account/syncData", "1", "{}")
+	send("10.0.0.2:5001", "", "/account/syncData", "2", "{}")
+
+	clients := p.Clients()
+	if len(clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %+v", clients)
+	}
+	if clients[0].IP != "10.0.0.2" || clients[1].IP != "10.0.0.3" {
+		t.Fatalf("Expected the most recently seen client first, got %+v", clients)
+	}
+	if c := clients[0]; c.UserAgent != "Phone" || c.Requests != 2 || !reflect.DeepEqual(c.Users, []string{"GL_2"}) ||
+		c.MAC != "aa:bb:cc:dd:ee:ff" || c.Name != "Phone" {
+		t.Fatalf("Unexpected client %+v", c)
+	}
+	if c := clients[1]; c.UserAgent != "Tablet" || !reflect.DeepEqual(c.Users, []string{"GL_1"}) || c.Name != "Tablet" {
+		t.Fatalf("Unexpected client %+v", c)
+	}
+	if name := p.DeviceName("10.0.0.4:7000"); name != "10.0.0.4" {
+		t.Fatalf("Expected unnamed devices to be named by IP, got %s", name)
+	}
+
+	p.clients.transferred("10.0.0.2:5000", 100, 200)
+	p.clients.transferred("10.0.0.2:5001", 1, 2)
+	if c := p.Clients()[0]; c.BytesIn != 101 || c.BytesOut != 202 {
+		t.Fatalf("Unexpected byte counts %+v", c)
+	}
+
+	p.clients.clients["10.0.0.3"].LastSeen = time.Now().Add(-clientExpiry - time.Minute)
+	if clients := p.Clients(); len(clients) != 1 || clients[0].IP != "10.0.0.2" {
+		t.Fatalf("Expected the stale client to expire, got %+v", clients)
+	}
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	for in, want := range map[string]string{
+		"AA-BB-CC-DD-EE-FF": "aa:bb:cc:dd:ee:ff",
+		"a:b:c:d:e:f":       "0a:0b:0c:0d:0e:0f",
+		"(incomplete)":      "",
+	} {
+		if got := normalizeMAC(in); got != want {
+			t.Errorf("normalizeMAC(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/tidwall/gjson"
+)
+
+// ClusterOptions configures routing users between instances sitting behind the
+// same load balancer. Every user is owned by one instance picked by consistent
+// hashing on the user's region and UID, the other instances forward the user's
+// game packets to the owner with the worker protocol, see WorkerOptions. An
+// unreachable owner is skipped for a while, its users moving to the next
+// instance on the ring, enable ShareState for them to be resumed there. Like
+// the worker protocol, peers authenticate each other with certificates signed
+// by Rhine's CA, which every instance must share.
+type ClusterOptions struct {
+	// Self is the address this instance serves its peers on, e.g.,
+	// "10.0.0.1:8082". Clustering is disabled if empty.
+	Self string `json:"self"`
+	// Peers are the addresses of every instance in the cluster, including Self.
+	Peers []string `json:"peers"`
+	// Timeout limits how long to wait for a peer to handle a packet, e.g.,
+	// "2s". Defaults to 5s.
+	Timeout string `json:"timeout"`
+}
+
+// ringReplicas is the number of points each instance has on the hash ring,
+// which evens out the share of users each instance owns.
+const ringReplicas = 64
+
+// hashRing maps keys to instances by consistent hashing, so that adding or
+// removing an instance only moves the keys it owns.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+	peers  int
+}
+
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newHashRing(peers []string) *hashRing {
+	r := &hashRing{owners: make(map[uint32]string)}
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		if seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		r.peers++
+		for i := 0; i < ringReplicas; i++ {
+			point := ringHash(peer + "#" + strconv.Itoa(i))
+			owner, taken := r.owners[point]
+			if !taken {
+				r.points = append(r.points, point)
+			}
+			// Collisions are resolved by address so that every instance builds
+			// the same ring.
+			if !taken || peer < owner {
+				r.owners[point] = peer
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// lookup returns the instances in the order they own the key, the first
+// being the owner and the others its fallbacks.
+func (r *hashRing) lookup(key string) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	ret := make([]string, 0, r.peers)
+	seen := make(map[string]bool, r.peers)
+	for i := 0; i < len(r.points) && len(ret) < r.peers; i++ {
+		owner := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[owner] {
+			seen[owner] = true
+			ret = append(ret, owner)
+		}
+	}
+	return ret
+}
+
+// cluster routes users to the instances owning them.
+type cluster struct {
+	self  string
+	ring  *hashRing
+	peers map[string]*workerClient
+}
+
+func newCluster(options *ClusterOptions, logger log.Logger) *cluster {
+	c := &cluster{
+		self:  options.Self,
+		ring:  newHashRing(append([]string{options.Self}, options.Peers...)),
+		peers: make(map[string]*workerClient),
+	}
+	for _, peer := range options.Peers {
+		if peer != options.Self {
+			c.peers[peer] = newWorkerClient(&WorkerOptions{Address: peer, Timeout: options.Timeout}, logger)
+		}
+	}
+	return c
+}
+
+// route returns the client of the instance owning the user, or nil if the user
+// is owned by this instance.
+func (c *cluster) route(rUID string) *workerClient {
+	for _, owner := range c.ring.lookup(rUID) {
+		if owner == c.self {
+			return nil
+		}
+		if client := c.peers[owner]; client.available() {
+			return client
+		}
+	}
+	return nil
+}
+
+// routeReq returns the client game packets of the request should be forwarded
+// to, nil if they are dispatched by this instance. Reading the body of a login
+// request to route it may fail.
+func (proxy *Proxy) routeReq(req *http.Request, op, uid, region string) (*workerClient, error) {
+	if proxy.worker != nil {
+		return proxy.worker, nil
+	}
+	if proxy.cluster == nil {
+		return nil, nil
+	}
+	if uid == "" {
+		if op != "C/account/login" {
+			return nil, nil
+		}
+		body, err := proxy.readReqBody(req)
+		if err != nil {
+			return nil, err
+		}
+		uid = gjson.GetBytes(body, "uid").String()
+	}
+	return proxy.cluster.route(region + "_" + uid), nil
+}
+
+// startCluster serves the cluster's peers, packets of users owned by this
+// instance are dispatched to its own dispatches.
+func (p *Proxy) startCluster() error {
+	p.cluster = newCluster(&p.options.Cluster, p.Logger)
+	l, err := net.Listen("tcp", p.options.Cluster.Self)
+	if err != nil {
+		return err
+	}
+	p.closeOnShutdown(l)
+	p.Printf("cluster peer listening on %s", l.Addr())
+	go func() {
+		if err := p.serveWorker(l, p.options.Cluster.Self); !p.stopping() {
+			p.Warnln(err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+func TestHashRing(t *testing.T) {
+	peers := []string{"a:1", "b:1", "c:1"}
+	ring := newHashRing(peers)
+	reordered := newHashRing([]string{"c:1", "a:1", "b:1", "a:1"})
+	shrunk := newHashRing([]string{"a:1", "b:1"})
+	owned := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := "GL_" + strconv.Itoa(i)
+		owners := ring.lookup(key)
+		if len(owners) != len(peers) {
+			t.Fatalf("Expected every peer as a fallback, got %v", owners)
+		}
+		if !reflect.DeepEqual(owners, reordered.lookup(key)) {
+			t.Fatal("The ring should not depend on the order of the peers")
+		}
+		if owners[0] != "c:1" && shrunk.lookup(key)[0] != owners[0] {
+			t.Fatal("Removing a peer should only move the keys it owned")
+		}
+		owned[owners[0]]++
+	}
+	for _, peer := range peers {
+		if owned[peer] < 150 {
+			t.Fatalf("Keys are unevenly distributed: %v", owned)
+		}
+	}
+}
+
+func TestClusterRoute(t *testing.T) {
+	c := newCluster(&ClusterOptions{Self: "a:1", Peers: []string{"a:1", "b:1"}}, log.New(false, false, "/dev/null", 0))
+	var key string
+	for i := 0; ; i++ {
+		key = "GL_" + strconv.Itoa(i)
+		if c.ring.lookup(key)[0] == "b:1" {
+			break
+		}
+	}
+	if c.route(key) != c.peers["b:1"] {
+		t.Fatal("Expected the user to be routed to its owner")
+	}
+	c.peers["b:1"].failedAt = time.Now()
+	if c.route(key) != nil {
+		t.Fatal("Expected the user to fall back to this instance while its owner is down")
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import stdLog "log"
+
+// APIVersion is the major version of the module API. Adapters for the previous
+// major version are kept around for modules which have not migrated yet, and
+// modules registered through them are warned about once when registered.
+const APIVersion = 1
+
+// Dispatch is the v0 name of RhineModule.
+//
+// Deprecated: Use RhineModule instead.
+type Dispatch = RhineModule
+
+// LegacyInitFunc is the v0 module initialization function which returned its
+// hooks instead of registering them.
+//
+// Deprecated: Use ModuleInitFunc instead.
+type LegacyInitFunc func(*Dispatch) ([]*PacketHook, ShutdownCb)
+
+// NewPacketHook creates a PacketHook to be returned from the LegacyInitFunc of
+// the module modName.
+//
+// Deprecated: Use RhineModule.Hook instead.
+func NewPacketHook(modName, target string, priority int, handler PacketHandler) *PacketHook {
+	return &PacketHook{target: target, priority: priority, handler: handler, mod: &RhineModule{name: modName}}
+}
+
+// RegisterMod registers a v0 module by adapting its LegacyInitFunc into a
+// ModuleInitFunc. A deprecation warning is logged to the standard logger, as
+// modules are registered before any proxy, and its logger, is created.
+//
+// Deprecated: Use RegisterInitFunc instead.
+func RegisterMod(name string, fun LegacyInitFunc) {
+	modules = append(modules, initFunc{
+		name:       name,
+		fun:        adaptLegacyInitFunc(fun),
+		apiVersion: 0,
+	})
+	stdLog.Printf("%s uses the deprecated module API v0, support will be removed in v%d, migrate to RegisterInitFunc",
+		name, APIVersion+1)
+}
+
+func adaptLegacyInitFunc(fun LegacyInitFunc) ModuleInitFunc {
+	return func(mod *RhineModule) {
+		hooks, shutdownCb := fun(mod)
+		for _, hook := range hooks {
+			if hook == nil {
+				continue
+			}
+			if hook.mod != nil && hook.mod.name != mod.name {
+				mod.Warnf("%s returned a hook on %s created for %s", mod.name, hook.target, hook.mod.name)
+			}
+			hook.mod = mod
+			mod.hooks = append(mod.hooks, hook)
+			mod.dispatch.insertHook(hook)
+		}
+		if shutdownCb != nil {
+			mod.OnShutdown(shutdownCb)
+		}
+	}
+}
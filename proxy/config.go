@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/kyoukaya/rhine/utils"
+)
+
+// LoadOptions reads Options from a JSON config file. Relative paths are resolved
+// against utils.BinDir. Fields which cannot be represented in JSON, such as
+// Logger and HostFilter, are left as their zero values.
+func LoadOptions(path string) (*Options, error) {
+	b, err := ioutil.ReadFile(configPath(path))
+	if err != nil {
+		return nil, err
+	}
+	options := &Options{}
+	if err := json.Unmarshal(b, options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// SaveOptions writes the options to a JSON config file which can be loaded with
+// LoadOptions. Relative paths are resolved against utils.BinDir.
+func SaveOptions(path string, options *Options) error {
+	b, err := json.MarshalIndent(options, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath(path), b, 0644)
+}
+
+func configPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return utils.BinDir + "/" + path
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kyoukaya/rhine/notify"
+)
+
+// TopicSessionConflict is the topic of the SessionConflict events published
+// for a user whose session was taken over.
+const TopicSessionConflict = "proxy/sessionConflict"
+
+// ConflictReason is how a SessionConflict was detected.
+type ConflictReason string
+
+// Reasons of a SessionConflict.
+const (
+	// ConflictSecondDevice is set when the user logged in through the proxy
+	// from another device than the one they were logged in from.
+	ConflictSecondDevice ConflictReason = "secondDevice"
+	// ConflictKicked is set when the game server rejected a request of the
+	// user as unauthorized, which it does once the account logged in
+	// elsewhere, including from devices not using the proxy.
+	ConflictKicked ConflictReason = "kicked"
+)
+
+// SessionConflict is published when a user's session is taken over by another
+// login.
+type SessionConflict struct {
+	Reason ConflictReason
+	// Previous is the client the user was logged in from and Current the
+	// client which logged in or whose request was rejected, nil if unknown.
+	Previous *ClientInfo
+	Current  *ClientInfo
+	// Op is the rejected request if the user was kicked.
+	Op string `json:",omitempty"`
+}
+
+// describe returns a sentence describing the conflict for logs and
+// notifications.
+func (c *SessionConflict) describe(rUID string) string {
+	device := func(client *ClientInfo) string {
+		if client == nil {
+			return "an unknown device"
+		}
+		return client.Device
+	}
+	if c.Reason == ConflictKicked {
+		return fmt.Sprintf("%s was logged out by the game server on %s, the account may have logged in elsewhere.",
+			rUID, device(c.Current))
+	}
+	return fmt.Sprintf("%s logged in from %s while logged in from %s.", rUID, device(c.Current), device(c.Previous))
+}
+
+// sessionConflict warns of the conflict and publishes it for the user.
+func (d *dispatch) sessionConflict(conflict *SessionConflict) {
+	msg := conflict.describe(fmt.Sprintf("%s_%d", d.region, d.uid))
+	d.Warnln(msg)
+	d.publish(TopicSessionConflict, conflict)
+	d.notifier.Send(&notify.Notification{
+		Title:  "Session conflict",
+		Body:   msg,
+		UID:    d.uid,
+		Region: d.region,
+	})
+}
+
+// checkLoginConflict reports a conflict if a user who was logged in from a
+// client logs in again from a client with another IP.
+func (d *dispatch) checkLoginConflict(previous *ClientInfo) {
+	current := d.clientInfo()
+	if previous == nil || current == nil || previous.IP == current.IP {
+		return
+	}
+	d.sessionConflict(&SessionConflict{Reason: ConflictSecondDevice, Previous: previous, Current: current})
+}
+
+// checkKicked reports a conflict the first time a game request of the user is
+// rejected as unauthorized, the client returning to the title screen after it.
+func (d *dispatch) checkKicked(resp *http.Response, op string, current *ClientInfo) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	d.mutex.Lock()
+	kicked := d.kicked
+	d.kicked = true
+	d.mutex.Unlock()
+	if !kicked {
+		d.sessionConflict(&SessionConflict{Reason: ConflictKicked, Previous: d.clientInfo(), Current: current, Op: op})
+	}
+}
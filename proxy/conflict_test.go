@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/notify"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestSessionConflict(t *testing.T) {
+	p := newTestProxy()
+	p.notifier = notify.New(p.Logger)
+	listener := make(chan events.Event, 4)
+	p.events.Subscribe(TopicSessionConflict, listener)
+
+	phone, tablet := &ClientInfo{IP: "10.0.0.2", Device: "Phone"}, &ClientInfo{IP: "10.0.0.3", Device: "Tablet"}
+	for _, client := range []*ClientInfo{phone, phone, tablet} {
+		if _, err := p.addUser("2", "GL", client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(listener) != 1 {
+		t.Fatalf("Expected a single conflict, got %d", len(listener))
+	}
+	conflict := (<-listener).Payload.(*SessionConflict)
+	if conflict.Reason != ConflictSecondDevice || conflict.Previous != phone || conflict.Current != tablet {
+		t.Fatalf("Unexpected conflict %+v", conflict)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := benchRequest("gs.arknights.global:8443", "/quest/battleStart")
+		req.Header.Set("uid", "2")
+		ctx := &goproxy.ProxyCtx{Req: req}
+		p.HandleReq(req, ctx)
+		resp := &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"statusCode":401}`))),
+		}
+		ctx.Resp = resp
+		p.HandleResp(resp, ctx)
+	}
+	if len(listener) != 1 {
+		t.Fatalf("Expected a single kick, got %d", len(listener))
+	}
+	evt := <-listener
+	conflict = evt.Payload.(*SessionConflict)
+	if evt.UID != 2 || conflict.Reason != ConflictKicked || conflict.Op != "C/quest/battleStart" || conflict.Previous != tablet {
+		t.Fatalf("Unexpected conflict %+v", conflict)
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+// Topics of the connection lifecycle events published on the proxy's bus, the
+// events aren't associated with a user.
+const (
+	TopicConnOpened = "conn/opened"
+	TopicTLSSession = "conn/tlsSession"
+	TopicConnClosed = "conn/closed"
+)
+
+// ConnOpened is published when a client connects to the proxy.
+type ConnOpened struct {
+	ID         uint64
+	RemoteAddr string
+	// Device is the client's name in Options.Devices, or its IP.
+	Device string
+}
+
+// TLSSession is published when a client issues a CONNECT for a host, MITM is
+// false if the connection was rejected by the host filter and is tunneled.
+type TLSSession struct {
+	ID         uint64
+	RemoteAddr string
+	Host       string
+	MITM       bool
+}
+
+// ConnClosed is published when a client connection is closed. BytesIn is the
+// number of bytes received from the client and BytesOut the number sent to it.
+// Host is empty and MITM false if the client never issued a CONNECT.
+type ConnClosed struct {
+	ID         uint64
+	RemoteAddr string
+	Device     string
+	Host       string
+	MITM       bool
+	BytesIn    uint64
+	BytesOut   uint64
+	Duration   time.Duration
+	Reason     string
+}
+
+var (
+	connsOpen      = metrics.NewGauge("rhine_connections_open", "Number of open client connections.")
+	connsTotal     = metrics.NewCounter("rhine_connections_total", "Number of client connections accepted.")
+	mitmSessions   = metrics.NewCounter("rhine_mitm_sessions_total", "Number of CONNECT requests intercepted.")
+	bytesReceived  = metrics.NewCounter("rhine_bytes_received_total", "Bytes received from clients.")
+	bytesSent      = metrics.NewCounter("rhine_bytes_sent_total", "Bytes sent to clients.")
+	connIDSequence uint64
+)
+
+// connListener wraps the listener of the proxy to track the lifecycle of each
+// client connection. Connections hijacked by goproxy for MITM remain tracked
+// as the hijacked conn is the one returned by Accept.
+type connListener struct {
+	net.Listener
+	bus     *events.Bus
+	clients *clientTracker
+	tunnels *tunnelTracker
+	mutex   sync.Mutex
+	// conns maps the remote address of open connections to the connection.
+	conns map[string]*trackedConn
+}
+
+func newConnListener(l net.Listener, bus *events.Bus) *connListener {
+	return &connListener{Listener: l, bus: bus, conns: make(map[string]*trackedConn)}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn := &trackedConn{
+		Conn:     c,
+		id:       atomic.AddUint64(&connIDSequence, 1),
+		listener: l,
+		opened:   time.Now(),
+	}
+	addr := c.RemoteAddr().String()
+	l.mutex.Lock()
+	l.conns[addr] = conn
+	l.mutex.Unlock()
+	connsOpen.Add(1)
+	connsTotal.Inc()
+	l.publish(TopicConnOpened, &ConnOpened{ID: conn.id, RemoteAddr: addr, Device: l.clients.device(addr)})
+	return conn, nil
+}
+
+// connect records the host a client connection issued a CONNECT for.
+func (l *connListener) connect(remoteAddr, host string, mitm bool) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	conn := l.conns[remoteAddr]
+	l.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+	conn.mutex.Lock()
+	conn.host = host
+	conn.mitm = mitm
+	conn.mutex.Unlock()
+	if mitm {
+		mitmSessions.Inc()
+	}
+	l.publish(TopicTLSSession, &TLSSession{ID: conn.id, RemoteAddr: remoteAddr, Host: host, MITM: mitm})
+}
+
+func (l *connListener) publish(topic string, payload interface{}) {
+	l.bus.Publish(events.Event{Topic: topic, Payload: payload})
+}
+
+// trackedConn counts the bytes transferred over a client connection and
+// records why it was closed.
+type trackedConn struct {
+	net.Conn
+	id       uint64
+	listener *connListener
+	opened   time.Time
+	bytesIn  uint64
+	bytesOut uint64
+
+	mutex       sync.Mutex
+	host        string
+	mitm        bool
+	fingerprint string
+	err         error
+	closed      bool
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	bytesReceived.Add(uint64(n))
+	c.recordErr(err)
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	bytesSent.Add(uint64(n))
+	c.recordErr(err)
+	return n, err
+}
+
+func (c *trackedConn) recordErr(err error) {
+	if err == nil {
+		return
+	}
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mutex.Unlock()
+}
+
+// reason describes why the connection was closed from the first error seen on
+// it, if any.
+func (c *trackedConn) reason() string {
+	switch err := c.err.(type) {
+	case nil:
+		return "closed by proxy"
+	case net.Error:
+		if err.Timeout() {
+			return "timeout"
+		}
+	}
+	if c.err == io.EOF {
+		return "closed by client"
+	}
+	return c.err.Error()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return err
+	}
+	c.closed = true
+	closed := &ConnClosed{
+		ID:         c.id,
+		RemoteAddr: c.RemoteAddr().String(),
+		Device:     c.listener.clients.device(c.RemoteAddr().String()),
+		Host:       c.host,
+		MITM:       c.mitm,
+		BytesIn:    atomic.LoadUint64(&c.bytesIn),
+		BytesOut:   atomic.LoadUint64(&c.bytesOut),
+		Duration:   time.Since(c.opened),
+		Reason:     c.reason(),
+	}
+	c.mutex.Unlock()
+	l := c.listener
+	l.mutex.Lock()
+	if l.conns[closed.RemoteAddr] == c {
+		delete(l.conns, closed.RemoteAddr)
+	}
+	l.mutex.Unlock()
+	l.clients.transferred(closed.RemoteAddr, closed.BytesIn, closed.BytesOut)
+	l.tunnels.closed(closed)
+	connsOpen.Add(-1)
+	l.publish(TopicConnClosed, closed)
+	return err
+}
+
+// connRemoteAddr returns the remote address of the client connection of a
+// connection lifecycle event.
+func connRemoteAddr(payload interface{}) string {
+	switch evt := payload.(type) {
+	case *ConnOpened:
+		return evt.RemoteAddr
+	case *TLSSession:
+		return evt.RemoteAddr
+	case *ConnClosed:
+		return evt.RemoteAddr
+	case *WSMessage:
+		return evt.RemoteAddr
+	}
+	return ""
+}
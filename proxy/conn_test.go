@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+)
+
+func TestConnListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := events.NewBus(nil)
+	listener := make(chan events.Event, 4)
+	bus.Subscribe(events.Wildcard, listener)
+	cl := newConnListener(l, bus)
+	defer cl.Close()
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+	c, err := cl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.connect(c.RemoteAddr().String(), "gs.arknights.global:8443", true)
+	buf := make([]byte, 16)
+	for {
+		if _, err := c.Read(buf); err != nil {
+			break
+		}
+	}
+	c.Close()
+	var closed *ConnClosed
+	timeout := time.After(time.Second)
+	for closed == nil {
+		select {
+		case evt := <-listener:
+			closed, _ = evt.Payload.(*ConnClosed)
+		case <-timeout:
+			t.Fatal("Timed out waiting for the connection to close")
+		}
+	}
+	if closed.BytesIn != 5 || closed.Host != "gs.arknights.global:8443" || closed.Reason != "closed by client" || !closed.MITM {
+		t.Fatalf("Unexpected close event %+v", closed)
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 8080}, "192.168.1.2:8080"},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 8080}, "[fe80::1]:8080"},
+	} {
+		if got := listenAddrs("", tc.addr); len(got) != 1 || got[0] != tc.want {
+			t.Errorf("listenAddrs(%s) = %v, want %s", tc.addr, got, tc.want)
+		}
+	}
+}
+
+type connRecorder chan *ConnClosed
+
+func (c connRecorder) OnConnClosed(closed *ConnClosed) { c <- closed }
+
+func TestBindConnHandlers(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	d.client = &ClientInfo{IP: "10.0.0.2"}
+	m := &RhineModule{name: "test", Region: "GL", UID: 1, dispatch: d}
+	closed := make(connRecorder, 2)
+	defer m.Bind(closed).Unhook()
+
+	for _, addr := range []string{"10.0.0.3:5000", "10.0.0.2:5001"} {
+		p.events.Publish(events.Event{Topic: TopicConnClosed, Payload: &ConnClosed{
+			RemoteAddr: addr, Host: "play.googleapis.com:443", BytesIn: 10, BytesOut: 20}})
+	}
+	select {
+	case c := <-closed:
+		if c.RemoteAddr != "10.0.0.2:5001" || c.MITM {
+			t.Fatalf("Unexpected close event %+v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the close event")
+	}
+	select {
+	case c := <-closed:
+		t.Fatalf("Unexpected close event from another device %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type connCounter struct{ n int }
+
+func (c *connCounter) OnConnClosed(*ConnClosed) { c.n++ }
+
+func TestBindUnhookWhilePublishing(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	d.client = &ClientInfo{IP: "10.0.0.2"}
+	m := &RhineModule{name: "test", Region: "GL", UID: 1, dispatch: d}
+	for i := 0; i < 50; i++ {
+		b := m.Bind(&connCounter{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 100; j++ {
+				p.events.Publish(events.Event{Topic: TopicConnClosed, Payload: &ConnClosed{RemoteAddr: "10.0.0.2:5000"}})
+			}
+		}()
+		b.Unhook()
+		<-done
+	}
+}
+
+func TestConnEventsWhileSettingClient(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	m := &RhineModule{name: "test", Region: "GL", UID: 1, dispatch: d}
+	counter := &connCounter{}
+	defer m.Bind(counter).Unhook()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.events.Publish(events.Event{Topic: TopicConnClosed, Payload: &ConnClosed{RemoteAddr: "10.0.0.2:5000"}})
+		}
+	}()
+	d.setClient(&ClientInfo{IP: "10.0.0.2"})
+	<-done
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+	"github.com/kyoukaya/rhine/utils/servertime"
+)
+
+// countdownLeads are the times before the end of an event or banner at which
+// a semantic.ContentEnding is published.
+var countdownLeads = []time.Duration{24 * time.Hour, time.Hour}
+
+// contentFunc returns the events and banners of a region which haven't ended,
+// leaving Remaining unset.
+type contentFunc func(region string) ([]semantic.ContentEnding, error)
+
+// gamedataContent returns a contentFunc looking up the events and banners in
+// the game data, whose updates are logged to logger.
+func gamedataContent(logger log.Logger) contentFunc {
+	return func(region string) ([]semantic.ContentEnding, error) {
+		gd, err := gamedata.New(region, logger)
+		if err != nil {
+			return nil, err
+		}
+		defer gd.Close()
+		activities, err := gd.GetActivityInfo()
+		if err != nil {
+			return nil, err
+		}
+		gachas, err := gd.GetGachaInfo()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().Unix()
+		var ret []semantic.ContentEnding
+		for _, act := range activities.BasicInfo {
+			if act.EndTime > now {
+				ret = append(ret, semantic.ContentEnding{Kind: semantic.ContentEvent, ID: act.ID, Name: act.Name,
+					StartTime: time.Unix(act.StartTime, 0), EndTime: time.Unix(act.EndTime, 0)})
+			}
+		}
+		for _, pool := range gachas.GachaPoolClient {
+			if pool.EndTime > now {
+				ret = append(ret, semantic.ContentEnding{Kind: semantic.ContentBanner, ID: pool.GachaPoolID,
+					Name: pool.GachaPoolName, StartTime: time.Unix(pool.OpenTime, 0), EndTime: time.Unix(pool.EndTime, 0)})
+			}
+		}
+		return ret, nil
+	}
+}
+
+// countdown is a semantic.ContentEnding due to be published at a time.
+type countdown struct {
+	at     time.Time
+	ending semantic.ContentEnding
+}
+
+// countdowns returns the countdowns of the content due in (since, until], in
+// chronological order. Content is only counted down once it has started.
+func countdowns(content []semantic.ContentEnding, since, until time.Time) []countdown {
+	var ret []countdown
+	for _, c := range content {
+		for _, lead := range countdownLeads {
+			at := c.EndTime.Add(-lead)
+			if at.After(since) && !at.After(until) && !at.Before(c.StartTime) {
+				ending := c
+				ending.Remaining = lead
+				ret = append(ret, countdown{at, ending})
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].at.Before(ret[j].at) })
+	return ret
+}
+
+// runCountdowns publishes the countdowns of the user's region until the
+// dispatch is stopped. The content is looked up again after every daily reset
+// to pick up new events and banners.
+func (d *dispatch) runCountdowns(content contentFunc) {
+	since := time.Now()
+	for {
+		until, err := servertime.NextDailyReset(d.region, since)
+		if err != nil {
+			d.Warnf("Not publishing countdowns for %s: %s", d.region, err)
+			return
+		}
+		current, err := content(d.region)
+		if err != nil {
+			d.Warnf("Failed to look up the events and banners of %s: %s", d.region, err)
+		}
+		for _, c := range countdowns(current, since, until) {
+			if !d.sleepUntil(c.at) {
+				return
+			}
+			ending := c.ending
+			d.publish(semantic.TopicContentEnding, &ending)
+		}
+		if !d.sleepUntil(until) {
+			return
+		}
+		since = until
+	}
+}
+
+// sleepUntil waits until t, returning false if the dispatch was stopped first.
+func (d *dispatch) sleepUntil(t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-d.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+)
+
+func TestCountdowns(t *testing.T) {
+	now := time.Now()
+	content := []semantic.ContentEnding{
+		{Kind: semantic.ContentEvent, ID: "act_1", StartTime: now.Add(-time.Hour), EndTime: now.Add(30 * time.Hour)},
+		{Kind: semantic.ContentBanner, ID: "NORM_1", StartTime: now.Add(-time.Hour), EndTime: now.Add(2 * time.Hour)},
+		// Starts after its 24 hour countdown would be due.
+		{Kind: semantic.ContentBanner, ID: "LIMITED_1", StartTime: now.Add(time.Hour), EndTime: now.Add(20 * time.Hour)},
+	}
+	due := countdowns(content, now, now.Add(48*time.Hour))
+	var got []string
+	for _, c := range due {
+		got = append(got, c.ending.ID+" "+c.ending.Remaining.String())
+	}
+	expected := []string{"NORM_1 1h0m0s", "act_1 24h0m0s", "LIMITED_1 1h0m0s", "act_1 1h0m0s"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+	if due := countdowns(content, now, now.Add(30*time.Minute)); len(due) != 0 {
+		t.Fatalf("Expected no countdowns before %s, got %+v", now.Add(30*time.Minute), due)
+	}
+
+	p := newTestProxy()
+	p.content = func(region string) ([]semantic.ContentEnding, error) {
+		return []semantic.ContentEnding{{Kind: semantic.ContentBanner, ID: "NORM_2", StartTime: now,
+			EndTime: time.Now().Add(time.Hour + 100*time.Millisecond)}}, nil
+	}
+	listener := make(chan events.Event, 1)
+	p.events.Subscribe(semantic.TopicContentEnding, listener)
+	if _, err := p.addUser("2", "GL", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evt := <-listener:
+		ending := evt.Payload.(*semantic.ContentEnding)
+		if evt.UID != 2 || ending.ID != "NORM_2" || ending.Remaining != time.Hour {
+			t.Fatalf("Unexpected event %+v %+v", evt, ending)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a countdown")
+	}
+	p.getUser("2", "GL").shutdown(true)
+}
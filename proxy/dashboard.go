@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+var dispatchedPackets = metrics.NewCounter("rhine_dispatched_packets_total", "Number of game packets dispatched.")
+
+// PacketSummary describes a dispatched packet without its body.
+type PacketSummary struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Direction string    `json:"direction"`
+	Bytes     int       `json:"bytes"`
+}
+
+// HookInfo describes a packet hook registered by a module.
+type HookInfo struct {
+	Module   string `json:"module"`
+	Target   string `json:"target"`
+	Priority int    `json:"priority"`
+	// Kind is "handler", "modifier" for the hooks which may drop packets, or
+	// "spilled" for the hooks on spilled responses.
+	Kind string `json:"kind"`
+}
+
+// UserOverview describes a connected user, whether their session is tracked
+// and what runs for them.
+type UserOverview struct {
+	UID    string      `json:"uid"`
+	Region string      `json:"region"`
+	Key    string      `json:"key"`
+	Client *ClientInfo `json:"client,omitempty"`
+	// Since is when the user logged in or their session was imported.
+	Since time.Time `json:"since"`
+	// Loaded is set once the user's gamestate was loaded from the account sync.
+	Loaded  bool       `json:"loaded"`
+	Modules []string   `json:"modules"`
+	Hooks   []HookInfo `json:"hooks"`
+	// Recent are the user's last dispatched packets, most recent first, see
+	// Options.RecentPackets.
+	Recent []PacketSummary `json:"recent"`
+}
+
+// ProxyStats are the proxy's counters, see /metrics for the complete set.
+// Packet counts include those of the tenants of the process.
+type ProxyStats struct {
+	Started          time.Time `json:"started"`
+	Users            int       `json:"users"`
+	Packets          uint64    `json:"packets"`
+	DispatchFailures uint64    `json:"dispatchFailures"`
+	DroppedPackets   uint64    `json:"droppedPackets"`
+	MalformedPackets uint64    `json:"malformedPackets"`
+	OpenConns        int64     `json:"openConns"`
+	Conns            uint64    `json:"conns"`
+	TrippedHooks     int       `json:"trippedHooks"`
+	Goroutines       int       `json:"goroutines"`
+	HeapBytes        uint64    `json:"heapBytes"`
+}
+
+// overview returns the overview of the user.
+func (d *dispatch) overview() UserOverview {
+	ret := UserOverview{
+		UID:    strconv.Itoa(d.uid),
+		Region: d.region,
+		Key:    d.key,
+		Client: d.clientInfo(),
+		Since:  d.since,
+		Loaded: d.state != nil && d.state.IsLoaded(),
+		Hooks:  []HookInfo{},
+		Recent: []PacketSummary{},
+	}
+	for _, packet := range d.recent.list() {
+		ret.Recent = append(ret.Recent, PacketSummary{packet.Time, packet.Op, packet.Direction, len(packet.Data())})
+	}
+	d.mutex.Lock()
+	ret.Modules = make([]string, 0, len(d.modules))
+	for _, mod := range d.modules {
+		ret.Modules = append(ret.Modules, mod.name)
+	}
+	d.mutex.Unlock()
+	d.hookMutex.RLock()
+	for _, hooks := range []map[string][]*PacketHook{d.hooks, d.spilledHooks} {
+		for _, list := range hooks {
+			for _, hook := range list {
+				info := HookInfo{Module: hook.mod.name, Target: hook.target, Priority: hook.priority, Kind: "handler"}
+				if hook.modifier != nil {
+					info.Kind = "modifier"
+				} else if hook.spilled != nil {
+					info.Kind = "spilled"
+				}
+				ret.Hooks = append(ret.Hooks, info)
+			}
+		}
+	}
+	d.hookMutex.RUnlock()
+	sort.Slice(ret.Hooks, func(i, j int) bool {
+		a, b := ret.Hooks[i], ret.Hooks[j]
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		return a.Target < b.Target
+	})
+	return ret
+}
+
+// Overview returns the overview of each connected user, ordered by region
+// and UID.
+func (p *Proxy) Overview() []UserOverview {
+	p.mutex.Lock()
+	dispatches := make([]*dispatch, 0, len(p.dispatches))
+	for _, d := range p.dispatches {
+		dispatches = append(dispatches, d)
+	}
+	p.mutex.Unlock()
+	ret := make([]UserOverview, 0, len(dispatches))
+	for _, d := range dispatches {
+		ret = append(ret, d.overview())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Region != ret[j].Region {
+			return ret[i].Region < ret[j].Region
+		}
+		return ret[i].UID < ret[j].UID
+	})
+	return ret
+}
+
+// Stats returns the proxy's counters.
+func (p *Proxy) Stats() ProxyStats {
+	p.mutex.Lock()
+	users := len(p.dispatches)
+	p.mutex.Unlock()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return ProxyStats{
+		Started:          p.started,
+		Users:            users,
+		Packets:          dispatchedPackets.Value(),
+		DispatchFailures: dispatchFailures.Value(),
+		DroppedPackets:   droppedPackets.Value(),
+		MalformedPackets: malformedPackets.Value(),
+		OpenConns:        connsOpen.Value(),
+		Conns:            connsTotal.Value(),
+		TrippedHooks:     len(p.TrippedHooks()),
+		Goroutines:       runtime.NumGoroutine(),
+		HeapBytes:        mem.HeapAlloc,
+	}
+}
+
+// handleOverview serves the overview of each connected user.
+func (p *Proxy) handleOverview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.Overview())
+}
+
+// handleStats serves the proxy's counters.
+func (p *Proxy) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.Stats())
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width"><title>Rhine</title>
+<style>body{font-family:sans-serif;margin:1em}table{border-collapse:collapse;margin-bottom:1em}td,th{border:1px solid #ccc;padding:2px 6px;text-align:left;vertical-align:top}details{margin-bottom:1em}</style>
+</head>
+<body>
+<h1>Rhine</h1>
+<table id="stats"></table>
+<h2>Users</h2>
+<div id="users">No user connected.</div>
+<script>
+const token = {{.}};
+const get = path => fetch(path + "?token=" + encodeURIComponent(token)).then(r => r.json());
+const text = s => document.createTextNode(s);
+function row(cells, header) {
+	const tr = document.createElement("tr");
+	for (const cell of cells) {
+		const td = document.createElement(header ? "th" : "td");
+		td.appendChild(text(cell));
+		tr.appendChild(td);
+	}
+	return tr;
+}
+function table(header, rows) {
+	const t = document.createElement("table");
+	t.appendChild(row(header, true));
+	rows.forEach(r => t.appendChild(row(r)));
+	return t;
+}
+async function refresh() {
+	const stats = await get("/stats");
+	const s = document.getElementById("stats");
+	s.textContent = "";
+	for (const [k, v] of Object.entries(stats)) s.appendChild(row([k, v]));
+	const users = await get("/users/overview");
+	const u = document.getElementById("users");
+	u.textContent = users.length ? "" : "No user connected.";
+	for (const user of users) {
+		const d = document.createElement("details");
+		d.open = true;
+		const summary = document.createElement("summary");
+		summary.appendChild(text(user.region + "_" + user.uid + " since " + user.since + (user.loaded ? "" : " (gamestate not loaded)")));
+		d.appendChild(summary);
+		d.appendChild(table(["Modules"], user.modules.map(m => [m])));
+		d.appendChild(table(["Module", "Hook", "Priority", "Kind"], user.hooks.map(h => [h.module, h.target, h.priority, h.kind])));
+		d.appendChild(table(["Time", "Op", "Bytes"], user.recent.map(p => [p.time, p.op, p.bytes])));
+		const bodies = document.createElement("a");
+		bodies.href = "/users/recent?user=" + encodeURIComponent(user.region + "_" + user.uid) + "&token=" + encodeURIComponent(token);
+		bodies.appendChild(text("Packet bodies (operators only)"));
+		d.appendChild(bodies);
+		u.appendChild(d);
+	}
+}
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body></html>
+`))
+
+// handleDashboard serves a page showing the proxy's stats and the overview of
+// each user, refreshed every 5 seconds. The page reuses the token of its URL,
+// e.g., https://127.0.0.1:8081/dashboard?token=<token>.
+func (p *Proxy) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); token == "" && len(auth) > len("Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = dashboardTemplate.Execute(w, token)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestOverview(t *testing.T) {
+	p := newTestProxy()
+	p.admin = p.newAdminMux()
+	d := p.getUser("1", "GL")
+	mod := &RhineModule{name: "test", dispatch: d}
+	d.modules = append(d.modules, mod)
+	mod.Hook("S/quest/battleFinish", 2, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte { return data })
+	d.run("C/quest/battleFinish", []byte("{}"), &goproxy.ProxyCtx{})
+	handler := requireToken(p.adminTokens("secret"), p.admin)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/users/overview?token=secret", nil))
+	var users []UserOverview
+	if err := json.NewDecoder(w.Body).Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Region != "GL" || users[0].UID != "1" {
+		t.Fatalf("Expected the user to be listed, got %+v", users)
+	}
+	user := users[0]
+	if len(user.Modules) != 1 || len(user.Hooks) != 1 || user.Hooks[0] != (HookInfo{"test", "S/quest/battleFinish", 2, "handler"}) {
+		t.Fatalf("Expected the module and its hook to be listed, got %v and %+v", user.Modules, user.Hooks)
+	}
+	if len(user.Recent) != 1 || user.Recent[0].Op != "C/quest/battleFinish" || user.Recent[0].Direction != "request" {
+		t.Fatalf("Expected the dispatched packet to be listed, got %+v", user.Recent)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/stats?token=secret", nil))
+	var stats ProxyStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Users != 1 || stats.Packets == 0 {
+		t.Fatalf("Expected the user and packet to be counted, got %+v", stats)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard?token=secret", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `const token = "secret";`) {
+		t.Fatalf("Expected the dashboard to reuse the token, got %d:\n%s", w.Code, w.Body)
+	}
+}
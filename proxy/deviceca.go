@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+// DeviceCA is a CA of its own trusted by some of the proxy's clients, e.g.,
+// the devices of one member of a household, so that distrusting one of them
+// only requires replacing its CA rather than the CA of every device. Its cert
+// and key are kept in "ca/<name>/" next to the main CA, generated with the
+// options of Options.CA if they don't exist. Deleting the directory replaces
+// the CA on the next start.
+type DeviceCA struct {
+	Name string `json:"name"`
+	// Devices are the names of the devices in Options.Devices, or their IPs,
+	// whose connections are signed by the CA. Other devices are signed by the
+	// main CA.
+	Devices []string `json:"devices"`
+}
+
+// deviceCA is a loaded DeviceCA.
+type deviceCA struct {
+	name  string
+	cert  *tls.Certificate
+	certs *certStore
+}
+
+// tlsConfig returns the TLS config serving host, which may include a port,
+// with a certificate signed by the CA.
+func (ca *deviceCA) tlsConfig(host string) (*tls.Config, error) {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	gen := func() (*tls.Certificate, error) {
+		cert, _, _, err := utils.SignCert(ca.cert, hostname, []string{hostname}, x509.ExtKeyUsageServerAuth)
+		return cert, err
+	}
+	var cert *tls.Certificate
+	var err error
+	if ca.certs != nil {
+		cert, err = ca.certs.Fetch(hostname, gen)
+	} else {
+		cert, err = gen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+}
+
+// deviceCAs selects the CA signing the connections of each client.
+type deviceCAs struct {
+	byName   map[string]*deviceCA
+	byDevice map[string]*deviceCA
+	clients  *clientTracker
+}
+
+// deviceCAPaths returns the paths of the cert and key of a device CA, relative
+// to utils.BinDir.
+func deviceCAPaths(name string) (string, string) {
+	dir := filepath.Join("ca", name)
+	return filepath.Join(dir, certPath), filepath.Join(dir, keyPath)
+}
+
+// loadDeviceCAs loads the device CAs configured by options, generating those
+// which don't exist.
+func loadDeviceCAs(options *Options, clients *clientTracker, logger log.Logger) (*deviceCAs, error) {
+	if len(options.DeviceCAs) == 0 {
+		return nil, nil
+	}
+	cas := &deviceCAs{
+		byName:   make(map[string]*deviceCA),
+		byDevice: make(map[string]*deviceCA),
+		clients:  clients,
+	}
+	for _, config := range options.DeviceCAs {
+		name := config.Name
+		if name == "" || strings.ContainsAny(name, `/\.`) {
+			return nil, fmt.Errorf("invalid device CA name %q", name)
+		}
+		if cas.byName[name] != nil {
+			return nil, fmt.Errorf("duplicate device CA %q", name)
+		}
+		cert, key := deviceCAPaths(name)
+		caOptions := options.CA
+		if caOptions.CommonName == "" {
+			caOptions.CommonName = "Rhine CA (" + name + ")"
+		}
+		if !utils.CAExists(cert, key, &caOptions) {
+			logger.Printf("Generating the CA of %s...", name)
+			if err := os.MkdirAll(filepath.Join(utils.BinDir, "ca", name), 0755); err != nil {
+				return nil, err
+			}
+			if err := utils.GenerateCAWithOptions(cert, key, &caOptions); err != nil {
+				return nil, fmt.Errorf("device CA %s: %s", name, err)
+			}
+			logger.Printf("Register '%s' with the devices of %s.", filepath.Join(utils.BinDir, cert), name)
+		}
+		loaded, err := utils.ReadCA(cert, key, &caOptions)
+		if err != nil {
+			return nil, fmt.Errorf("device CA %s: %s", name, err)
+		}
+		ca := &deviceCA{name: name, cert: loaded}
+		if !options.DisableCertStore {
+			ca.certs = newCertStore(logger)
+		}
+		cas.byName[name] = ca
+		for _, device := range config.Devices {
+			if other := cas.byDevice[device]; other != nil {
+				return nil, fmt.Errorf("device %s is assigned to the CAs of both %s and %s", device, other.name, name)
+			}
+			cas.byDevice[device] = ca
+		}
+	}
+	return cas, nil
+}
+
+// match returns the device CA signing the connections of the client at
+// remoteAddr, nil if it's signed by the main CA.
+func (cas *deviceCAs) match(remoteAddr string) *deviceCA {
+	if cas == nil {
+		return nil
+	}
+	if ca := cas.byDevice[cas.clients.device(remoteAddr)]; ca != nil {
+		return ca
+	}
+	return cas.byDevice[clientIP(remoteAddr)]
+}
+
+// caFor returns the certificate of the CA named by the "ca" query parameter of
+// r, or else of the CA signing the connections of the client sending r. A
+// false ok means the named CA doesn't exist.
+func (p *Proxy) caFor(r *http.Request) (cert *tls.Certificate, ok bool) {
+	if name := r.FormValue("ca"); name != "" {
+		if p.cas == nil || p.cas.byName[name] == nil {
+			return nil, false
+		}
+		return p.cas.byName[name].cert, true
+	}
+	if ca := p.cas.match(r.RemoteAddr); ca != nil {
+		return ca.cert, true
+	}
+	return &goproxy.GoproxyCa, true
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+func TestDeviceCAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-deviceca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := utils.BinDir
+	defer func() { utils.BinDir = binDir }()
+	utils.BinDir = dir + "/"
+
+	options := &Options{
+		CA:      utils.CAOptions{KeyType: "ecdsa"},
+		Devices: map[string]string{"10.0.0.3": "bob's tablet"},
+		DeviceCAs: []DeviceCA{
+			{Name: "alice", Devices: []string{"10.0.0.2"}},
+			{Name: "bob", Devices: []string{"bob's tablet"}},
+		},
+	}
+	logger := log.New(false, false, "/dev/null", 0)
+	cas, err := loadDeviceCAs(options, newClientTracker(options.Devices), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]string{"10.0.0.2:1234": "alice", "10.0.0.3:1234": "bob", "10.0.0.4:1234": ""} {
+		ca := cas.match(addr)
+		if (ca == nil && want != "") || (ca != nil && ca.name != want) {
+			t.Fatalf("Expected %s to be signed by %q, got %+v", addr, want, ca)
+		}
+	}
+
+	config, err := cas.match("10.0.0.2:1234").tlsConfig("gs.arknights.global:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ca := range cas.byName {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert.Leaf)
+		_, err := leaf.Verify(x509.VerifyOptions{DNSName: "gs.arknights.global", Roots: roots})
+		if (name == "alice") != (err == nil) {
+			t.Fatalf("Expected the certificate to only verify against alice's CA, %s: %v", name, err)
+		}
+	}
+
+	// The CAs are kept across restarts.
+	again, err := loadDeviceCAs(options, newClientTracker(options.Devices), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.byName["alice"].cert.Leaf.Equal(cas.byName["alice"].cert.Leaf) {
+		t.Fatal("Expected the device CA to be loaded rather than regenerated")
+	}
+
+	options.DeviceCAs = append(options.DeviceCAs, DeviceCA{Name: "carol", Devices: []string{"10.0.0.2"}})
+	if _, err := loadDeviceCAs(options, newClientTracker(options.Devices), logger); err == nil {
+		t.Fatal("Expected a device assigned to two CAs to be rejected")
+	}
+}
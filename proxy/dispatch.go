@@ -1,14 +1,24 @@
 package proxy
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/elazarl/goproxy"
+	"github.com/kyoukaya/rhine/events"
 	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/metrics"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/packetlog"
 	"github.com/kyoukaya/rhine/proxy/gamestate"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/recorder"
+	"github.com/kyoukaya/rhine/storage"
 )
 
 // Dispatch contains all the state pertaining to an authenticated user connected with
@@ -21,74 +31,249 @@ type dispatch struct {
 	mutex         *sync.Mutex
 	uid           int
 	region        string
+	key           string
+	hookMutex     sync.RWMutex
 	hooks         map[string][]*PacketHook
+	spilledHooks  map[string][]*PacketHook
 	coreHandlers  []func(string, []byte, *goproxy.ProxyCtx)
 	modules       []*RhineModule
 	intialized    bool
 	noUnknownJSON bool
+	failClosed    bool
+	breaker       *hookBreaker
+	dryRunMode    bool
+	moduleTimeout time.Duration
+	// client is the client the user logged in from, nil if unknown.
+	client *ClientInfo
+	// since is when the dispatch was created, see UserOverview.
+	since  time.Time
+	recent *recentPackets
+	// kicked is set once the game server rejected a request of the user.
+	kicked   bool
+	capture  *captureFilter
+	events   *events.Bus
+	store    storage.Store
+	packets  packetlog.Storage
+	recorder *recorder.Writer
+	stream   *packetStream
+	notifier *notify.Notifier
+	// stop is closed when the dispatch is shut down.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// logFile is the user's log, closed when the dispatch is shut down, see
+	// Options.UserLogs.
+	logFile io.Closer
+
+	// ownerChecked is when findUser last found that no other instance saved
+	// the user's shared gamestate.
+	ownerChecked time.Time
 
 	// Core modules
 	state *gamestate.GameState
 }
 
-func (d *dispatch) dispatch(op string, data []byte, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+var (
+	dispatchFailures = metrics.NewCounter("rhine_dispatch_failures_total", "Number of game packets whose dispatch failed.")
+	droppedPackets   = metrics.NewCounter("rhine_dropped_packets_total", "Number of game packets dropped by a hook.")
+)
+
+// wants reports whether any handler reads the packet, packets which aren't
+// wanted are passed through without their body being read. The core handlers
+// read every server response.
+func (d *dispatch) wants(op string) bool {
+	if strings.HasPrefix(op, "S/") || semantic.WantsRequest(op) {
+		return true
+	}
+	d.hookMutex.RLock()
+	defer d.hookMutex.RUnlock()
+	return len(d.hooks[op]) > 0 || len(d.hooks["*"]) > 0
+}
+
+// dispatch runs the core handlers and hooks for the packet. Every handler
+// receives the same buffer, hooks which modify the packet must return a new
+// slice instead of writing to the one they received, which then becomes the
+// packet's body.
+// A panic in a core handler fails the packet's dispatch, see bypass.
+func (d *dispatch) dispatch(op string, data []byte, ctx *goproxy.ProxyCtx) (req *http.Request, resp *http.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			req, resp = d.bypass(op, err, ctx)
+		}
+	}()
+	ret, err := d.run(op, data, ctx)
+	if err != nil {
+		return d.drop(op, err, ctx)
+	}
+	applyBody(op, data, ret, ctx.Req, ctx.Resp)
+	return ctx.Req, ctx.Resp
+}
+
+// drop answers a packet dropped by a hook with a 502 carrying the hook's
+// error, see PacketModifier. The proxy's answer to a dropped request isn't
+// dispatched as a response.
+func (d *dispatch) drop(op string, err error, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	droppedPackets.Inc()
+	if reqCtx, ok := ctx.UserData.(*RequestContext); ok && !strings.HasPrefix(op, "S/") {
+		reqCtx.RequestIsBlocked = true
+	}
+	return ctx.Req, goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+}
+
+// bypass forwards a packet whose dispatch failed untouched, or answers it with
+// a 502 if the proxy fails closed, see Options.FailClosed.
+func (d *dispatch) bypass(op string, err interface{}, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	dispatchFailures.Inc()
+	if d.failClosed {
+		d.Warnf("Dispatch of %s failed, answering with a 502: %v", op, err)
+		return ctx.Req, goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprint(err))
+	}
+	d.Warnf("Dispatch of %s failed, forwarding it untouched: %v", op, err)
+	return ctx.Req, ctx.Resp
+}
+
+// run runs the core handlers and hooks for the packet, returning the body
+// returned by the last hook, or the error of the hook which dropped the packet.
+// Packets whose body isn't valid JSON are only dispatched to the hooks which
+// opted in, see runMalformed.
+func (d *dispatch) run(op string, data []byte, ctx *goproxy.ProxyCtx) ([]byte, error) {
+	d.record(op, data)
+	if err := parseError(data); err != nil {
+		return d.runMalformed(op, data, err, ctx)
+	}
 	// Run core handlers
 	for _, hook := range d.coreHandlers {
 		hook(op, data, ctx)
 	}
-	// Run wildcard hooks
-	if hooks, ok := d.hooks["*"]; ok {
-		for _, hook := range hooks {
-			data = d.hookWrapper(hook, op, data, ctx)
+	// Run wildcard hooks, then normal hooks for op
+	for _, target := range []string{"*", op} {
+		for _, hook := range d.hooksOf(d.hooks, target) {
+			var err error
+			if data, err = d.hookWrapper(hook, op, data, ctx); err != nil {
+				return nil, err
+			}
 		}
 	}
-	// Run normal hooks for op
-	if hooks, ok := d.hooks[op]; ok {
-		for _, hook := range hooks {
-			data = d.hookWrapper(hook, op, data, ctx)
-		}
+	if op == syncOp {
+		d.runSyncSections(data, ctx)
 	}
-	return ctx.Req, ctx.Resp
+	return data, nil
 }
 
 // Wrap hook handlers in a recover so we don't crash the entire proxy if it a
 // module throws a panic.
-func (d *dispatch) hookWrapper(hook *PacketHook, op string, data []byte, ctx *goproxy.ProxyCtx) []byte {
+// The packet is left unchanged by a hook which panics. Hooks disabled by the
+// circuit breaker or whose filter doesn't match the packet are skipped, and
+// the changes of hooks, or their dropping the packet, are only logged in dry
+// run mode.
+func (d *dispatch) hookWrapper(hook *PacketHook, op string, data []byte, ctx *goproxy.ProxyCtx) (ret []byte, dropErr error) {
+	if !hook.filter.match(ctx) || d.breaker.open(hook.mod.name, hook.target) {
+		return data, nil
+	}
+	start := time.Now()
 	defer func() {
-		if err := recover(); err != nil {
+		err := recover()
+		if err != nil {
 			d.Warnf("Recovered from panic while executing %s:\n%+v", hook.mod.name, err)
+			ret, dropErr = data, nil
 		}
+		d.breaker.record(hook.mod.name, hook.target, time.Since(start), err)
 	}()
-	return hook.handle(op, data, ctx)
+	ret, dropErr = hook.handle(op, data, ctx)
+	if dropErr != nil {
+		if d.dryRunMode {
+			d.Printf("[dry run] %s would drop %s: %s", hook.mod.name, op, dropErr)
+			return data, nil
+		}
+		d.Printf("%s dropped %s: %s", hook.mod.name, op, dropErr)
+		return nil, dropErr
+	}
+	if d.dryRunMode && !sameBuffer(ret, data) {
+		d.dryRun(hook.mod.name, op, data, ret)
+		return data, nil
+	}
+	return ret, nil
 }
 
 func (d *dispatch) initMods(mods []initFunc) {
 	startT := time.Now()
 	// Load core modules
-	gs, gsHandler := gamestate.New(d.Logger, d.noUnknownJSON)
+	gs, gsHandler := gamestate.New(d.Logger, d.region, d.noUnknownJSON)
 	d.state = gs
 	d.coreHandlers = append(d.coreHandlers, gsHandler)
+	d.coreHandlers = append(d.coreHandlers, semantic.New(d.events, d.uid, d.region))
 	// Load user modules
 	for _, mod := range mods {
-		newMod := &RhineModule{
-			name:      mod.name,
-			Region:    d.region,
-			UID:       d.uid,
-			gameState: gs,
-			dispatch:  d,
+		newMod, err := d.loadModule(mod)
+		if err != nil {
+			d.Warnf("%s_%d: %v", d.region, d.uid, err)
+			continue
 		}
-		mod.fun(newMod)
 		d.modules = append(d.modules, newMod)
-		newMod.initialized = true
-		d.Printf("%s loaded.", mod.name)
 	}
 	d.sortHooks()
 	d.Verbosef("Mods loaded in %dms", time.Since(startT).Milliseconds())
 	d.intialized = true
+	go d.runResetTimer()
+}
+
+// loadModule initializes a module for the user, its hooks are sorted as they
+// are registered once the dispatch is initialized. A module whose init func
+// panics is unhooked and an error is returned instead.
+func (d *dispatch) loadModule(mod initFunc) (newMod *RhineModule, err error) {
+	newMod = &RhineModule{
+		name:      mod.name,
+		Region:    d.region,
+		UID:       d.uid,
+		Key:       d.key,
+		gameState: d.state,
+		Logger:    d.Logger,
+		dispatch:  d,
+	}
+	if l, ok := d.Logger.(*log.Log); ok {
+		newMod.Logger = l.WithModule(mod.name)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			for _, hook := range newMod.hooks {
+				d.removeHook(hook)
+			}
+			for _, hooker := range newMod.hookers {
+				hooker.Unhook()
+			}
+			newMod, err = nil, fmt.Errorf("%s panicked while initializing: %v", mod.name, r)
+		}
+	}()
+	mod.fun(newMod)
+	newMod.initialized = true
+	d.Printf("%s loaded.", mod.name)
+	return newMod, nil
+}
+
+// shutdown shuts down all of the user's modules concurrently and stops the
+// dispatch's background routines, returning the names of the modules which
+// panicked or didn't stop within the module shutdown timeout.
+func (d *dispatch) shutdown(shuttingDown bool) []string {
+	d.mutex.Lock()
+	mods := d.modules
+	d.mutex.Unlock()
+	failed := shutdownModules(mods, shuttingDown, d.moduleTimeout, d.Logger)
+	if len(failed) > 0 {
+		d.Warnf("%s_%d: modules failed to shut down cleanly: %s", d.region, d.uid, strings.Join(failed, ", "))
+	}
+	d.stopOnce.Do(func() {
+		close(d.stop)
+		if d.logFile != nil {
+			d.logFile.Close()
+		}
+	})
+	return failed
 }
 
 func (d *dispatch) removeHook(oldHook *PacketHook) {
-	hooks, ok := d.hooks[oldHook.target]
+	d.hookMutex.Lock()
+	defer d.hookMutex.Unlock()
+	hookMap := d.hookMap(oldHook)
+	hooks, ok := hookMap[oldHook.target]
 	if !ok {
 		d.Warnf("Tried to remove hook that doesn't exist: %#v", oldHook)
 		return
@@ -104,7 +289,7 @@ func (d *dispatch) removeHook(oldHook *PacketHook) {
 		// Hook not found
 		return
 	}
-	d.hooks[oldHook.target] = append(hooks[:i], hooks[i+1:]...)
+	hookMap[oldHook.target] = append(hooks[:i:i], hooks[i+1:]...)
 }
 
 type byPriority []*PacketHook
@@ -115,11 +300,18 @@ func (a byPriority) Less(i, j int) bool { return a[i].priority > a[j].priority }
 
 // Sort hooks in descending order
 func (d *dispatch) sortHooks() {
+	d.hookMutex.Lock()
+	defer d.hookMutex.Unlock()
 	for _, v := range d.hooks {
 		sortHookSl(byPriority(v))
 	}
+	for _, v := range d.spilledHooks {
+		sortHookSl(byPriority(v))
+	}
 }
 
+// sortHookSl sorts hooks by priority, keeping hooks of equal priority in the
+// order they were registered.
 func sortHookSl(hooks []*PacketHook) {
-	sort.Sort(byPriority(hooks))
+	sort.Stable(byPriority(hooks))
 }
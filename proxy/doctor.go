@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/kyoukaya/rhine/outbound"
+	"github.com/kyoukaya/rhine/utils"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+)
+
+// doctorDialTimeout bounds each connectivity check of Doctor.
+const doctorDialTimeout = 5 * time.Second
+
+// doctorHosts are the hosts the proxy connects to, checked by Doctor.
+var doctorHosts = []struct {
+	name, address string
+}{
+	{"game server (GL)", "gs.arknights.global:8443"},
+	{"game server (JP)", "gs.arknights.jp:8443"},
+	{"game server (KR)", "gs.arknights.kr:8443"},
+	{"gamedata source", "raw.githubusercontent.com:443"},
+}
+
+// DoctorCheck is the outcome of one of the checks run by Doctor.
+type DoctorCheck struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Problem and Fix describe what's wrong and how to fix it if the check
+	// failed.
+	Problem string `json:"problem,omitempty"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+func checkPassed(name string) DoctorCheck {
+	return DoctorCheck{Name: name, OK: true}
+}
+
+func checkFailed(name, problem, fix string) DoctorCheck {
+	return DoctorCheck{Name: name, Problem: problem, Fix: fix}
+}
+
+// Doctor checks the setup of the proxy configured by the config file at path:
+// the config itself, the CA, the availability of the listen addresses, the
+// connectivity to the game servers of each region and the gamedata cache. The
+// proxy doesn't need to be running, and the checks don't modify anything
+// besides moving the CA key to its configured storage, as starting would.
+func Doctor(path string) []DoctorCheck {
+	options, checks := doctorConfig(path)
+	checks = append(checks, doctorCA(options)...)
+	checks = append(checks, doctorPorts(options)...)
+	checks = append(checks, doctorConnectivity()...)
+	checks = append(checks, doctorGamedata()...)
+	return checks
+}
+
+// doctorLogger records the warnings logged while parsing options.
+type doctorLogger struct {
+	warnings []string
+}
+
+func (l *doctorLogger) Flush()                                   {}
+func (l *doctorLogger) Printf(format string, v ...interface{})   {}
+func (l *doctorLogger) Println(v ...interface{})                 {}
+func (l *doctorLogger) Verbosef(format string, v ...interface{}) {}
+func (l *doctorLogger) Verboseln(v ...interface{})               {}
+
+func (l *doctorLogger) Warnf(format string, v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+}
+
+func (l *doctorLogger) Warnln(v ...interface{}) {
+	l.warnings = append(l.warnings, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// doctorConfig loads the config, checking for unknown fields, modules and
+// invalid values. The default options are returned if it can't be loaded.
+func doctorConfig(path string) (*Options, []DoctorCheck) {
+	const name = "config"
+	b, err := ioutil.ReadFile(configPath(path))
+	if os.IsNotExist(err) {
+		return &Options{}, []DoctorCheck{checkFailed(name, fmt.Sprintf("%s doesn't exist", path),
+			"Start the proxy once to generate it with the default options.")}
+	} else if err != nil {
+		return &Options{}, []DoctorCheck{checkFailed(name, err.Error(), "Check the permissions of the config file.")}
+	}
+	options := &Options{}
+	if err := json.Unmarshal(b, options); err != nil {
+		return &Options{}, []DoctorCheck{checkFailed(name, fmt.Sprintf("%s isn't valid: %s", path, err),
+			"Fix the JSON syntax, or delete the file to regenerate it with the default options.")}
+	}
+
+	var checks []DoctorCheck
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&Options{}); err != nil {
+		checks = append(checks, checkFailed(name, err.Error(),
+			"Check the spelling of the field against the documentation of proxy.Options, unknown fields are ignored."))
+	}
+	registered := make(map[string]bool)
+	for _, mod := range modules {
+		registered[mod.name] = true
+	}
+	for _, list := range [][]string{options.Modules, options.SafeModeModules} {
+		for _, mod := range list {
+			if !registered[mod] {
+				checks = append(checks, checkFailed(name, fmt.Sprintf("unknown module %q", mod),
+					"Check the spelling of the module's name, and that it's compiled into the binary."))
+			}
+		}
+	}
+
+	if options.Reverse.Enable {
+		if _, err := options.Reverse.reverseHosts(); err != nil {
+			checks = append(checks, checkFailed(name, err.Error(), "Fix reverse.hosts in the config file."))
+		}
+	}
+	if options.Observe.URL != "" {
+		if _, err := options.Observe.client(); err != nil {
+			checks = append(checks, checkFailed(name, "observe: "+err.Error(), "Fix observe.caCert, observe.clientCert and observe.clientKey in the config file."))
+		}
+	}
+
+	logger := &doctorLogger{}
+	options.Transport.apply(&http.Transport{}, logger)
+	options.Annihilation.lead(logger)
+	options.Shutdown.timeouts(logger)
+	parsePolicy(options.Backpressure.EventPolicy, logger)
+	parsePolicy(options.Backpressure.NotificationPolicy, logger)
+	newHookBreaker(&options.HookBreaker, nil, logger)
+	parseDuration("retention.interval", options.Retention.Interval, logger)
+	parseDuration("archive.interval", options.Archive.Interval, logger)
+	options.Outbound.apply(outbound.New(outbound.Budget{}, 0), logger)
+	r := &retention{options: &options.Retention, Logger: logger}
+	r.policy("logs", &options.Retention.Logs)
+	r.policy("captures", &options.Retention.Captures)
+	r.policy("history", &options.Retention.History)
+	for _, warning := range logger.warnings {
+		checks = append(checks, checkFailed(name, warning, "Fix the value in the config file, it's ignored otherwise."))
+	}
+	if len(checks) == 0 {
+		checks = append(checks, checkPassed(name))
+	}
+	return options, checks
+}
+
+// doctorCA checks that the CA loads, is valid and signs certificates which
+// verify against it.
+func doctorCA(options *Options) []DoctorCheck {
+	const name = "CA"
+	const regenerate = "Regenerate the CA with the cert subcommand and register the new cert.pem with your clients."
+	if !utils.CAExists(certPath, keyPath, &options.CA) {
+		return []DoctorCheck{checkFailed(name, "cert.pem or its key doesn't exist",
+			"Start the proxy once to generate the CA, then register cert.pem with your clients.")}
+	}
+	if err := utils.LoadCAWithOptions(certPath, keyPath, &options.CA); err != nil {
+		fix := regenerate
+		if err == utils.ErrNoPassphrase {
+			fix = "Set the passphrase of the CA key in the environment variable configured by ca.passphraseEnv."
+		}
+		return []DoctorCheck{checkFailed(name, fmt.Sprintf("failed to load the CA: %s", err), fix)}
+	}
+	ca := goproxy.GoproxyCa
+	leaf := ca.Leaf
+	now := time.Now()
+	switch {
+	case !leaf.IsCA:
+		return []DoctorCheck{checkFailed(name, "cert.pem isn't a CA certificate", regenerate)}
+	case now.After(leaf.NotAfter):
+		return []DoctorCheck{checkFailed(name, fmt.Sprintf("the CA expired on %s", leaf.NotAfter.Format("2006-01-02")), regenerate)}
+	case now.Before(leaf.NotBefore):
+		return []DoctorCheck{checkFailed(name, fmt.Sprintf("the CA is only valid from %s", leaf.NotBefore.Format("2006-01-02")),
+			"Check the system clock, or regenerate the CA.")}
+	}
+	cert, _, _, err := utils.SignCert(&ca, "gs.arknights.global", []string{"gs.arknights.global"}, x509.ExtKeyUsageServerAuth)
+	if err == nil {
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err == nil {
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "gs.arknights.global", Roots: roots})
+		}
+	}
+	if err != nil {
+		return []DoctorCheck{checkFailed(name, fmt.Sprintf("certificates signed by the CA don't verify: %s", err), regenerate)}
+	}
+	if remaining := leaf.NotAfter.Sub(now); remaining < 30*24*time.Hour {
+		return []DoctorCheck{checkFailed(name, fmt.Sprintf("the CA expires in %d days", int(remaining.Hours()/24)), regenerate)}
+	}
+	return []DoctorCheck{checkPassed(name)}
+}
+
+// doctorPorts checks that the addresses the proxy listens on are free.
+func doctorPorts(options *Options) []DoctorCheck {
+	addresses := map[string]string{"address": options.Address}
+	if options.Address == "" {
+		addresses["address"] = ":8080"
+	}
+	if options.Admin.Address != "" {
+		addresses["admin.address"] = options.Admin.Address
+	}
+	for _, tenant := range options.Tenants {
+		addresses["tenant "+tenant.Name] = tenant.Address
+	}
+	if options.Reverse.Enable {
+		if ports, err := options.Reverse.reverseHosts(); err == nil {
+			for port := range ports {
+				addresses["reverse.hosts port "+port] = net.JoinHostPort(options.Reverse.BindAddress, port)
+			}
+		}
+	}
+	var names []string
+	for name := range addresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var checks []DoctorCheck
+	for _, name := range names {
+		check := "port of " + name
+		l, err := net.Listen("tcp", addresses[name])
+		if err != nil {
+			checks = append(checks, checkFailed(check, fmt.Sprintf("can't listen on %s: %s", addresses[name], err),
+				fmt.Sprintf("Stop the process using the port, possibly another instance of Rhine, or change %s in the config.", name)))
+			continue
+		}
+		l.Close()
+		checks = append(checks, checkPassed(check))
+	}
+	return checks
+}
+
+// doctorConnectivity checks that the hosts the proxy connects to are
+// reachable.
+func doctorConnectivity() []DoctorCheck {
+	var checks []DoctorCheck
+	for _, host := range doctorHosts {
+		conn, err := net.DialTimeout("tcp", host.address, doctorDialTimeout)
+		if err != nil {
+			checks = append(checks, checkFailed(host.name, fmt.Sprintf("can't connect to %s: %s", host.address, err),
+				"Check the network, DNS and firewall of the host running the proxy."))
+			continue
+		}
+		conn.Close()
+		checks = append(checks, checkPassed(host.name))
+	}
+	return checks
+}
+
+// doctorGamedata checks that the gamedata of each region is cached and valid.
+func doctorGamedata() []DoctorCheck {
+	var checks []DoctorCheck
+	for _, region := range gamedata.Regions() {
+		name := fmt.Sprintf("gamedata (%s)", region)
+		if err := gamedata.Verify(region); err != nil {
+			checks = append(checks, checkFailed(name, err.Error(),
+				"Delete data/.version and start the proxy with access to the gamedata source to download it again."))
+			continue
+		}
+		checks = append(checks, checkPassed(name))
+	}
+	return checks
+}
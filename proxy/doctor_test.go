@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kyoukaya/rhine/utils"
+)
+
+func TestDoctorConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := utils.BinDir
+	defer func() { utils.BinDir = binDir }()
+	utils.BinDir = dir + "/"
+	registered := modules
+	defer func() { modules = registered }()
+	modules = []initFunc{{name: "Drop Logger", optional: true}}
+
+	config := `{"modules": ["Drop Logger", "Drop Loger"], "shutdown": {"timeout": "soon"}, "adress": ":8080"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options, checks := doctorConfig("config.json")
+	if len(options.Modules) != 2 {
+		t.Fatalf("Expected the options to be loaded, got %+v", options)
+	}
+	var problems []string
+	for _, check := range checks {
+		if check.OK || check.Fix == "" {
+			t.Fatalf("Unexpected check %+v", check)
+		}
+		problems = append(problems, check.Problem)
+	}
+	for _, want := range []string{"adress", `"Drop Loger"`, "shutdown.timeout"} {
+		if !strings.Contains(strings.Join(problems, "\n"), want) {
+			t.Fatalf("Expected a problem mentioning %s, got %q", want, problems)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"modules": ["Drop Logger"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, checks := doctorConfig("config.json"); len(checks) != 1 || !checks[0].OK {
+		t.Fatalf("Expected a valid config to pass, got %+v", checks)
+	}
+	if checks := doctorCA(&Options{}); len(checks) != 1 || checks[0].OK {
+		t.Fatalf("Expected a missing CA to fail, got %+v", checks)
+	}
+}
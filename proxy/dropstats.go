@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+// dropStatsPrefix is the key prefix of the drop records in the store, records
+// are saved under "dropstats/{region_UID}/{stageID}".
+const dropStatsPrefix = "dropstats/"
+
+// confidenceZ is the z-score of the 95% confidence intervals of drop rates.
+const confidenceZ = 1.96
+
+// stageRecord aggregates a user's completed runs of a stage.
+type stageRecord struct {
+	Runs     int64                  `json:"runs"`
+	FirstRun time.Time              `json:"firstRun"`
+	LastRun  time.Time              `json:"lastRun"`
+	Items    map[string]*itemRecord `json:"items"`
+}
+
+// itemRecord sums the counts of an item dropped per run and their squares, from
+// which the variance of the count is derived.
+type itemRecord struct {
+	Sum   int64 `json:"sum"`
+	SumSq int64 `json:"sumSq"`
+}
+
+// add records a run which dropped items at t.
+func (r *stageRecord) add(items map[string]int64, t time.Time) {
+	if r.Items == nil {
+		r.Items = make(map[string]*itemRecord, len(items))
+	}
+	if r.Runs == 0 || t.Before(r.FirstRun) {
+		r.FirstRun = t
+	}
+	if t.After(r.LastRun) {
+		r.LastRun = t
+	}
+	r.Runs++
+	for id, count := range items {
+		item := r.Items[id]
+		if item == nil {
+			item = &itemRecord{}
+			r.Items[id] = item
+		}
+		item.Sum += count
+		item.SumSq += count * count
+	}
+}
+
+// merge adds the runs of o to r.
+func (r *stageRecord) merge(o *stageRecord) {
+	if r.Items == nil {
+		r.Items = make(map[string]*itemRecord, len(o.Items))
+	}
+	if r.Runs == 0 || o.FirstRun.Before(r.FirstRun) {
+		r.FirstRun = o.FirstRun
+	}
+	if o.LastRun.After(r.LastRun) {
+		r.LastRun = o.LastRun
+	}
+	r.Runs += o.Runs
+	for id, o := range o.Items {
+		item := r.Items[id]
+		if item == nil {
+			item = &itemRecord{}
+			r.Items[id] = item
+		}
+		item.Sum += o.Sum
+		item.SumSq += o.SumSq
+	}
+}
+
+// ItemDropRate estimates how many of an item a run of a stage drops.
+type ItemDropRate struct {
+	ItemID string `json:"itemId"`
+	// Total is the number of the item dropped over all runs.
+	Total int64 `json:"total"`
+	// Rate is the mean count dropped per run, Low and High bound its 95%
+	// confidence interval.
+	Rate float64 `json:"rate"`
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+// StageDropStats are the drop rate estimates of a stage, the most dropped item
+// first.
+type StageDropStats struct {
+	StageID  string         `json:"stageId"`
+	Runs     int64          `json:"runs"`
+	FirstRun time.Time      `json:"firstRun"`
+	LastRun  time.Time      `json:"lastRun"`
+	Items    []ItemDropRate `json:"items"`
+}
+
+// dropRate estimates the rate of an item over runs. Items dropping at most
+// once per run use the Wilson score interval, which holds up for small samples
+// and rare drops. Otherwise the interval is based on the sample variance of the
+// count, assuming a Poisson distributed count for a single run.
+func dropRate(id string, item *itemRecord, runs int64) ItemDropRate {
+	n := float64(runs)
+	rate := float64(item.Sum) / n
+	ret := ItemDropRate{ItemID: id, Total: item.Sum, Rate: rate}
+	z2 := confidenceZ * confidenceZ
+	if item.SumSq == item.Sum {
+		denom := 1 + z2/n
+		center := (rate + z2/(2*n)) / denom
+		half := confidenceZ * math.Sqrt(rate*(1-rate)/n+z2/(4*n*n)) / denom
+		ret.Low, ret.High = math.Max(0, center-half), math.Min(1, center+half)
+		return ret
+	}
+	variance := rate
+	if runs > 1 {
+		variance = (float64(item.SumSq) - n*rate*rate) / (n - 1)
+	}
+	half := confidenceZ * math.Sqrt(variance/n)
+	ret.Low, ret.High = math.Max(0, rate-half), rate+half
+	return ret
+}
+
+func (r *stageRecord) stats(stageID string) StageDropStats {
+	stats := StageDropStats{StageID: stageID, Runs: r.Runs, FirstRun: r.FirstRun, LastRun: r.LastRun}
+	for id, item := range r.Items {
+		stats.Items = append(stats.Items, dropRate(id, item, r.Runs))
+	}
+	sort.Slice(stats.Items, func(i, j int) bool {
+		if stats.Items[i].Rate != stats.Items[j].Rate {
+			return stats.Items[i].Rate > stats.Items[j].Rate
+		}
+		return stats.Items[i].ItemID < stats.Items[j].ItemID
+	})
+	return stats
+}
+
+// recordDrops adds the drops of a completed battle to the user's record of the
+// stage. Practice runs, failed battles and LMD are not recorded.
+func recordDrops(store storage.Store, rUID string, battle *semantic.BattleResult, t time.Time) error {
+	if battle.Practice || !battle.Completed || battle.StageID == "" {
+		return nil
+	}
+	key := dropStatsPrefix + rUID + "/" + battle.StageID
+	record := &stageRecord{}
+	b, err := store.Get(key)
+	if err == nil {
+		err = json.Unmarshal(b, record)
+	}
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	record.add(battle.Items(false), t)
+	if b, err = json.Marshal(record); err != nil {
+		return err
+	}
+	return store.Put(key, b)
+}
+
+// LoadDropStats returns the drop rate estimates of the stages recorded in the
+// store, the most run stage first. user limits the estimates to a region_UID's
+// runs and stage to a stage ID, the runs of every user are pooled if user is
+// empty.
+func LoadDropStats(store storage.Store, user, stage string) ([]StageDropStats, error) {
+	prefix := dropStatsPrefix
+	if user != "" {
+		prefix += user + "/"
+	}
+	keys, err := store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]*stageRecord)
+	for _, key := range keys {
+		stageID := key[strings.LastIndexByte(key, '/')+1:]
+		if stage != "" && stageID != stage {
+			continue
+		}
+		b, err := store.Get(key)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		record := &stageRecord{}
+		if err := json.Unmarshal(b, record); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		if records[stageID] == nil {
+			records[stageID] = &stageRecord{}
+		}
+		records[stageID].merge(record)
+	}
+	stats := make([]StageDropStats, 0, len(records))
+	for stageID, record := range records {
+		stats = append(stats, record.stats(stageID))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Runs != stats[j].Runs {
+			return stats[i].Runs > stats[j].Runs
+		}
+		return stats[i].StageID < stats[j].StageID
+	})
+	return stats, nil
+}
+
+// DropStats returns the drop rate estimates recorded by the proxy, see
+// LoadDropStats.
+func (p *Proxy) DropStats(user, stage string) ([]StageDropStats, error) {
+	return LoadDropStats(p.store, user, stage)
+}
+
+// recordDropStats records the drops of every user's battles in the store until
+// the proxy is shut down.
+func (p *Proxy) recordDropStats() {
+	if p.options.DisableDropStats {
+		return
+	}
+	listener := make(chan events.Event, 8)
+	sub := p.events.Subscribe(semantic.TopicBattleFinished, listener)
+	go func() {
+		defer sub.Unhook()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case evt := <-listener:
+				battle, ok := evt.Payload.(*semantic.BattleFinished)
+				if !ok {
+					continue
+				}
+				rUID := fmt.Sprintf("%s_%d", evt.Region, evt.UID)
+				if err := recordDrops(p.store, rUID, &battle.BattleResult, time.Now()); err != nil {
+					p.Warnf("Failed to record the drops of %s: %s", rUID, err)
+				}
+			}
+		}
+	}()
+}
+
+// handleDropStats serves the drop rate estimates for the optional "user" and
+// "stage" query parameters.
+func (p *Proxy) handleDropStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	stats, err := p.DropStats(query.Get("user"), query.Get("stage"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+// FormatDropStats formats the estimates of a stage on one line, e.g.,
+// "main_01-07, 120 runs: 30012 0.45 (0.36-0.54), 30011 0.10 (0.06-0.17)".
+func FormatDropStats(stats *StageDropStats) string {
+	items := make([]string, len(stats.Items))
+	for i, item := range stats.Items {
+		items[i] = fmt.Sprintf("%s %.2f (%.2f-%.2f)", item.ItemID, item.Rate, item.Low, item.High)
+	}
+	line := fmt.Sprintf("%s, %d runs", stats.StageID, stats.Runs)
+	if len(items) == 0 {
+		return line + ", no drops"
+	}
+	return line + ": " + strings.Join(items, ", ")
+}
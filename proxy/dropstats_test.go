@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestDropStats(t *testing.T) {
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	battle := func(stage string, drops ...semantic.Drop) *semantic.BattleResult {
+		return &semantic.BattleResult{StageID: stage, Completed: true, Stars: 3, Drops: drops}
+	}
+	for i := 0; i < 4; i++ {
+		drops := []semantic.Drop{{ID: "4001", Count: 12}}
+		if i%2 == 0 {
+			drops = append(drops, semantic.Drop{ID: "30012", Count: 1})
+		}
+		if err := recordDrops(store, "GL_1", battle("main_01-07", drops...), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, count := range []int64{2, 4} {
+		if err := recordDrops(store, "GL_2", battle("main_01-07", semantic.Drop{ID: "30011", Count: count}), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = recordDrops(store, "GL_2", battle("main_00-01"), now)
+	_ = recordDrops(store, "GL_2", &semantic.BattleResult{StageID: "main_00-01", Practice: true, Completed: true}, now)
+	_ = recordDrops(store, "GL_2", &semantic.BattleResult{StageID: "main_00-01"}, now)
+
+	stats, err := LoadDropStats(store, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].StageID != "main_01-07" || stats[0].Runs != 6 || stats[1].Runs != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	items := stats[0].Items
+	if len(items) != 2 || items[0].ItemID != "30011" || items[0].Total != 6 || items[1].ItemID != "30012" {
+		t.Fatalf("Unexpected items %+v", items)
+	}
+	if math.Abs(items[1].Rate-2.0/6) > 1e-9 || items[1].Low <= 0 || items[1].High >= 1 || items[1].Low > items[1].Rate {
+		t.Fatalf("Unexpected drop rate %+v", items[1])
+	}
+
+	stats, err = LoadDropStats(store, "GL_1", "main_01-07")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Runs != 4 || len(stats[0].Items) != 1 || stats[0].Items[0].Rate != 0.5 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	p := newTestProxy()
+	p.store = store
+	w := httptest.NewRecorder()
+	p.handleDropStats(w, httptest.NewRequest("GET", "/dropstats?user=GL_2", nil))
+	var served []StageDropStats
+	if err := json.NewDecoder(w.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 2 || served[0].Items[0].Rate != 3 {
+		t.Fatalf("Unexpected stats served %+v", served)
+	}
+	if line := FormatDropStats(&served[1]); line != "main_00-01, 1 runs, no drops" {
+		t.Fatalf("Unexpected line %q", line)
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxDryRunChanges is the number of changes logged for a packet in dry run
+// mode, the rest being summarized.
+const maxDryRunChanges = 20
+
+// dryRun logs the changes a hook would have made to a packet in dry run mode,
+// see Options.DryRun.
+func (d *dispatch) dryRun(module, op string, before, after []byte) {
+	changes := jsonChanges(before, after)
+	if changes == nil {
+		d.Printf("[dry run] %s would replace the %d bytes of %s with %d bytes", module, len(before), op, len(after))
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+	if len(changes) > maxDryRunChanges {
+		changes = append(changes[:maxDryRunChanges], fmt.Sprintf("and %d more", len(changes)-maxDryRunChanges))
+	}
+	d.Printf("[dry run] %s would change %s:\n\t%s", module, op, strings.Join(changes, "\n\t"))
+}
+
+// jsonChanges returns the paths of the values which differ between two JSON
+// documents, e.g., `user.status.ap: 10 -> 135`, nil if either isn't JSON.
+func jsonChanges(before, after []byte) []string {
+	var a, b interface{}
+	if json.Unmarshal(before, &a) != nil || json.Unmarshal(after, &b) != nil {
+		return nil
+	}
+	changes := []string{}
+	diffJSON("", a, b, &changes)
+	return changes
+}
+
+func diffJSON(path string, a, b interface{}, changes *[]string) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				diffJSON(joinPath(path, k), a[k], b[k], changes)
+			}
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok && len(a) == len(b) {
+			for i := range a {
+				diffJSON(joinPath(path, fmt.Sprint(i)), a[i], b[i], changes)
+			}
+			return
+		}
+	}
+	before, after := compactJSON(a), compactJSON(b)
+	if before != after {
+		if path == "" {
+			path = "@this"
+		}
+		*changes = append(*changes, fmt.Sprintf("%s: %s -> %s", path, before, after))
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// compactJSON formats a decoded value, missing values being formatted as null.
+func compactJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+	return strings.TrimSpace(buf.String())
+}
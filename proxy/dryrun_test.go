@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestJSONChanges(t *testing.T) {
+	before := []byte(`{"user":{"status":{"ap":10,"gold":5}},"items":[1,2]}`)
+	after := []byte(`{"user":{"status":{"ap":135,"gold":5,"new":"a"}},"items":[1,2,3]}`)
+	want := []string{
+		"items: [1,2] -> [1,2,3]",
+		"user.status.ap: 10 -> 135",
+		`user.status.new: null -> "a"`,
+	}
+	if got := jsonChanges(before, after); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+	if got := jsonChanges([]byte("not json"), after); got != nil {
+		t.Fatalf("Expected nil for non JSON bodies, got %q", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	d.dryRunMode = true
+	hook := &PacketHook{
+		target: "S/quest/battleStart",
+		mod:    &RhineModule{name: "rewriter"},
+		handler: func(op string, data []byte, ctx *goproxy.ProxyCtx) []byte {
+			return []byte(`{"modified":true}`)
+		},
+	}
+	data := []byte(`{"modified":false}`)
+	if got, _ := d.hookWrapper(hook, hook.target, data, nil); !sameBuffer(got, data) {
+		t.Fatalf("Expected the original packet to be forwarded, got %s", got)
+	}
+}
@@ -5,25 +5,96 @@ package filters
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 )
 
 var (
-	// HostFilter is the default host filter for Rhine.
-	// Requests to hosts in the hostFilter slice will be blocked.
-	HostFilter = GenerateFilter([]string{
+	// CommonHostFilters are the hosts blocked regardless of the region of the
+	// client.
+	CommonHostFilters = []string{
 		`android\.bugly\.qq\.com`,
 		`sessions\.bugsnag\.com`,
 		`app\.adjust\.com`,
-	})
+	}
+	// RegionHostFilters are the additional hosts blocked for each region, the
+	// set for a region is only enabled once game traffic for the region has
+	// been observed.
+	RegionHostFilters = map[string][]string{
+		"GL": {
+			`app-measurement\.com`,
+			`firebaselogging-pa\.googleapis\.com`,
+		},
+		"JP": {
+			`app-measurement\.com`,
+			`firebaselogging-pa\.googleapis\.com`,
+		},
+		"KR": {
+			`app-measurement\.com`,
+			`firebaselogging-pa\.googleapis\.com`,
+		},
+		"CN": {
+			`alog\.umeng\.com`,
+			`ulogs\.umeng\.com`,
+			`tdid\.talkingdata\.com`,
+		},
+	}
+	// HostFilter is the default host filter for Rhine.
+	// Requests to hosts in the CommonHostFilters slice will be blocked.
+	HostFilter = GenerateFilter(CommonHostFilters)
 )
 
-// GenerateFilter compiles a regexp expression for a given list of URLs
+// GenerateFilter compiles a regexp expression for a given list of URLs, returns
+// nil if the list is empty. Panics if a URL isn't a valid expression.
 func GenerateFilter(list []string) *regexp.Regexp {
+	filter, err := compileFilter(list)
+	if err != nil {
+		panic(err)
+	}
+	return filter
+}
+
+// compileFilter is GenerateFilter returning an error for invalid URLs. Each URL
+// is compiled on its own first, so that one can't unbalance the others'
+// groups.
+func compileFilter(list []string) (*regexp.Regexp, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
 	ret := ""
 	for _, v := range list {
+		if _, err := regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("invalid host filter %q: %s", v, err)
+		}
 		ret += fmt.Sprintf(`(^.*%s.*$)|`, v)
 	}
 	ret = strings.TrimRight(ret, "|")
-	return regexp.MustCompile(ret)
+	return regexp.Compile(ret)
+}
+
+// GenerateRegionFilter compiles the common filters along with the filter sets
+// of the specified regions. Sets found in overrides take precedence over the
+// ones in RegionHostFilters. Returns an error if a filter isn't a valid
+// expression.
+func GenerateRegionFilter(regions []string, overrides map[string][]string) (*regexp.Regexp, error) {
+	seen := make(map[string]bool)
+	var list []string
+	add := func(hosts []string) {
+		for _, host := range hosts {
+			if !seen[host] {
+				seen[host] = true
+				list = append(list, host)
+			}
+		}
+	}
+	add(CommonHostFilters)
+	sort.Strings(regions)
+	for _, region := range regions {
+		if set, ok := overrides[region]; ok {
+			add(set)
+		} else {
+			add(RegionHostFilters[region])
+		}
+	}
+	return compileFilter(list)
 }
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClientKind is the kind of device a user plays on.
+type ClientKind string
+
+// Kinds of clients, see ClientInfo.
+const (
+	ClientUnknown  ClientKind = "unknown"
+	ClientEmulator ClientKind = "emulator"
+	ClientPhone    ClientKind = "phone"
+	ClientPC       ClientKind = "pc"
+)
+
+// ClientInfo describes the client a user logged in from.
+type ClientInfo struct {
+	Kind ClientKind
+	IP   string
+	// Device is the client's name in Options.Devices, or its IP.
+	Device    string
+	UserAgent string
+	// TLSFingerprint identifies the TLS stack of the client from its
+	// ClientHello, see Options.TLSFingerprints.
+	TLSFingerprint string
+}
+
+// emulatorMarkers are found in the user agents of Android emulators, which
+// report the emulator's build or device model.
+var emulatorMarkers = []string{
+	"sdk_gphone", "android sdk built for", "google_sdk", "genymotion", "vbox86",
+	"bluestacks", "noxplayer", "mumu", "ldplayer", "memu", "emulator",
+}
+
+// isGREASE reports whether v is one of the reserved values clients advertise
+// at random to keep servers tolerant (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsFingerprint hashes the parameters advertised in a ClientHello, similar to
+// JA3 without the extensions, which crypto/tls doesn't expose.
+func tlsFingerprint(hello *tls.ClientHelloInfo) string {
+	var b strings.Builder
+	list := func(values []uint16) {
+		first := true
+		for _, v := range values {
+			if isGREASE(v) {
+				continue
+			}
+			if !first {
+				b.WriteByte('-')
+			}
+			first = false
+			b.WriteString(strconv.Itoa(int(v)))
+		}
+		b.WriteByte(',')
+	}
+	list(hello.SupportedVersions)
+	list(hello.CipherSuites)
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, curve := range hello.SupportedCurves {
+		curves[i] = uint16(curve)
+	}
+	list(curves)
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, point := range hello.SupportedPoints {
+		points[i] = uint16(point)
+	}
+	list(points)
+	schemes := make([]uint16, len(hello.SignatureSchemes))
+	for i, scheme := range hello.SignatureSchemes {
+		schemes[i] = uint16(scheme)
+	}
+	list(schemes)
+	b.WriteString(strings.Join(hello.SupportedProtos, "-"))
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// classifyClient infers the kind of client from its user agent and headers,
+// fingerprints maps TLS fingerprints to kinds which take precedence.
+func classifyClient(userAgent string, header http.Header, fingerprint string, fingerprints map[string]ClientKind) ClientKind {
+	if kind, ok := fingerprints[fingerprint]; ok && fingerprint != "" {
+		return kind
+	}
+	ua := strings.ToLower(userAgent)
+	for _, marker := range emulatorMarkers {
+		if strings.Contains(ua, marker) {
+			return ClientEmulator
+		}
+	}
+	switch {
+	case strings.Contains(ua, "android"), strings.Contains(ua, "dalvik"),
+		strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"),
+		strings.Contains(ua, "cfnetwork"):
+		return ClientPhone
+	case strings.Contains(ua, "windows"), strings.Contains(ua, "macintosh"):
+		return ClientPC
+	}
+	// Unity's web requests on desktop platforms don't send a user agent.
+	if header.Get("X-Unity-Version") != "" && userAgent == "" {
+		return ClientPC
+	}
+	return ClientUnknown
+}
+
+// clientInfo describes the client which made the request.
+func (p *Proxy) clientInfo(req *http.Request) *ClientInfo {
+	fingerprint := p.listener.fingerprint(req.RemoteAddr)
+	return &ClientInfo{
+		Kind:           classifyClient(req.UserAgent(), req.Header, fingerprint, p.options.TLSFingerprints),
+		IP:             clientIP(req.RemoteAddr),
+		Device:         p.clients.device(req.RemoteAddr),
+		UserAgent:      req.UserAgent(),
+		TLSFingerprint: fingerprint,
+	}
+}
+
+// hello records the TLS fingerprint of a client connection.
+func (l *connListener) hello(remoteAddr string, hello *tls.ClientHelloInfo) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	conn := l.conns[remoteAddr]
+	l.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+	fingerprint := tlsFingerprint(hello)
+	conn.mutex.Lock()
+	conn.fingerprint = fingerprint
+	conn.mutex.Unlock()
+}
+
+// fingerprint returns the TLS fingerprint of a client connection, if known.
+func (l *connListener) fingerprint(remoteAddr string) string {
+	if l == nil {
+		return ""
+	}
+	l.mutex.Lock()
+	conn := l.conns[remoteAddr]
+	l.mutex.Unlock()
+	if conn == nil {
+		return ""
+	}
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.fingerprint
+}
+
+func (d *dispatch) clientInfo() *ClientInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.client
+}
+
+// setClient sets the client of the user if it isn't known yet.
+func (d *dispatch) setClient(client *ClientInfo) {
+	d.mutex.Lock()
+	if d.client == nil {
+		d.client = client
+	}
+	d.mutex.Unlock()
+}
+
+// Client returns the client the module's user logged in from, nil if unknown,
+// e.g., for sessions resumed from another instance.
+func (m *RhineModule) Client() *ClientInfo {
+	return m.dispatch.clientInfo()
+}
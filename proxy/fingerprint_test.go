@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestClassifyClient(t *testing.T) {
+	unity := http.Header{"X-Unity-Version": {"2017.4.39f1"}}
+	fingerprints := map[string]ClientKind{"abc": ClientEmulator}
+	for _, test := range []struct {
+		userAgent   string
+		header      http.Header
+		fingerprint string
+		want        ClientKind
+	}{
+		{"Dalvik/2.1.0 (Linux; U; Android 9; SM-G973N Build/PPR1.190810.011)", nil, "", ClientPhone},
+		{"Dalvik/2.1.0 (Linux; U; Android 11; sdk_gphone_x86 Build/RSR1.201013.001)", nil, "", ClientEmulator},
+		{"Dalvik/2.1.0 (Linux; U; Android 7.1.2; SM-G973N Build/PPR1.190810.011)", nil, "abc", ClientEmulator},
+		{"arknights/61 CFNetwork/1220.1 Darwin/20.3.0", nil, "", ClientPhone},
+		{"", unity, "", ClientPC},
+		{"", nil, "", ClientUnknown},
+	} {
+		if got := classifyClient(test.userAgent, test.header, test.fingerprint, fingerprints); got != test.want {
+			t.Errorf("%q: expected %s, got %s", test.userAgent, test.want, got)
+		}
+	}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		CipherSuites:      []uint16{0x1301, 0x1302},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+	greased := &tls.ClientHelloInfo{
+		CipherSuites:      []uint16{0x3a3a, 0x1301, 0x1302},
+		SupportedCurves:   []tls.CurveID{0xaaaa, tls.X25519},
+		SupportedVersions: []uint16{0x7a7a, tls.VersionTLS13, tls.VersionTLS12},
+	}
+	if tlsFingerprint(hello) != tlsFingerprint(greased) {
+		t.Fatal("Expected GREASE values to be ignored")
+	}
+	hello.CipherSuites = hello.CipherSuites[:1]
+	if tlsFingerprint(hello) == tlsFingerprint(greased) {
+		t.Fatal("Expected different cipher suites to change the fingerprint")
+	}
+}
+
+func TestLoginClientInfo(t *testing.T) {
+	p := newTestProxy()
+	req := httptest.NewRequest("POST", "https://gs.arknights.global:8443/account/login",
+		bytes.NewReader([]byte(`{"uid":"2"}`)))
+	req.Header.Set("User-Agent", "Dalvik/2.1.0 (Linux; U; Android 9; SM-G973N Build/PPR1.190810.011)")
+	p.HandleReq(req, &goproxy.ProxyCtx{Req: req})
+	d := p.getUser("2", "GL")
+	if d == nil {
+		t.Fatal("Expected the user to be logged in")
+	}
+	client := (&RhineModule{dispatch: d}).Client()
+	if client == nil || client.Kind != ClientPhone || client.Device != "192.0.2.1" {
+		t.Fatalf("Unexpected client %+v", client)
+	}
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+)
+
+const (
+	// pitySoftLimit is the number of pulls without a 6★ after which the
+	// chance of a 6★ rises by pityStep with every pull.
+	pitySoftLimit = 50
+	baseSixRate   = 0.02
+	pityStep      = 0.02
+	// sparkPulls is the number of pulls on a limited banner after which the
+	// rate up operator can be exchanged for.
+	sparkPulls = 300
+)
+
+// GachaOptions configures the headhunting statistics computed from the gacha
+// history, see Proxy.GachaStats.
+type GachaOptions struct {
+	// RateUps lists the rate up 6★ operators of banners by pool ID, as the
+	// game data doesn't. Pulls of the operators are counted in
+	// BannerStats.RateUps.
+	RateUps map[string][]string `json:"rateUps"`
+	// PityThresholds are the numbers of pulls without a 6★ on a banner at
+	// which a notification is sent, e.g., [50, 90].
+	PityThresholds []int `json:"pityThresholds"`
+	// SparkThresholds are the numbers of pulls on a banner at which a
+	// notification is sent, e.g., [250, 290]. Only limited banners spark.
+	SparkThresholds []int `json:"sparkThresholds"`
+}
+
+// BannerStats are a user's headhunting statistics of a banner.
+type BannerStats struct {
+	User   string `json:"user"`
+	PoolID string `json:"poolId"`
+	Pulls  int    `json:"pulls"`
+	// Pity is the number of pulls since the last 6★.
+	Pity     int `json:"pity"`
+	SixStars int `json:"sixStars"`
+	// SixStarRate is the share of the pulls which were 6★.
+	SixStarRate float64 `json:"sixStarRate"`
+	// RateUps is the number of 6★ which were rate up operators, see
+	// GachaOptions.RateUps.
+	RateUps int `json:"rateUps"`
+	// NextRate is the chance of the next pull being a 6★ given the pity.
+	NextRate float64 `json:"nextRate"`
+	// SparkIn is the number of pulls left until the spark of a limited banner,
+	// 0 once reached.
+	SparkIn int `json:"sparkIn"`
+	// Operators counts the 6★ operators pulled by charId.
+	Operators map[string]int `json:"operators,omitempty"`
+}
+
+// nextSixRate returns the chance of a 6★ after pity pulls without one.
+func nextSixRate(pity int) float64 {
+	rate := baseSixRate
+	if pity >= pitySoftLimit {
+		rate += pityStep * float64(pity-pitySoftLimit+1)
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	return rate
+}
+
+// rarityFunc returns the number of stars of an operator.
+type rarityFunc func(region, charID string) (int, error)
+
+// gamedataRarity looks up the rarity of operators in the game data, holding
+// the character table of each region until closed.
+type gamedataRarity struct {
+	logger  log.Logger
+	handles map[string]*gamedata.GameData
+}
+
+func newGamedataRarity(logger log.Logger) *gamedataRarity {
+	return &gamedataRarity{logger: logger, handles: make(map[string]*gamedata.GameData)}
+}
+
+func (g *gamedataRarity) stars(region, charID string) (int, error) {
+	gd := g.handles[region]
+	if gd == nil {
+		var err error
+		if gd, err = gamedata.New(region, g.logger); err != nil {
+			return 0, err
+		}
+		g.handles[region] = gd
+	}
+	table, err := gd.GetCharInfo()
+	if err != nil {
+		return 0, err
+	}
+	char, ok := (*table)[charID]
+	if !ok {
+		return 0, fmt.Errorf("unknown operator %s", charID)
+	}
+	return char.Rarity.Stars(), nil
+}
+
+func (g *gamedataRarity) close() {
+	for _, gd := range g.handles {
+		gd.Close()
+	}
+}
+
+// computeGachaStats computes the statistics of each user's banners from the
+// rows of the gacha history, see LoadHistory.
+func computeGachaStats(rows [][]string, rarity rarityFunc, rateUps map[string][]string) ([]BannerStats, error) {
+	banners := make(map[string]*BannerStats)
+	var keys []string
+	for _, row := range rows[1:] {
+		user, poolID, charID := row[1], row[2], row[3]
+		key := user + "/" + poolID
+		banner := banners[key]
+		if banner == nil {
+			banner = &BannerStats{User: user, PoolID: poolID}
+			banners[key] = banner
+			keys = append(keys, key)
+		}
+		region := user[:strings.IndexByte(user+"_", '_')]
+		stars, err := rarity(region, charID)
+		if err != nil {
+			return nil, err
+		}
+		banner.Pulls++
+		if stars < 6 {
+			banner.Pity++
+			continue
+		}
+		banner.Pity = 0
+		banner.SixStars++
+		if banner.Operators == nil {
+			banner.Operators = make(map[string]int)
+		}
+		banner.Operators[charID]++
+		for _, rateUp := range rateUps[poolID] {
+			if rateUp == charID {
+				banner.RateUps++
+			}
+		}
+	}
+	sort.Strings(keys)
+	ret := make([]BannerStats, len(keys))
+	for i, key := range keys {
+		banner := banners[key]
+		banner.SixStarRate = float64(banner.SixStars) / float64(banner.Pulls)
+		banner.NextRate = nextSixRate(banner.Pity)
+		if banner.Pulls < sparkPulls {
+			banner.SparkIn = sparkPulls - banner.Pulls
+		}
+		ret[i] = *banner
+	}
+	return ret, nil
+}
+
+// LoadGachaStats returns the statistics of each banner pulled on in the gacha
+// history, ordered by user and pool ID. user limits the statistics to a
+// region_UID's banners. Operator rarities are looked up in the game data,
+// whose updates are logged to logger.
+func LoadGachaStats(store storage.Store, user string, options *GachaOptions, logger log.Logger) ([]BannerStats, error) {
+	rows, err := LoadHistory(store, HistoryGacha, user)
+	if err != nil {
+		return nil, err
+	}
+	rarity := newGamedataRarity(logger)
+	defer rarity.close()
+	return computeGachaStats(rows, rarity.stars, options.RateUps)
+}
+
+// GachaStats returns the headhunting statistics of the proxy's users, see
+// LoadGachaStats.
+func (p *Proxy) GachaStats(user string) ([]BannerStats, error) {
+	rows, err := LoadHistory(p.store, HistoryGacha, user)
+	if err != nil {
+		return nil, err
+	}
+	if p.charRarity != nil {
+		return computeGachaStats(rows, p.charRarity, p.options.Gacha.RateUps)
+	}
+	rarity := newGamedataRarity(p.Logger)
+	defer rarity.close()
+	return computeGachaStats(rows, rarity.stars, p.options.Gacha.RateUps)
+}
+
+// crossed reports whether one of the thresholds lies in (before, after].
+func crossed(thresholds []int, before, after int) (int, bool) {
+	for _, threshold := range thresholds {
+		if before < threshold && after >= threshold {
+			return threshold, true
+		}
+	}
+	return 0, false
+}
+
+// checkPity notifies the user if their latest pulls on a banner crossed one of
+// the thresholds of GachaOptions. pulls is the number of pulls just recorded.
+func (p *Proxy) checkPity(region string, uid int, poolID string, pulls int) {
+	options := &p.options.Gacha
+	if len(options.PityThresholds) == 0 && len(options.SparkThresholds) == 0 {
+		return
+	}
+	rUID := fmt.Sprintf("%s_%d", region, uid)
+	stats, err := p.GachaStats(rUID)
+	if err != nil {
+		p.Warnf("Failed to compute the gacha statistics of %s: %s", rUID, err)
+		return
+	}
+	for _, banner := range stats {
+		if banner.PoolID != poolID {
+			continue
+		}
+		var body []string
+		// The pity before the pulls is unknown if one of them was a 6★.
+		if threshold, ok := crossed(options.PityThresholds, banner.Pity-pulls, banner.Pity); ok && banner.Pity >= pulls {
+			body = append(body, fmt.Sprintf("%d pulls without a 6★ (threshold %d), the next pull has a %.0f%% chance of a 6★.",
+				banner.Pity, threshold, banner.NextRate*100))
+		}
+		if threshold, ok := crossed(options.SparkThresholds, banner.Pulls-pulls, banner.Pulls); ok {
+			body = append(body, fmt.Sprintf("%d pulls on the banner (threshold %d), %d left until the spark.",
+				banner.Pulls, threshold, banner.SparkIn))
+		}
+		if len(body) == 0 {
+			return
+		}
+		p.notifier.Send(&notify.Notification{
+			Title:  "Headhunting on " + poolID,
+			Body:   strings.Join(body, "\n"),
+			UID:    uid,
+			Region: region,
+		})
+		return
+	}
+}
+
+// handleGacha serves the headhunting statistics for the optional "user" query
+// parameter.
+func (p *Proxy) handleGacha(w http.ResponseWriter, r *http.Request) {
+	stats, err := p.GachaStats(r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+type chanBackend chan *notify.Notification
+
+func (c chanBackend) Name() string                      { return "chan" }
+func (c chanBackend) Send(n *notify.Notification) error { c <- n; return nil }
+
+func TestGachaStats(t *testing.T) {
+	p := newTestProxy()
+	p.store = storage.NewMemoryStore()
+	p.charRarity = func(region, charID string) (int, error) {
+		if strings.HasPrefix(charID, "six") {
+			return 6, nil
+		}
+		return 3, nil
+	}
+	p.options.Gacha = GachaOptions{
+		RateUps:         map[string][]string{"LIMITED_1": {"six_a"}},
+		PityThresholds:  []int{50},
+		SparkThresholds: []int{70},
+	}
+	sent := make(chanBackend, 4)
+	p.notifier = notify.New(log.New(false, false, "/dev/null", 0))
+	p.notifier.Add(sent)
+
+	pull := func(poolID string, chars ...string) {
+		results := make([]semantic.GachaResult, len(chars))
+		for i, char := range chars {
+			results[i] = semantic.GachaResult{CharID: char}
+		}
+		evt := events.Event{UID: 1, Region: "GL", Payload: &semantic.GachaPulled{PoolID: poolID, Results: results}}
+		dataset, rows := historyRows(evt, time.Now())
+		if err := appendHistory(p.store, dataset, "GL_1", time.Now(), rows); err != nil {
+			t.Fatal(err)
+		}
+		p.checkPity("GL", 1, poolID, len(rows))
+	}
+	ten := func(char string) []string {
+		ret := make([]string, 10)
+		for i := range ret {
+			ret[i] = "three"
+		}
+		ret[9] = char
+		return ret
+	}
+	pull("LIMITED_1", ten("six_a")...)
+	pull("LIMITED_1", ten("six_b")...)
+	for i := 0; i < 4; i++ {
+		pull("LIMITED_1", ten("three")...)
+	}
+	select {
+	case n := <-sent:
+		t.Fatalf("Unexpected notification %+v", n)
+	case <-time.After(10 * time.Millisecond):
+	}
+	pull("LIMITED_1", ten("three")...)
+	select {
+	case n := <-sent:
+		if !strings.Contains(n.Body, "50 pulls without a 6★") || !strings.Contains(n.Body, "70 pulls on the banner") ||
+			n.UID != 1 || n.Region != "GL" {
+			t.Fatalf("Unexpected notification %+v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a notification")
+	}
+	pull("NORM_1", "three")
+
+	stats, err := p.GachaStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[1].PoolID != "NORM_1" || stats[1].Pulls != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	limited := stats[0]
+	if limited.Pulls != 70 || limited.Pity != 50 || limited.SixStars != 2 || limited.RateUps != 1 ||
+		limited.SparkIn != 230 || limited.Operators["six_b"] != 1 {
+		t.Fatalf("Unexpected stats %+v", limited)
+	}
+	if limited.NextRate != nextSixRate(50) || nextSixRate(49) != 0.02 || nextSixRate(98) != 1 {
+		t.Fatalf("Unexpected rates %v %v %v", limited.NextRate, nextSixRate(49), nextSixRate(98))
+	}
+}
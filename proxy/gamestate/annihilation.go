@@ -0,0 +1,15 @@
+package gamestate
+
+// Annihilation returns the orundum the user has earned from annihilation since
+// the weekly reset and the weekly cap. Blocks until the state is ready.
+func (mod *GameState) Annihilation() (earned, max int64, err error) {
+	var vals [2]int64
+	for i, path := range []string{"dungeon.campaigns.campaignCurrentFee", "dungeon.campaigns.campaignTotalFee"} {
+		v, err := mod.Get(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		vals[i] = v.(int64)
+	}
+	return vals[0], vals[1], nil
+}
@@ -6,6 +6,8 @@ package gamestate
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"strings"
 	"sync"
 
 	rhLog "github.com/kyoukaya/rhine/log"
@@ -17,34 +19,38 @@ import (
 	"github.com/tidwall/gjson"
 )
 
-const hookQueueMax = 100
-
 // GameState provides a handle in which users can obtain a reference to the
 // gamestate struct.
 type GameState struct {
 	state      *statestruct.User
 	stateMutex sync.Mutex
 	log        rhLog.Logger
+	region     string
 	loaded     bool
 	strict     bool
 	// Hooks are first added into the hookQueue and then added into the
-	// stateHooks map just before notifying listeners with parseHookQueue.
-	hookQueue  chan *GameStateHook
+	// stateHooks map just before parsing a packet with attachQueuedHooks.
+	hookMutex  sync.Mutex
+	hookQueue  []*GameStateHook
 	stateHooks map[string][]*GameStateHook
 }
 
-// New provides a newly instantiated GameState struct and a callback for the
-// proxy to call on every game packet.
-func New(log rhLog.Logger, strict bool) (*GameState, func(string, []byte, *goproxy.ProxyCtx)) {
-	mod := GameState{
+// New provides a newly instantiated GameState struct for a user of the region
+// and a callback for the proxy to call on every game packet of the user.
+func New(log rhLog.Logger, region string, strict bool) (*GameState, func(string, []byte, *goproxy.ProxyCtx)) {
+	mod := &GameState{
 		log:        log,
+		region:     region,
 		strict:     strict,
 		stateHooks: make(map[string][]*GameStateHook),
-		hookQueue:  make(chan *GameStateHook, hookQueueMax),
 	}
 	mod.stateMutex.Lock()
-	go mod.parseHookQueue()
-	return &mod, mod.handle
+	return mod, mod.handle
+}
+
+// Region returns the region of the user whose state is mirrored.
+func (mod *GameState) Region() string {
+	return mod.region
 }
 
 // IsLoaded checks if the initial sync packet has already been parsed and the
@@ -85,8 +91,35 @@ func (mod *GameState) Get(path string) (interface{}, error) {
 	return val.Interface(), nil
 }
 
+// Snapshot returns the state encoded as JSON, which can be loaded with Restore.
+// Blocks until the state is ready.
+func (mod *GameState) Snapshot() ([]byte, error) {
+	mod.stateMutex.Lock()
+	defer mod.stateMutex.Unlock()
+	return json.Marshal(mod.state)
+}
+
+// Restore loads a state returned by Snapshot in place of S/account/syncData,
+// resuming a user whose sync was observed elsewhere. It must be called before
+// the state is loaded.
+func (mod *GameState) Restore(data []byte) error {
+	if mod.loaded {
+		return errors.New("gamestate already loaded")
+	}
+	user, err := unmarshalUserData(data, false)
+	if err != nil {
+		return err
+	}
+	mod.attachQueuedHooks()
+	mod.state = user
+	mod.loaded = true
+	mod.stateMutex.Unlock()
+	return nil
+}
+
 func (mod *GameState) parseDataDelta(data []byte, op string) {
 	defer mod.stateMutex.Unlock()
+	mod.attachQueuedHooks()
 	res := gjson.GetBytes(data, "playerDataDelta.modified")
 	if !res.Exists() {
 		return
@@ -110,6 +143,10 @@ func (mod *GameState) parseDataDelta(data []byte, op string) {
 }
 
 func (mod *GameState) handle(op string, data []byte, pktCtx *goproxy.ProxyCtx) {
+	// Client requests never carry changes to the state.
+	if strings.HasPrefix(op, "C/") {
+		return
+	}
 	if mod.loaded {
 		mod.stateMutex.Lock()
 		go mod.parseDataDelta(data, op)
@@ -121,6 +158,7 @@ func (mod *GameState) handle(op string, data []byte, pktCtx *goproxy.ProxyCtx) {
 
 func (mod *GameState) handleSyncData(data []byte) []byte {
 	defer mod.stateMutex.Unlock()
+	mod.attachQueuedHooks()
 	syncData, err := unmarshalSyncData(data, mod.strict)
 	if err != nil {
 		mod.log.Warnf("%s:\n%s", err, data)
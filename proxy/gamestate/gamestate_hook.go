@@ -10,15 +10,17 @@ type GameStateHook struct {
 
 type StateEvent struct {
 	Path    string
+	Region  string
 	Payload interface{}
 }
 
 // Unhook unhooks the hook from the gamestate.
 func (oldHook *GameStateHook) Unhook() {
 	if oldHook == nil {
-		oldHook.gs.log.Warnf("GameStateHook.Unhook called on nil receiver")
+		// Fail silently
 		return
 	}
+	oldHook.gs.removeQueuedHook(oldHook)
 	oldHook.gs.stateMutex.Lock()
 	defer oldHook.gs.stateMutex.Unlock()
 	oldHooks := oldHook.gs.stateHooks[oldHook.target]
@@ -36,19 +38,33 @@ func (oldHook *GameStateHook) Unhook() {
 	oldHook.gs.stateHooks[oldHook.target] = append(oldHooks[:i], oldHooks[i+1:]...)
 }
 
-func (mod *GameState) parseHookQueue() {
-	for hook := range mod.hookQueue {
-		mod.stateMutex.Lock()
+// attachQueuedHooks moves the hooks in the hookQueue into the stateHooks map,
+// must be called with the stateMutex held.
+func (mod *GameState) attachQueuedHooks() {
+	mod.hookMutex.Lock()
+	defer mod.hookMutex.Unlock()
+	for _, hook := range mod.hookQueue {
 		mod.stateHooks[hook.target] = append(mod.stateHooks[hook.target], hook)
-		mod.stateMutex.Unlock()
 	}
+	mod.hookQueue = nil
 }
 
-// Hook creates a GameStateHook and attaches it as soon as possible. Notably, users
-// should not expect the hook to be attached when the function returns as the attaching
-// is done in a separate goroutine, allowing users to hook without blocking when
-// the module is initialized on account/login, i.e., before game state is initialized
-// from the SyncData packet.
+func (mod *GameState) removeQueuedHook(oldHook *GameStateHook) {
+	mod.hookMutex.Lock()
+	defer mod.hookMutex.Unlock()
+	for i, hook := range mod.hookQueue {
+		if hook == oldHook {
+			mod.hookQueue = append(mod.hookQueue[:i], mod.hookQueue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Hook creates a GameStateHook and attaches it before the next packet is parsed.
+// Notably, users should not expect the hook to be attached when the function
+// returns as the state may be locked while a packet is being parsed, allowing
+// users to hook without blocking when the module is initialized on account/login,
+// i.e., before game state is initialized from the SyncData packet.
 func (mod *GameState) Hook(target, moduleName string, listener chan StateEvent, event bool) *GameStateHook {
 	hook := &GameStateHook{
 		target:     target,
@@ -57,11 +73,8 @@ func (mod *GameState) Hook(target, moduleName string, listener chan StateEvent,
 		gs:         mod,
 		event:      event,
 	}
-	select {
-	case mod.hookQueue <- hook:
-	default:
-		mod.log.Warnf("gamestate: failed to add hook into hook queue %#v", hook)
-		return nil
-	}
+	mod.hookMutex.Lock()
+	mod.hookQueue = append(mod.hookQueue, hook)
+	mod.hookMutex.Unlock()
 	return hook
 }
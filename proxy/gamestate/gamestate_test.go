@@ -33,7 +33,7 @@ func openAndRead(t *testing.T, filename string) []byte {
 // TestHookWithPayload registers a hook which receives the value that has
 // changed when an event is emitted.
 func TestHookWithPayload(t *testing.T) {
-	mod, _ := New(logShim{t}, true)
+	mod, _ := New(logShim{t}, "GL", true)
 	mod.handle("S/account/syncData", openAndRead(t, "testdata/syncdata.json"), nil)
 	testChan := make(chan StateEvent, 1)
 	done := make(chan error)
@@ -51,7 +51,7 @@ func TestHookWithPayload(t *testing.T) {
 }
 
 func TestGamestate(t *testing.T) {
-	mod, _ := New(logShim{t}, true)
+	mod, _ := New(logShim{t}, "GL", true)
 	mod.handle("S/account/syncData", openAndRead(t, "testdata/syncdata.json"), nil)
 	mod.StateSync()
 	mod.handle("S/building/sync", openAndRead(t, "testdata/buildingsync.json"), nil)
@@ -61,7 +61,7 @@ func TestGamestate(t *testing.T) {
 func TestModificationHooks(t *testing.T) {
 	const testPath = "dexNav.enemy.stage.camp_02"
 	testChan := make(chan StateEvent, 1)
-	mod, _ := New(logShim{t}, true)
+	mod, _ := New(logShim{t}, "GL", true)
 	hook := mod.Hook(testPath, "test", testChan, false)
 	mod.handle("S/account/syncData", openAndRead(t, "testdata/syncdata.json"), nil)
 	b := openAndRead(t, "testdata/buildingsync.json")
@@ -91,7 +91,7 @@ func TestModificationHooks(t *testing.T) {
 // map[string]interface{} did not add new entries in the map. Workaround with
 // map[string]struct{} instead.
 func TestMapInterfaceBug(t *testing.T) {
-	mod, _ := New(logShim{t}, true)
+	mod, _ := New(logShim{t}, "GL", true)
 	mod.handle("S/account/syncData", openAndRead(t, "testdata/syncdata.json"), nil)
 	mod.handle("S/building/sync", openAndRead(t, "testdata/buildingsync.json"), nil)
 	mod.StateSync()
@@ -101,7 +101,7 @@ func TestMapInterfaceBug(t *testing.T) {
 }
 
 func TestStructAccess(t *testing.T) {
-	mod, _ := New(logShim{t}, true)
+	mod, _ := New(logShim{t}, "GL", true)
 	mod.handle("S/account/syncData", openAndRead(t, "testdata/syncdata.json"), nil)
 	val, err := mod.Get("building.rooms")
 	check(t, err)
@@ -116,10 +116,30 @@ func TestStructAccess(t *testing.T) {
 // mod.handle has a latency of about 150-200ms, there's a lot of room for improvement
 // here but it's usually not noticeable since it's typically faster than the game client.
 func BenchmarkHandleSync(b *testing.B) {
-	mod, _ := New(nil, true)
+	mod, _ := New(nil, "GL", true)
 	data := openAndRead(nil, "testdata/syncdata.json")
 	for i := 0; i < b.N; i++ {
 		mod.handle("S/account/syncData", data, nil)
 		mod.stateMutex.Lock()
 	}
 }
+
+func TestSnapshotRestore(t *testing.T) {
+	mod, _ := New(logShim{t}, "GL", true)
+	mod.handle("S/account/syncData", openAndRead(t, "testdata/syncdata.json"), nil)
+	b, err := mod.Snapshot()
+	check(t, err)
+	restored, _ := New(logShim{t}, "GL", true)
+	check(t, restored.Restore(b))
+	if !restored.IsLoaded() {
+		t.Fatal("Restored state should be loaded")
+	}
+	val, err := restored.Get("building.rooms")
+	check(t, err)
+	if rooms := val.(*statestruct.Rooms); rooms.Dormitory["slot_20"].Comfort != 3000 || len(rooms.Corridor) != 8 {
+		t.Fatal("Restored rooms not as expected.")
+	}
+	if restored.Restore(b) == nil {
+		t.Fatal("Restoring a loaded state should fail")
+	}
+}
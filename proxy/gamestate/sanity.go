@@ -0,0 +1,29 @@
+package gamestate
+
+import "time"
+
+// APInterval is the time taken to regenerate a single point of sanity.
+const APInterval = 6 * time.Minute
+
+// Sanity returns the user's current sanity, their sanity cap and the time at
+// which the cap is or was reached. Blocks until the state is ready.
+func (mod *GameState) Sanity() (current, max int64, fullAt time.Time, err error) {
+	var vals [3]int64
+	for i, path := range []string{"status.ap", "status.maxAp", "status.lastApAddTime"} {
+		v, err := mod.Get(path)
+		if err != nil {
+			return 0, 0, time.Time{}, err
+		}
+		vals[i] = v.(int64)
+	}
+	ap, max, lastAdd := vals[0], vals[1], vals[2]
+	lastAddT := time.Unix(lastAdd, 0)
+	if ap >= max {
+		return ap, max, lastAddT, nil
+	}
+	current = ap + int64(time.Since(lastAddT)/APInterval)
+	if current > max {
+		current = max
+	}
+	return current, max, lastAddT.Add(time.Duration(max-ap) * APInterval), nil
+}
@@ -65,7 +65,8 @@ func (mod *GameState) WalkAndNotify(data []byte) error {
 
 			curPath := string(bytes.Join(path[:depth], []byte(".")))
 			evt := StateEvent{
-				Path: curPath,
+				Path:   curPath,
+				Region: mod.region,
 			}
 			var payload interface{}
 			for _, hook := range mod.stateHooks[curPath] {
@@ -4,86 +4,155 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 
-	"github.com/kyoukaya/rhine/utils"
 	"github.com/tidwall/gjson"
 
 	"github.com/elazarl/goproxy"
 )
 
-var (
-	gameHostMatcher = regexp.MustCompile(`^gs\.arknights\.(jp|kr|global):8?443$`)
-)
-
 // HandleReq processes an outgoing HTTP request, dispatching it if it's game traffic.
+// Requests which aren't game traffic, and game requests which no handler
+// wants, are passed through without their body being read.
 func (proxy *Proxy) HandleReq(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	defer proxy.Flush()
-	reqCtx := &RequestContext{}
-	reqCtx.StartT = time.Now()
-	ctx.UserData = reqCtx
+	proxy.clients.seen(req.RemoteAddr, req.UserAgent())
 	// Block telemetry requests
-	if proxy.hostFilter != nil && proxy.hostFilter.MatchString(req.Host) {
+	if proxy.hostFilter.match(req.Host) {
 		proxy.Verbosef("==== Rejecting %v", req.Host)
 		// Use the UserData field as a flag to indicate to the response handler that the
 		// request that generated the response was blocked.
-		reqCtx.RequestIsBlocked = true
+		ctx.UserData = &RequestContext{RequestIsBlocked: true}
 		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "")
 	}
 	// Return if not game traffic
-	if !gameHostMatcher.MatchString(req.URL.Host) {
+	region, ok := proxy.regions.ofHost(req.URL.Host)
+	if !ok {
 		return req, nil
 	}
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Check(err)
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	defer proxy.Flush()
+	reqCtx := &RequestContext{}
+	reqCtx.StartT = time.Now()
+	ctx.UserData = reqCtx
 
 	op := "C/" + strings.Trim(req.URL.Path, "/")
 	uid := req.Header.Get("uid")
-	region := regionMap[req.URL.Hostname()[13:]]
+	proxy.hostFilter.observe(region)
+	worker, err := proxy.routeReq(req, op, uid, region)
+	if err != nil {
+		return proxy.readFailed(req, op, err)
+	}
+	if uid != "" {
+		proxy.mapClientUser(req.RemoteAddr, region+"_"+uid)
+	}
+	if worker != nil {
+		req, resp := proxy.forwardReq(worker, req, reqCtx, op, uid, region)
+		reqCtx.sent(resp)
+		return req, resp
+	}
 	var d *dispatch
+	var body []byte
 	if uid == "" {
 		if op != "C/account/login" {
 			return req, nil
 		}
+		if body, err = proxy.readReqBody(req); err != nil {
+			return proxy.readFailed(req, op, err)
+		}
 		uid = gjson.GetBytes(body, "uid").String()
-		d = proxy.addUser(uid, region)
-	} else {
-		d = proxy.getUser(uid, region)
+		proxy.mapClientUser(req.RemoteAddr, region+"_"+uid)
+		if d, err = proxy.addUser(uid, region, proxy.clientInfo(req)); err != nil {
+			proxy.Warnf("Not dispatching %s: %s", op, err)
+			return req, nil
+		}
+	} else if d = proxy.findUser(uid, region); d != nil && d.clientInfo() == nil {
+		d.setClient(proxy.clientInfo(req))
 	}
 	if d == nil {
 		return req, nil
 	}
 	reqCtx.dispatch = d
-	reqCtx.RequestData = body
 	reqCtx.RequestOp = op
+	if body == nil && !d.wants(op) {
+		reqCtx.sent(nil)
+		return req, nil
+	}
+	if body == nil {
+		if body, err = proxy.readReqBody(req); err != nil {
+			return proxy.readFailed(req, op, err)
+		}
+	}
+	reqCtx.RequestData = body
 	req, resp := d.dispatch(op, body, ctx)
+	reqCtx.sent(resp)
 	if proxy.options.Verbose {
-		proxy.Verbosef(">>>> %s (%d)\n", op, time.Since(reqCtx.StartT).Milliseconds())
+		d.Verbosef(">>>> %s (%d)\n", op, time.Since(reqCtx.StartT).Milliseconds())
 	}
 	return req, resp
 }
 
-// HandleResp processes an incoming http(s) response.
+// readReqBody reads the body of the request and replaces it with a reader over
+// the returned buffer.
+func (proxy *Proxy) readReqBody(req *http.Request) ([]byte, error) {
+	body, err := readBody(req.Body, req.ContentLength)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// readFailed answers a request whose body could not be read with a 502.
+func (proxy *Proxy) readFailed(req *http.Request, op string, err error) (*http.Request, *http.Response) {
+	proxy.Warnf("Failed to read %s: %s", op, err)
+	return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+}
+
+// HandleResp processes an incoming http(s) response. Only responses to game
+// requests are read.
 func (proxy *Proxy) HandleResp(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-	defer proxy.Flush()
-	reqCtx := GetRequestContext(ctx)
-	// If request that generated response was blocked or response not OK.
-	if reqCtx == nil || resp == nil || reqCtx.RequestIsBlocked {
+	reqCtx, _ := ctx.UserData.(*RequestContext)
+	// If request that generated response was blocked, wasn't game traffic, or
+	// the response is not OK.
+	if reqCtx == nil || resp == nil || reqCtx.RequestIsBlocked || (reqCtx.dispatch == nil && reqCtx.worker == nil) {
 		return resp
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	utils.Check(err)
-	resp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	// Game traffic
+	region, _ := proxy.regions.ofHost(ctx.Req.URL.Host)
+	if !reqCtx.sentT.IsZero() {
+		proxy.rtt.rtt(region, time.Since(reqCtx.sentT))
+	}
 	if reqCtx.dispatch != nil {
-		recvT := time.Now()
+		reqCtx.dispatch.checkKicked(resp, reqCtx.RequestOp, proxy.clientInfo(ctx.Req))
+	}
+	if proxy.memory.tunnel(resp.ContentLength) {
+		proxy.Verbosef("<<<< %s tunnelled as the memory limit is exceeded", ctx.Req.URL.Path)
+		return resp
+	}
+	defer proxy.Flush()
+	if reqCtx.worker != nil {
+		return proxy.forwardResp(resp, ctx, reqCtx)
+	}
+	if proxy.spills(resp.ContentLength) {
 		op := "S/" + strings.Trim(ctx.Req.URL.Path, "/")
-		_, resp := reqCtx.dispatch.dispatch(op, body, ctx)
-		proxy.Verbosef("<<<< %s (%d,%d)\n", op, recvT.Sub(reqCtx.StartT).Milliseconds(), time.Since(recvT).Milliseconds())
+		resp, err := reqCtx.dispatch.dispatchSpilled(op, resp, proxy.options.SpillDir, ctx)
+		if err != nil {
+			proxy.Warnf("Failed to spill %s: %s", op, err)
+			return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+		}
+		proxy.Verbosef("<<<< %s spilled to disk (%d)\n", op, resp.ContentLength)
 		return resp
 	}
+	op := "S/" + strings.Trim(ctx.Req.URL.Path, "/")
+	body, err := readBody(resp.Body, resp.ContentLength)
+	if err != nil {
+		proxy.Warnf("Failed to read %s: %s", op, err)
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	recvT := time.Now()
+	_, resp = reqCtx.dispatch.dispatch(op, body, ctx)
+	if !reqCtx.sentT.IsZero() {
+		proxy.rtt.dispatched(region, reqCtx.sentT.Sub(reqCtx.StartT)+time.Since(recvT))
+	}
+	if proxy.options.Verbose {
+		reqCtx.dispatch.Verbosef("<<<< %s (%d,%d)\n", op, recvT.Sub(reqCtx.StartT).Milliseconds(), time.Since(recvT).Milliseconds())
+	}
 	return resp
 }
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+
+	"github.com/elazarl/goproxy"
+)
+
+var benchBody = []byte(`{"playerDataDelta":{"modified":{},"deleted":{}},"padding":"` + strings.Repeat("x", 3000) + `"}`)
+
+func newTestProxy() *Proxy {
+	p := &Proxy{
+		mutex:      &sync.Mutex{},
+		options:    &Options{},
+		dispatches: make(map[string]*dispatch),
+		events:     events.NewBus(nil),
+		Logger:     log.New(false, false, "/dev/null", 0),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		content:    func(string) ([]semantic.ContentEnding, error) { return nil, nil },
+	}
+	if _, err := p.addUser("1", "GL", nil); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func benchRequest(host, path string) *http.Request {
+	req := httptest.NewRequest("POST", "https://"+host+path, bytes.NewReader(benchBody))
+	req.Header.Set("uid", "1")
+	return req
+}
+
+func benchmarkPacket(b *testing.B, p *Proxy, host, path string) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := benchRequest(host, path)
+		ctx := &goproxy.ProxyCtx{Req: req}
+		p.HandleReq(req, ctx)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        make(http.Header),
+			Body:          ioutil.NopCloser(bytes.NewReader(benchBody)),
+			ContentLength: int64(len(benchBody)),
+		}
+		ctx.Resp = resp
+		p.HandleResp(resp, ctx)
+	}
+}
+
+// BenchmarkBaseline measures the cost of building the benchmarked packets.
+func BenchmarkBaseline(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := benchRequest("example.com:443", "/")
+		_ = &goproxy.ProxyCtx{Req: req}
+		_ = &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        make(http.Header),
+			Body:          ioutil.NopCloser(bytes.NewReader(benchBody)),
+			ContentLength: int64(len(benchBody)),
+		}
+	}
+}
+
+// BenchmarkNonGameTraffic measures traffic to hosts other than the game servers.
+func BenchmarkNonGameTraffic(b *testing.B) {
+	benchmarkPacket(b, newTestProxy(), "example.com:443", "/")
+}
+
+// BenchmarkUnhookedRequest measures a game request which no handler reads,
+// while its response is still read by the core handlers.
+func BenchmarkUnhookedRequest(b *testing.B) {
+	benchmarkPacket(b, newTestProxy(), "gs.arknights.global:8443", "/building/sync")
+}
+
+// BenchmarkHookedRequest measures a game request with a hook on it.
+func BenchmarkHookedRequest(b *testing.B) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	(&RhineModule{name: "bench", dispatch: d}).Hook("C/building/sync", 0,
+		func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte { return data })
+	benchmarkPacket(b, p, "gs.arknights.global:8443", "/building/sync")
+}
+
+func TestUnhookedRequestNotRead(t *testing.T) {
+	p := newTestProxy()
+	req := benchRequest("gs.arknights.global:8443", "/building/sync")
+	body := req.Body
+	p.HandleReq(req, &goproxy.ProxyCtx{Req: req})
+	if req.Body != body {
+		t.Fatal("The body of an unhooked request should not be read")
+	}
+	req = benchRequest("example.com:443", "/")
+	ctx := &goproxy.ProxyCtx{Req: req}
+	p.HandleReq(req, ctx)
+	if ctx.UserData != nil {
+		t.Fatal("Non game traffic should not be given a request context")
+	}
+}
+
+func TestHookReplacesBody(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	(&RhineModule{name: "test", dispatch: d}).Hook("C/building/sync", 0,
+		func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte { return []byte("{}") })
+	req := benchRequest("gs.arknights.global:8443", "/building/sync")
+	p.HandleReq(req, &goproxy.ProxyCtx{Req: req})
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != "{}" || req.ContentLength != 2 {
+		t.Fatalf("Expected the body to be replaced, got %q (%d)", body, req.ContentLength)
+	}
+}
+
+func TestHookFiltered(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	calls := 0
+	(&RhineModule{name: "test", dispatch: d}).HookFiltered("S/building/sync", 0,
+		HookFilter{Methods: []string{"POST"}, StatusClasses: []int{2}},
+		func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+			calls++
+			return data
+		})
+	for _, test := range []struct {
+		method string
+		status int
+		calls  int
+	}{
+		{"POST", http.StatusOK, 1},
+		{"POST", http.StatusInternalServerError, 1},
+		{"GET", http.StatusOK, 1},
+		{"POST", http.StatusNoContent, 2},
+	} {
+		req := httptest.NewRequest(test.method, "https://gs.arknights.global:8443/building/sync", nil)
+		ctx := &goproxy.ProxyCtx{Req: req, Resp: &http.Response{StatusCode: test.status}}
+		d.run("S/building/sync", []byte("{}"), ctx)
+		if calls != test.calls {
+			t.Fatalf("%s %d: expected %d calls, got %d", test.method, test.status, test.calls, calls)
+		}
+	}
+}
+
+func TestSpilledResponse(t *testing.T) {
+	p := newTestProxy()
+	p.options.SpillThresholdBytes = 16
+	dir, err := ioutil.TempDir("", "rhine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p.options.SpillDir = dir
+	d := p.getUser("1", "GL")
+	var size int64
+	(&RhineModule{name: "test", dispatch: d}).HookSpilled("S/building/sync", 0,
+		func(op string, body *SpilledBody, pktCtx *goproxy.ProxyCtx) { size = body.Size() })
+	req := benchRequest("gs.arknights.global:8443", "/building/sync")
+	ctx := &goproxy.ProxyCtx{Req: req}
+	p.HandleReq(req, ctx)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(benchBody)),
+		ContentLength: int64(len(benchBody)),
+	}
+	ctx.Resp = resp
+	resp = p.HandleResp(resp, ctx)
+	if size != int64(len(benchBody)) {
+		t.Fatalf("Spilled hook saw %d bytes, expected %d", size, len(benchBody))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, benchBody) {
+		t.Fatal("Client should receive the spilled body unchanged")
+	}
+	if files, _ := ioutil.ReadDir(p.options.SpillDir); len(files) != 0 {
+		t.Fatal("Spilled body should be removed once closed")
+	}
+}
+
+func TestMalformedUID(t *testing.T) {
+	p := newTestProxy()
+	req := httptest.NewRequest("POST", "https://gs.arknights.global:8443/account/login",
+		bytes.NewReader([]byte(`{"uid":"abc"}`)))
+	req, resp := p.HandleReq(req, &goproxy.ProxyCtx{Req: req})
+	if resp != nil {
+		t.Fatal("Expected a login with a malformed UID to be passed through")
+	}
+	if p.getUser("abc", "GL") != nil {
+		t.Fatal("Expected no user to be created for a malformed UID")
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		p := newTestProxy()
+		d := p.getUser("1", "GL")
+		d.failClosed = failClosed
+		d.coreHandlers = append(d.coreHandlers, func(op string, data []byte, ctx *goproxy.ProxyCtx) {
+			panic("broken handler")
+		})
+		req := benchRequest("gs.arknights.global:8443", "/quest/battleStart")
+		ctx := &goproxy.ProxyCtx{Req: req}
+		p.HandleReq(req, ctx)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        make(http.Header),
+			Body:          ioutil.NopCloser(bytes.NewReader(benchBody)),
+			ContentLength: int64(len(benchBody)),
+		}
+		ctx.Resp = resp
+		got := p.HandleResp(resp, ctx)
+		if failClosed {
+			if got.StatusCode != http.StatusBadGateway {
+				t.Fatalf("Expected a 502 when failing closed, got %d", got.StatusCode)
+			}
+			continue
+		}
+		body, _ := ioutil.ReadAll(got.Body)
+		if got != resp || !bytes.Equal(body, benchBody) {
+			t.Fatal("Expected the response to be forwarded untouched when failing open")
+		}
+	}
+}
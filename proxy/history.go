@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+// Datasets tracked in the history of each user, see ExportHistory.
+const (
+	HistoryDrops    = "drops"
+	HistoryGacha    = "gacha"
+	HistorySanity   = "sanity"
+	HistoryMissions = "missions"
+)
+
+// HistoryDatasets are the datasets in the order they're exported in.
+var HistoryDatasets = []string{HistoryDrops, HistoryGacha, HistorySanity, HistoryMissions}
+
+// Formats the history is exported in.
+const (
+	ExportCSV  = "csv"
+	ExportXLSX = "xlsx"
+)
+
+// historyPrefix is the key prefix of the history in the store, each user's
+// rows of a day are saved under "history/{dataset}/{region_UID}/{date}".
+const historyPrefix = "history/"
+
+// historyHeaders are the columns of each dataset.
+var historyHeaders = map[string][]string{
+	HistoryDrops:    {"time", "user", "stage", "stars", "item", "count", "kind"},
+	HistoryGacha:    {"time", "user", "pool", "char", "new"},
+	HistorySanity:   {"time", "user", "old", "new", "max", "change"},
+	HistoryMissions: {"time", "user", "mission", "item", "count"},
+}
+
+// historyTopics are the topics of the events recorded in the history.
+var historyTopics = []string{
+	semantic.TopicBattleFinished,
+	semantic.TopicGachaPulled,
+	semantic.TopicSanityChanged,
+	semantic.TopicMissionDone,
+}
+
+// historyRows returns the dataset and rows an event is recorded as. Battles
+// without drops are recorded as a row without an item so that runs can be
+// counted, practice runs and failed battles aren't recorded.
+func historyRows(evt events.Event, t time.Time) (string, [][]string) {
+	prefix := []string{t.UTC().Format(time.RFC3339), fmt.Sprintf("%s_%d", evt.Region, evt.UID)}
+	row := func(values ...string) []string {
+		return append(append([]string(nil), prefix...), values...)
+	}
+	var rows [][]string
+	switch payload := evt.Payload.(type) {
+	case *semantic.BattleFinished:
+		if payload.Practice || !payload.Completed {
+			return "", nil
+		}
+		stars := strconv.Itoa(payload.Stars)
+		for _, drop := range payload.Drops {
+			rows = append(rows, row(payload.StageID, stars, drop.ID, strconv.FormatInt(drop.Count, 10), string(drop.Kind)))
+		}
+		if len(rows) == 0 {
+			rows = append(rows, row(payload.StageID, stars, "", "", ""))
+		}
+		return HistoryDrops, rows
+	case *semantic.GachaPulled:
+		for _, result := range payload.Results {
+			rows = append(rows, row(payload.PoolID, result.CharID, strconv.FormatBool(result.IsNew)))
+		}
+		return HistoryGacha, rows
+	case *semantic.SanityChanged:
+		return HistorySanity, [][]string{row(
+			strconv.FormatInt(payload.Old, 10),
+			strconv.FormatInt(payload.New, 10),
+			strconv.FormatInt(payload.Max, 10),
+			strconv.FormatInt(payload.New-payload.Old, 10),
+		)}
+	case *semantic.MissionDone:
+		for _, reward := range payload.Rewards {
+			rows = append(rows, row(payload.MissionID, reward.ID, strconv.FormatInt(reward.Count, 10)))
+		}
+		if len(rows) == 0 {
+			rows = append(rows, row(payload.MissionID, "", ""))
+		}
+		return HistoryMissions, rows
+	}
+	return "", nil
+}
+
+// appendHistory appends the rows to the user's rows of the day in the dataset.
+func appendHistory(store storage.Store, dataset, rUID string, t time.Time, rows [][]string) error {
+	key := historyPrefix + dataset + "/" + rUID + "/" + t.UTC().Format("2006-01-02")
+	var day [][]string
+	b, err := store.Get(key)
+	if err == nil {
+		err = json.Unmarshal(b, &day)
+	}
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if b, err = json.Marshal(append(day, rows...)); err != nil {
+		return err
+	}
+	return store.Put(key, b)
+}
+
+// LoadHistory returns the rows recorded in a dataset in chronological order,
+// headed by the dataset's columns. user limits the rows to a region_UID's.
+func LoadHistory(store storage.Store, dataset, user string) ([][]string, error) {
+	header, ok := historyHeaders[dataset]
+	if !ok {
+		return nil, fmt.Errorf("unknown dataset %s", dataset)
+	}
+	prefix := historyPrefix + dataset + "/"
+	if user != "" {
+		prefix += user + "/"
+	}
+	keys, err := store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, key := range keys {
+		b, err := store.Get(key)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var day [][]string
+		if err := json.Unmarshal(b, &day); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		rows = append(rows, day...)
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	return append([][]string{header}, rows...), nil
+}
+
+// ExportHistory writes the history of a dataset, or of every dataset if
+// dataset is empty, to w in the format. CSV only holds a single dataset, the
+// datasets of an XLSX workbook are written as sheets. user limits the rows to a
+// region_UID's.
+func ExportHistory(w io.Writer, store storage.Store, format, dataset, user string) error {
+	datasets := HistoryDatasets
+	if dataset != "" {
+		datasets = []string{dataset}
+	}
+	switch format {
+	case ExportCSV:
+		if len(datasets) != 1 {
+			return fmt.Errorf("a dataset is required for %s, one of %s", format, strings.Join(HistoryDatasets, ", "))
+		}
+		rows, err := LoadHistory(store, dataset, user)
+		if err != nil {
+			return err
+		}
+		cw := csv.NewWriter(w)
+		if err := cw.WriteAll(rows); err != nil {
+			return err
+		}
+		return cw.Error()
+	case ExportXLSX:
+		sheets := make([]utils.Sheet, len(datasets))
+		for i, dataset := range datasets {
+			rows, err := LoadHistory(store, dataset, user)
+			if err != nil {
+				return err
+			}
+			sheets[i] = utils.Sheet{Name: dataset, Rows: rows}
+		}
+		return utils.WriteXLSX(w, sheets)
+	}
+	return fmt.Errorf("unknown format %s", format)
+}
+
+// recordHistory records the events of every user's datasets in the store until
+// the proxy is shut down.
+func (p *Proxy) recordHistory() {
+	if p.options.DisableHistory {
+		return
+	}
+	listener := make(chan events.Event, 32)
+	subs := make([]*events.Subscription, len(historyTopics))
+	for i, topic := range historyTopics {
+		subs[i] = p.events.Subscribe(topic, listener)
+	}
+	go func() {
+		defer func() {
+			for _, sub := range subs {
+				sub.Unhook()
+			}
+		}()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case evt := <-listener:
+				now := time.Now()
+				dataset, rows := historyRows(evt, now)
+				if len(rows) == 0 {
+					continue
+				}
+				rUID := fmt.Sprintf("%s_%d", evt.Region, evt.UID)
+				if err := appendHistory(p.store, dataset, rUID, now, rows); err != nil {
+					p.Warnf("Failed to record the %s history of %s: %s", dataset, rUID, err)
+					continue
+				}
+				if pulled, ok := evt.Payload.(*semantic.GachaPulled); ok {
+					p.checkPity(evt.Region, evt.UID, pulled.PoolID, len(rows))
+				}
+			}
+		}
+	}()
+}
+
+// historyContentTypes are the content types of the export formats.
+var historyContentTypes = map[string]string{
+	ExportCSV:  "text/csv",
+	ExportXLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// handleExport serves the history exported with the "format", "dataset" and
+// "user" query parameters, see ExportHistory. The format defaults to CSV.
+func (p *Proxy) handleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format, dataset := query.Get("format"), query.Get("dataset")
+	if format == "" {
+		format = ExportCSV
+	}
+	contentType, ok := historyContentTypes[format]
+	if !ok {
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+		return
+	}
+	if _, ok := historyHeaders[dataset]; !ok && (dataset != "" || format == ExportCSV) {
+		http.Error(w, "unknown dataset "+dataset, http.StatusBadRequest)
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err := ExportHistory(buf, p.store, format, dataset, query.Get("user")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := dataset
+	if name == "" {
+		name = "history"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+format+`"`)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestHistory(t *testing.T) {
+	store := storage.NewMemoryStore()
+	day := time.Date(2020, 5, 1, 23, 0, 0, 0, time.UTC)
+	record := func(uid int, payload interface{}, t time.Time) {
+		dataset, rows := historyRows(events.Event{UID: uid, Region: "GL", Payload: payload}, t)
+		if len(rows) == 0 {
+			return
+		}
+		if err := appendHistory(store, dataset, fmt.Sprintf("GL_%d", uid), t, rows); err != nil {
+			panic(err)
+		}
+	}
+	battle := &semantic.BattleFinished{BattleResult: semantic.BattleResult{
+		StageID: "main_01-07", Completed: true, Stars: 3,
+		Drops: []semantic.Drop{{ID: "30012", Count: 2, Kind: semantic.DropNormal}},
+	}}
+	record(1, battle, day.Add(2*time.Hour))
+	record(2, &semantic.BattleFinished{BattleResult: semantic.BattleResult{StageID: "main_00-01", Completed: true, Stars: 2}}, day)
+	record(1, &semantic.BattleFinished{BattleResult: semantic.BattleResult{StageID: "main_00-01"}}, day)
+	record(1, &semantic.SanityChanged{Old: 30, New: 24, Max: 100}, day)
+	record(1, &semantic.GachaPulled{PoolID: "NORM_1", Results: []semantic.GachaResult{{CharID: "char_002_amiya", IsNew: true}}}, day)
+
+	rows, err := LoadHistory(store, HistoryDrops, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		historyHeaders[HistoryDrops],
+		{"2020-05-01T23:00:00Z", "GL_2", "main_00-01", "2", "", "", ""},
+		{"2020-05-02T01:00:00Z", "GL_1", "main_01-07", "3", "30012", "2", "NORMAL_DROP"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("Expected %v, got %v", expected, rows)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ExportHistory(buf, store, ExportCSV, HistorySanity, "GL_1"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][5] != "-6" {
+		t.Fatalf("Unexpected sanity history %v", rows)
+	}
+	if err := ExportHistory(buf, store, ExportCSV, "", ""); err == nil {
+		t.Fatal("Expected CSV export without a dataset to fail")
+	}
+
+	p := newTestProxy()
+	p.store = store
+	for _, test := range []struct {
+		target string
+		status int
+		ctype  string
+	}{
+		{"/export?dataset=gacha", 200, "text/csv"},
+		{"/export?format=xlsx", 200, historyContentTypes[ExportXLSX]},
+		{"/export", 400, ""},
+		{"/export?format=pdf&dataset=gacha", 400, ""},
+	} {
+		w := httptest.NewRecorder()
+		p.handleExport(w, httptest.NewRequest("GET", test.target, nil))
+		if w.Code != test.status || (test.ctype != "" && w.Header().Get("Content-Type") != test.ctype) {
+			t.Fatalf("%s: unexpected response %d %s", test.target, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/proxy/filters"
+)
+
+// hostFilter blocks requests to hosts matching the common filters and the
+// filter sets of the regions whose game traffic has been observed. If a custom
+// filter is specified, it is used as is regardless of the regions observed.
+type hostFilter struct {
+	mutex     sync.RWMutex
+	custom    bool
+	regexp    *regexp.Regexp
+	regions   []string
+	overrides map[string][]string
+	log.Logger
+}
+
+// newHostFilter returns the host filter, failing if a filter set of overrides
+// isn't valid, which is checked upfront rather than once its region is
+// observed.
+func newHostFilter(custom *regexp.Regexp, overrides map[string][]string, logger log.Logger) (*hostFilter, error) {
+	f := &hostFilter{overrides: overrides, Logger: logger}
+	if custom != nil {
+		f.custom = true
+		f.regexp = custom
+		return f, nil
+	}
+	regions := make([]string, 0, len(overrides))
+	for region := range overrides {
+		regions = append(regions, region)
+	}
+	if _, err := filters.GenerateRegionFilter(regions, overrides); err != nil {
+		return nil, err
+	}
+	var err error
+	f.regexp, err = filters.GenerateRegionFilter(nil, overrides)
+	return f, err
+}
+
+// match checks if requests to the host should be blocked.
+func (f *hostFilter) match(host string) bool {
+	if f == nil {
+		return false
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.regexp != nil && f.regexp.MatchString(host)
+}
+
+// observe enables the filter set for the region if it hasn't been enabled yet.
+func (f *hostFilter) observe(region string) {
+	if f == nil || f.custom || region == "" {
+		return
+	}
+	f.mutex.RLock()
+	for _, r := range f.regions {
+		if r == region {
+			f.mutex.RUnlock()
+			return
+		}
+	}
+	f.mutex.RUnlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, r := range f.regions {
+		if r == region {
+			return
+		}
+	}
+	filter, err := filters.GenerateRegionFilter(append([]string{region}, f.regions...), f.overrides)
+	if err != nil {
+		f.Warnf("Failed to enable host filter set for %s: %s", region, err)
+		return
+	}
+	f.regions = append(f.regions, region)
+	f.regexp = filter
+	f.Printf("Enabled host filter set for %s", region)
+}
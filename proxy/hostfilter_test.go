@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+func TestHostFilterOverrides(t *testing.T) {
+	logger := log.New(false, false, "/dev/null", 0)
+	if _, err := newHostFilter(nil, map[string][]string{"GL": {`ads\.example\.com`, `(`}}, logger); err == nil {
+		t.Fatal("Expected an invalid filter set to be rejected")
+	}
+	f, err := newHostFilter(nil, map[string][]string{"GL": {`ads\.example\.com`}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.match("ads.example.com") {
+		t.Fatal("Expected the region's filter set to be disabled until its traffic is observed")
+	}
+	f.observe("GL")
+	if !f.match("ads.example.com") || f.match("app-measurement.com") {
+		t.Fatal("Expected the override to replace the region's default filter set")
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+// logTailBuffer is the number of lines buffered for each /logs client, lines
+// are dropped for clients which fall further behind.
+const logTailBuffer = 256
+
+// logLevels ranks the levels of log entries for the "level" filter of /logs.
+var logLevels = map[string]int{"VERB": 0, "INFO": 1, "WARN": 2}
+
+// logTailFilter selects the log entries streamed to a /logs client.
+type logTailFilter struct {
+	level   int
+	modules []string
+}
+
+func parseLogTailFilter(r *http.Request) (*logTailFilter, error) {
+	f := &logTailFilter{modules: r.URL.Query()["module"]}
+	switch level := r.URL.Query().Get("level"); level {
+	case "", "verbose":
+	case "info":
+		f.level = logLevels["INFO"]
+	case "warn":
+		f.level = logLevels["WARN"]
+	default:
+		return nil, fmt.Errorf("unknown level %q", level)
+	}
+	return f, nil
+}
+
+func (f *logTailFilter) match(e *log.Entry) bool {
+	if logLevels[e.Level] < f.level {
+		return false
+	}
+	if len(f.modules) == 0 {
+		return true
+	}
+	module := e.Module
+	if module == "" {
+		module = "proxy"
+	}
+	return containsString(f.modules, module)
+}
+
+// handleLogs streams the lines logged by the proxy and its modules as Server
+// Sent Events, each a JSON log.Entry, until the client disconnects. "level" is
+// the minimum level streamed, one of "verbose", "info" or "warn", and "module"
+// may be repeated to only stream the lines of the modules, "proxy" being the
+// proxy's own lines. Verbose lines are only logged if Options.Verbose is set.
+// Only operators may follow the log, as it contains the users' account data.
+func (p *Proxy) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if AdminRole(r) != RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	logger, ok := p.Logger.(*log.Log)
+	flusher, canFlush := w.(http.Flusher)
+	if !ok || !canFlush {
+		http.Error(w, "log streaming is not supported", http.StatusNotImplemented)
+		return
+	}
+	filter, err := parseLogTailFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := make(chan log.Entry, logTailBuffer)
+	unsubscribe := logger.Subscribe(func(e *log.Entry) {
+		if !filter.match(e) {
+			return
+		}
+		select {
+		case entries <- *e:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case e := <-entries:
+			b, _ := json.Marshal(&e)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-p.stop:
+			return
+		}
+	}
+}
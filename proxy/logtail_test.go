@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+func TestLogTail(t *testing.T) {
+	p := newTestProxy()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.handleLogs(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, RoleOperator)))
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/logs?level=info&module=droplogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type %q", ct)
+	}
+
+	mod := p.Logger.(*log.Log).WithModule("droplogger")
+	p.Printf("filtered out by module")
+	mod.Verbosef("filtered out by level")
+	mod.Warnf("dropped %d", 3)
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &log.Entry{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Level != "WARN" || e.Module != "droplogger" || e.Message != "dropped 3" {
+		t.Fatalf("Unexpected entry %+v", e)
+	}
+
+	w := httptest.NewRecorder()
+	p.handleLogs(w, httptest.NewRequest("GET", "/logs", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected viewers to be forbidden, got %d", w.Code)
+	}
+}
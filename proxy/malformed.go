@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/json"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+var malformedPackets = metrics.NewCounter("rhine_malformed_packets_total",
+	"Number of game packets whose body isn't valid JSON, e.g., truncated responses.")
+
+// parseError returns the syntax error of a body which isn't valid JSON, nil if
+// it's valid or empty.
+func parseError(data []byte) error {
+	if len(data) == 0 || json.Valid(data) {
+		return nil
+	}
+	var raw json.RawMessage
+	return json.Unmarshal(data, &raw)
+}
+
+// ParseError returns the error parsing the body of the packet being
+// dispatched if it isn't valid JSON, see HookFilter.Malformed.
+func ParseError(ctx *goproxy.ProxyCtx) error {
+	if ctx == nil {
+		return nil
+	}
+	if reqCtx, ok := ctx.UserData.(*RequestContext); ok {
+		return reqCtx.parseError
+	}
+	return nil
+}
+
+// runMalformed dispatches a packet whose body isn't valid JSON to the hooks
+// which opted in with HookFilter.Malformed, skipping the core handlers and
+// the other hooks, which expect JSON.
+func (d *dispatch) runMalformed(op string, data []byte, err error, ctx *goproxy.ProxyCtx) ([]byte, error) {
+	malformedPackets.Inc()
+	d.Warnf("%s isn't valid JSON (%s), only dispatching it to the hooks of malformed packets", op, err)
+	if ctx != nil {
+		if reqCtx, ok := ctx.UserData.(*RequestContext); ok {
+			reqCtx.parseError = err
+			defer func() { reqCtx.parseError = nil }()
+		}
+	}
+	for _, target := range []string{"*", op} {
+		for _, hook := range d.hooksOf(d.hooks, target) {
+			if hook.filter != nil && hook.filter.Malformed {
+				if data, err = d.hookWrapper(hook, op, data, ctx); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return data, nil
+}
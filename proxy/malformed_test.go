@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestMalformedPacket(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	mod := &RhineModule{name: "test", dispatch: d}
+	mod.Hook("S/quest/battleFinish", 0, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+		t.Fatal("Expected malformed packets to skip hooks which didn't opt in")
+		return data
+	})
+	var received string
+	var parseErr error
+	mod.HookFiltered("S/quest/battleFinish", 0, HookFilter{Malformed: true},
+		func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+			received, parseErr = string(data), ParseError(pktCtx)
+			return data
+		})
+	before := malformedPackets.Value()
+	ctx := &goproxy.ProxyCtx{UserData: &RequestContext{}}
+	d.run("S/quest/battleFinish", []byte(`{"playerDataDelta":{"modi`), ctx)
+	if received != `{"playerDataDelta":{"modi` || parseErr == nil {
+		t.Fatalf("Expected the raw body with a parse error, got %q, %v", received, parseErr)
+	}
+	if ParseError(ctx) != nil {
+		t.Fatal("Expected the parse error to be cleared after dispatch")
+	}
+	if malformedPackets.Value() != before+1 {
+		t.Fatal("Expected the malformed packet to be counted")
+	}
+}
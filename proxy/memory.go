@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+const (
+	memoryCheckInterval   = 2 * time.Second
+	defaultLargeBodyBytes = 1 << 20
+)
+
+var (
+	memoryDegraded = metrics.NewGauge("rhine_memory_degraded",
+		"1 while the heap exceeds the memory limit and the proxy is degraded.")
+	tunnelledBodies = metrics.NewCounter("rhine_tunnelled_bodies_total",
+		"Number of bodies passed through without dispatch because of the memory limit.")
+)
+
+// memoryGuard samples the size of the heap and degrades the proxy while it
+// exceeds the limit: large bodies are tunnelled instead of being buffered for
+// dispatch and caches are dropped. The proxy recovers once the heap falls below
+// 90% of the limit.
+type memoryGuard struct {
+	limit     uint64
+	largeBody int64
+	over      int32
+	mutex     sync.Mutex
+	shrinkers []func()
+	stop      chan struct{}
+	stopOnce  sync.Once
+	log.Logger
+}
+
+// newMemoryGuard returns nil if limitMB is not positive.
+func newMemoryGuard(limitMB int, largeBody int64, logger log.Logger) *memoryGuard {
+	if limitMB <= 0 {
+		return nil
+	}
+	if largeBody <= 0 {
+		largeBody = defaultLargeBodyBytes
+	}
+	return &memoryGuard{
+		limit:     uint64(limitMB) << 20,
+		largeBody: largeBody,
+		stop:      make(chan struct{}),
+		Logger:    logger,
+	}
+}
+
+// onPressure registers a function which frees memory, called when the limit is
+// exceeded.
+func (g *memoryGuard) onPressure(fn func()) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	g.shrinkers = append(g.shrinkers, fn)
+	g.mutex.Unlock()
+}
+
+// tunnel reports whether a body of the given length, -1 if unknown, should be
+// passed through without being buffered.
+func (g *memoryGuard) tunnel(contentLength int64) bool {
+	if g == nil || atomic.LoadInt32(&g.over) == 0 {
+		return false
+	}
+	if contentLength >= 0 && contentLength <= g.largeBody {
+		return false
+	}
+	tunnelledBodies.Inc()
+	return true
+}
+
+func (g *memoryGuard) run() {
+	if g == nil {
+		return
+	}
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	var stats runtime.MemStats
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+		runtime.ReadMemStats(&stats)
+		over := atomic.LoadInt32(&g.over) == 1
+		switch {
+		case !over && stats.HeapAlloc > g.limit:
+			atomic.StoreInt32(&g.over, 1)
+			memoryDegraded.Set(1)
+			g.Warnf("Heap usage of %dMB exceeds the memory limit of %dMB, tunnelling bodies over %d bytes "+
+				"without dispatching them and dropping caches until usage falls", stats.HeapAlloc>>20, g.limit>>20, g.largeBody)
+			g.shrink()
+		case over && stats.HeapAlloc < g.limit/10*9:
+			atomic.StoreInt32(&g.over, 0)
+			memoryDegraded.Set(0)
+			g.Printf("Heap usage of %dMB is back under the memory limit, dispatching all bodies again", stats.HeapAlloc>>20)
+		}
+	}
+}
+
+func (g *memoryGuard) shrink() {
+	g.mutex.Lock()
+	shrinkers := g.shrinkers
+	g.mutex.Unlock()
+	for _, fn := range shrinkers {
+		fn()
+	}
+	debug.FreeOSMemory()
+}
+
+func (g *memoryGuard) close() {
+	if g == nil {
+		return
+	}
+	g.stopOnce.Do(func() { close(g.stop) })
+}
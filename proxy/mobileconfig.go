@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/kyoukaya/rhine/utils"
+
+	"github.com/elazarl/goproxy"
+)
+
+const mobileConfigIdentifier = "com.github.kyoukaya.rhine"
+
+// plistDict is a plist dictionary whose keys keep their order.
+type plistDict []plistEntry
+
+type plistEntry struct {
+	key   string
+	value interface{}
+}
+
+// writePlist writes v as plist XML, v being a string, int, bool, []byte,
+// plistDict or []plistDict.
+func writePlist(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString("<string>")
+		_ = xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buf, "<integer>%d</integer>", v)
+	case bool:
+		fmt.Fprintf(buf, "<%t/>", v)
+	case []byte:
+		fmt.Fprintf(buf, "<data>%s</data>", base64.StdEncoding.EncodeToString(v))
+	case plistDict:
+		buf.WriteString("<dict>")
+		for _, entry := range v {
+			buf.WriteString("<key>")
+			_ = xml.EscapeText(buf, []byte(entry.key))
+			buf.WriteString("</key>")
+			writePlist(buf, entry.value)
+		}
+		buf.WriteString("</dict>")
+	case []plistDict:
+		buf.WriteString("<array>")
+		for _, dict := range v {
+			writePlist(buf, dict)
+		}
+		buf.WriteString("</array>")
+	}
+}
+
+// payloadUUID derives a UUID from the CA and name, so that installing a newer
+// profile for the same CA replaces the old one.
+func payloadUUID(caDER []byte, name string) string {
+	sum := sha256.Sum256(append(append([]byte{}, caDER...), name...))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// proxyHostPort returns the host and port devices should configure to reach
+// the proxy, host defaulting to the machine's outbound IPv4 address if the
+// proxy listens on every address.
+func (p *Proxy) proxyHostPort(host string) (string, int, error) {
+	listenHost, listenPort, err := net.SplitHostPort(p.options.Address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(listenPort)
+	if err != nil {
+		return "", 0, err
+	}
+	if host != "" {
+		return host, port, nil
+	}
+	if ip := net.ParseIP(listenHost); listenHost != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenHost, port, nil
+	}
+	if host = utils.GetOutboundIP(); host == "" {
+		return "", 0, errors.New("no outbound address, specify the proxy's host")
+	}
+	return host, port, nil
+}
+
+// MobileConfig returns an unsigned iOS configuration profile installing Rhine's
+// CA. If ssid is set, the profile also configures the Wi-Fi network to use the
+// proxy at host, which defaults to the machine's outbound address. The Wi-Fi
+// payload needs the network's password as iOS replaces the network's settings.
+func (p *Proxy) MobileConfig(ssid, password, host string) ([]byte, error) {
+	return p.mobileConfig(&goproxy.GoproxyCa, ssid, password, host)
+}
+
+// mobileConfig is MobileConfig installing ca.
+func (p *Proxy) mobileConfig(ca *tls.Certificate, ssid, password, host string) ([]byte, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("CA not loaded")
+	}
+	caDER := ca.Certificate[0]
+	payloads := []plistDict{{
+		{"PayloadType", "com.apple.security.root"},
+		{"PayloadVersion", 1},
+		{"PayloadIdentifier", mobileConfigIdentifier + ".ca"},
+		{"PayloadUUID", payloadUUID(caDER, "ca")},
+		{"PayloadDisplayName", "Rhine CA"},
+		{"PayloadCertificateFileName", "cert.cer"},
+		{"PayloadContent", caDER},
+	}}
+	if ssid != "" {
+		proxyHost, proxyPort, err := p.proxyHostPort(host)
+		if err != nil {
+			return nil, err
+		}
+		encryption := "None"
+		if password != "" {
+			encryption = "Any"
+		}
+		wifi := plistDict{
+			{"PayloadType", "com.apple.wifi.managed"},
+			{"PayloadVersion", 1},
+			{"PayloadIdentifier", mobileConfigIdentifier + ".wifi"},
+			{"PayloadUUID", payloadUUID(caDER, "wifi/"+ssid)},
+			{"PayloadDisplayName", "Rhine proxy on " + ssid},
+			{"SSID_STR", ssid},
+			{"AutoJoin", true},
+			{"EncryptionType", encryption},
+			{"ProxyType", "Manual"},
+			{"ProxyServer", proxyHost},
+			{"ProxyServerPort", proxyPort},
+		}
+		if password != "" {
+			wifi = append(wifi, plistEntry{"Password", password})
+		}
+		payloads = append(payloads, wifi)
+	}
+	profile := plistDict{
+		{"PayloadType", "Configuration"},
+		{"PayloadVersion", 1},
+		{"PayloadIdentifier", mobileConfigIdentifier},
+		{"PayloadUUID", payloadUUID(caDER, "profile/"+ssid)},
+		{"PayloadDisplayName", "Rhine"},
+		{"PayloadDescription", "Installs Rhine's CA so that it can read the game's HTTPS traffic. " +
+			"Enable full trust for it in Settings > General > About > Certificate Trust Settings."},
+		{"PayloadOrganization", "Rhine Labs"},
+		{"PayloadRemovalDisallowed", false},
+		{"PayloadContent", payloads},
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	buf.WriteString(`<plist version="1.0">`)
+	writePlist(buf, profile)
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+// handleMobileConfig serves the configuration profile returned by MobileConfig
+// for the "ssid", "password" and "host" query parameters. Opening
+// /ca.mobileconfig?token=... in Safari prompts to install the profile, which
+// installs the device CA of the device if it has one, like /ca.
+func (p *Proxy) handleMobileConfig(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ca, ok := p.caFor(r)
+	if !ok {
+		http.Error(w, "unknown CA", http.StatusNotFound)
+		return
+	}
+	profile, err := p.mobileConfig(ca, query.Get("ssid"), query.Get("password"), query.Get("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+	w.Header().Set("Content-Disposition", `attachment; filename="rhine.mobileconfig"`)
+	_, _ = w.Write(profile)
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestMobileConfig(t *testing.T) {
+	p := newTestProxy()
+	p.options.Address = "192.168.1.2:8080"
+	profile, err := p.MobileConfig("Home & Away", "hunter2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Collect the text of every element to check that the profile is well
+	// formed and escaped.
+	var text []string
+	decoder := xml.NewDecoder(bytes.NewReader(profile))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Malformed profile: %s", err)
+		}
+		if data, ok := token.(xml.CharData); ok {
+			text = append(text, string(data))
+		}
+	}
+	joined := strings.Join(text, "\n")
+	for _, want := range []string{
+		base64.StdEncoding.EncodeToString(goproxy.GoproxyCa.Certificate[0]),
+		"Home & Away", "192.168.1.2", "8080", "hunter2", "com.apple.security.root",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Profile is missing %q", want)
+		}
+	}
+
+	again, err := p.MobileConfig("Home & Away", "hunter2", "")
+	if err != nil || !bytes.Equal(profile, again) {
+		t.Fatalf("Expected profiles to be reproducible (%v)", err)
+	}
+	caOnly, err := p.MobileConfig("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(caOnly, []byte("com.apple.wifi.managed")) {
+		t.Fatal("Expected no Wi-Fi payload without an SSID")
+	}
+}
@@ -1,8 +1,19 @@
 package proxy
 
 import (
+	"net/http"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/outbound"
+	"github.com/kyoukaya/rhine/outbox"
 	"github.com/kyoukaya/rhine/proxy/gamestate"
 	"github.com/kyoukaya/rhine/proxy/gamestate/statestruct"
+	"github.com/kyoukaya/rhine/scheduler"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+	"github.com/kyoukaya/rhine/utils/servertime"
 )
 
 // RhineModule provides modules with an interface to Rhine, allowing them to
@@ -10,18 +21,30 @@ import (
 type RhineModule struct {
 	Region string
 	UID    int
+	// Key identifies the user in what's persisted for them, "<Region>_<UID>"
+	// unless the embedder keys users otherwise, see Options.UserKey.
+	Key string
 
 	name        string
 	initialized bool
 	shutdownCB  ShutdownCb
 	hooks       []*PacketHook
-	gameState   *gamestate.GameState
+	// hookers are unhooked when the module is shut down.
+	hookers   []Hooker
+	scheduler *scheduler.Scheduler
+	outbox    *outbox.Outbox
+	gameState *gamestate.GameState
+	// Logger attributes the module's lines to it when the proxy's logger is a
+	// log.Log, see the /logs endpoint.
+	log.Logger
 	*dispatch
 }
 
 type initFunc struct {
-	name string
-	fun  ModuleInitFunc
+	name       string
+	fun        ModuleInitFunc
+	optional   bool
+	apiVersion int
 }
 
 var (
@@ -45,12 +68,45 @@ type Hooker interface {
 // Hook registers a new packet hook whose PacketHandler will be called back when
 // the specified target packet is received by Rhine. A Hooker is returned, allowing
 // the caller to Unhook the hook to stop receiving callbacks.
+// The hooks of "*" run before those of the packet's op, each in descending
+// order of priority and hooks of equal priority in the order they were
+// registered. Every hook receives the body returned by the previous one, the
+// body returned by the last being forwarded in place of the packet's.
 // The current implementation sorts the hooks to maintain priority ordering,
 // while this isn't the most efficient, especially after the initial hooking is done
 // when all the modules are initialized, doing a binary search and bisecting would
 // result in a lot of expensive copying anyway.
 func (m *RhineModule) Hook(target string, priority int, handler PacketHandler) Hooker {
-	hook := &PacketHook{target, priority, handler, m}
+	hook := &PacketHook{target: target, priority: priority, handler: handler, mod: m}
+	m.hooks = append(m.hooks, hook)
+	m.dispatch.insertHook(hook)
+	return hook
+}
+
+// HookFiltered registers a hook like Hook which only receives the packets
+// matching filter, e.g., the successful responses of POST requests with
+// HookFilter{Methods: []string{"POST"}, StatusClasses: []int{2}}.
+func (m *RhineModule) HookFiltered(target string, priority int, filter HookFilter, handler PacketHandler) Hooker {
+	hook := &PacketHook{target: target, priority: priority, handler: handler, filter: &filter, mod: m}
+	m.hooks = append(m.hooks, hook)
+	m.dispatch.insertHook(hook)
+	return hook
+}
+
+// HookModifier registers a hook like Hook whose handler may drop the packet
+// by returning an error, e.g., to keep a request from reaching the server.
+func (m *RhineModule) HookModifier(target string, priority int, modifier PacketModifier) Hooker {
+	hook := &PacketHook{target: target, priority: priority, modifier: modifier, mod: m}
+	m.hooks = append(m.hooks, hook)
+	m.dispatch.insertHook(hook)
+	return hook
+}
+
+// HookSpilled registers a hook for responses spilled to disk because they are
+// larger than Options.SpillThresholdBytes, which regular hooks don't receive.
+// The target and priority behave as they do in Hook.
+func (m *RhineModule) HookSpilled(target string, priority int, handler SpilledHandler) Hooker {
+	hook := &PacketHook{target: target, priority: priority, spilled: handler, mod: m}
 	m.hooks = append(m.hooks, hook)
 	m.dispatch.insertHook(hook)
 	return hook
@@ -60,17 +116,82 @@ func (m *RhineModule) Hook(target string, priority int, handler PacketHandler) H
 // when the specified game state has been modified. The StateEvent passed through
 // the chan will exclude the new state at the path if the event bool is set to true.
 func (m *RhineModule) StateHook(target string, listener chan gamestate.StateEvent, event bool) Hooker {
-	return m.gameState.Hook(target, m.name, listener, event)
+	hook := m.gameState.Hook(target, m.name, listener, event)
+	m.hookers = append(m.hookers, hook)
+	return hook
 }
 
 // OnShutdown registers a void function which accepts a boolean argument to be called
 // back the program is killed with SIGINT or when an Arknights user reconnects.
 // The boolean argument will be set to true if the callback is initiated because
-// of a SIGINT event, and false if it's a user reconnecting.
+// of a SIGINT event or a user reconnecting, and false if it's the module being
+// disabled or reloaded for the user, see Proxy.DisableModule.
 func (m *RhineModule) OnShutdown(cb ShutdownCb) {
 	m.shutdownCB = cb
 }
 
+// HTTPClient returns a client for the module's requests to external services,
+// e.g., uploaders and webhooks. Its requests are delayed to keep within the
+// budget of their host, shared by the modules of every user, so that they
+// don't all hit a service after the same login sync, see Options.Outbound.
+// Official modules must use it.
+func (m *RhineModule) HTTPClient(timeout time.Duration) *http.Client {
+	return outbound.Default.Client(timeout)
+}
+
+// GameData returns a handle to the gamedata of the module's region. The handle
+// is closed automatically when the module is shut down.
+func (m *RhineModule) GameData() (*gamedata.GameData, error) {
+	gd, err := gamedata.New(m.Region, m.Logger)
+	if err != nil {
+		return nil, err
+	}
+	m.hookers = append(m.hookers, closerHook{gd.Close})
+	return gd, nil
+}
+
+// Store returns a storage.Store namespaced to the module and its user's Key,
+// for persisting data across restarts.
+func (m *RhineModule) Store() storage.Store {
+	return storage.Prefixed(m.dispatch.store, "modules/"+m.name+"/"+m.Key+"/")
+}
+
+// Scheduler returns the module's job scheduler. Jobs are persisted across
+// restarts and cron expressions are evaluated in the server time of the
+// module's region. The scheduler is stopped when the module is shut down.
+func (m *RhineModule) Scheduler() *scheduler.Scheduler {
+	if m.scheduler == nil {
+		loc, err := servertime.Location(m.Region)
+		if err != nil {
+			loc = nil
+		}
+		prefix := "schedules/" + m.Key + "/" + m.name + "/"
+		m.scheduler = scheduler.New(m.dispatch.store, prefix, loc, m.Logger)
+		m.hookers = append(m.hookers, m.scheduler)
+	}
+	return m.scheduler
+}
+
+// Outbox returns the module's durable outbox, whose messages are persisted
+// until they are delivered and retried with a backoff while the network or
+// their destination is down. Messages enqueued with EnqueueHTTP are sent with
+// HTTPClient, the handlers of others must be registered with Handle on each
+// login. Messages left undelivered when the module is shut down are retried
+// the next time it's loaded for the user.
+func (m *RhineModule) Outbox() *outbox.Outbox {
+	if m.outbox == nil {
+		prefix := "outbox/" + m.name + "/" + m.Key + "/"
+		m.outbox = outbox.New(m.dispatch.store, prefix, m.HTTPClient(30*time.Second), m.Logger)
+		m.hookers = append(m.hookers, m.outbox)
+	}
+	return m.outbox
+}
+
+// closerHook adapts a close function into a Hooker.
+type closerHook struct{ close func() }
+
+func (c closerHook) Unhook() { c.close() }
+
 // GetGameState will block until the gamestate module finishes parsing S/account/syncData.
 func (m *RhineModule) GetGameState() *statestruct.User {
 	return m.gameState.GetStateRef()
@@ -82,3 +203,60 @@ func (m *RhineModule) GetGameState() *statestruct.User {
 func (m *RhineModule) StateGet(path string) (interface{}, error) {
 	return m.gameState.Get(path)
 }
+
+// Sanity returns the user's current sanity, their sanity cap and the time at
+// which the cap is or was reached, see gamestate.GameState.Sanity.
+func (m *RhineModule) Sanity() (current, max int64, fullAt time.Time, err error) {
+	return m.gameState.Sanity()
+}
+
+// Subscribe attaches the listener to an events topic, see the semantic
+// package for the topics of the domain events published by Rhine. Only events
+// which belong to the module's user, or which don't belong to any user and are
+// either for the module's region or not for any region, will be delivered.
+// Subscriptions are unhooked automatically when the module is shut down.
+func (m *RhineModule) Subscribe(topic string, listener chan events.Event) Hooker {
+	sub := m.dispatch.events.SubscribeFilter(topic, listener, func(evt events.Event) bool {
+		if evt.UID == 0 {
+			return evt.Region == "" || evt.Region == m.Region
+		}
+		return evt.UID == m.UID && evt.Region == m.Region
+	})
+	m.hookers = append(m.hookers, sub)
+	return sub
+}
+
+// subscribeConn attaches the listener to a connection lifecycle topic, only
+// delivering the events of connections from the device the module's user
+// logged in from, none if the device is unknown.
+func (m *RhineModule) subscribeConn(topic string, listener chan events.Event) Hooker {
+	sub := m.dispatch.events.SubscribeFilter(topic, listener, func(evt events.Event) bool {
+		client := m.dispatch.clientInfo()
+		return client != nil && clientIP(connRemoteAddr(evt.Payload)) == client.IP
+	})
+	m.hookers = append(m.hookers, sub)
+	return sub
+}
+
+// Publish publishes an event with the payload on the topic on behalf of the
+// module's user.
+func (m *RhineModule) Publish(topic string, payload interface{}) {
+	m.dispatch.events.Publish(events.Event{
+		Topic:   topic,
+		UID:     m.UID,
+		Region:  m.Region,
+		Payload: payload,
+	})
+}
+
+// shutdown calls the module's shutdown callback, if any, and unhooks the
+// module's event subscriptions and state hooks.
+func (m *RhineModule) shutdown(shuttingDown bool) {
+	if m.shutdownCB != nil {
+		m.shutdownCB(shuttingDown)
+	}
+	for _, hooker := range m.hookers {
+		hooker.Unhook()
+	}
+	m.hookers = nil
+}
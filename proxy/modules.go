@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	errUserNotFound   = errors.New("user not found")
+	errModuleNotFound = errors.New("module not registered")
+)
+
+// ModuleStatus is the status of a registered module for a user.
+type ModuleStatus struct {
+	Name string `json:"name"`
+	// Optional modules are only loaded at login if listed in Options.Modules.
+	Optional bool `json:"optional"`
+	// Enabled is set if the module is loaded when the user logs in, see
+	// Options.Modules and Options.SafeMode.
+	Enabled bool `json:"enabled"`
+	// Loaded is set if the module is running for the user, which differs from
+	// Enabled once the module was toggled with EnableModule or DisableModule.
+	Loaded bool `json:"loaded"`
+}
+
+// Modules returns the status of the registered modules for the user, e.g.,
+// "GL_1234", in the order they were registered.
+func (p *Proxy) Modules(rUID string) ([]ModuleStatus, error) {
+	d := p.findDispatch(rUID)
+	if d == nil {
+		return nil, errUserNotFound
+	}
+	enabled := p.enabledModules()
+	ret := make([]ModuleStatus, 0, len(modules))
+	for _, mod := range modules {
+		status := ModuleStatus{Name: mod.name, Optional: mod.optional, Loaded: d.module(mod.name) != nil}
+		for _, e := range enabled {
+			status.Enabled = status.Enabled || e.name == mod.name
+		}
+		ret = append(ret, status)
+	}
+	return ret, nil
+}
+
+// EnableModule loads a registered module for the user, e.g., "GL_1234", until
+// they reconnect, even if it isn't enabled in the options. The module is
+// initialized as it would be at login, registering its hooks.
+func (p *Proxy) EnableModule(rUID, name string) error {
+	d := p.findDispatch(rUID)
+	if d == nil {
+		return errUserNotFound
+	}
+	mod, ok := registeredModule(name)
+	if !ok {
+		return errModuleNotFound
+	}
+	return d.enableModule(mod)
+}
+
+// DisableModule shuts a module down for the user, e.g., "GL_1234", until they
+// reconnect, calling its shutdown callback and unhooking its hooks.
+func (p *Proxy) DisableModule(rUID, name string) error {
+	d := p.findDispatch(rUID)
+	if d == nil {
+		return errUserNotFound
+	}
+	if _, ok := registeredModule(name); !ok {
+		return errModuleNotFound
+	}
+	return d.disableModule(name)
+}
+
+// ReloadModule shuts a module down for the user, e.g., "GL_1234", and
+// initializes it again, e.g., to pick up a change of its configuration,
+// without the user having to reconnect.
+func (p *Proxy) ReloadModule(rUID, name string) error {
+	if err := p.DisableModule(rUID, name); err != nil {
+		return err
+	}
+	return p.EnableModule(rUID, name)
+}
+
+func (p *Proxy) findDispatch(rUID string) *dispatch {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.dispatches[rUID]
+}
+
+func registeredModule(name string) (initFunc, bool) {
+	for _, mod := range modules {
+		if mod.name == name {
+			return mod, true
+		}
+	}
+	return initFunc{}, false
+}
+
+// module returns the user's module with the name, nil if it isn't loaded.
+func (d *dispatch) module(name string) *RhineModule {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, mod := range d.modules {
+		if mod.name == name {
+			return mod
+		}
+	}
+	return nil
+}
+
+func (d *dispatch) enableModule(mod initFunc) error {
+	if d.module(mod.name) != nil {
+		return fmt.Errorf("%s is already loaded", mod.name)
+	}
+	newMod, err := d.loadModule(mod)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.modules = append(d.modules, newMod)
+	d.mutex.Unlock()
+	return nil
+}
+
+// disableModule unhooks the module's packet hooks, so that it doesn't receive
+// any packet after its shutdown callback is called, and shuts it down.
+func (d *dispatch) disableModule(name string) error {
+	d.mutex.Lock()
+	var mod *RhineModule
+	for i, m := range d.modules {
+		if m.name == name {
+			mod = m
+			d.modules = append(d.modules[:i:i], d.modules[i+1:]...)
+			break
+		}
+	}
+	d.mutex.Unlock()
+	if mod == nil {
+		return fmt.Errorf("%s is not loaded", name)
+	}
+	for _, hook := range mod.hooks {
+		d.removeHook(hook)
+	}
+	if failed := shutdownModules([]*RhineModule{mod}, false, d.moduleTimeout, d.Logger); len(failed) > 0 {
+		d.Warnf("%s_%d: %s failed to shut down cleanly", d.region, d.uid, name)
+	}
+	d.Printf("%s unloaded.", name)
+	return nil
+}
+
+// handleModules lists the status of the registered modules for the user in
+// the "user" query parameter on GET. Operators may enable the module in the
+// "module" query parameter on PUT, disable it on DELETE and reload it on POST.
+func (p *Proxy) handleModules(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	rUID, name := query.Get("user"), query.Get("module")
+	var err error
+	switch r.Method {
+	case "GET":
+		var statuses []ModuleStatus
+		if statuses, err = p.Modules(rUID); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(statuses)
+			return
+		}
+	case "PUT":
+		err = p.EnableModule(rUID, name)
+	case "DELETE":
+		err = p.DisableModule(rUID, name)
+	case "POST":
+		err = p.ReloadModule(rUID, name)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errUserNotFound, errModuleNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
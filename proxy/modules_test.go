@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestModuleToggle(t *testing.T) {
+	registered := modules
+	defer func() { modules = registered }()
+	var loaded, received, shutdowns int
+	modules = []initFunc{{name: "A", optional: true, fun: func(mod *RhineModule) {
+		loaded++
+		mod.Hook("S/quest/battleStart", 0, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+			received++
+			return data
+		})
+		mod.OnShutdown(func(bool) { shutdowns++ })
+	}}}
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	dispatch := func() {
+		d.run("S/quest/battleStart", []byte("{}"), &goproxy.ProxyCtx{})
+	}
+
+	statuses, err := p.Modules("GL_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Enabled || statuses[0].Loaded {
+		t.Fatalf("Expected the optional module to be neither enabled nor loaded, got %+v", statuses)
+	}
+	if err := p.EnableModule("GL_1", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.EnableModule("GL_1", "A"); err == nil {
+		t.Fatal("Expected enabling a loaded module to fail")
+	}
+	dispatch()
+	if loaded != 1 || received != 1 {
+		t.Fatalf("Expected the enabled module to receive the packet, loaded %d, received %d", loaded, received)
+	}
+
+	if err := p.ReloadModule("GL_1", "A"); err != nil {
+		t.Fatal(err)
+	}
+	dispatch()
+	if loaded != 2 || shutdowns != 1 || received != 2 {
+		t.Fatalf("Expected the reloaded module to receive the packet once, loaded %d, shut down %d, received %d", loaded, shutdowns, received)
+	}
+
+	if err := p.DisableModule("GL_1", "A"); err != nil {
+		t.Fatal(err)
+	}
+	dispatch()
+	if shutdowns != 2 || received != 2 {
+		t.Fatalf("Expected the disabled module to be shut down and unhooked, shut down %d, received %d", shutdowns, received)
+	}
+	if statuses, _ := p.Modules("GL_1"); statuses[0].Loaded {
+		t.Fatal("Expected the disabled module not to be loaded")
+	}
+	if err := p.DisableModule("GL_1", "A"); err == nil {
+		t.Fatal("Expected disabling a module which isn't loaded to fail")
+	}
+}
+
+func TestHandleModules(t *testing.T) {
+	registered := modules
+	defer func() { modules = registered }()
+	modules = []initFunc{{name: "A", fun: func(*RhineModule) {}}}
+	p := newTestProxy()
+	p.admin = p.newAdminMux()
+	p.options.Admin.Tokens = map[string]Role{"view": RoleViewer}
+	handler := requireToken(p.adminTokens("secret"), p.admin)
+	for _, test := range []struct {
+		method, target, token string
+		code                  int
+	}{
+		{"GET", "/users/modules?user=GL_1", "view", http.StatusOK},
+		{"DELETE", "/users/modules?user=GL_1&module=A", "view", http.StatusForbidden},
+		{"DELETE", "/users/modules?user=GL_1&module=A", "secret", http.StatusNoContent},
+		{"DELETE", "/users/modules?user=GL_1&module=A", "secret", http.StatusConflict},
+		{"PUT", "/users/modules?user=GL_1&module=A", "secret", http.StatusNoContent},
+		{"POST", "/users/modules?user=GL_1&module=A", "secret", http.StatusNoContent},
+		{"PUT", "/users/modules?user=GL_1&module=B", "secret", http.StatusNotFound},
+		{"GET", "/users/modules?user=GL_2", "view", http.StatusNotFound},
+		{"PATCH", "/users/modules?user=GL_1&module=A", "secret", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.target, test.code, w.Code)
+		}
+	}
+}
+
+func TestModuleInitPanic(t *testing.T) {
+	registered := modules
+	defer func() { modules = registered }()
+	var received int
+	modules = []initFunc{
+		{name: "A", fun: func(mod *RhineModule) {
+			mod.Hook("S/quest/battleStart", 0, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+				received++
+				return data
+			})
+			panic("init failed")
+		}},
+		{name: "B", fun: func(*RhineModule) {}},
+	}
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	if d.module("A") != nil || d.module("B") == nil {
+		t.Fatal("Expected only the module which didn't panic to be loaded")
+	}
+	d.run("S/quest/battleStart", []byte("{}"), &goproxy.ProxyCtx{})
+	if received != 0 {
+		t.Fatal("Expected the hooks of the panicking module to be unhooked")
+	}
+	if err := p.EnableModule("GL_1", "A"); err == nil {
+		t.Fatal("Expected enabling a panicking module to fail")
+	}
+}
+
+func TestReconnectShutdown(t *testing.T) {
+	registered := modules
+	defer func() { modules = registered }()
+	var shuttingDown []bool
+	modules = []initFunc{{name: "A", fun: func(mod *RhineModule) {
+		mod.OnShutdown(func(b bool) { shuttingDown = append(shuttingDown, b) })
+	}}}
+	p := newTestProxy()
+	if _, err := p.addUser("1", "GL", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(shuttingDown) != 1 || !shuttingDown[0] {
+		t.Fatalf("Expected the modules of a reconnecting user to be shut down with true, got %v", shuttingDown)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+)
+
+// NotificationOptions configures the backends of the proxy's notifier.
+type NotificationOptions struct {
+	// Desktop enables notifications on the desktop of the machine running Rhine.
+	Desktop bool `json:"desktop"`
+	// Email enables notifications by email if it is not nil.
+	Email *notify.EmailOptions `json:"email"`
+	// Telegram enables notifications and commands through a Telegram bot if it
+	// is not nil.
+	Telegram *notify.TelegramOptions `json:"telegram"`
+	// Ntfy enables push notifications to a ntfy topic if it is not nil.
+	Ntfy *notify.NtfyOptions `json:"ntfy"`
+	// Gotify enables push notifications to a Gotify server if it is not nil.
+	Gotify *notify.GotifyOptions `json:"gotify"`
+	// Sound enables audible alerts on the machine running Rhine if it is not nil.
+	Sound *notify.SoundOptions `json:"sound"`
+}
+
+// addNotificationBackends adds the backends enabled in the options to the notifier.
+func addNotificationBackends(notifier *notify.Notifier, options *NotificationOptions, logger log.Logger) {
+	if options.Desktop {
+		notifier.Add(notify.NewDesktop())
+	}
+	if options.Email != nil {
+		email, err := notify.NewEmail(*options.Email, logger)
+		if err != nil {
+			logger.Warnf("Email notifications disabled: %s", err)
+		} else {
+			notifier.Add(email)
+		}
+	}
+	if options.Ntfy != nil {
+		ntfy, err := notify.NewNtfy(*options.Ntfy)
+		if err != nil {
+			logger.Warnf("ntfy notifications disabled: %s", err)
+		} else {
+			notifier.Add(ntfy)
+		}
+	}
+	if options.Gotify != nil {
+		gotify, err := notify.NewGotify(*options.Gotify)
+		if err != nil {
+			logger.Warnf("Gotify notifications disabled: %s", err)
+		} else {
+			notifier.Add(gotify)
+		}
+	}
+	if options.Sound != nil {
+		sound, err := notify.NewSound(*options.Sound)
+		if err != nil {
+			logger.Warnf("Sound alerts disabled: %s", err)
+		} else {
+			notifier.Add(sound)
+		}
+	}
+}
+
+// Notifier returns the proxy's notifier.
+func (p *Proxy) Notifier() *notify.Notifier {
+	return p.notifier
+}
+
+// Notify sends a notification on behalf of the module's user to the proxy's
+// notification backends, without blocking.
+func (m *RhineModule) Notify(title, body string, urgency notify.Urgency) {
+	m.dispatch.notifier.Send(&notify.Notification{
+		Title:   title,
+		Body:    body,
+		Urgency: urgency,
+		UID:     m.UID,
+		Region:  m.Region,
+	})
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/recorder"
+)
+
+const (
+	minObserverBackoff = time.Second
+	maxObserverBackoff = time.Minute
+)
+
+// ObserverOptions configures running the proxy as a read-only observer of
+// another instance, which follows the packets the other instance dispatches
+// at /stream on its admin listener and runs its own modules against them,
+// e.g., to run heavy analysis on a beefier machine than the one doing the
+// MITM. An observer doesn't serve proxy clients, nothing it does reaches the
+// game and the changes its hooks make to packets are discarded.
+type ObserverOptions struct {
+	// URL is the address of the other instance's admin listener, e.g.,
+	// "https://10.0.0.2:8081". Observing is disabled if empty.
+	URL string `json:"url"`
+	// Token is an operator token of the other instance's admin listener.
+	Token string `json:"token"`
+	// CACert is the path of the other instance's CA cert, which signs its
+	// admin listener's certificate, e.g., "observed/cert.pem".
+	CACert string `json:"caCert"`
+	// ClientCert and ClientKey are the paths of a client certificate minted by
+	// the other instance, if its admin listener requires one.
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+	// Users are the region_UIDs to observe, e.g., "GL_1234", every user if
+	// empty.
+	Users []string `json:"users"`
+}
+
+// client returns the HTTP client connecting to the observed instance.
+func (o *ObserverOptions) client() (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.CACert != "" {
+		b, err := ioutil.ReadFile(o.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", o.CACert)
+		}
+	}
+	if o.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment}}, nil
+}
+
+// Observe follows the packets of the instance configured by Options.Observe,
+// dispatching them to the modules of their users, until ctx is done, when the
+// proxy is stopped with Stop. The stream is reconnected with a backoff when
+// it fails. It returns once the proxy is shut down, with an error only if the
+// options are invalid.
+func (p *Proxy) Observe(ctx context.Context) error {
+	options := &p.options.Observe
+	if options.URL == "" {
+		return errors.New("observe.url is required to observe an instance")
+	}
+	stream, err := url.Parse(strings.TrimSuffix(options.URL, "/") + "/stream")
+	if err != nil {
+		return err
+	}
+	stream.RawQuery = url.Values{"user": options.Users}.Encode()
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+	for _, cb := range onStartCbs {
+		cb(p.Logger)
+	}
+	go p.serveAdmin()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Stop()
+		case <-p.stop:
+			cancel()
+		}
+	}()
+	p.Printf("observing %s", options.URL)
+	r := p.newReplayer()
+	backoff := minObserverBackoff
+	for {
+		start := time.Now()
+		err := p.follow(ctx, client, stream.String(), options.Token, r)
+		if ctx.Err() != nil {
+			<-p.Done()
+			return nil
+		}
+		if time.Since(start) > maxObserverBackoff {
+			backoff = minObserverBackoff
+		}
+		p.Warnf("Observed stream interrupted, reconnecting in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if backoff *= 2; backoff > maxObserverBackoff {
+			backoff = maxObserverBackoff
+		}
+	}
+}
+
+// follow reads the stream at target until it fails, importing the sessions
+// it starts with and replaying its packets.
+func (p *Proxy) follow(ctx context.Context, client *http.Client, target, token string, r *replayer) error {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /stream: %s", resp.Status)
+	}
+	var event string
+	var data bytes.Buffer
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxBodyPrealloc)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			if data.Len() > 0 {
+				p.observed(event, data.Bytes(), r)
+			}
+			event = ""
+			data.Reset()
+		case bytes.HasPrefix(line, []byte("event: ")):
+			event = string(line[len("event: "):])
+		case bytes.HasPrefix(line, []byte("data: ")):
+			data.Write(line[len("data: "):])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream closed")
+}
+
+// observed handles an event of the observed stream.
+func (p *Proxy) observed(event string, data []byte, r *replayer) {
+	switch event {
+	case "session":
+		session := &Session{}
+		if err := json.Unmarshal(data, session); err != nil {
+			p.Warnf("Failed to read an observed session: %s", err)
+			return
+		}
+		// Users observed before the stream was reconnected are kept.
+		if d := p.getUser(session.UID, session.Region); d != nil && d.state.IsLoaded() {
+			return
+		}
+		if err := p.ImportSession(session); err != nil {
+			p.Warnf("Failed to resume the observed user %s_%s: %s", session.Region, session.UID, err)
+		}
+	case "":
+		packet := &recorder.Packet{}
+		if err := json.Unmarshal(data, packet); err != nil {
+			p.Warnf("Failed to read an observed packet: %s", err)
+			return
+		}
+		r.replay(packet)
+	}
+}
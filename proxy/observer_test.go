@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/tidwall/gjson"
+
+	"github.com/kyoukaya/rhine/notify"
+)
+
+func TestObserver(t *testing.T) {
+	syncData, err := ioutil.ReadFile("gamestate/testdata/syncdata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed := newTestProxy()
+	observed.stream = newPacketStream()
+	observed.admin = observed.newAdminMux()
+	d := observed.getUser("1", "GL")
+	d.stream = observed.stream
+	req := benchRequest("gs.arknights.global:8443", "/account/syncData")
+	d.dispatch("S/account/syncData", syncData, &goproxy.ProxyCtx{Req: req})
+	server := httptest.NewServer(requireToken(observed.adminTokens("secret"), observed.admin))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	observer := newTestProxy()
+	observer.notifier = notify.New(observer.Logger)
+	delete(observer.dispatches, "GL_1")
+	observer.options.Observe = ObserverOptions{URL: server.URL, Token: "secret"}
+	done := make(chan error)
+	go func() { done <- observer.ListenAndServe(ctx) }()
+
+	// The observer resumes the session of the connected user, then follows
+	// its packets.
+	ap := func() int64 {
+		state, _ := observer.getUser("1", "GL").state.Snapshot()
+		return gjson.GetBytes(state, "status.ap").Int()
+	}
+	waitFor := func(what string, ok func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("the session", func() bool { return observer.getUser("1", "GL") != nil })
+	waitFor("the subscription", observed.stream.active)
+	req = benchRequest("gs.arknights.global:8443", "/quest/battleFinish")
+	d.dispatch("S/quest/battleFinish", []byte(`{"playerDataDelta":{"modified":{"status":{"ap":7}},"deleted":{}}}`), &goproxy.ProxyCtx{Req: req})
+	waitFor("the packet", func() bool { return ap() == 7 })
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/outbound"
+)
+
+const (
+	defaultOutboundBudget   = 30
+	defaultOutboundInterval = time.Minute
+	defaultOutboundJitter   = 2 * time.Second
+)
+
+// OutboundOptions configures the budgets of the requests the notification
+// backends, the archive and the modules' HTTPClient send to external
+// services, see the outbound package.
+type OutboundOptions struct {
+	// Budget is the number of requests allowed to each host per Interval,
+	// defaults to 30. A negative budget doesn't limit the hosts.
+	Budget int `json:"budget"`
+	// Interval defaults to 1m.
+	Interval string `json:"interval"`
+	// Jitter is the longest random delay of each request, defaults to 2s.
+	// Set it to "0s" to send the requests as soon as the budget allows.
+	Jitter string `json:"jitter"`
+	// Hosts overrides Budget for some hosts, e.g., {"ntfy.sh": 10}.
+	Hosts map[string]int `json:"hosts"`
+}
+
+// apply configures s with the options.
+func (o *OutboundOptions) apply(s *outbound.Scheduler, logger log.Logger) {
+	interval := parseDuration("outbound.interval", o.Interval, logger)
+	if interval <= 0 {
+		interval = defaultOutboundInterval
+	}
+	jitter := defaultOutboundJitter
+	if o.Jitter != "" {
+		jitter = parseDuration("outbound.jitter", o.Jitter, logger)
+	}
+	budget := func(requests int) outbound.Budget {
+		if requests == 0 {
+			requests = defaultOutboundBudget
+		}
+		return outbound.Budget{Requests: requests, Interval: interval}
+	}
+	hosts := make(map[string]outbound.Budget, len(o.Hosts))
+	for host, requests := range o.Hosts {
+		hosts[strings.ToLower(host)] = budget(requests)
+	}
+	s.Configure(budget(o.Budget), hosts, jitter)
+}
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"strings"
+
 	"github.com/elazarl/goproxy"
 )
 
@@ -10,12 +12,69 @@ type PacketHook struct {
 	target   string
 	priority int
 	handler  PacketHandler
-	mod      *RhineModule
+	// modifier is set instead of handler for hooks which may drop the packet.
+	modifier PacketModifier
+	// spilled is set instead of handler for hooks on spilled responses.
+	spilled SpilledHandler
+	filter  *HookFilter
+	mod     *RhineModule
+}
+
+// HookFilter constrains the packets a hook receives beyond its target, see
+// RhineModule.HookFiltered.
+type HookFilter struct {
+	// Methods are the HTTP methods of the packet's request, e.g., "POST". Any
+	// method matches if empty.
+	Methods []string
+	// StatusClasses are the classes of the response's status code, e.g., 2 for
+	// 2xx. Any status matches if empty, requests never match otherwise.
+	StatusClasses []int
+	// Malformed also delivers the packets whose body isn't valid JSON, e.g.,
+	// truncated responses, as is. ParseError returns the error while they are
+	// dispatched. Other hooks and the core modules don't receive them.
+	Malformed bool
+}
+
+// match reports whether the packet of ctx passes the filter.
+func (f *HookFilter) match(ctx *goproxy.ProxyCtx) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Methods) > 0 {
+		if ctx == nil || ctx.Req == nil || !containsFold(f.Methods, ctx.Req.Method) {
+			return false
+		}
+	}
+	if len(f.StatusClasses) > 0 {
+		if ctx == nil || ctx.Resp == nil {
+			return false
+		}
+		class := ctx.Resp.StatusCode / 100
+		for _, c := range f.StatusClasses {
+			if c == class {
+				return true
+			}
+		}
+		return false
+	}
+	return true
 }
 
-// handle calls the handle method of the underlying PacketHandler.
-func (hook *PacketHook) handle(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
-	return hook.handler(op, data, pktCtx)
+func containsFold(s []string, v string) bool {
+	for _, e := range s {
+		if strings.EqualFold(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle calls the underlying PacketHandler or PacketModifier.
+func (hook *PacketHook) handle(op string, data []byte, pktCtx *goproxy.ProxyCtx) ([]byte, error) {
+	if hook.modifier != nil {
+		return hook.modifier(op, data, pktCtx)
+	}
+	return hook.handler(op, data, pktCtx), nil
 }
 
 // Unhook will unhook the receiving PacketHook if it's hooked.
@@ -27,18 +86,43 @@ func (hook *PacketHook) Unhook() {
 	hook.mod.dispatch.removeHook(hook)
 }
 
-// PacketHandler represents handler functions exposed by a module.
+// PacketHandler represents handler functions exposed by a module. data is shared
+// with the other handlers of the packet and must not be modified, a handler
+// which modifies the packet returns a new slice instead; returning data as is
+// leaves the packet untouched.
 type PacketHandler func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte
 
-func (d *dispatch) insertHook(hook *PacketHook) {
-	var hookSlice []*PacketHook
-	hookSlice, ok := d.hooks[hook.target]
-	if !ok {
-		hookSlice = make([]*PacketHook, 0)
+// PacketModifier is a PacketHandler which may also drop the packet by
+// returning an error, in which case the hooks after it don't run and the
+// packet is answered with a 502 carrying the error instead of being forwarded;
+// a dropped request never reaches the game server.
+type PacketModifier func(op string, data []byte, pktCtx *goproxy.ProxyCtx) ([]byte, error)
+
+// hookMap returns the map of hooks the hook belongs in.
+func (d *dispatch) hookMap(hook *PacketHook) map[string][]*PacketHook {
+	if hook.spilled != nil {
+		return d.spilledHooks
 	}
-	hookSlice = append(hookSlice, hook)
+	return d.hooks
+}
+
+// hooksOf returns the hooks of target in hooks, a map returned by hookMap.
+// The slices of the hook maps are replaced rather than modified, so the hooks
+// can be iterated without holding hookMutex while modules are toggled.
+func (d *dispatch) hooksOf(hooks map[string][]*PacketHook, target string) []*PacketHook {
+	d.hookMutex.RLock()
+	defer d.hookMutex.RUnlock()
+	return hooks[target]
+}
+
+func (d *dispatch) insertHook(hook *PacketHook) {
+	d.hookMutex.Lock()
+	defer d.hookMutex.Unlock()
+	hooks := d.hookMap(hook)
+	hookSlice := make([]*PacketHook, 0, len(hooks[hook.target])+1)
+	hookSlice = append(append(hookSlice, hooks[hook.target]...), hook)
 	if d.intialized {
 		sortHookSl(hookSlice)
 	}
-	d.hooks[hook.target] = hookSlice
+	hooks[hook.target] = hookSlice
 }
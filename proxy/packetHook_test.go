@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestHookModifier(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	mod := &RhineModule{name: "test", dispatch: d}
+	var order []string
+	appendHook := func(name string) PacketHandler {
+		return func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+			order = append(order, name)
+			return []byte(strings.TrimSuffix(string(data), "]") + `,"` + name + `"]`)
+		}
+	}
+	mod.Hook("C/quest/battleStart", 0, appendHook("first"))
+	mod.Hook("C/quest/battleStart", 0, appendHook("second"))
+	mod.Hook("C/quest/battleStart", 1, appendHook("priority"))
+	mod.Hook("*", -1, appendHook("wildcard"))
+	mod.HookModifier("C/quest/battleStart", -1, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) ([]byte, error) {
+		if strings.Contains(string(data), "drop") {
+			return nil, errors.New("sanity cost not allowed")
+		}
+		return data, nil
+	})
+	mod.Hook("C/quest/battleStart", -2, appendHook("last"))
+
+	req := httptest.NewRequest("POST", "https://gs.arknights.global:8443/quest/battleStart", nil)
+	ctx := &goproxy.ProxyCtx{Req: req, UserData: &RequestContext{}}
+	req, resp := d.dispatch("C/quest/battleStart", []byte(`["start"]`), ctx)
+	if resp != nil {
+		t.Fatalf("Expected the request to be forwarded, got %d", resp.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if want := `["start","wildcard","priority","first","second","last"]`; string(body) != want {
+		t.Fatalf("Expected %s to be forwarded, got %s", want, body)
+	}
+
+	order = nil
+	reqCtx := &RequestContext{}
+	ctx = &goproxy.ProxyCtx{Req: req, UserData: reqCtx}
+	_, resp = d.dispatch("C/quest/battleStart", []byte(`["drop"]`), ctx)
+	if resp == nil || resp.StatusCode != http.StatusBadGateway || !reqCtx.RequestIsBlocked {
+		t.Fatalf("Expected the dropped request to be answered by the proxy, got %+v", resp)
+	}
+	if strings.Join(order, ",") != "wildcard,priority,first,second" {
+		t.Fatalf("Expected the hooks after the drop to be skipped, ran %v", order)
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/kyoukaya/rhine/packetlog"
+)
+
+// PacketStorageOptions configures where the Packet Logger persists packet
+// logs, see packetlog.Storage.
+type PacketStorageOptions struct {
+	// Backend is "file", the default, to keep logs in "logs/Packet Logger"
+	// where they can be queried and bundled, "sql" to insert packets into a
+	// database, or "s3" to upload each log to an S3 compatible object store
+	// once it's closed.
+	Backend string `json:"backend"`
+	// Driver and DSN open the database of the sql backend. The driver
+	// defaults to "sqlite3" and must be registered by the binary, e.g., by
+	// importing github.com/mattn/go-sqlite3.
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+	// Table defaults to "packets".
+	Table string              `json:"table"`
+	S3    packetlog.S3Options `json:"s3"`
+}
+
+// openPacketStorage returns options.PacketStore, or the storage configured by
+// options if it's nil.
+func openPacketStorage(options *Options) (packetlog.Storage, error) {
+	if options.PacketStore != nil {
+		return options.PacketStore, nil
+	}
+	o := &options.PacketStorage
+	switch o.Backend {
+	case "", "file":
+		return packetlog.NewFileStorage(packetlog.Dir()), nil
+	case "sql":
+		driver := o.Driver
+		if driver == "" {
+			driver = "sqlite3"
+		}
+		table := o.Table
+		if table == "" {
+			table = "packets"
+		}
+		db, err := sql.Open(driver, o.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("packet storage: %s", err)
+		}
+		s, err := packetlog.NewSQLStorage(db, table)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("packet storage: %s", err)
+		}
+		return s, nil
+	case "s3":
+		s, err := packetlog.NewS3Storage(o.S3, nil)
+		if err != nil {
+			return nil, fmt.Errorf("packet storage: %s", err)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("packet storage: unknown backend %q", o.Backend)
+	}
+}
+
+// PacketStorage returns the storage the module should persist packet logs to,
+// see Options.PacketStorage.
+func (m *RhineModule) PacketStorage() packetlog.Storage {
+	if m.dispatch.packets == nil {
+		return packetlog.NewFileStorage(packetlog.Dir())
+	}
+	return m.dispatch.packets
+}
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+const (
+	defaultPairingCodeTTL = 10 * time.Minute
+	// pairingMaxFailures is the number of wrong codes after which the code is
+	// replaced, so that it can't be guessed.
+	pairingMaxFailures = 5
+	pairingPrefix      = "pairing/"
+	// pairingFreeFailures is the number of wrong codes a client may enter
+	// before it has to wait pairingBackoff, doubled with every further one up
+	// to pairingMaxBackoff.
+	pairingFreeFailures = 3
+	pairingBackoff      = time.Minute
+	pairingMaxBackoff   = time.Hour
+	// pairingBudget is the number of wrong codes accepted from all clients
+	// within pairingBudgetWindow, after which nobody may pair until it ends.
+	pairingBudget       = 30
+	pairingBudgetWindow = time.Hour
+)
+
+// PairingOptions configures pairing devices with the proxy. Once enabled,
+// only paired devices and the proxy's own host may use the proxy. A device is
+// paired by opening http://<proxy address>/pair on it, through the proxy or
+// directly, and entering the one-time code printed in the console, after
+// which it's served the CA to install.
+type PairingOptions struct {
+	Enable bool `json:"enable"`
+	// CodeTTL is how long a code is valid for, e.g., "5m". Defaults to 10m.
+	CodeTTL string `json:"codeTTL"`
+}
+
+// pairingAttempts are the wrong codes entered by a client.
+type pairingAttempts struct {
+	failures    int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+// PairedClient is a device paired with the proxy.
+type PairedClient struct {
+	IP       string    `json:"ip"`
+	PairedAt time.Time `json:"pairedAt"`
+}
+
+// pairing keeps the one-time code and the paired clients, which are saved in
+// the store.
+type pairing struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	code     string
+	expires  time.Time
+	failures int
+	paired   map[string]PairedClient
+	store    storage.Store
+	// url returns the URL devices open to pair, printed with each code.
+	url func() string
+	log.Logger
+
+	// attempts are the wrong codes entered by each client IP, spent the number
+	// entered by all of them since budgetStart.
+	attempts    map[string]*pairingAttempts
+	spent       int
+	budgetStart time.Time
+}
+
+func newPairing(options *PairingOptions, store storage.Store, logger log.Logger) *pairing {
+	if !options.Enable {
+		return nil
+	}
+	ttl := parseDuration("pairing.codeTTL", options.CodeTTL, logger)
+	if ttl <= 0 {
+		ttl = defaultPairingCodeTTL
+	}
+	p := &pairing{
+		ttl:    ttl,
+		paired: make(map[string]PairedClient),
+		store:  store,
+		url:    func() string { return "/pair" },
+		Logger: logger,
+	}
+	keys, err := store.Keys(pairingPrefix)
+	if err != nil {
+		logger.Warnf("Failed to load the paired devices: %s", err)
+	}
+	for _, key := range keys {
+		var client PairedClient
+		b, err := store.Get(key)
+		if err == nil {
+			err = json.Unmarshal(b, &client)
+		}
+		if err != nil {
+			logger.Warnf("Failed to load the paired device %s: %s", key, err)
+			continue
+		}
+		p.paired[client.IP] = client
+	}
+	return p
+}
+
+// pairingKey returns the key of the store saving a paired client, colons of
+// IPv6 addresses being replaced as they aren't valid in every file system.
+func pairingKey(ip string) string {
+	return pairingPrefix + strings.Replace(ip, ":", "-", -1)
+}
+
+// newCode replaces the code, printing it in the console. Must be called with
+// the mutex held.
+func (p *pairing) newCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		p.Warnf("Failed to generate a pairing code: %s", err)
+		p.code = ""
+		return ""
+	}
+	p.code = fmt.Sprintf("%06d", n.Int64())
+	p.expires = time.Now().Add(p.ttl)
+	p.failures = 0
+	p.Printf("Pair a device by opening %s on it and entering the code %s, valid for %s", p.url(), p.code, p.ttl)
+	return p.code
+}
+
+// Code returns a new one-time code, replacing the previous one.
+func (p *pairing) Code() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.newCode()
+}
+
+// allowed reports whether the client at remoteAddr may use the proxy.
+func (p *pairing) allowed(remoteAddr string) bool {
+	if p == nil {
+		return true
+	}
+	ip := clientIP(remoteAddr)
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.IsLoopback() {
+		return true
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, ok := p.paired[ip]
+	return ok
+}
+
+// pair pairs the client at remoteAddr if code is the current code, which is
+// then used up. A new code is printed once the code expired or was guessed
+// wrong too many times. Clients entering wrong codes are locked out for
+// increasingly long, as is everybody once too many wrong codes were entered,
+// in which case how long until the next attempt is returned.
+func (p *pairing) pair(remoteAddr, code string) (bool, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ip, now := clientIP(remoteAddr), time.Now()
+	if now.Sub(p.budgetStart) >= pairingBudgetWindow {
+		p.spent, p.budgetStart = 0, now
+	}
+	if p.spent >= pairingBudget {
+		return false, p.budgetStart.Add(pairingBudgetWindow).Sub(now)
+	}
+	attempts := p.attempts[ip]
+	if attempts != nil && now.Before(attempts.lockedUntil) {
+		return false, attempts.lockedUntil.Sub(now)
+	}
+	if p.code == "" || now.After(p.expires) {
+		p.newCode()
+		return false, 0
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(p.code)) != 1 {
+		if p.failures++; p.failures >= pairingMaxFailures {
+			p.Warnf("Too many wrong pairing codes, the last from %s", ip)
+			p.newCode()
+		}
+		if p.spent++; p.spent == pairingBudget {
+			p.Warnf("Too many wrong pairing codes, pairing is disabled for %s", pairingBudgetWindow)
+		}
+		if attempts == nil {
+			if p.attempts == nil {
+				p.attempts = make(map[string]*pairingAttempts)
+			}
+			p.pruneAttempts(now)
+			attempts = &pairingAttempts{}
+			p.attempts[ip] = attempts
+		}
+		attempts.failures++
+		attempts.last = now
+		if n := attempts.failures - pairingFreeFailures; n > 0 {
+			backoff := pairingBackoff
+			for i := 1; i < n && backoff < pairingMaxBackoff; i++ {
+				backoff *= 2
+			}
+			if backoff > pairingMaxBackoff {
+				backoff = pairingMaxBackoff
+			}
+			attempts.lockedUntil = now.Add(backoff)
+			return false, backoff
+		}
+		return false, 0
+	}
+	delete(p.attempts, ip)
+	client := PairedClient{IP: ip, PairedAt: now}
+	p.paired[client.IP] = client
+	if b, err := json.Marshal(client); err == nil {
+		if err := p.store.Put(pairingKey(client.IP), b); err != nil {
+			p.Warnf("Failed to save the paired device %s: %s", client.IP, err)
+		}
+	}
+	p.Printf("Paired %s", client.IP)
+	p.newCode()
+	return true, 0
+}
+
+// pruneAttempts forgets the clients which haven't entered a wrong code for
+// longer than they could be locked out. Must be called with the mutex held.
+func (p *pairing) pruneAttempts(now time.Time) {
+	for ip, attempts := range p.attempts {
+		if now.Sub(attempts.last) > pairingMaxBackoff {
+			delete(p.attempts, ip)
+		}
+	}
+}
+
+// unpair removes a paired client, reporting whether it was paired.
+func (p *pairing) unpair(ip string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.paired[ip]; !ok {
+		return false
+	}
+	delete(p.paired, ip)
+	if err := p.store.Delete(pairingKey(ip)); err != nil {
+		p.Warnf("Failed to delete the paired device %s: %s", ip, err)
+	}
+	return true
+}
+
+// clients returns the paired clients sorted by IP.
+func (p *pairing) clients() []PairedClient {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ret := make([]PairedClient, 0, len(p.paired))
+	for _, client := range p.paired {
+		ret = append(ret, client)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IP < ret[j].IP })
+	return ret
+}
+
+var pairTemplate = template.Must(template.New("pair").Parse(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width"><title>Pair with Rhine</title></head>
+<body>
+{{if .Paired}}<p>This device is paired. Install the CA so that Rhine can read the game's traffic:</p>
+<ul>
+<li><a href="/pair/ca?format=pem">cert.pem</a></li>
+<li><a href="/pair/ca?format=der">cert.cer</a> (Android)</li>
+<li><a href="/pair/ca.mobileconfig">rhine.mobileconfig</a> (iOS)</li>
+</ul>
+{{else}}<form method="POST" action="/pair">
+{{if .Wrong}}<p>Wrong or expired code, check the console of Rhine for the current code.</p>{{end}}
+{{if .RetryAfter}}<p>Too many wrong codes, try again in {{.RetryAfter}}.</p>{{end}}
+<p>Enter the code shown in the console of Rhine:</p>
+<input name="code" inputmode="numeric" autocomplete="one-time-code" autofocus>
+<button type="submit">Pair</button>
+</form>{{end}}
+</body></html>
+`))
+
+// handlePair serves the pairing page, pairing the device with the code POSTed
+// or given in the "code" query parameter, and the CA to paired devices.
+func (p *Proxy) handlePair(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/pair/ca", "/pair/ca.mobileconfig":
+		if !p.pairing.allowed(r.RemoteAddr) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/pair/ca" {
+			p.handleCA(w, r)
+		} else {
+			p.handleMobileConfig(w, r)
+		}
+		return
+	}
+	var data struct {
+		Paired, Wrong bool
+		RetryAfter    time.Duration
+	}
+	data.Paired = p.pairing.allowed(r.RemoteAddr)
+	if code := r.FormValue("code"); code != "" && !data.Paired {
+		data.Paired, data.RetryAfter = p.pairing.pair(r.RemoteAddr, strings.TrimSpace(code))
+		data.RetryAfter = data.RetryAfter.Round(time.Second)
+		data.Wrong = !data.Paired
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = pairTemplate.Execute(w, data)
+}
+
+// isPairRequest reports whether r is for the pairing page, sent directly to
+// the proxy or through it.
+func isPairRequest(r *http.Request, self string) bool {
+	if r.Method == "CONNECT" || (r.URL.Path != "/pair" && !strings.HasPrefix(r.URL.Path, "/pair/")) {
+		return false
+	}
+	return !r.URL.IsAbs() || r.URL.Host == self
+}
+
+// pairingGate wraps the proxy's handler, serving only paired clients and the
+// pairing page to the others.
+func (p *Proxy) pairingGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPairRequest(r, p.pairingHost()) {
+			p.handlePair(w, r)
+			return
+		}
+		if !p.pairing.allowed(r.RemoteAddr) {
+			p.Verbosef("==== Rejecting unpaired client %s", clientIP(r.RemoteAddr))
+			http.Error(w, fmt.Sprintf("Pair this device first by opening %s", p.pairing.url()), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pairingHost returns the host:port devices reach the proxy at.
+func (p *Proxy) pairingHost() string {
+	host, port, err := p.proxyHostPort("")
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+// PairingCode returns a new one-time code pairing a device, replacing the
+// previous one. It's empty if pairing isn't enabled, see Options.Pairing.
+func (p *Proxy) PairingCode() string {
+	if p.pairing == nil {
+		return ""
+	}
+	return p.pairing.Code()
+}
+
+// handlePairing lists the paired clients on GET, returns a new code on POST
+// and unpairs the client of the "ip" query parameter on DELETE. Only operators
+// may use it.
+func (p *Proxy) handlePairing(w http.ResponseWriter, r *http.Request) {
+	if AdminRole(r) != RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if p.pairing == nil {
+		http.Error(w, "pairing not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.pairing.clients())
+	case "POST":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"code": p.pairing.Code(), "url": p.pairing.url()})
+	case "DELETE":
+		if !p.pairing.unpair(r.URL.Query().Get("ip")) {
+			http.Error(w, "client not paired", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// startPairing prints the first pairing code once the proxy's address is
+// known.
+func (p *Proxy) startPairing() {
+	if p.pairing == nil {
+		return
+	}
+	p.pairing.url = func() string {
+		if host := p.pairingHost(); host != "" {
+			return "http://" + host + "/pair"
+		}
+		return "http://<proxy address>/pair"
+	}
+	p.Printf("Pairing enabled, %d devices paired", len(p.pairing.clients()))
+	p.pairing.Code()
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestPairing(t *testing.T) {
+	p := newTestProxy()
+	store := storage.NewMemoryStore()
+	p.pairing = newPairing(&PairingOptions{Enable: true}, store, p.Logger)
+	code := p.PairingCode()
+	proxied := false
+	handler := p.pairingGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { proxied = true }))
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "192.168.1.5:40000"
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("CONNECT", "https://gs.arknights.global:8443", ""); rec.Code != http.StatusForbidden || proxied {
+		t.Fatalf("Expected unpaired clients to be rejected, got %d", rec.Code)
+	}
+	if rec := send("GET", "/pair/ca", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected the CA to be served to paired clients only, got %d", rec.Code)
+	}
+	if rec := send("POST", "/pair", url.Values{"code": {"wrong"}}.Encode()); !strings.Contains(rec.Body.String(), "Wrong") {
+		t.Fatalf("Expected a wrong code to be reported, got %q", rec.Body.String())
+	}
+	if rec := send("POST", "/pair", url.Values{"code": {code}}.Encode()); !strings.Contains(rec.Body.String(), "/pair/ca") {
+		t.Fatalf("Expected the device to be paired, got %q", rec.Body.String())
+	}
+	if send("CONNECT", "https://gs.arknights.global:8443", ""); !proxied {
+		t.Fatal("Expected paired clients to be proxied")
+	}
+	if p.pairing.code == code {
+		t.Fatal("Expected codes to be used once")
+	}
+
+	// Paired devices are saved.
+	if restored := newPairing(&PairingOptions{Enable: true}, store, p.Logger); !restored.allowed("192.168.1.5:1") {
+		t.Fatal("Expected the paired device to be restored from the store")
+	}
+
+	code = p.PairingCode()
+	for i := 0; i < pairingMaxFailures; i++ {
+		p.pairing.pair(fmt.Sprintf("192.168.2.%d:1", i), "wrong")
+	}
+	if paired, _ := p.pairing.pair("192.168.1.7:1", code); paired {
+		t.Fatal("Expected the code to be replaced after too many wrong guesses")
+	}
+}
+
+func TestPairingLockout(t *testing.T) {
+	p := newTestProxy()
+	p.pairing = newPairing(&PairingOptions{Enable: true}, storage.NewMemoryStore(), p.Logger)
+	p.PairingCode()
+	var retry time.Duration
+	for i := 0; i <= pairingFreeFailures; i++ {
+		_, retry = p.pairing.pair("192.168.1.6:1", "wrong")
+	}
+	if retry != pairingBackoff {
+		t.Fatalf("Expected the client to be locked out for %s, got %s", pairingBackoff, retry)
+	}
+	if paired, retry := p.pairing.pair("192.168.1.6:1", p.PairingCode()); paired || retry <= 0 {
+		t.Fatal("Expected a locked out client not to pair with the right code")
+	}
+	if paired, _ := p.pairing.pair("192.168.1.7:1", p.PairingCode()); !paired {
+		t.Fatal("Expected other clients not to be locked out")
+	}
+
+	p.pairing.spent = pairingBudget
+	if paired, retry := p.pairing.pair("192.168.1.8:1", p.PairingCode()); paired || retry <= 0 {
+		t.Fatal("Expected nobody to pair once the budget of wrong codes is spent")
+	}
+}
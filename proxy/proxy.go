@@ -1,6 +1,11 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -9,22 +14,24 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/kyoukaya/rhine/events"
 	"github.com/kyoukaya/rhine/log"
-	"github.com/kyoukaya/rhine/proxy/filters"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/outbound"
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/recorder"
+	"github.com/kyoukaya/rhine/redis"
+	"github.com/kyoukaya/rhine/storage"
 	"github.com/kyoukaya/rhine/utils"
+	"github.com/kyoukaya/rhine/utils/gamedata"
+	"github.com/kyoukaya/rhine/utils/gamedata/buildingtable"
 
 	"github.com/elazarl/goproxy"
 )
 
 var (
-	// regionMap maps the TLD of the host string to their constant regional
-	// representation: ["GL", "JP", "KR"]
-	regionMap = map[string]string{
-		"global": "GL",
-		"jp":     "JP",
-		"kr":     "KR",
-	}
 	// onStartCbs will be called when proxy.Run() is called.
 	onStartCbs []func(log.Logger)
 )
@@ -34,39 +41,262 @@ const (
 	keyPath  = "key.pem"
 )
 
-// Options optionally changes the behavior of the proxy
+// Options optionally changes the behavior of the proxy. Options can also be
+// loaded from a JSON config file with LoadOptions.
 type Options struct {
-	Logger      log.Logger // Defaults to log.Log if not specified
-	LoggerFlags int        // Flags to pass to the standard logger, if a custom logger is not specified
+	Logger      log.Logger `json:"-"`           // Defaults to log.Log if not specified
+	LoggerFlags int        `json:"loggerFlags"` // Flags to pass to the standard logger, if a custom logger is not specified
 	// LogPath defaults to "logs/proxy.log", setting it to "/dev/null", even on Windows,
 	// will make the logger not output a file.
-	LogPath          string
-	LogDisableStdOut bool           // Should stdout output be DISABLED for the default logger
-	EnableHostFilter bool           // Filters out packets from certain hosts if they match HostFilter
-	HostFilter       *regexp.Regexp // Custom regexp filter for filtering packets, defaults to the block list in proxy/filters.go
-	Verbose          bool           // log more Rhine information
-	VerboseGoProxy   bool           // log every GoProxy request to stdout
-	Address          string         // proxy listen address, defaults to ":8080"
-	DisableCertStore bool           // Disables the built in certstore, reduces memory usage but increases HTTP latency and CPU usage.
-	NoUnknownJSON    bool           // Disallows unknown fields when unmarshalling json in the gamestate module.
+	LogPath          string         `json:"logPath"`
+	LogDisableStdOut bool           `json:"logDisableStdOut"` // Should stdout output be DISABLED for the default logger
+	EnableHostFilter bool           `json:"enableHostFilter"` // Filters out packets from certain hosts if they match HostFilter
+	HostFilter       *regexp.Regexp `json:"-"`                // Custom regexp filter for filtering packets, defaults to the region filter sets in proxy/filters
+	Verbose          bool           `json:"verbose"`          // log more Rhine information
+	VerboseGoProxy   bool           `json:"verboseGoProxy"`   // log every GoProxy request to stdout
+	Address          string         `json:"address"`          // proxy listen address, defaults to ":8080"
+	DisableCertStore bool           `json:"disableCertStore"` // Disables the built in certstore, reduces memory usage but increases HTTP latency and CPU usage.
+	NoUnknownJSON    bool           `json:"noUnknownJSON"`    // Disallows unknown fields when unmarshalling json in the gamestate module.
+	// RegionHostFilters overrides the default filter set of a region, see
+	// filters.RegionHostFilters. Filter sets are enabled for a region once
+	// game traffic for the region is observed.
+	RegionHostFilters map[string][]string `json:"regionHostFilters"`
+	// GameHosts maps the hosts of additional game servers to their region,
+	// e.g., {"gs.example.com": "GL"}, taking precedence over the built in
+	// servers of GL, JP, KR, CN, including Bilibili's, and TW. Regions must
+	// be one of gamedata.Regions.
+	GameHosts map[string]string `json:"gameHosts"`
+	// StorePath is the directory used by the default file store, defaults to
+	// "data/store" in utils.BinDir.
+	StorePath string `json:"storePath"`
+	// Store persists module and scheduler data, defaults to a redis.Store if
+	// Redis is configured, or a storage.FileStore at StorePath.
+	Store storage.Store `json:"-"`
+	// Redis configures Redis as the backend of the store and for sharing
+	// events between instances.
+	Redis RedisOptions `json:"redis"`
+	// PacketStorage configures where the Packet Logger persists packet logs,
+	// defaults to files in "logs/Packet Logger".
+	PacketStorage PacketStorageOptions `json:"packetStorage"`
+	// PacketStore overrides the storage configured by PacketStorage.
+	PacketStore packetlog.Storage `json:"-"`
+	// Observe runs the proxy as a read-only observer of another instance's
+	// packets instead of serving proxy clients, see ObserverOptions.
+	Observe ObserverOptions `json:"observe"`
+	// RecordPath is a file every dispatched game packet is appended to, which
+	// Proxy.Replay replays with a replay.Source, see the recorder package.
+	RecordPath string `json:"recordPath"`
+	// ShareState saves each user's gamestate to the Store, letting instances
+	// sharing the Store resume users who connected through another instance.
+	ShareState bool `json:"shareState"`
+	// DisableDropStats stops recording the drops of each user's battles, from
+	// which per stage drop rates are estimated, see Proxy.DropStats.
+	DisableDropStats bool `json:"disableDropStats"`
+	// DisableHistory stops recording each user's drops, headhunts, sanity
+	// changes and missions, which are exported with ExportHistory.
+	DisableHistory bool `json:"disableHistory"`
+	// DisableSupportStats stops recording the operators each user lends as
+	// supports and the credits they earn, see Proxy.SupportStats.
+	DisableSupportStats bool `json:"disableSupportStats"`
+	// DisableUserMetrics removes the gauges of each user's sanity, LMD,
+	// orundum, recruitments and drones from the admin listener's /metrics.
+	DisableUserMetrics bool `json:"disableUserMetrics"`
+	// Notifications configures the notification backends.
+	Notifications NotificationOptions `json:"notifications"`
+	// Notifier overrides the notifier created from Notifications.
+	Notifier *notify.Notifier `json:"-"`
+	// EventBus is the bus on which Rhine publishes events, defaults to events.Default.
+	// Gamedata updates are published to the bus of the last proxy created.
+	EventBus *events.Bus `json:"-"`
+	// Backpressure configures how slow event listeners and notification
+	// backends are handled.
+	Backpressure BackpressureOptions `json:"backpressure"`
+	// Transport tunes the connections made to upstream servers.
+	Transport TransportOptions `json:"transport"`
+	// RoundTripper replaces the transport used for upstream requests, including
+	// those of MITM'd connections, in which case Transport only applies to
+	// tunnelled connections.
+	RoundTripper http.RoundTripper `json:"-"`
+	// Admin configures the admin listener serving Rhine's API.
+	Admin AdminOptions `json:"admin"`
+	// Worker configures running the modules in a separate worker process.
+	Worker WorkerOptions `json:"worker"`
+	// Cluster configures routing users between instances behind a load balancer.
+	Cluster ClusterOptions `json:"cluster"`
+	// TLS configures TLS session resumption.
+	TLS TLSOptions `json:"tls"`
+	// CA configures the CA generated when cert.pem and key.pem don't exist.
+	CA utils.CAOptions `json:"ca"`
+	// DeviceCAs are CAs of their own signing the connections of some devices.
+	DeviceCAs []DeviceCA `json:"deviceCAs"`
+	// Pairing restricts the proxy to devices paired with a one-time code.
+	Pairing PairingOptions `json:"pairing"`
+	// MemoryLimitMB is the heap size in megabytes above which the proxy degrades
+	// to protect itself, disabled if 0.
+	MemoryLimitMB int `json:"memoryLimitMB"`
+	// LargeBodyBytes is the size above which bodies are tunnelled without being
+	// dispatched while the memory limit is exceeded, defaults to 1MB.
+	LargeBodyBytes int64 `json:"largeBodyBytes"`
+	// SpillThresholdBytes is the Content-Length above which game responses are
+	// spilled to a temporary file instead of being read into memory, disabled
+	// if 0. Spilled responses are only seen by hooks registered with HookSpilled.
+	SpillThresholdBytes int64 `json:"spillThresholdBytes"`
+	// SpillDir is the directory responses are spilled to, defaults to the OS'
+	// temporary directory.
+	SpillDir string `json:"spillDir"`
+	// Devices names client devices by IP or MAC address in logs and the admin
+	// API, e.g., {"192.168.1.37": "Tablet"}. MAC addresses are only known for
+	// devices on the same network as the proxy.
+	Devices map[string]string `json:"devices"`
+	// Capture scopes packet capture to some clients and users.
+	Capture CaptureFilter `json:"capture"`
+	// TLSFingerprints maps the TLS fingerprints of clients to their kind,
+	// overriding the kind inferred from the user agent. Fingerprints are
+	// found in ClientInfo.TLSFingerprint.
+	TLSFingerprints map[string]ClientKind `json:"tlsFingerprints"`
+	// Gacha configures the headhunting statistics and their notifications.
+	Gacha GachaOptions `json:"gacha"`
+	// Annihilation configures the reminder of the weekly annihilation cap.
+	Annihilation AnnihilationOptions `json:"annihilation"`
+	// DisableCountdowns stops publishing semantic.ContentEnding events before
+	// events and banners end.
+	DisableCountdowns bool `json:"disableCountdowns"`
+	// FailClosed answers game packets whose dispatch failed, e.g., because a
+	// core handler panicked or the worker couldn't be reached, with a 502.
+	// By default such packets are forwarded untouched. Every failure is
+	// logged either way.
+	FailClosed bool `json:"failClosed"`
+	// Retention configures pruning old logs, packet logs and history.
+	Retention RetentionOptions `json:"retention"`
+	// Reverse configures serving the game's hosts as an HTTPS reverse proxy.
+	Reverse ReverseOptions `json:"reverse"`
+	// Archive configures uploading packet logs and gamestate snapshots to an
+	// S3 compatible object store.
+	Archive ArchiveOptions `json:"archive"`
+	// Outbound configures the budgets of the requests sent to external
+	// services, e.g., notification backends.
+	Outbound OutboundOptions `json:"outbound"`
+	// DryRun runs the hooks which modify packets but forwards the packets
+	// unmodified, logging the changes each hook would have made. Every hook
+	// receives the original packet.
+	DryRun bool `json:"dryRun"`
+	// HookBreaker configures disabling hooks which fail repeatedly.
+	HookBreaker HookBreakerOptions `json:"hookBreaker"`
+	// EnableWebSocket serves MITM'd connections with net/http instead of
+	// goproxy, which can't relay WebSocket upgrades, and publishes the messages
+	// of WebSocket connections as WSMessage events. RoundTripper doesn't apply
+	// to WebSocket connections.
+	EnableWebSocket bool `json:"enableWebSocket"`
+	// Stealth forwards the requests and responses of MITM'd connections
+	// byte for byte, keeping their header order and casing, unless a hook
+	// modifies them. Each client connection gets its own upstream connection,
+	// which is closed with it. Upgraded connections are relayed as is, without
+	// publishing WebSocket messages, and RoundTripper doesn't apply.
+	Stealth bool `json:"stealth"`
+	// Strict only MITMs the game servers and explicitly allowed hosts,
+	// tunneling the connections to every other host untouched.
+	Strict StrictOptions `json:"strict"`
+	// Modules contains the names of the optional modules to load, modules
+	// registered with RegisterOptionalInitFunc are disabled unless listed here.
+	Modules []string `json:"modules"`
+	// SafeMode disables every registered module except those listed in
+	// SafeModeModules, to recover from a module which crashes on init. Core
+	// modules such as the game state are still loaded.
+	SafeMode        bool     `json:"safeMode"`
+	SafeModeModules []string `json:"safeModeModules"`
+	// Shutdown bounds the time taken to shut modules down.
+	Shutdown ShutdownOptions `json:"shutdown"`
+	// UserLogs also writes the lines logged by each user's modules and for
+	// their packets to logs/users/<region>_<uid>.log, see UserLogPath. Only
+	// supported with the default logger.
+	UserLogs bool `json:"userLogs"`
+	// RecentPackets is the number of packets kept in memory for each user,
+	// which modules and the admin listener can read to debug what just
+	// happened without capturing packets ahead of time. Defaults to 50,
+	// negative to keep none.
+	RecentPackets int `json:"recentPackets"`
+	// UserKey resolves the key identifying each user in what's persisted for
+	// them, DefaultUserKey if nil.
+	UserKey UserKeyFunc `json:"-"`
+	// Tenants are separate proxies served alongside this one, each on its own
+	// address with its own modules, host filters and store namespace.
+	Tenants []TenantOptions `json:"tenants"`
 }
 
 // Proxy contains the internal state relevant to the proxy
 type Proxy struct {
 	mutex      *sync.Mutex
 	server     *goproxy.ProxyHttpServer
-	hostFilter *regexp.Regexp
+	hostFilter *hostFilter
+	regions    *regions
+	strict     *strictFilter
 	options    *Options
 	// dispatches contains a mapping of a user's UID and region in string form
 	// to the user's Dispatch.
 	dispatches map[string]*dispatch
+	events     *events.Bus
+	store      storage.Store
+	packets    packetlog.Storage
+	recorder   *recorder.Writer
+	stream     *packetStream
+	notifier   *notify.Notifier
+	memory     *memoryGuard
+	listener   *connListener
+	clients    *clientTracker
+	tunnels    *tunnelTracker
+	rtt        *rttTracker
+	breaker    *hookBreaker
+	started    time.Time
+	// moduleTimeout and shutdownTimeout bound shutting modules down, see
+	// ShutdownOptions.
+	moduleTimeout   time.Duration
+	shutdownTimeout time.Duration
+	capture         *captureFilter
+	mitm            *goproxy.ConnectAction
+	// cas are the device CAs, nil if none are configured.
+	cas *deviceCAs
+	// pairing is nil unless Options.Pairing is enabled.
+	pairing *pairing
+	// hijack is set if MITM'd connections are served by Rhine instead of
+	// goproxy, see Options.EnableWebSocket and Options.Stealth.
+	hijack *goproxy.ConnectAction
+	admin  *http.ServeMux
+	// charRarity overrides the lookup of operator rarities in the game data.
+	charRarity rarityFunc
+	// buildingTable overrides the building table of the game data.
+	buildingTable *buildingtable.BuildingData
+	// content overrides the lookup of events and banners in the game data.
+	content contentFunc
+	// worker is set if game packets are dispatched to a worker process.
+	worker *workerClient
+	// cluster is set if users are routed between clustered instances.
+	cluster *cluster
+	// instance identifies the proxy among the instances sharing gamestates.
+	instance string
+	bridge   *redis.Bridge
+	// tenants are served and shut down along with the proxy.
+	tenants []*Proxy
+	// listeners are closed on shutdown.
+	listeners []io.Closer
+	// servers are the HTTP servers shut down gracefully by Stop.
+	servers []*http.Server
+	// stop is closed when Shutdown is called, and done once it has completed.
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
 	log.Logger
 }
 
 // RegisterInitFunc adds a rhineModule that will be initialized when a user authenticates
 // with the Arknights server.
 func RegisterInitFunc(name string, fun ModuleInitFunc) {
-	modules = append(modules, initFunc{name: name, fun: fun})
+	modules = append(modules, initFunc{name: name, fun: fun, apiVersion: APIVersion})
+}
+
+// RegisterOptionalInitFunc adds a rhineModule like RegisterInitFunc, but the module
+// is disabled unless its name is listed in Options.Modules.
+func RegisterOptionalInitFunc(name string, fun ModuleInitFunc) {
+	modules = append(modules, initFunc{name: name, fun: fun, optional: true, apiVersion: APIVersion})
 }
 
 // OnStart registers a function to be called back when the proxy is initialized, i.e.,
@@ -76,29 +306,100 @@ func OnStart(cb func(log.Logger)) {
 	onStartCbs = append(onStartCbs, cb)
 }
 
-// NewProxy returns a new initialized Dispatch
+// NewProxy returns a new initialized Proxy, panicking if New fails.
 func NewProxy(options *Options) *Proxy {
+	proxy, err := New(options)
+	if err != nil {
+		panic(err)
+	}
+	return proxy
+}
+
+// New returns a new initialized Proxy, or an error if something it requires,
+// such as the store or the CA, could not be set up. Together with Serve and
+// Shutdown, it lets the proxy be embedded without it handling signals or
+// exiting the process.
+func New(options *Options) (*Proxy, error) {
 	logger := options.Logger
 	if logger == nil {
-		logger = log.New(!options.LogDisableStdOut, options.Verbose, options.LogPath, options.LoggerFlags)
+		var err error
+		logger, err = log.Open(!options.LogDisableStdOut, options.Verbose, options.LogPath, options.LoggerFlags)
+		if err != nil {
+			return nil, err
+		}
 	}
 	if options.Address == "" {
 		options.Address = ":8080"
 	}
-	var proxyFilter *regexp.Regexp = nil
+	for host, region := range options.GameHosts {
+		if !supportedRegion(region) {
+			return nil, fmt.Errorf("Unknown region %q of game host %s", region, host)
+		}
+	}
+	gameRegions := newRegions(options.GameHosts)
+	var proxyFilter *hostFilter
 	if options.EnableHostFilter {
-		if options.HostFilter == nil {
-			proxyFilter = filters.HostFilter
-		} else {
-			proxyFilter = options.HostFilter
+		var err error
+		if proxyFilter, err = newHostFilter(options.HostFilter, options.RegionHostFilters, logger); err != nil {
+			return nil, err
 		}
 	}
 
+	bus := options.EventBus
+	if bus == nil {
+		bus = events.Default
+		bus.SetLogger(logger)
+	}
+	gamedata.SetEventBus(bus)
+	options.Backpressure.applyEvents(bus, logger)
+
+	if err := loadCA(&options.CA, logger); err != nil {
+		return nil, err
+	}
+	instance, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	var redisClient *redis.Client
+	if options.Redis.Address != "" {
+		redisClient = redis.New(options.Redis.Address, options.Redis.Password, options.Redis.DB)
+	}
+
+	store, err := openStore(options, redisClient)
+	if err != nil {
+		return nil, err
+	}
+	packets, err := openPacketStorage(options)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := openRecorder(options)
+	if err != nil {
+		return nil, err
+	}
+
+	options.Outbound.apply(outbound.Default, logger)
+	notifier := options.Notifier
+	if notifier == nil {
+		notifier = notify.New(logger)
+		options.Backpressure.applyNotifier(notifier, logger)
+		addNotificationBackends(notifier, &options.Notifications, logger)
+	}
+
+	memory := newMemoryGuard(options.MemoryLimitMB, options.LargeBodyBytes, logger)
 	server := goproxy.NewProxyHttpServer()
 	if !options.DisableCertStore {
-		server.CertStore = newCertStore(logger)
+		certs := newCertStore(logger)
+		memory.onPressure(certs.purge)
+		server.CertStore = certs
 	}
 
+	options.Transport.apply(server.Tr, logger)
+	if size := options.TLS.UpstreamSessionCacheSize; size > 0 {
+		// goproxy's TLS client config is shared between instances.
+		server.Tr.TLSClientConfig = server.Tr.TLSClientConfig.Clone()
+		server.Tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(size)
+	}
 	server.Logger = printfFunc(logShim(logger))
 	server.Verbose = options.VerboseGoProxy
 	proxy := &Proxy{
@@ -108,28 +409,125 @@ func NewProxy(options *Options) *Proxy {
 		Logger:     logger,
 		dispatches: make(map[string]*dispatch),
 		hostFilter: proxyFilter,
+		regions:    gameRegions,
+		strict:     newStrictFilter(&options.Strict, gameRegions, logger),
+		events:     bus,
+		store:      store,
+		packets:    packets,
+		recorder:   rec,
+		stream:     newPacketStream(),
+		notifier:   notifier,
+		memory:     memory,
+		clients:    newClientTracker(options.Devices),
+		tunnels:    newTunnelTracker(),
+		rtt:        newRTTTracker(),
+		started:    time.Now(),
+		instance:   instance,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	proxy.moduleTimeout, proxy.shutdownTimeout = options.Shutdown.timeouts(logger)
+	proxy.breaker = newHookBreaker(&options.HookBreaker, notifier, logger)
+	proxy.capture = newCaptureFilter(options.Capture, proxy.clients)
+	if proxy.cas, err = loadDeviceCAs(options, proxy.clients, logger); err != nil {
+		return nil, err
+	}
+	proxy.pairing = newPairing(&options.Pairing, store, logger)
+	proxy.mitm = mitmConnect(newTicketKeys(&options.TLS, logger), proxy.cas, func(remoteAddr string, hello *tls.ClientHelloInfo) {
+		proxy.listener.hello(remoteAddr, hello)
+	})
+	switch {
+	case options.Stealth:
+		proxy.hijack = &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: proxy.stealthMITM}
+	case options.EnableWebSocket:
+		proxy.hijack = &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: proxy.hijackMITM}
+	}
+	proxy.admin = proxy.newAdminMux()
+	if rec != nil {
+		proxy.closeOnShutdown(rec)
+	}
+	if redisClient != nil {
+		proxy.bridge = startRedisBridge(redisClient, &options.Redis, bus, instance, logger)
+	}
+	if options.SafeMode {
+		proxy.Warnf("Safe mode enabled, only loading modules %v", options.SafeModeModules)
+	}
+	proxy.startTelegram()
+	proxy.recordDropStats()
+	proxy.recordHistory()
+	proxy.recordSupportStats()
+	proxy.startRetention()
+	proxy.startArchive()
+	go memory.run()
+	if options.RoundTripper != nil {
+		rt := roundTripperFunc(options.RoundTripper)
+		server.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			ctx.RoundTripper = rt
+			return req, nil
+		})
 	}
 	server.OnRequest().DoFunc(proxy.HandleReq)
 	server.OnResponse().DoFunc(proxy.HandleResp)
+	server.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(proxy.httpsHandler))
+	if err := proxy.newTenants(); err != nil {
+		proxy.Shutdown()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// openStore returns options.Store, or the store configured by options if it's
+// nil. redisClient is the client of options.Redis, if configured.
+func openStore(options *Options, redisClient *redis.Client) (storage.Store, error) {
+	if options.Store != nil {
+		return options.Store, nil
+	}
+	if redisClient != nil {
+		return redis.NewStore(redisClient, options.Redis.prefix()), nil
+	}
+	storePath := options.StorePath
+	if storePath == "" {
+		storePath = "data/store"
+	}
+	return storage.NewFileStore(configPath(storePath))
+}
 
-	_, certStatErr := os.Stat(utils.BinDir + certPath)
-	_, keyStatErr := os.Stat(utils.BinDir + keyPath)
+// OpenStore returns the store the proxy would use with options, for reading
+// the data it persisted without starting it.
+func OpenStore(options *Options) (storage.Store, error) {
+	var redisClient *redis.Client
+	if options.Redis.Address != "" {
+		redisClient = redis.New(options.Redis.Address, options.Redis.Password, options.Redis.DB)
+	}
+	return openStore(options, redisClient)
+}
+
+// loadCA loads the CA, generating it as configured by options if it doesn't
+// exist. logger may be nil.
+func loadCA(options *utils.CAOptions, logger log.Logger) error {
 	// Generate CA if it doesn't exist
-	if os.IsNotExist(certStatErr) || os.IsNotExist(keyStatErr) {
-		proxy.Printf("Generating CA...")
-		if err := utils.GenerateCA(certPath, keyPath); err != nil {
-			proxy.Warnln(err)
-			panic(err)
+	if !utils.CAExists(certPath, keyPath, options) {
+		if logger != nil {
+			logger.Printf("Generating CA...")
+		}
+		if err := utils.GenerateCAWithOptions(certPath, keyPath, options); err != nil {
+			return err
+		}
+		if logger != nil {
+			logger.Printf("CA's key and cert saved in '%s'.", utils.BinDir)
+			logger.Printf("Copy and register the created 'cert.pem' with your client.")
 		}
-		proxy.Printf("CA's key and cert saved in '%s'.", utils.BinDir)
-		proxy.Printf("Copy and register the created 'cert.pem' with your client.")
 	}
-	if err := utils.LoadCA(certPath, keyPath); err != nil {
-		proxy.Warnln(err)
-		panic(err)
+	return utils.LoadCAWithOptions(certPath, keyPath, options)
+}
+
+// GenerateCA generates a new CA as configured by options, replacing the
+// existing one. Clients must register the new cert.pem.
+func GenerateCA(options *utils.CAOptions) error {
+	if err := utils.GenerateCAWithOptions(certPath, keyPath, options); err != nil {
+		return err
 	}
-	server.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(proxy.httpsHandler))
-	return proxy
+	return utils.LoadCAWithOptions(certPath, keyPath, options)
 }
 
 // Interface shim for goproxy.Logger
@@ -148,51 +546,214 @@ func (f printfFunc) Printf(format string, v ...interface{}) {
 // HTTPSHandler to allow HTTPS connections to pass through the proxy without being
 // MITM'd.
 func (p *Proxy) httpsHandler(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-	if p.hostFilter != nil && p.hostFilter.MatchString(host) {
+	p.clients.seen(ctx.Req.RemoteAddr, ctx.Req.UserAgent())
+	if p.hostFilter.match(host) {
 		p.Verbosef("==== Rejecting %v", host)
+		p.listener.connect(ctx.Req.RemoteAddr, host, false)
 		return goproxy.RejectConnect, host
 	}
-	return goproxy.MitmConnect, host
+	if !p.strict.allow(host) {
+		p.listener.connect(ctx.Req.RemoteAddr, host, false)
+		return goproxy.OkConnect, host
+	}
+	p.listener.connect(ctx.Req.RemoteAddr, host, true)
+	if p.hijack != nil {
+		return p.hijack, host
+	}
+	return p.mitm, host
 }
 
-// Start starts the proxy. This is blocking and does not return.
+// Start starts the proxy on Options.Address, stopping it on SIGINT or
+// SIGTERM. It blocks until the proxy is shut down.
 func (p *Proxy) Start() {
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	// Catch sigint/sigterm and cleanly exit
+	p.ShutdownOnSignal()
+	if err := p.ListenAndServe(context.Background()); err != nil {
+		p.Warnln(err)
+		panic(err)
+	}
+}
+
+// ListenAndServe listens on Options.Address and serves the proxy until ctx is
+// done, when the proxy is stopped with Stop, or observes another instance if
+// Options.Observe is configured, see Observe. It returns once the proxy is shut
+// down, whether by ctx, Stop or Shutdown, with the error which stopped it
+// otherwise, in which case the proxy is stopped too.
+func (p *Proxy) ListenAndServe(ctx context.Context) error {
+	if p.options.Observe.URL != "" {
+		return p.Observe(ctx)
+	}
+	l, err := net.Listen("tcp", p.options.Address)
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- p.Serve(l) }()
+	select {
+	case <-ctx.Done():
+		p.Stop()
+		return <-errc
+	case err = <-errc:
+		p.Stop()
+		return err
+	}
+}
+
+// Stop stops the proxy gracefully: its HTTP servers stop accepting
+// connections and wait for the requests in flight, for up to the shutdown
+// timeout, before the proxy is shut down as by Shutdown. It returns once the
+// modules of every user are shut down.
+func (p *Proxy) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.shutdownTimeout)
+	defer cancel()
+	for _, t := range p.tenants {
+		t.Stop()
+	}
+	p.mutex.Lock()
+	servers := p.servers
+	p.servers = nil
+	p.mutex.Unlock()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			p.Warnf("Failed to wait for the requests in flight: %s", err)
+		}
+	}
+	p.Shutdown()
+	<-p.Done()
+}
+
+// serveHTTP serves handler on l until the proxy is stopped, the server being
+// shut down gracefully by Stop.
+func (p *Proxy) serveHTTP(l net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler}
+	p.mutex.Lock()
+	if p.stopping() {
+		p.mutex.Unlock()
+		l.Close()
+		return nil
+	}
+	p.servers = append(p.servers, server)
+	p.mutex.Unlock()
+	err := server.Serve(l)
+	if err == http.ErrServerClosed || p.stopping() {
+		return nil
+	}
+	return err
+}
+
+// ShutdownOnSignal shuts the proxy down when one of the signals is received,
+// SIGINT or SIGTERM if none are specified. The process isn't exited, callers
+// wait on Done to decide when it does.
+func (p *Proxy) ShutdownOnSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
 	go func() {
-		<-sigs
-		p.Printf("Shutting down.\n")
-		p.Flush()
-		p.Shutdown()
-		os.Exit(0)
+		select {
+		case <-c:
+			p.Printf("Shutting down.\n")
+			p.Flush()
+			p.Stop()
+		case <-p.stop:
+		}
+		signal.Stop(c)
 	}()
+}
 
-	ipstring := utils.GetOutboundIP()
-	addrSplit := strings.Split(p.options.Address, ":")
-	if len(addrSplit) == 2 {
-		ipstring += ":" + addrSplit[1]
-	}
+// Done returns a chan which is closed once Shutdown has completed.
+func (p *Proxy) Done() <-chan struct{} {
+	return p.done
+}
 
+// Serve serves proxy clients on l, dispatching game packets to a worker
+// process if Options.Worker is configured. It blocks until l fails, returning
+// the error, or until Shutdown is called, returning nil.
+func (p *Proxy) Serve(l net.Listener) error {
 	for _, cb := range onStartCbs {
 		cb(p.Logger)
 	}
+	p.listener = newConnListener(l, p.events)
+	p.listener.clients = p.clients
+	p.listener.tunnels = p.tunnels
+	p.closeOnShutdown(p.listener)
+	if p.options.Worker.Address != "" {
+		p.worker = newWorkerClient(&p.options.Worker, p.Logger)
+	} else {
+		go p.serveAdmin()
+	}
+	if p.options.Cluster.Self != "" {
+		if err := p.startCluster(); err != nil {
+			return err
+		}
+	}
+	if err := p.serveTenants(); err != nil {
+		return err
+	}
+	if err := p.serveReverse(); err != nil {
+		return err
+	}
+	p.Printf("proxy server listening on %s", strings.Join(listenAddrs(p.options.Address, l.Addr()), ", "))
+	handler := http.Handler(p.server)
+	if p.pairing != nil {
+		handler = p.pairingGate(handler)
+		p.startPairing()
+	}
+	return p.serveHTTP(p.listener, handler)
+}
+
+// closeOnShutdown registers a listener to be closed by Shutdown, closing it
+// immediately if the proxy is already shut down.
+func (p *Proxy) closeOnShutdown(l io.Closer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopping() {
+		l.Close()
+		return
+	}
+	p.listeners = append(p.listeners, l)
+}
+
+// stopping reports whether Shutdown has been called.
+func (p *Proxy) stopping() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
 
-	p.Printf("proxy server listening on %s", ipstring)
-	err := http.ListenAndServe(p.options.Address, p.server)
-	p.Warnln(err)
-	panic(err)
+// Events returns the bus on which the proxy publishes events.
+func (p *Proxy) Events() *events.Bus {
+	return p.events
 }
 
-// Shutdown calls Shutdown on all modules for all users.
+// Shutdown closes the proxy's listeners and calls Shutdown on all modules for
+// all users, closing Done once complete. Calls after the first do nothing.
 func (p *Proxy) Shutdown() {
-	for _, dispatch := range p.dispatches {
-		for _, mod := range dispatch.modules {
-			if mod.shutdownCB != nil {
-				mod.shutdownCB(true)
-			}
+	p.stopOnce.Do(func() {
+		p.mutex.Lock()
+		close(p.stop)
+		for _, l := range p.listeners {
+			l.Close()
 		}
-	}
+		dispatches := make([]*dispatch, 0, len(p.dispatches))
+		for _, dispatch := range p.dispatches {
+			dispatches = append(dispatches, dispatch)
+		}
+		p.mutex.Unlock()
+		for _, t := range p.tenants {
+			t.Shutdown()
+		}
+		p.shutdownUsers(dispatches, p.shutdownTimeout)
+		p.notifier.Close()
+		p.memory.close()
+		if p.bridge != nil {
+			p.bridge.Close()
+		}
+		close(p.done)
+	})
 }
 
 // getUser returns a Dispatch for the specified UID
@@ -205,33 +766,123 @@ func (p *Proxy) getUser(UID, region string) *dispatch {
 
 // addUser records a user's information indexed by their UID, if a record belonging to
 // the specified UID already exists, its hooks will be shutdown and the record will be overwritten.
-func (p *Proxy) addUser(UID, region string) *dispatch {
+// Returns an error if the UID is malformed.
+func (p *Proxy) addUser(UID, region string, client *ClientInfo) (*dispatch, error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
+	return p.addUserLocked(UID, region, client)
+}
+
+// addUserLocked is addUser for callers holding p.mutex.
+func (p *Proxy) addUserLocked(UID, region string, client *ClientInfo) (*dispatch, error) {
+	UIDint, err := strconv.Atoi(UID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID %q", UID)
+	}
 	rUID := region + "_" + UID
 
+	var previous *ClientInfo
 	if dispatch, exists := p.dispatches[rUID]; exists {
 		p.Printf("%s reconnecting. Shutting down mods.", rUID)
-		for _, module := range dispatch.modules {
-			if module.shutdownCB != nil {
-				module.shutdownCB(true)
-			}
-		}
+		previous = dispatch.clientInfo()
+		dispatch.shutdown(true)
 	} else {
 		p.Printf("User %s logged in", rUID)
 	}
 
-	UIDint, err := strconv.Atoi(UID)
-	utils.Check(err)
+	key := p.userKey(UID, region, client)
+	if key != rUID {
+		p.Printf("%s keyed as %s", rUID, key)
+	}
+
+	logger, logFile := p.userLogger(rUID)
 	d := &dispatch{
 		mutex:         &sync.Mutex{},
 		noUnknownJSON: p.options.NoUnknownJSON,
+		failClosed:    p.options.FailClosed,
+		breaker:       p.breaker,
+		dryRunMode:    p.options.DryRun,
+		moduleTimeout: p.moduleTimeout,
 		uid:           UIDint,
 		region:        region,
+		key:           key,
 		hooks:         make(map[string][]*PacketHook),
-		Logger:        p.Logger,
+		spilledHooks:  make(map[string][]*PacketHook),
+		events:        p.events,
+		store:         p.store,
+		packets:       p.packets,
+		recorder:      p.recorder,
+		stream:        p.stream,
+		notifier:      p.notifier,
+		client:        client,
+		since:         time.Now(),
+		recent:        newRecentPackets(recentPacketsSize(p.options)),
+		capture:       p.capture,
+		stop:          make(chan struct{}),
+		logFile:       logFile,
+		Logger:        logger,
+	}
+	d.initMods(p.enabledModules())
+	if lead := p.options.Annihilation.lead(p.Logger); lead > 0 {
+		go d.runAnnihilationReminder(lead)
+	}
+	if !p.options.DisableCountdowns {
+		content := p.content
+		if content == nil {
+			content = gamedataContent(p.Logger)
+		}
+		go d.runCountdowns(content)
+	}
+	if p.options.ShareState {
+		d.shareState(rUID, p.instance)
 	}
-	d.initMods(modules)
 	p.dispatches[rUID] = d
-	return d
+	d.checkLoginConflict(previous)
+	return d, nil
+}
+
+// enabledModules returns the registered modules excluding optional modules
+// which are not enabled in the options, and modules not allowed in safe mode.
+func (p *Proxy) enabledModules() []initFunc {
+	ret := make([]initFunc, 0, len(modules))
+	for _, mod := range modules {
+		if mod.optional && !p.moduleEnabled(mod.name) {
+			continue
+		}
+		if p.options.SafeMode && !containsString(p.options.SafeModeModules, mod.name) {
+			continue
+		}
+		ret = append(ret, mod)
+	}
+	return ret
+}
+
+func (p *Proxy) moduleEnabled(name string) bool {
+	return containsString(p.options.Modules, name)
+}
+
+// listenAddrs returns the addresses clients can reach the proxy on, formatted
+// with brackets around IPv6 addresses. A listener on an unspecified address is
+// reachable on the machine's outbound addresses, only IPv4 ones if the
+// configured address was 0.0.0.0.
+func listenAddrs(configured string, addr net.Addr) []string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return []string{addr.String()}
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		return []string{net.JoinHostPort(host, port)}
+	}
+	configuredHost, _, _ := net.SplitHostPort(configured)
+	var ret []string
+	for _, outbound := range utils.GetOutboundIPs() {
+		if configuredHost == "0.0.0.0" && net.ParseIP(outbound).To4() == nil {
+			continue
+		}
+		ret = append(ret, net.JoinHostPort(outbound, port))
+	}
+	if len(ret) == 0 {
+		ret = append(ret, net.JoinHostPort("localhost", port))
+	}
+	return ret
 }
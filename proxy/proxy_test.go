@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestServeShutdown(t *testing.T) {
+	p, err := New(&Options{
+		Logger:   log.New(false, false, "/dev/null", 0),
+		Store:    storage.NewMemoryStore(),
+		EventBus: events.NewBus(nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- p.Serve(l) }()
+	time.Sleep(50 * time.Millisecond)
+	p.Shutdown()
+	p.Shutdown()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Serve to return nil after Shutdown, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("Expected Done to be closed after Shutdown")
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	registered := modules
+	defer func() { modules = registered }()
+	modules = []initFunc{{name: "A"}, {name: "B"}, {name: "C", optional: true}}
+	p := &Proxy{options: &Options{Modules: []string{"C"}}}
+	if got := len(p.enabledModules()); got != 3 {
+		t.Fatalf("Expected 3 modules enabled, got %d", got)
+	}
+	p.options.SafeMode = true
+	if got := p.enabledModules(); len(got) != 0 {
+		t.Fatalf("Expected no modules enabled in safe mode, got %d", len(got))
+	}
+	p.options.SafeModeModules = []string{"B", "C"}
+	got := p.enabledModules()
+	if len(got) != 2 || got[0].name != "B" || got[1].name != "C" {
+		t.Fatalf("Expected the allowed modules to be enabled, got %+v", got)
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/kyoukaya/rhine/packetlog"
+)
+
+// ParsePacketQuery parses a packet log query from URL query parameters: "user"
+// and "op" may be repeated, "from" and "to" are RFC 3339 times, "contains" is
+// a substring of the body, "path" is a gjson path and "changed" only returns
+// the packets whose value changed, see packetlog.Query.
+func ParsePacketQuery(values url.Values) (*packetlog.Query, error) {
+	q := &packetlog.Query{
+		Filter: packetlog.Filter{
+			Ops:      values["op"],
+			Contains: values.Get("contains"),
+		},
+		Users: values["user"],
+		Path:  values.Get("path"),
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return nil, err
+		}
+	}
+	if changed := values.Get("changed"); changed != "" {
+		if q.Changed, err = strconv.ParseBool(changed); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// handlePackets streams the packets of the logs written by the Packet Logger
+// matching the query parameters, see ParsePacketQuery, as JSON lines. "limit"
+// caps the number of packets returned. Only operators may query packets, as
+// they contain the users' account data.
+func (p *Proxy) handlePackets(w http.ResponseWriter, r *http.Request) {
+	if AdminRole(r) != RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	q, err := ParsePacketQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := -1
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err = packetlog.Run(packetlog.Dir(), q, func(res *packetlog.Result) bool {
+		if limit == 0 {
+			return false
+		}
+		limit--
+		return enc.Encode(res) == nil
+	})
+	if err != nil {
+		p.Warnf("Failed to query packet logs: %s", err)
+	}
+}
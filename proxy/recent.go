@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/kyoukaya/rhine/recorder"
+)
+
+// defaultRecentPackets is the number of packets kept for each user unless
+// Options.RecentPackets is set.
+const defaultRecentPackets = 50
+
+// recentPackets is a ring of the last packets dispatched for a user.
+type recentPackets struct {
+	mutex   sync.Mutex
+	packets []*recorder.Packet
+	next    int
+}
+
+// newRecentPackets returns a ring of the last size packets, nil if size isn't
+// positive.
+func newRecentPackets(size int) *recentPackets {
+	if size <= 0 {
+		return nil
+	}
+	return &recentPackets{packets: make([]*recorder.Packet, 0, size)}
+}
+
+// recentPacketsSize returns the number of packets kept for each user, see
+// Options.RecentPackets.
+func recentPacketsSize(options *Options) int {
+	if options.RecentPackets == 0 {
+		return defaultRecentPackets
+	}
+	return options.RecentPackets
+}
+
+func (r *recentPackets) add(packet *recorder.Packet) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.packets) < cap(r.packets) {
+		r.packets = append(r.packets, packet)
+		return
+	}
+	r.packets[r.next] = packet
+	r.next = (r.next + 1) % len(r.packets)
+}
+
+// list returns the packets, most recent first.
+func (r *recentPackets) list() []*recorder.Packet {
+	ret := []*recorder.Packet{}
+	if r == nil {
+		return ret
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := len(r.packets) - 1; i >= 0; i-- {
+		ret = append(ret, r.packets[(r.next+i)%len(r.packets)])
+	}
+	return ret
+}
+
+// RecentPackets returns the last packets dispatched for the module's user,
+// most recent first, see Options.RecentPackets. The packets' bodies are shared
+// and must not be modified.
+func (m *RhineModule) RecentPackets() []*recorder.Packet {
+	return m.dispatch.recent.list()
+}
+
+// RecentPackets returns the last packets dispatched for the user, e.g.,
+// "GL_1234", most recent first, see Options.RecentPackets. The packets' bodies
+// are shared and must not be modified.
+func (p *Proxy) RecentPackets(rUID string) ([]*recorder.Packet, error) {
+	d := p.findDispatch(rUID)
+	if d == nil {
+		return nil, errUserNotFound
+	}
+	return d.recent.list(), nil
+}
+
+// handleRecent serves the last packets dispatched for the user in the "user"
+// query parameter, most recent first, at most "limit" of them if set. Only
+// operators may read them, as they contain the user's account data.
+func (p *Proxy) handleRecent(w http.ResponseWriter, r *http.Request) {
+	if AdminRole(r) != RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	packets, err := p.RecentPackets(query.Get("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit < len(packets) {
+			packets = packets[:limit]
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(packets)
+}
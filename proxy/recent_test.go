@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/recorder"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestRecentPackets(t *testing.T) {
+	if r := newRecentPackets(recentPacketsSize(&Options{RecentPackets: -1})); r != nil {
+		t.Fatal("Expected no packets to be kept with a negative size")
+	}
+	r := newRecentPackets(recentPacketsSize(&Options{}))
+	for i := 0; i < defaultRecentPackets+2; i++ {
+		r.add(recorder.NewPacket(time.Now(), "1", "GL", "S/op"+strconv.Itoa(i), []byte("{}")))
+	}
+	got := r.list()
+	if len(got) != defaultRecentPackets {
+		t.Fatalf("Expected %d packets kept, got %d", defaultRecentPackets, len(got))
+	}
+	if got[0].Op != "S/op51" || got[len(got)-1].Op != "S/op2" {
+		t.Fatalf("Expected the most recent packets first, got %s to %s", got[0].Op, got[len(got)-1].Op)
+	}
+}
+
+func TestHandleRecent(t *testing.T) {
+	p := newTestProxy()
+	p.admin = p.newAdminMux()
+	p.options.Admin.Tokens = map[string]Role{"view": RoleViewer}
+	d := p.getUser("1", "GL")
+	d.run("C/quest/battleStart", []byte(`{"stageId":"main_01-07"}`), &goproxy.ProxyCtx{})
+	d.run("S/quest/battleStart", []byte(`{"result":0}`), &goproxy.ProxyCtx{})
+	handler := requireToken(p.adminTokens("secret"), p.admin)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/users/recent?user=GL_1&token=view", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected viewers not to read the packets, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/users/recent?user=GL_1&limit=1&token=secret", nil))
+	var packets []recorder.Packet
+	if err := json.NewDecoder(w.Body).Decode(&packets); err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || packets[0].Op != "S/quest/battleStart" || string(packets[0].Body) != `{"result":0}` {
+		t.Fatalf("Expected the last packet with its body, got %+v", packets)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/users/recent?user=GL_2&token=secret", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected an unknown user to be reported, got %d", w.Code)
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/redis"
+)
+
+// RedisOptions configures Redis as the backend of the store and for sharing
+// events between instances connected to the same server.
+type RedisOptions struct {
+	// Address of the server, e.g., "127.0.0.1:6379". Disabled if empty.
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	// Prefix is prepended to all keys and channels, defaults to "rhine:".
+	Prefix string `json:"prefix"`
+	// Topics are the event topics shared with the other instances, e.g.,
+	// "semantic/battleFinished".
+	Topics []string `json:"topics"`
+}
+
+// sharedPayloads are the payload types of the topics published by Rhine, used
+// to decode events received from other instances.
+var sharedPayloads = map[string]interface{}{
+	TopicConnOpened:                  &ConnOpened{},
+	TopicTLSSession:                  &TLSSession{},
+	TopicConnClosed:                  &ConnClosed{},
+	TopicSessionConflict:             &SessionConflict{},
+	TopicWSMessage:                   &WSMessage{},
+	semantic.TopicLoginCompleted:     &semantic.LoginCompleted{},
+	semantic.TopicBattleFinished:     &semantic.BattleFinished{},
+	semantic.TopicRecruitFinished:    &semantic.RecruitFinished{},
+	semantic.TopicGachaPulled:        &semantic.GachaPulled{},
+	semantic.TopicSanityChanged:      &semantic.SanityChanged{},
+	semantic.TopicMissionDone:        &semantic.MissionDone{},
+	semantic.TopicSupportsSynced:     &semantic.SupportsSynced{},
+	semantic.TopicOperatorProgressed: &semantic.OperatorProgressed{},
+	semantic.TopicContentEnding:      &semantic.ContentEnding{},
+	semantic.TopicDailyReset:         &semantic.DailyReset{},
+	semantic.TopicWeeklyReset:        &semantic.WeeklyReset{},
+}
+
+func (options *RedisOptions) prefix() string {
+	if options.Prefix == "" {
+		return "rhine:"
+	}
+	return options.Prefix
+}
+
+// startRedisBridge shares the configured topics of the bus with the other
+// instances, returning nil if no topics are configured or the bridge failed.
+func startRedisBridge(client *redis.Client, options *RedisOptions, bus *events.Bus, instance string, logger log.Logger) *redis.Bridge {
+	if len(options.Topics) == 0 {
+		return nil
+	}
+	bridge := redis.NewBridge(client, bus, options.prefix()+"events", instance, logger)
+	for topic, payload := range sharedPayloads {
+		bridge.RegisterPayload(topic, payload)
+	}
+	if err := bridge.Start(); err != nil {
+		logger.Warnf("Event sharing disabled: %s", err)
+		return nil
+	}
+	for _, topic := range options.Topics {
+		bridge.Share(topic)
+	}
+	return bridge
+}
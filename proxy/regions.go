@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/kyoukaya/rhine/utils/gamedata"
+)
+
+// gameHost is the host of a game server and the region it serves.
+type gameHost struct {
+	host   string
+	region string
+}
+
+// gameHosts are the game servers of each region, the first of a region being
+// the one packets are replayed to.
+var gameHosts = []gameHost{
+	{"gs.arknights.global", "GL"},
+	{"gs.arknights.jp", "JP"},
+	{"gs.arknights.kr", "KR"},
+	{"ak-gs-gf.hypergryph.com", "CN"}, // Official
+	{"ak-gs-b.hypergryph.com", "CN"},  // Bilibili
+	{"gs.arknights.tw", "TW"},
+}
+
+var defaultRegions = newRegions(nil)
+
+// regions resolves the region of the game servers, see Options.GameHosts.
+type regions struct {
+	hosts []gameHost
+}
+
+// newRegions returns the regions of the built in game servers and the extra
+// hosts, which take precedence, mapped to their region.
+func newRegions(extra map[string]string) *regions {
+	r := &regions{}
+	for host, region := range extra {
+		r.hosts = append(r.hosts, gameHost{strings.ToLower(host), region})
+	}
+	r.hosts = append(r.hosts, gameHosts...)
+	return r
+}
+
+// ofHost returns the region of the game server at host, with or without a
+// port, reporting whether host is a game server.
+func (r *regions) ofHost(host string) (string, bool) {
+	if r == nil {
+		r = defaultRegions
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(host)
+	for _, h := range r.hosts {
+		if h.host == host {
+			return h.region, true
+		}
+	}
+	return "", false
+}
+
+// known reports whether region has a game server.
+func (r *regions) known(region string) bool {
+	return r.host(region) != ""
+}
+
+// host returns the first game server of region, empty if it has none.
+func (r *regions) host(region string) string {
+	if r == nil {
+		r = defaultRegions
+	}
+	for _, h := range r.hosts {
+		if h.region == region {
+			return h.host
+		}
+	}
+	return ""
+}
+
+// supportedRegion reports whether region has gamedata, which the dispatches
+// of the region's users require.
+func supportedRegion(region string) bool {
+	for _, r := range gamedata.Regions() {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
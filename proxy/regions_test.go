@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+func TestRegions(t *testing.T) {
+	r := newRegions(map[string]string{"GS.example.com": "GL", "gs.arknights.tw": "XX"})
+	for _, test := range []struct {
+		host, region string
+		ok           bool
+	}{
+		{"gs.arknights.global:8443", "GL", true},
+		{"gs.arknights.kr:443", "KR", true},
+		{"ak-gs-gf.hypergryph.com:443", "CN", true},
+		{"ak-gs-b.hypergryph.com", "CN", true},
+		{"gs.example.com:8443", "GL", true},
+		{"gs.arknights.tw:8443", "XX", true},
+		{"example.com:443", "", false},
+	} {
+		if region, ok := r.ofHost(test.host); region != test.region || ok != test.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", test.host, test.region, test.ok, region, ok)
+		}
+	}
+	if region, ok := defaultRegions.ofHost("gs.arknights.tw:443"); region != "TW" || !ok {
+		t.Errorf("Expected the built in TW server, got %q %v", region, ok)
+	}
+	if !r.known("CN") || !r.known("XX") || r.known("ZZ") {
+		t.Fatal("Expected the regions with game servers to be known")
+	}
+	if host := r.host("CN"); host != "ak-gs-gf.hypergryph.com" {
+		t.Fatalf("Expected the official CN server to be the region's first, got %s", host)
+	}
+}
+
+func TestGameHostRegions(t *testing.T) {
+	if !supportedRegion("TW") || supportedRegion("XX") {
+		t.Fatal("Expected only regions with gamedata to be supported")
+	}
+	_, err := New(&Options{
+		Logger:    log.New(false, false, "/dev/null", 0),
+		GameHosts: map[string]string{"gs.example.com": "XX"},
+	})
+	if err == nil {
+		t.Fatal("Expected a game host of an unknown region to be rejected")
+	}
+}
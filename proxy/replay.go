@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/recorder"
+)
+
+// PacketSource is a source of recorded packets, e.g., a replay.Source.
+type PacketSource interface {
+	// Next returns the next packet, or io.EOF once there are none left.
+	Next() (*recorder.Packet, error)
+}
+
+// openRecorder opens the recording of the dispatched packets, nil if
+// Options.RecordPath isn't set.
+func openRecorder(options *Options) (*recorder.Writer, error) {
+	if options.RecordPath == "" {
+		return nil, nil
+	}
+	w, err := recorder.Create(options.RecordPath)
+	if err != nil {
+		return nil, fmt.Errorf("recording packets: %s", err)
+	}
+	return w, nil
+}
+
+// record keeps a packet in the user's recent packets, appends it to the
+// recording if packets are recorded, and publishes it to the /stream clients.
+func (d *dispatch) record(op string, data []byte) {
+	dispatchedPackets.Inc()
+	streaming := d.stream.active()
+	if d.recent == nil && d.recorder == nil && !streaming {
+		return
+	}
+	packet := recorder.NewPacket(time.Now(), strconv.Itoa(d.uid), d.region, op, data)
+	d.recent.add(packet)
+	if streaming {
+		d.stream.publish(packet)
+	}
+	if d.recorder == nil {
+		return
+	}
+	if err := d.recorder.WritePacket(packet); err != nil {
+		d.Warnf("Failed to record %s: %s", op, err)
+	}
+}
+
+// replayURL returns the URL of the game server receiving op in region.
+func (p *Proxy) replayURL(region, op string) string {
+	host := p.regions.host(region)
+	if host == "" {
+		host = gameHosts[0].host
+	}
+	return "https://" + host + ":8443/" + op[strings.Index(op, "/")+1:]
+}
+
+// Replay dispatches the packets of src to the modules of their users as if
+// they were received by the proxy, returning the number of packets
+// dispatched. Users are logged in by their recorded login requests, the
+// packets of users who aren't logged in yet being skipped. Nothing is sent to
+// the game servers and the changes hooks make to the packets are discarded.
+func (p *Proxy) Replay(src PacketSource) (int, error) {
+	r := p.newReplayer()
+	n := 0
+	for {
+		packet, err := src.Next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if r.replay(packet) {
+			n++
+		}
+	}
+}
+
+// replayer dispatches recorded packets, see Replay.
+type replayer struct {
+	*Proxy
+	service *workerService
+	// requests are the bodies of the last request of each user and op, which
+	// responses are dispatched along with.
+	requests map[string][]byte
+}
+
+func (p *Proxy) newReplayer() *replayer {
+	return &replayer{Proxy: p, service: &workerService{p}, requests: make(map[string][]byte)}
+}
+
+// replay dispatches a packet, reporting whether it belonged to a logged in
+// user.
+func (r *replayer) replay(packet *recorder.Packet) bool {
+	op := packet.Op
+	if !strings.HasPrefix(op, "C/") && !strings.HasPrefix(op, "S/") {
+		return false
+	}
+	key := packet.Region + "_" + packet.UID + op[1:]
+	pkt := &WorkerPacket{
+		Op:     op,
+		UID:    packet.UID,
+		Region: packet.Region,
+		URL:    r.replayURL(packet.Region, op),
+		Header: make(http.Header),
+		Body:   packet.Data(),
+	}
+	if op == "C/account/login" {
+		pkt.UID = ""
+	}
+	if strings.HasPrefix(op, "S/") {
+		pkt.StatusCode = http.StatusOK
+		pkt.RequestHeader = make(http.Header)
+		pkt.RequestData = r.requests[key]
+	} else {
+		r.requests[key] = pkt.Body
+	}
+	reply := &WorkerReply{}
+	if err := r.service.Dispatch(pkt, reply); err != nil {
+		r.Warnf("Failed to replay %s: %s", op, err)
+		return false
+	}
+	return reply.UID != ""
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/kyoukaya/rhine/recorder"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	var recording bytes.Buffer
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	d.recorder = recorder.NewWriter(&recording)
+	req := benchRequest("gs.arknights.global:8443", "/quest/battleStart")
+	d.dispatch("C/quest/battleStart", []byte(`{"stageId":"main_01-07"}`), &goproxy.ProxyCtx{Req: req, UserData: &RequestContext{}})
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	d.dispatch("S/quest/battleStart", []byte(`{"battleId":"1"}`), &goproxy.ProxyCtx{Req: req, Resp: resp, UserData: &RequestContext{}})
+	// Packets of users who aren't logged in are skipped.
+	recorder.NewWriter(&recording).WritePacket(recorder.NewPacket(time.Now(), "2", "GL", "S/quest/battleStart", []byte("{}")))
+
+	q := newTestProxy()
+	mod := &RhineModule{name: "test", dispatch: q.getUser("1", "GL")}
+	var stage, battle string
+	mod.Hook("S/quest/battleStart", 0, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+		stage, battle = string(GetRequestContext(pktCtx).RequestData), string(data)
+		return data
+	})
+	n, err := q.Replay(recorder.NewReader(&recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || stage != `{"stageId":"main_01-07"}` || battle != `{"battleId":"1"}` {
+		t.Fatalf("Expected the recorded packets to be replayed, got %d packets, %q and %q", n, stage, battle)
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -13,13 +14,33 @@ type RequestContext struct {
 	// Was the request blocked by the proxy
 	RequestIsBlocked bool
 	RequestOp        string
-	// Contains the request body. Nil if DispatchState is for a request.
+	// Contains the request body, nil if the body was not read as no handler
+	// wanted the request.
 	RequestData []byte
 	// Start time for handling the request
 	StartT time.Time
+	// sentT is when the request was forwarded upstream, zero if it was
+	// answered by the proxy.
+	sentT time.Time
 	// Contains the dispatch object for the corresponding user if this is
 	// a response to a game request.
 	dispatch *dispatch
+	// worker the request was dispatched to, along with the uid and region of
+	// its user.
+	worker *workerClient
+	uid    string
+	region string
+	// parseError is set while a packet whose body isn't valid JSON is being
+	// dispatched, see ParseError.
+	parseError error
+}
+
+// sent records that the request was forwarded upstream unless resp, the
+// response the request handler answered it with, is set.
+func (c *RequestContext) sent(resp *http.Response) {
+	if resp == nil {
+		c.sentT = time.Now()
+	}
 }
 
 // GetRequestContext returns the dispatch context for a goproxy.ProxyCtx, will panic if
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/utils/servertime"
+)
+
+// runResetTimer publishes the daily and weekly reset events of the user's
+// region at the correct server times until the dispatch is stopped.
+func (d *dispatch) runResetTimer() {
+	for {
+		next, err := servertime.NextDailyReset(d.region, time.Now())
+		if err != nil {
+			d.Warnf("Not publishing reset events for %s: %s", d.region, err)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-d.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		d.publish(semantic.TopicDailyReset, &semantic.DailyReset{Time: next})
+		if weekly, err := servertime.LastWeeklyReset(d.region, next); err == nil && weekly.Equal(next) {
+			d.publish(semantic.TopicWeeklyReset, &semantic.WeeklyReset{Time: next})
+		}
+	}
+}
+
+// publish publishes an event for the dispatch's user.
+func (d *dispatch) publish(topic string, payload interface{}) {
+	d.events.Publish(events.Event{
+		Topic:   topic,
+		UID:     d.uid,
+		Region:  d.region,
+		Payload: payload,
+	})
+}
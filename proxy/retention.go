@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+const defaultRetentionInterval = time.Hour
+
+// RetentionOptions configures pruning the data the proxy accumulates on disk,
+// nothing is pruned by default.
+type RetentionOptions struct {
+	// Interval is the time between prunings, e.g., "30m". Defaults to 1h.
+	Interval string `json:"interval"`
+	// Logs are the text logs in the logs directory, e.g., the Drop Logger's,
+	// excluding the proxy's own log which is recreated on every start.
+	Logs RetentionPolicy `json:"logs"`
+	// Captures are the packet logs written by the Packet Logger, along with
+	// their indexes. The newest log of each user is kept as it may be open.
+	Captures RetentionPolicy `json:"captures"`
+	// CompressCaptures compresses the packet logs with gzip, except the newest
+	// of each user's.
+	CompressCaptures bool `json:"compressCaptures"`
+	// History are the daily records of each user's history in the store,
+	// MaxSizeMB doesn't apply to them.
+	History RetentionPolicy `json:"history"`
+}
+
+// RetentionPolicy bounds the data of a class, the oldest data being pruned
+// first.
+type RetentionPolicy struct {
+	// MaxAge is the age above which data is pruned, e.g., "720h".
+	MaxAge string `json:"maxAge"`
+	// MaxSizeMB is the total size above which the oldest data is pruned.
+	MaxSizeMB int64 `json:"maxSizeMB"`
+}
+
+// retentionFile is a file subject to a retention policy, its related files,
+// e.g., a packet log's index, are pruned along with it. Kept files count
+// towards the total size but aren't pruned.
+type retentionFile struct {
+	path    string
+	related []string
+	size    int64
+	modTime time.Time
+	keep    bool
+}
+
+// pruned returns the files to prune under the policy, oldest first.
+func pruned(files []retentionFile, maxAge time.Duration, maxSize int64, now time.Time) []retentionFile {
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	var ret []retentionFile
+	for _, f := range files {
+		if f.keep {
+			continue
+		}
+		if (maxAge > 0 && now.Sub(f.modTime) > maxAge) || (maxSize > 0 && total > maxSize) {
+			ret = append(ret, f)
+			total -= f.size
+		}
+	}
+	return ret
+}
+
+// logFiles returns the text logs under dir, excluding the packet logs and
+// the proxy's log.
+func logFiles(dir, proxyLog string) ([]retentionFile, error) {
+	var files []retentionFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == packetlog.Dir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".log") && path != proxyLog {
+			files = append(files, retentionFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// captureFiles returns the packet logs under dir, keeping the newest of each
+// user's.
+func captureFiles(dir string) ([]retentionFile, error) {
+	users, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	var files []retentionFile
+	for _, user := range users {
+		logs, err := packetlog.Logs(user)
+		if err != nil {
+			return nil, err
+		}
+		for i, path := range logs {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			f := retentionFile{path: path, size: info.Size(), modTime: info.ModTime(), keep: i == len(logs)-1}
+			if idx, err := os.Stat(packetlog.IndexPath(path)); err == nil {
+				f.related = []string{packetlog.IndexPath(path)}
+				f.size += idx.Size()
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// pruneHistory deletes the history records of the days older than maxAge.
+func pruneHistory(store storage.Store, maxAge time.Duration, now time.Time) (int, error) {
+	keys, err := store.Keys(historyPrefix)
+	if err != nil {
+		return 0, err
+	}
+	oldest := now.Add(-maxAge).UTC().Format("2006-01-02")
+	n := 0
+	for _, key := range keys {
+		// Keys end with the record's date, see appendHistory.
+		if date := key[strings.LastIndex(key, "/")+1:]; date >= oldest {
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// retention prunes the data of each class under its policy.
+type retention struct {
+	options  *RetentionOptions
+	store    storage.Store
+	logDir   string
+	proxyLog string
+	log.Logger
+}
+
+func (r *retention) policy(name string, policy *RetentionPolicy) (time.Duration, int64) {
+	return parseDuration("retention."+name+".maxAge", policy.MaxAge, r.Logger), policy.MaxSizeMB << 20
+}
+
+// compressCaptures compresses the packet logs which are no longer written to.
+func (r *retention) compressCaptures() {
+	files, err := captureFiles(packetlog.Dir())
+	if err != nil {
+		r.Warnf("Failed to list captures to compress: %s", err)
+		return
+	}
+	for _, f := range files {
+		if f.keep || !strings.HasSuffix(f.path, ".log") {
+			continue
+		}
+		if _, err := packetlog.Compress(f.path); err != nil {
+			r.Warnf("Failed to compress %s: %s", f.path, err)
+		}
+	}
+}
+
+// prune prunes the data of every class once, compressing the captures first if
+// enabled.
+func (r *retention) prune(now time.Time) {
+	if r.options.CompressCaptures {
+		r.compressCaptures()
+	}
+	classes := []struct {
+		name   string
+		policy *RetentionPolicy
+		files  func() ([]retentionFile, error)
+	}{
+		{"logs", &r.options.Logs, func() ([]retentionFile, error) { return logFiles(r.logDir, r.proxyLog) }},
+		{"captures", &r.options.Captures, func() ([]retentionFile, error) { return captureFiles(packetlog.Dir()) }},
+	}
+	for _, class := range classes {
+		maxAge, maxSize := r.policy(class.name, class.policy)
+		if maxAge <= 0 && maxSize <= 0 {
+			continue
+		}
+		files, err := class.files()
+		if err != nil {
+			r.Warnf("Failed to list %s to prune: %s", class.name, err)
+			continue
+		}
+		var size int64
+		deleted := 0
+		for _, f := range pruned(files, maxAge, maxSize, now) {
+			if err := os.Remove(f.path); err != nil {
+				r.Warnf("Failed to prune %s: %s", f.path, err)
+				continue
+			}
+			for _, related := range f.related {
+				os.Remove(related)
+			}
+			size += f.size
+			deleted++
+		}
+		if deleted > 0 {
+			r.Printf("Pruned %d %s files, %dMB", deleted, class.name, size>>20)
+		}
+	}
+	if maxAge, _ := r.policy("history", &r.options.History); maxAge > 0 {
+		n, err := pruneHistory(r.store, maxAge, now)
+		if err != nil {
+			r.Warnf("Failed to prune history: %s", err)
+		}
+		if n > 0 {
+			r.Printf("Pruned %d days of history", n)
+		}
+	}
+}
+
+// startRetention prunes the data under the retention policies on start and
+// at every interval until the proxy is shut down.
+func (p *Proxy) startRetention() {
+	options := &p.options.Retention
+	if options.Logs == (RetentionPolicy{}) && options.Captures == (RetentionPolicy{}) &&
+		options.History == (RetentionPolicy{}) && !options.CompressCaptures {
+		return
+	}
+	interval := parseDuration("retention.interval", options.Interval, p.Logger)
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	proxyLog := p.options.LogPath
+	if proxyLog == "" {
+		proxyLog = "logs/proxy.log"
+	}
+	r := &retention{
+		options:  options,
+		store:    p.store,
+		logDir:   filepath.Join(utils.BinDir, "logs"),
+		proxyLog: filepath.Clean(configPath(proxyLog)),
+		Logger:   p.Logger,
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			r.prune(time.Now())
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := utils.BinDir
+	defer func() { utils.BinDir = binDir }()
+	utils.BinDir = dir
+
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	write := func(path string, size int, age time.Duration) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logs := filepath.Join(dir, "logs")
+	write(filepath.Join(logs, "proxy.log"), 10, 100*time.Hour)
+	write(filepath.Join(logs, "Drop Logger", "GL_1.log"), 10, 100*time.Hour)
+	write(filepath.Join(logs, "Drop Logger", "GL_2.log"), 10, time.Hour)
+	captures := packetlog.UserDir("GL_1")
+	old := filepath.Join(captures, "2020-01-01_00.00.00.log")
+	write(old, 1<<20, 3*time.Hour)
+	write(packetlog.IndexPath(old), 10, 3*time.Hour)
+	write(filepath.Join(captures, "2020-01-02_00.00.00.log"), 1<<20, 2*time.Hour)
+	newest := filepath.Join(captures, "2020-01-03_00.00.00.log")
+	write(newest, 1<<20, time.Hour)
+
+	store := storage.NewMemoryStore()
+	_ = store.Put(historyPrefix+"drops/GL_1/2020-01-01", []byte("[]"))
+	_ = store.Put(historyPrefix+"drops/GL_1/2020-02-29", []byte("[]"))
+
+	r := &retention{
+		options: &RetentionOptions{
+			Logs:     RetentionPolicy{MaxAge: "48h"},
+			Captures: RetentionPolicy{MaxSizeMB: 1},
+			History:  RetentionPolicy{MaxAge: "240h"},
+		},
+		store:    store,
+		logDir:   logs,
+		proxyLog: filepath.Join(logs, "proxy.log"),
+		Logger:   log.New(false, false, "/dev/null", 0),
+	}
+	r.prune(now)
+
+	for path, exists := range map[string]bool{
+		filepath.Join(logs, "proxy.log"):               true,
+		filepath.Join(logs, "Drop Logger", "GL_1.log"): false,
+		filepath.Join(logs, "Drop Logger", "GL_2.log"): true,
+		old:                      false,
+		packetlog.IndexPath(old): false,
+		filepath.Join(captures, "2020-01-02_00.00.00.log"): false,
+		newest: true,
+	} {
+		if _, err := os.Stat(path); (err == nil) != exists {
+			t.Errorf("%s: expected exists to be %t", path, exists)
+		}
+	}
+	keys, _ := store.Keys(historyPrefix)
+	if len(keys) != 1 || keys[0] != historyPrefix+"drops/GL_1/2020-02-29" {
+		t.Fatalf("Unexpected history %q", keys)
+	}
+}
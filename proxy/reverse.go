@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/kyoukaya/rhine/utils"
+)
+
+// defaultReverseHosts returns the hosts served in reverse proxy mode by
+// default, the game servers of each region.
+func defaultReverseHosts() []string {
+	hosts := make([]string, 0, len(gameHosts))
+	for _, h := range gameHosts {
+		hosts = append(hosts, net.JoinHostPort(h.host, "8443"))
+	}
+	return hosts
+}
+
+// ReverseOptions configures serving a fixed set of the game's hosts as an
+// HTTPS reverse proxy, for devices whose DNS resolves the hosts to the proxy
+// instead of being configured to use it as an HTTP proxy, which some
+// emulators and routers handle more reliably. The proxy's own host must
+// resolve the hosts to the real servers. The explicit proxy keeps being
+// served on Options.Address.
+type ReverseOptions struct {
+	Enable bool `json:"enable"`
+	// Hosts are the hosts served along with the port the game connects to,
+	// e.g., "gs.arknights.global:8443". A listener is opened on each of their
+	// ports. Defaults to the game servers of every region.
+	Hosts []string `json:"hosts"`
+	// BindAddress is the IP the listeners are bound to, defaults to all.
+	BindAddress string `json:"bindAddress"`
+}
+
+// reverseHosts returns the hosts to serve, grouped by port.
+func (o *ReverseOptions) reverseHosts() (map[string][]string, error) {
+	hosts := o.Hosts
+	if len(hosts) == 0 {
+		hosts = defaultReverseHosts()
+	}
+	ports := make(map[string][]string)
+	for _, host := range hosts {
+		hostname, port, err := net.SplitHostPort(host)
+		if err != nil || hostname == "" || port == "" {
+			return nil, fmt.Errorf("invalid reverse proxy host %q, expected host:port", host)
+		}
+		ports[port] = append(ports[port], strings.ToLower(hostname))
+	}
+	return ports, nil
+}
+
+// reverseHandler serves the requests for hostnames received on port through
+// the proxy, as if they were sent through a CONNECT to the host.
+func (p *Proxy) reverseHandler(port string, hostnames []string) http.Handler {
+	served := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		served[hostname] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			hostname = h
+		}
+		hostname = strings.ToLower(hostname)
+		if !served[hostname] {
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		if !p.pairing.allowed(r.RemoteAddr) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		p.clients.seen(r.RemoteAddr, r.UserAgent())
+		r.URL.Scheme = "https"
+		r.URL.Host = net.JoinHostPort(hostname, port)
+		r.Host = r.URL.Host
+		r.RequestURI = ""
+		p.server.ServeHTTP(w, r)
+	})
+}
+
+// serveReverse opens the listeners of the reverse proxy mode if it's enabled.
+// Clients with a device CA are served certificates signed by it.
+func (p *Proxy) serveReverse() error {
+	options := &p.options.Reverse
+	if !options.Enable {
+		return nil
+	}
+	ports, err := options.reverseHosts()
+	if err != nil {
+		return err
+	}
+	var all []string
+	for _, hostnames := range ports {
+		all = append(all, hostnames...)
+	}
+	sort.Strings(all)
+	cert, _, _, err := utils.SignCert(&goproxy.GoproxyCa, all[0], all, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if p.cas != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			ca := p.cas.match(hello.Conn.RemoteAddr().String())
+			if ca == nil || hello.ServerName == "" {
+				return nil, nil
+			}
+			deviceConfig, err := ca.tlsConfig(hello.ServerName)
+			if err != nil {
+				return nil, err
+			}
+			deviceConfig.MinVersion = config.MinVersion
+			deviceConfig.NextProtos = config.NextProtos
+			return deviceConfig, nil
+		}
+	}
+	for port, hostnames := range ports {
+		l, err := tls.Listen("tcp", net.JoinHostPort(options.BindAddress, port), config)
+		if err != nil {
+			return fmt.Errorf("reverse proxy: %s", err)
+		}
+		p.closeOnShutdown(l)
+		p.Printf("reverse proxy for %s listening on %s", strings.Join(hostnames, ", "), l.Addr())
+		go func(l net.Listener, handler http.Handler) {
+			if err := p.serveHTTP(l, handler); err != nil {
+				p.Warnln(err)
+			}
+		}(l, p.reverseHandler(port, hostnames))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestReverseHandler(t *testing.T) {
+	var upstreamHost string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost = r.Host
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy()
+	p.server = goproxy.NewProxyHttpServer()
+	p.server.Tr = &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			return tls.Dial(network, upstream.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		},
+	}
+	p.server.OnRequest().DoFunc(p.HandleReq)
+	hooked := false
+	(&RhineModule{name: "test", dispatch: p.getUser("1", "GL")}).Hook("C/building/sync", 0,
+		func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+			hooked = true
+			return data
+		})
+	handler := p.reverseHandler("8443", []string{"gs.arknights.global"})
+
+	req := httptest.NewRequest("POST", "https://gs.arknights.global/building/sync", bytes.NewReader(benchBody))
+	req.Header.Set("uid", "1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "{}" {
+		t.Fatalf("Expected the upstream's response, got %d %q", rec.Code, rec.Body.String())
+	}
+	if upstreamHost != "gs.arknights.global:8443" {
+		t.Fatalf("Expected the request to be forwarded to the served host, got %q", upstreamHost)
+	}
+	if !hooked {
+		t.Fatal("Expected the request to be dispatched to the hooks")
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Fatalf("Expected hosts which aren't served to be refused, got %d", rec.Code)
+	}
+}
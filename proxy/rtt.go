@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+// rttWindow is the number of recent samples the RTT stats of a region are
+// computed from.
+const rttWindow = 100
+
+var (
+	upstreamRTT = metrics.NewGaugeVec("rhine_upstream_rtt_ms",
+		"Mean time in milliseconds game servers took to respond to recent requests.", "region")
+	proxyTime = metrics.NewGaugeVec("rhine_dispatch_time_ms",
+		"Mean time in milliseconds the proxy spent dispatching recent game packets.", "region")
+)
+
+// RTTStats are the recent latencies of a region's game server in milliseconds,
+// from forwarding a request to receiving the response's headers. ProxyMean is
+// the time the proxy spent dispatching the request and response, telling a
+// slow server apart from a slow proxy.
+type RTTStats struct {
+	Region  string  `json:"region"`
+	Samples int     `json:"samples"`
+	Last    float64 `json:"lastMs"`
+	Mean    float64 `json:"meanMs"`
+	P50     float64 `json:"p50Ms"`
+	P95     float64 `json:"p95Ms"`
+	// ProxyMean is the mean dispatch time, excluding spilled responses and
+	// packets dispatched to a worker.
+	ProxyMean float64 `json:"proxyMeanMs"`
+}
+
+// rttSamples are rings of a region's recent samples.
+type rttSamples struct {
+	rtt, proxy         []time.Duration
+	rttNext, proxyNext int
+	last               time.Duration
+}
+
+// pushSample adds a sample to the ring, replacing the oldest once full.
+func pushSample(ring []time.Duration, next int, d time.Duration) ([]time.Duration, int) {
+	if len(ring) < rttWindow {
+		return append(ring, d), 0
+	}
+	ring[next] = d
+	return ring, (next + 1) % rttWindow
+}
+
+func meanDuration(ds []time.Duration) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return sum / time.Duration(len(ds))
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// rttTracker records the recent latencies of each region.
+type rttTracker struct {
+	mutex   sync.Mutex
+	regions map[string]*rttSamples
+}
+
+func newRTTTracker() *rttTracker {
+	return &rttTracker{regions: make(map[string]*rttSamples)}
+}
+
+func (t *rttTracker) samples(region string) *rttSamples {
+	s := t.regions[region]
+	if s == nil {
+		s = &rttSamples{}
+		t.regions[region] = s
+	}
+	return s
+}
+
+// rtt records the time a request of the region took to be answered.
+func (t *rttTracker) rtt(region string, d time.Duration) {
+	if t == nil || region == "" {
+		return
+	}
+	t.mutex.Lock()
+	s := t.samples(region)
+	s.rtt, s.rttNext = pushSample(s.rtt, s.rttNext, d)
+	s.last = d
+	mean := meanDuration(s.rtt)
+	t.mutex.Unlock()
+	upstreamRTT.With(region).Set(mean.Milliseconds())
+}
+
+// dispatched records the time the proxy spent dispatching a packet of the
+// region.
+func (t *rttTracker) dispatched(region string, d time.Duration) {
+	if t == nil || region == "" {
+		return
+	}
+	t.mutex.Lock()
+	s := t.samples(region)
+	s.proxy, s.proxyNext = pushSample(s.proxy, s.proxyNext, d)
+	mean := meanDuration(s.proxy)
+	t.mutex.Unlock()
+	proxyTime.With(region).Set(mean.Milliseconds())
+}
+
+// stats returns the stats of each region, ordered by region.
+func (t *rttTracker) stats() []RTTStats {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ret := make([]RTTStats, 0, len(t.regions))
+	for region, s := range t.regions {
+		stats := RTTStats{
+			Region:    region,
+			Samples:   len(s.rtt),
+			Last:      millis(s.last),
+			Mean:      millis(meanDuration(s.rtt)),
+			ProxyMean: millis(meanDuration(s.proxy)),
+		}
+		if len(s.rtt) > 0 {
+			sorted := append([]time.Duration(nil), s.rtt...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			stats.P50 = millis(sorted[len(sorted)/2])
+			stats.P95 = millis(sorted[len(sorted)*95/100])
+		}
+		ret = append(ret, stats)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Region < ret[j].Region })
+	return ret
+}
+
+// RTT returns the recent latencies of the game server of each region users
+// played on since the proxy started.
+func (p *Proxy) RTT() []RTTStats {
+	return p.rtt.stats()
+}
+
+// handleRTT serves the recent latencies of each region's game server.
+func (p *Proxy) handleRTT(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.RTT())
+}
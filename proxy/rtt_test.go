@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestRTTTracker(t *testing.T) {
+	tracker := newRTTTracker()
+	for i := 1; i <= rttWindow+10; i++ {
+		tracker.rtt("GL", time.Duration(i)*time.Millisecond)
+	}
+	tracker.dispatched("GL", 2*time.Millisecond)
+	tracker.rtt("JP", 50*time.Millisecond)
+	stats := tracker.stats()
+	if len(stats) != 2 || stats[0].Region != "GL" || stats[1].Region != "JP" {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	gl := stats[0]
+	// The window holds the samples 11 to 110.
+	if gl.Samples != rttWindow || gl.Last != 110 || gl.Mean != 60.5 || gl.P50 != 61 || gl.P95 != 106 || gl.ProxyMean != 2 {
+		t.Fatalf("Unexpected stats %+v", gl)
+	}
+}
+
+func TestHandleRespRTT(t *testing.T) {
+	p := newTestProxy()
+	p.rtt = newRTTTracker()
+	req := benchRequest("gs.arknights.global:8443", "/quest/battleStart")
+	ctx := &goproxy.ProxyCtx{Req: req}
+	p.HandleReq(req, ctx)
+	time.Sleep(5 * time.Millisecond)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("{}"))),
+	}
+	ctx.Resp = resp
+	p.HandleResp(resp, ctx)
+	stats := p.RTT()
+	if len(stats) != 1 || stats[0].Region != "GL" || stats[0].Samples != 1 || stats[0].Last < 5 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
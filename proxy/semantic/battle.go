@@ -0,0 +1,151 @@
+package semantic
+
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+)
+
+// DropKind is the category of a battle's reward, matching the drop types
+// reported to Penguin Statistics.
+type DropKind string
+
+// Kinds of drops, see Drop.
+const (
+	DropNormal    DropKind = "NORMAL_DROP"
+	DropSpecial   DropKind = "SPECIAL_DROP"
+	DropExtra     DropKind = "EXTRA_DROP"
+	DropFurniture DropKind = "FURNITURE"
+	DropFirst     DropKind = "FIRST_DROP"
+)
+
+// goldID is the item ID of LMD.
+const goldID = "4001"
+
+// SquadMember is an operator deployed in a battle.
+type SquadMember struct {
+	CharInstID int64  `json:"charInstId"`
+	CharID     string `json:"charId,omitempty"`
+	SkillIndex int64  `json:"skillIndex"`
+}
+
+// BattleResult is the outcome of a battle, parsed by ParseBattleResult.
+type BattleResult struct {
+	StageID  string
+	Practice bool
+	// Completed is false if the battle was lost or abandoned.
+	Completed bool
+	// Stars is 3 for a perfect clear, 2 for other clears and 0 if the battle
+	// wasn't completed. The response doesn't tell one and two star clears
+	// apart.
+	Stars int
+	// Drops are the battle's rewards, with the counts of an item summed per
+	// kind and empty rewards left out. First clear rewards are in FirstClear.
+	Drops      []Drop
+	FirstClear []Drop
+	// Squad are the operators deployed, in the order of their slots, without
+	// the support unit. CharID is only set if the user's operators are known.
+	Squad []SquadMember
+}
+
+// ThreeStar reports whether the battle was a perfect clear.
+func (r *BattleResult) ThreeStar() bool {
+	return r.Stars == 3
+}
+
+// Items returns the counts of the items dropped, regardless of their kind,
+// leaving out LMD if gold is false.
+func (r *BattleResult) Items(gold bool) map[string]int64 {
+	items := make(map[string]int64, len(r.Drops))
+	for _, drop := range r.Drops {
+		if gold || drop.ID != goldID {
+			items[drop.ID] += drop.Count
+		}
+	}
+	return items
+}
+
+// normalizeDrops sums the counts of each item in drops, keeping the order
+// items first appear in and leaving out empty rewards.
+func normalizeDrops(drops []Drop, kind DropKind) []Drop {
+	var ret []Drop
+	index := make(map[string]int, len(drops))
+	for _, drop := range drops {
+		if drop.ID == "" || drop.Count <= 0 {
+			continue
+		}
+		if i, ok := index[drop.ID]; ok {
+			ret[i].Count += drop.Count
+			continue
+		}
+		drop.Kind = kind
+		index[drop.ID] = len(ret)
+		ret = append(ret, drop)
+	}
+	return ret
+}
+
+// ParseBattleResult parses a battle's result from the C/quest/battleStart
+// request which started it and the S/quest/battleFinish response. start may be
+// nil if the request wasn't seen, leaving the stage and squad unset.
+func ParseBattleResult(start, finish []byte) (*BattleResult, error) {
+	var r struct {
+		ExpScale          float64 `json:"expScale"`
+		Rewards           []Drop  `json:"rewards"`
+		FirstRewards      []Drop  `json:"firstRewards"`
+		UnusualRewards    []Drop  `json:"unusualRewards"`
+		AdditionalRewards []Drop  `json:"additionalRewards"`
+		FurnitureRewards  []Drop  `json:"furnitureRewards"`
+	}
+	if err := json.Unmarshal(finish, &r); err != nil {
+		return nil, err
+	}
+	result := &BattleResult{Completed: r.ExpScale > 0}
+	switch {
+	case r.ExpScale >= 1.2:
+		result.Stars = 3
+	case result.Completed:
+		result.Stars = 2
+	}
+	for _, rewards := range []struct {
+		drops []Drop
+		kind  DropKind
+	}{
+		{r.Rewards, DropNormal},
+		{r.UnusualRewards, DropSpecial},
+		{r.AdditionalRewards, DropExtra},
+		{r.FurnitureRewards, DropFurniture},
+	} {
+		result.Drops = append(result.Drops, normalizeDrops(rewards.drops, rewards.kind)...)
+	}
+	result.FirstClear = normalizeDrops(r.FirstRewards, DropFirst)
+
+	if start != nil {
+		req := gjson.ParseBytes(start)
+		result.StageID = req.Get("stageId").String()
+		result.Practice = req.Get("usePracticeTicket").Bool()
+		for _, slot := range req.Get("squad.slots").Array() {
+			if slot.Type != gjson.JSON {
+				continue
+			}
+			result.Squad = append(result.Squad, SquadMember{
+				CharInstID: slot.Get("charInstId").Int(),
+				SkillIndex: slot.Get("skillIndex").Int(),
+			})
+		}
+	}
+	return result, nil
+}
+
+func (t *translator) battleFinish(data []byte) {
+	result, err := ParseBattleResult(t.battleStart, data)
+	if err != nil {
+		return
+	}
+	for i := range result.Squad {
+		if c := t.chars[result.Squad[i].CharInstID]; c != nil {
+			result.Squad[i].CharID = c.charID
+		}
+	}
+	t.publish(TopicBattleFinished, &BattleFinished{BattleResult: *result})
+}
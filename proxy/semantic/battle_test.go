@@ -0,0 +1,72 @@
+package semantic
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kyoukaya/rhine/events"
+)
+
+func TestParseBattleResult(t *testing.T) {
+	start := []byte(`{"stageId":"main_01-07","usePracticeTicket":0,"squad":{"squadId":"0","slots":[
+		{"charInstId":3,"skillIndex":0},null,{"charInstId":12,"skillIndex":1}]}}`)
+	finish := []byte(`{"result":0,"expScale":1.2,"rewards":[
+		{"type":"MATERIAL","id":"30012","count":1},{"type":"GOLD","id":"4001","count":12},
+		{"type":"MATERIAL","id":"30012","count":2},{"type":"MATERIAL","id":"30011","count":0}],
+		"firstRewards":[{"type":"DIAMOND","id":"4002","count":1}],
+		"unusualRewards":[],"additionalRewards":[{"type":"MATERIAL","id":"30012","count":1}],
+		"furnitureRewards":[]}`)
+	result, err := ParseBattleResult(start, finish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &BattleResult{
+		StageID:   "main_01-07",
+		Completed: true,
+		Stars:     3,
+		Drops: []Drop{
+			{ID: "30012", Count: 3, Type: "MATERIAL", Kind: DropNormal},
+			{ID: "4001", Count: 12, Type: "GOLD", Kind: DropNormal},
+			{ID: "30012", Count: 1, Type: "MATERIAL", Kind: DropExtra},
+		},
+		FirstClear: []Drop{{ID: "4002", Count: 1, Type: "DIAMOND", Kind: DropFirst}},
+		Squad:      []SquadMember{{CharInstID: 3}, {CharInstID: 12, SkillIndex: 1}},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, result)
+	}
+	if items := result.Items(false); !reflect.DeepEqual(items, map[string]int64{"30012": 4}) {
+		t.Fatalf("Unexpected items %v", items)
+	}
+
+	result, err = ParseBattleResult(nil, []byte(`{"result":1,"expScale":0,"rewards":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Completed || result.Stars != 0 || result.ThreeStar() {
+		t.Fatalf("Expected a failed battle, got %+v", result)
+	}
+}
+
+func TestBattleFinishedSquad(t *testing.T) {
+	bus := events.NewBus(nil)
+	listener := make(chan events.Event, 1)
+	bus.Subscribe(TopicBattleFinished, listener)
+	handle := New(bus, 1, "GL")
+	handle("S/account/syncData", []byte(`{"user":{"troop":{"chars":{"3":{"charId":"char_002_amiya"}}}}}`), nil)
+	handle("S/gacha/finishNormalGacha", []byte(`{"playerDataDelta":{"modified":{"troop":{"chars":{"12":{"charId":"char_285_medic2"}}}}}}`), nil)
+	handle("C/quest/battleStart", []byte(`{"stageId":"main_00-01","squad":{"slots":[{"charInstId":3},{"charInstId":12},{"charInstId":40}]}}`), nil)
+	handle("S/quest/battleFinish", []byte(`{"expScale":1.0}`), nil)
+
+	battle := (<-listener).Payload.(*BattleFinished)
+	charIDs := make([]string, len(battle.Squad))
+	for i, member := range battle.Squad {
+		charIDs[i] = member.CharID
+	}
+	if !reflect.DeepEqual(charIDs, []string{"char_002_amiya", "char_285_medic2", ""}) {
+		t.Fatalf("Unexpected squad %v", charIDs)
+	}
+	if battle.StageID != "main_00-01" || battle.Stars != 2 {
+		t.Fatalf("Unexpected battle %+v", battle)
+	}
+}
@@ -0,0 +1,26 @@
+package semantic
+
+import "time"
+
+// TopicContentEnding is the topic of ContentEnding events.
+const TopicContentEnding = "semantic/contentEnding"
+
+// Kinds of limited time content, see ContentEnding.
+const (
+	ContentEvent  = "event"
+	ContentBanner = "banner"
+)
+
+// ContentEnding is published for every connected user when an event or banner
+// of their region ends in 24 hours, and again when it ends in an hour.
+type ContentEnding struct {
+	// Kind is ContentEvent or ContentBanner.
+	Kind string
+	// ID is the activity ID of an event or the pool ID of a banner.
+	ID        string
+	Name      string
+	StartTime time.Time
+	EndTime   time.Time
+	// Remaining is the time left until the content ends.
+	Remaining time.Duration
+}
@@ -0,0 +1,147 @@
+package semantic
+
+import (
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+// TopicOperatorProgressed is the topic of OperatorProgressed events.
+const TopicOperatorProgressed = "semantic/operatorProgressed"
+
+// ProgressKind is the kind of an operator's progression.
+type ProgressKind string
+
+// Kinds of progression, see ProgressChange.
+const (
+	ProgressElite      ProgressKind = "elite"
+	ProgressLevel      ProgressKind = "level"
+	ProgressSkillLevel ProgressKind = "skillLevel"
+	ProgressMastery    ProgressKind = "mastery"
+	ProgressModule     ProgressKind = "module"
+)
+
+// ProgressChange is a single change of an operator's progression.
+type ProgressChange struct {
+	Kind ProgressKind
+	// ID is the skill ID of a mastery, or the module's ID.
+	ID  string `json:",omitempty"`
+	Old int64
+	New int64
+}
+
+// OperatorProgressed is published when the elite phase, level, skill level,
+// skill masteries or modules of one of the user's operators change. Operators
+// joining the user aren't reported.
+type OperatorProgressed struct {
+	CharInstID int64
+	CharID     string
+	Changes    []ProgressChange
+}
+
+// charProgress is the progression of an operator, see troop.chars.
+type charProgress struct {
+	charID      string
+	elite       int64
+	level       int64
+	skillLevel  int64
+	masteries   map[string]int64
+	moduleLevel map[string]int64
+}
+
+// parseCharProgress returns the progression of an operator from an entry of
+// troop.chars. Fields missing from a delta are copied from old, if set.
+func parseCharProgress(value gjson.Result, old *charProgress) *charProgress {
+	c := &charProgress{masteries: make(map[string]int64), moduleLevel: make(map[string]int64)}
+	if old != nil {
+		*c = *old
+		c.masteries = make(map[string]int64, len(old.masteries))
+		for id, level := range old.masteries {
+			c.masteries[id] = level
+		}
+		c.moduleLevel = make(map[string]int64, len(old.moduleLevel))
+		for id, level := range old.moduleLevel {
+			c.moduleLevel[id] = level
+		}
+	}
+	if v := value.Get("charId"); v.Exists() {
+		c.charID = v.String()
+	}
+	if v := value.Get("evolvePhase"); v.Exists() {
+		c.elite = v.Int()
+	}
+	if v := value.Get("level"); v.Exists() {
+		c.level = v.Int()
+	}
+	if v := value.Get("mainSkillLvl"); v.Exists() {
+		c.skillLevel = v.Int()
+	}
+	for _, skill := range value.Get("skills").Array() {
+		if id := skill.Get("skillId").String(); id != "" {
+			c.masteries[id] = skill.Get("specializeLevel").Int()
+		}
+	}
+	value.Get("equip").ForEach(func(key, equip gjson.Result) bool {
+		c.moduleLevel[key.String()] = equip.Get("level").Int()
+		return true
+	})
+	return c
+}
+
+// changes returns the progression from old to c, which must be parsed from a
+// delta of old.
+func (c *charProgress) changes(old *charProgress) []ProgressChange {
+	var ret []ProgressChange
+	if c.elite != old.elite {
+		ret = append(ret, ProgressChange{Kind: ProgressElite, Old: old.elite, New: c.elite})
+	}
+	if c.level != old.level {
+		ret = append(ret, ProgressChange{Kind: ProgressLevel, Old: old.level, New: c.level})
+	}
+	if c.skillLevel != old.skillLevel {
+		ret = append(ret, ProgressChange{Kind: ProgressSkillLevel, Old: old.skillLevel, New: c.skillLevel})
+	}
+	for _, id := range sortedKeys(c.masteries) {
+		if level := c.masteries[id]; level != old.masteries[id] {
+			ret = append(ret, ProgressChange{Kind: ProgressMastery, ID: id, Old: old.masteries[id], New: level})
+		}
+	}
+	for _, id := range sortedKeys(c.moduleLevel) {
+		if level := c.moduleLevel[id]; level != old.moduleLevel[id] {
+			ret = append(ret, ProgressChange{Kind: ProgressModule, ID: id, Old: old.moduleLevel[id], New: level})
+		}
+	}
+	return ret
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// updateChars records the progression of the user's operators from a
+// troop.chars object keyed by their instance IDs, publishing the changes if
+// the object is a delta.
+func (t *translator) updateChars(chars gjson.Result, delta bool) {
+	chars.ForEach(func(key, value gjson.Result) bool {
+		instID := key.Int()
+		old := t.chars[instID]
+		c := parseCharProgress(value, old)
+		t.chars[instID] = c
+		if !delta || old == nil {
+			return true
+		}
+		if changes := c.changes(old); len(changes) > 0 {
+			t.publish(TopicOperatorProgressed, &OperatorProgressed{
+				CharInstID: instID,
+				CharID:     c.charID,
+				Changes:    changes,
+			})
+		}
+		return true
+	})
+}
@@ -0,0 +1,44 @@
+package semantic
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kyoukaya/rhine/events"
+)
+
+func TestOperatorProgressed(t *testing.T) {
+	bus := events.NewBus(nil)
+	listener := make(chan events.Event, 4)
+	bus.Subscribe(TopicOperatorProgressed, listener)
+	handle := New(bus, 1, "GL")
+	handle("S/account/syncData", []byte(`{"user":{"troop":{"chars":{"3":{"charId":"char_002_amiya",
+		"evolvePhase":1,"level":80,"mainSkillLvl":7,"skills":[{"skillId":"skchr_amiya_1","specializeLevel":2},
+		{"skillId":"skchr_amiya_2","specializeLevel":0}],"equip":{"uniequip_001_amiya":{"level":1}}}}}}}`), nil)
+	handle("S/char/upgradeSpecialize", []byte(`{"playerDataDelta":{"modified":{"troop":{"chars":{"3":{
+		"skills":[{"skillId":"skchr_amiya_1","specializeLevel":3},{"skillId":"skchr_amiya_2","specializeLevel":0}]}}}}}`), nil)
+	handle("S/char/evolveChar", []byte(`{"playerDataDelta":{"modified":{"troop":{"chars":{"3":{"evolvePhase":2,"level":1}}}}}}`), nil)
+	handle("S/gacha/finishNormalGacha", []byte(`{"playerDataDelta":{"modified":{"troop":{"chars":{"12":{"charId":"char_285_medic2","level":1}}}}}}`), nil)
+	handle("S/char/upgradeChar", []byte(`{"playerDataDelta":{"modified":{"troop":{"chars":{"3":{"level":1}}}}}}`), nil)
+
+	mastery := (<-listener).Payload.(*OperatorProgressed)
+	expected := &OperatorProgressed{CharInstID: 3, CharID: "char_002_amiya", Changes: []ProgressChange{
+		{Kind: ProgressMastery, ID: "skchr_amiya_1", Old: 2, New: 3},
+	}}
+	if !reflect.DeepEqual(mastery, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, mastery)
+	}
+	elite := (<-listener).Payload.(*OperatorProgressed)
+	expected.Changes = []ProgressChange{
+		{Kind: ProgressElite, Old: 1, New: 2},
+		{Kind: ProgressLevel, Old: 80, New: 1},
+	}
+	if !reflect.DeepEqual(elite, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, elite)
+	}
+	select {
+	case evt := <-listener:
+		t.Fatalf("Unexpected event %+v", evt.Payload)
+	default:
+	}
+}
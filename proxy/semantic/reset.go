@@ -0,0 +1,21 @@
+package semantic
+
+import "time"
+
+// Topics of the server reset events.
+const (
+	TopicDailyReset  = "semantic/dailyReset"
+	TopicWeeklyReset = "semantic/weeklyReset"
+)
+
+// DailyReset is published for every connected user when their server resets
+// daily.
+type DailyReset struct {
+	Time time.Time
+}
+
+// WeeklyReset is published for every connected user when their server resets
+// weekly, after the DailyReset of the same instant.
+type WeeklyReset struct {
+	Time time.Time
+}
@@ -0,0 +1,207 @@
+// Package semantic translates raw game packets into typed domain events which
+// are published on an events.Bus, so that modules can react to things like
+// battles finishing or sanity changing without knowing endpoint paths or
+// payload shapes.
+package semantic
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/kyoukaya/rhine/events"
+
+	"github.com/elazarl/goproxy"
+	"github.com/tidwall/gjson"
+)
+
+// Topics of the events published by the translator.
+const (
+	TopicLoginCompleted  = "semantic/loginCompleted"
+	TopicBattleFinished  = "semantic/battleFinished"
+	TopicRecruitFinished = "semantic/recruitFinished"
+	TopicGachaPulled     = "semantic/gachaPulled"
+	TopicSanityChanged   = "semantic/sanityChanged"
+	TopicMissionDone     = "semantic/missionDone"
+)
+
+// LoginCompleted is published once the initial sync data has been received.
+type LoginCompleted struct {
+	UID      int
+	Region   string
+	NickName string
+}
+
+// Drop is a single reward from a battle.
+type Drop struct {
+	ID    string   `json:"id"`
+	Count int64    `json:"count"`
+	Type  string   `json:"type"`
+	Kind  DropKind `json:"kind,omitempty"`
+}
+
+// BattleFinished is published when a battle's results are received.
+type BattleFinished struct {
+	BattleResult
+}
+
+// RecruitFinished is published when the operator from a recruitment slot is
+// collected.
+type RecruitFinished struct {
+	SlotID int64
+	CharID string
+	IsNew  bool
+}
+
+// GachaResult is a single operator obtained from headhunting.
+type GachaResult struct {
+	CharID string `json:"charId"`
+	IsNew  bool   `json:"isNew"`
+}
+
+// GachaPulled is published for every single or ten roll headhunt.
+type GachaPulled struct {
+	PoolID  string
+	Results []GachaResult
+}
+
+// SanityChanged is published whenever the user's sanity is modified by the
+// server.
+type SanityChanged struct {
+	Old int64
+	New int64
+	Max int64
+}
+
+// MissionDone is published when the rewards of a mission are claimed.
+type MissionDone struct {
+	MissionID string
+	Rewards   []Drop
+}
+
+// translator keeps the state needed to correlate requests with responses.
+type translator struct {
+	mutex  sync.Mutex
+	bus    *events.Bus
+	uid    int
+	region string
+	// battleStart is the request of the battle in progress.
+	battleStart []byte
+	// chars maps the instance IDs of the user's operators to their
+	// progression.
+	chars       map[int64]*charProgress
+	poolID      string
+	recruitSlot int64
+	missionID   string
+	ap          int64
+	maxAp       int64
+}
+
+// requestOps are the client requests read by the translator, all server
+// responses are read.
+var requestOps = map[string]bool{
+	"C/quest/battleStart":       true,
+	"C/gacha/finishNormalGacha": true,
+	"C/gacha/advancedGacha":     true,
+	"C/gacha/tenAdvancedGacha":  true,
+	"C/mission/confirmMission":  true,
+}
+
+// WantsRequest reports whether the translator reads the client request op.
+func WantsRequest(op string) bool {
+	return requestOps[op]
+}
+
+// New returns a callback for the proxy to call on every game packet of a user,
+// publishing the derived events on the bus.
+func New(bus *events.Bus, uid int, region string) func(string, []byte, *goproxy.ProxyCtx) {
+	t := &translator{bus: bus, uid: uid, region: region, chars: make(map[int64]*charProgress)}
+	return t.handle
+}
+
+func (t *translator) publish(topic string, payload interface{}) {
+	t.bus.Publish(events.Event{
+		Topic:   topic,
+		UID:     t.uid,
+		Region:  t.region,
+		Payload: payload,
+	})
+}
+
+func (t *translator) handle(op string, data []byte, pktCtx *goproxy.ProxyCtx) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch op {
+	case "C/quest/battleStart":
+		t.battleStart = append([]byte(nil), data...)
+	case "S/quest/battleFinish":
+		t.battleFinish(data)
+	case "C/gacha/finishNormalGacha":
+		t.recruitSlot = gjson.GetBytes(data, "slotId").Int()
+	case "S/gacha/finishNormalGacha":
+		charGet := gjson.GetBytes(data, "charGet")
+		t.publish(TopicRecruitFinished, &RecruitFinished{
+			SlotID: t.recruitSlot,
+			CharID: charGet.Get("charId").String(),
+			IsNew:  charGet.Get("isNew").Bool(),
+		})
+	case "C/gacha/advancedGacha", "C/gacha/tenAdvancedGacha":
+		t.poolID = gjson.GetBytes(data, "poolId").String()
+	case "S/gacha/advancedGacha":
+		charGet := gjson.GetBytes(data, "charGet")
+		t.publish(TopicGachaPulled, &GachaPulled{
+			PoolID: t.poolID,
+			Results: []GachaResult{{
+				CharID: charGet.Get("charId").String(),
+				IsNew:  charGet.Get("isNew").Bool(),
+			}},
+		})
+	case "S/gacha/tenAdvancedGacha":
+		var results []GachaResult
+		_ = json.Unmarshal([]byte(gjson.GetBytes(data, "gachaResultList").Raw), &results)
+		t.publish(TopicGachaPulled, &GachaPulled{PoolID: t.poolID, Results: results})
+	case "C/mission/confirmMission":
+		t.missionID = gjson.GetBytes(data, "missionId").String()
+	case "S/mission/confirmMission":
+		var rewards []Drop
+		_ = json.Unmarshal([]byte(gjson.GetBytes(data, "items").Raw), &rewards)
+		t.publish(TopicMissionDone, &MissionDone{MissionID: t.missionID, Rewards: rewards})
+	case "S/account/syncData":
+		status := gjson.GetBytes(data, "user.status")
+		t.ap = status.Get("ap").Int()
+		t.maxAp = status.Get("maxAp").Int()
+		t.updateChars(gjson.GetBytes(data, "user.troop.chars"), false)
+		if social := gjson.GetBytes(data, "user.social"); social.Exists() {
+			t.supportsSynced(social.Get("assistCharList"), true, social.Get("yesterdayReward.assistAmount").Int())
+		}
+		t.publish(TopicLoginCompleted, &LoginCompleted{
+			UID:      t.uid,
+			Region:   t.region,
+			NickName: status.Get("nickName").String(),
+		})
+		return
+	}
+	if len(op) > 2 && op[0] == 'S' {
+		t.updateChars(gjson.GetBytes(data, "playerDataDelta.modified.troop.chars"), true)
+		t.sanityDelta(data)
+		if list := gjson.GetBytes(data, "playerDataDelta.modified.social.assistCharList"); list.Exists() {
+			t.supportsSynced(list, false, 0)
+		}
+	}
+}
+
+func (t *translator) sanityDelta(data []byte) {
+	status := gjson.GetBytes(data, "playerDataDelta.modified.status")
+	if !status.Exists() {
+		return
+	}
+	if maxAp := status.Get("maxAp"); maxAp.Exists() {
+		t.maxAp = maxAp.Int()
+	}
+	ap := status.Get("ap")
+	if !ap.Exists() || ap.Int() == t.ap {
+		return
+	}
+	evt := &SanityChanged{Old: t.ap, New: ap.Int(), Max: t.maxAp}
+	t.ap = ap.Int()
+	t.publish(TopicSanityChanged, evt)
+}
@@ -0,0 +1,40 @@
+package semantic
+
+import "github.com/tidwall/gjson"
+
+// TopicSupportsSynced is the topic of SupportsSynced events.
+const TopicSupportsSynced = "semantic/supportsSynced"
+
+// SupportsSynced is published on login and whenever the user changes the
+// operators lent to their friends as supports.
+type SupportsSynced struct {
+	// Supports are the operators lent, in the order of their slots. CharID is
+	// only set if the user's operators are known.
+	Supports []SquadMember
+	// Login is set for the event published on login, only which reports
+	// AssistCredits.
+	Login bool
+	// AssistCredits are the credits earned from friends using the supports on
+	// the previous day.
+	AssistCredits int64
+}
+
+// supportsSynced publishes the supports in an assistCharList, slots may be
+// null if empty.
+func (t *translator) supportsSynced(list gjson.Result, login bool, credits int64) {
+	evt := &SupportsSynced{Login: login, AssistCredits: credits}
+	for _, slot := range list.Array() {
+		if slot.Type != gjson.JSON {
+			continue
+		}
+		member := SquadMember{
+			CharInstID: slot.Get("charInstId").Int(),
+			SkillIndex: slot.Get("skillIndex").Int(),
+		}
+		if c := t.chars[member.CharInstID]; c != nil {
+			member.CharID = c.charID
+		}
+		evt.Supports = append(evt.Supports, member)
+	}
+	t.publish(TopicSupportsSynced, evt)
+}
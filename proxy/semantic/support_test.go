@@ -0,0 +1,32 @@
+package semantic
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kyoukaya/rhine/events"
+)
+
+func TestSupportsSynced(t *testing.T) {
+	bus := events.NewBus(nil)
+	listener := make(chan events.Event, 2)
+	bus.Subscribe(TopicSupportsSynced, listener)
+	handle := New(bus, 1, "GL")
+	handle("S/account/syncData", []byte(`{"user":{"troop":{"chars":{"3":{"charId":"char_002_amiya"}}},
+		"social":{"assistCharList":[{"charInstId":3,"skillIndex":1},null],"yesterdayReward":{"assistAmount":40}}}}`), nil)
+	handle("S/social/setAssistCharList", []byte(`{"playerDataDelta":{"modified":{"social":{"assistCharList":[null,{"charInstId":3,"skillIndex":0}]}}}}`), nil)
+
+	login := (<-listener).Payload.(*SupportsSynced)
+	expected := &SupportsSynced{
+		Supports:      []SquadMember{{CharInstID: 3, CharID: "char_002_amiya", SkillIndex: 1}},
+		Login:         true,
+		AssistCredits: 40,
+	}
+	if !reflect.DeepEqual(login, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, login)
+	}
+	changed := (<-listener).Payload.(*SupportsSynced)
+	if changed.Login || len(changed.Supports) != 1 || changed.Supports[0].SkillIndex != 0 {
+		t.Fatalf("Unexpected event %+v", changed)
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Session is a live user's state exported by an instance for another to
+// import, letting an instance be drained without its users logging in again.
+type Session struct {
+	UID    string          `json:"uid"`
+	Region string          `json:"region"`
+	State  json.RawMessage `json:"state"`
+}
+
+// ExportSession exports the session of the user, rUID being the user's region
+// and UID, e.g., "GL_1234".
+func (p *Proxy) ExportSession(rUID string) (*Session, error) {
+	p.mutex.Lock()
+	d := p.dispatches[rUID]
+	p.mutex.Unlock()
+	if d == nil {
+		return nil, errors.New("user not found")
+	}
+	// Snapshot blocks until the state is loaded.
+	if !d.state.IsLoaded() {
+		return nil, errors.New("gamestate not loaded")
+	}
+	state, err := d.state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{UID: strings.TrimPrefix(rUID, d.region+"_"), Region: d.region, State: state}, nil
+}
+
+// ImportSession resumes the user of a session exported by another instance,
+// replacing the user's dispatch if it exists.
+func (p *Proxy) ImportSession(s *Session) error {
+	if !p.regions.known(s.Region) {
+		return errors.New("unknown region")
+	}
+	if _, err := p.restoreUser(s.UID, s.Region, s.State); err != nil {
+		return err
+	}
+	if !p.options.ShareState {
+		return nil
+	}
+	// Claim the user so that it isn't resumed from an older shared state.
+	key := stateKey(s.Region + "_" + s.UID)
+	if err := p.store.Put(key+"state", s.State); err != nil {
+		return err
+	}
+	return p.store.Put(key+"instance", []byte(p.instance))
+}
+
+// handleSession exports the session of the user in the "user" query parameter
+// on GET, and imports the session in the body on POST. Only operators may do
+// either, as sessions contain the user's account data.
+func (p *Proxy) handleSession(w http.ResponseWriter, r *http.Request) {
+	if AdminRole(r) != RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		session, err := p.ExportSession(r.URL.Query().Get("user"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(session)
+	case "POST":
+		session := &Session{}
+		if err := json.NewDecoder(r.Body).Decode(session); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.ImportSession(session); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.Printf("Imported session of %s_%s", session.Region, session.UID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
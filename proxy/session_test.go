@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestSessionHandoff(t *testing.T) {
+	syncData, err := ioutil.ReadFile("gamestate/testdata/syncdata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestProxy()
+	a.admin = a.newAdminMux()
+	a.options.Admin.Tokens = map[string]Role{"view": RoleViewer}
+	req := benchRequest("gs.arknights.global:8443", "/account/syncData")
+	a.getUser("1", "GL").dispatch("S/account/syncData", syncData, &goproxy.ProxyCtx{Req: req})
+	handlerA := requireToken(a.adminTokens("secret"), a.admin)
+
+	export := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/session?user=GL_1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handlerA.ServeHTTP(w, req)
+		return w
+	}
+	if w := export("view"); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected viewers to be forbidden from exporting sessions, got %d", w.Code)
+	}
+	w := export("secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Export failed with %d: %s", w.Code, w.Body)
+	}
+
+	b := newTestProxy()
+	b.admin = b.newAdminMux()
+	b.dispatches = make(map[string]*dispatch)
+	req = httptest.NewRequest("POST", "/session", bytes.NewReader(w.Body.Bytes()))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	requireToken(b.adminTokens("secret"), b.admin).ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Import failed with %d: %s", w.Code, w.Body)
+	}
+	d := b.getUser("1", "GL")
+	if d == nil || !d.state.IsLoaded() {
+		t.Fatal("Expected the imported user to be resumed")
+	}
+
+	if err := b.ImportSession(&Session{UID: "x", Region: "GL"}); err == nil {
+		t.Fatal("Expected an invalid UID to be rejected")
+	}
+}
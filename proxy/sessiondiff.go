@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kyoukaya/rhine/packetlog"
+)
+
+// SessionDiff are the differences between two session bundles or snapshots,
+// e.g., from before and after a game update.
+type SessionDiff struct {
+	// State are the paths of the gamestate values which differ, e.g.,
+	// `status.ap: 10 -> 135`, empty if either has no gamestate.
+	State []string `json:"state"`
+	// AddedOps and RemovedOps are the ops observed only in the second or first
+	// bundle's packet logs respectively, empty if either is a snapshot.
+	AddedOps   []string `json:"addedOps"`
+	RemovedOps []string `json:"removedOps"`
+	// OpCounts are the number of packets of each op observed in either bundle,
+	// as pairs of the first and second bundle's counts.
+	OpCounts map[string][2]int `json:"opCounts"`
+}
+
+// sessionSource is the gamestate and ops of a bundle or snapshot.
+type sessionSource struct {
+	state json.RawMessage
+	ops   map[string]int
+}
+
+// DiffSessions compares the session bundles or snapshots at the paths. A
+// snapshot is a JSON file of a Session, as served by /session on the admin
+// listener, or of a bare gamestate.
+func DiffSessions(before, after string) (*SessionDiff, error) {
+	a, err := loadSessionSource(before)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", before, err)
+	}
+	b, err := loadSessionSource(after)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", after, err)
+	}
+	diff := &SessionDiff{State: []string{}, OpCounts: make(map[string][2]int)}
+	if a.state != nil && b.state != nil {
+		if diff.State = jsonChanges(a.state, b.state); diff.State == nil {
+			return nil, errors.New("invalid gamestate")
+		}
+	}
+	if a.ops == nil || b.ops == nil {
+		return diff, nil
+	}
+	for op, n := range a.ops {
+		counts := diff.OpCounts[op]
+		counts[0] = n
+		diff.OpCounts[op] = counts
+		if b.ops[op] == 0 {
+			diff.RemovedOps = append(diff.RemovedOps, op)
+		}
+	}
+	for op, n := range b.ops {
+		counts := diff.OpCounts[op]
+		counts[1] = n
+		diff.OpCounts[op] = counts
+		if a.ops[op] == 0 {
+			diff.AddedOps = append(diff.AddedOps, op)
+		}
+	}
+	sort.Strings(diff.AddedOps)
+	sort.Strings(diff.RemovedOps)
+	return diff, nil
+}
+
+// loadSessionSource loads a bundle if path is a zip archive, a snapshot
+// otherwise.
+func loadSessionSource(p string) (*sessionSource, error) {
+	if strings.EqualFold(path.Ext(p), ".zip") {
+		return loadBundleSource(p)
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(b, session); err != nil {
+		return nil, err
+	}
+	if session.State == nil {
+		// A bare gamestate.
+		session.State = b
+	}
+	return &sessionSource{state: session.State}, nil
+}
+
+func loadBundleSource(p string) (*sessionSource, error) {
+	archive, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	src := &sessionSource{ops: make(map[string]int)}
+	for _, f := range archive.File {
+		isLog := strings.HasPrefix(f.Name, bundleLogs)
+		if f.Name != bundleSession && !isLog {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !isLog {
+			session := &Session{}
+			if err := json.Unmarshal(b, session); err != nil {
+				return nil, err
+			}
+			src.state = session.State
+			continue
+		}
+		start, _ := packetlog.FileTime(f.Name)
+		err = packetlog.NewReader(bytes.NewReader(b), start).ForEach(func(p *packetlog.Packet) bool {
+			src.ops[p.Op]++
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+// Format returns a readable report of the differences.
+func (d *SessionDiff) Format() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Gamestate: %d changes\n", len(d.State))
+	for _, change := range d.State {
+		fmt.Fprintf(&b, "\t%s\n", change)
+	}
+	fmt.Fprintf(&b, "New endpoints: %d\n", len(d.AddedOps))
+	for _, op := range d.AddedOps {
+		fmt.Fprintf(&b, "\t%s (%d packets)\n", op, d.OpCounts[op][1])
+	}
+	fmt.Fprintf(&b, "Missing endpoints: %d\n", len(d.RemovedOps))
+	for _, op := range d.RemovedOps {
+		fmt.Fprintf(&b, "\t%s (%d packets)\n", op, d.OpCounts[op][0])
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestBundle(t *testing.T, path, state string, log string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	archive := zip.NewWriter(f)
+	if err := zipBytes(archive, bundleSession, []byte(`{"uid":"1","region":"GL","state":`+state+`}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipBytes(archive, bundleLogs+"2020-01-02_10.00.00.log", []byte(log)); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	before, after := filepath.Join(dir, "before.zip"), filepath.Join(dir, "after.zip")
+	writeTestBundle(t, before, `{"status":{"ap":10}}`,
+		"10:00:00 [S/account/syncData] {}\n10:00:01 [S/quest/battleStart] {}\n")
+	writeTestBundle(t, after, `{"status":{"ap":135}}`,
+		"10:00:00 [S/account/syncData] {}\n10:00:01 [S/quest/squadFormation] {}\n")
+
+	diff, err := DiffSessions(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"status.ap: 10 -> 135"}; !reflect.DeepEqual(diff.State, want) {
+		t.Fatalf("Expected state changes %q, got %q", want, diff.State)
+	}
+	if !reflect.DeepEqual(diff.AddedOps, []string{"S/quest/squadFormation"}) ||
+		!reflect.DeepEqual(diff.RemovedOps, []string{"S/quest/battleStart"}) {
+		t.Fatalf("Unexpected ops %+v", diff)
+	}
+	if diff.OpCounts["S/account/syncData"] != [2]int{1, 1} {
+		t.Fatalf("Unexpected op counts %+v", diff.OpCounts)
+	}
+
+	snapshot := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(snapshot, []byte(`{"status":{"ap":20}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = DiffSessions(before, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"status.ap: 10 -> 20"}; !reflect.DeepEqual(diff.State, want) {
+		t.Fatalf("Expected state changes %q, got %q", want, diff.State)
+	}
+	if len(diff.RemovedOps) != 0 {
+		t.Fatal("Expected no ops to be compared with a snapshot")
+	}
+}
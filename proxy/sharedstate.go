@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/storage"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ownerCheckInterval is how long findUser trusts that the user's shared state
+// wasn't saved by another instance before reading it from the store again.
+const ownerCheckInterval = 10 * time.Second
+
+// stateKey is the key prefix under which the gamestate of a user is shared,
+// the state is saved under "state" and the instance which saved it under
+// "instance".
+func stateKey(rUID string) string {
+	return "gamestate/" + rUID + "/"
+}
+
+// shareState saves the user's gamestate to the store whenever it changes until
+// the dispatch is shut down, saves are coalesced if the store falls behind.
+func (d *dispatch) shareState(rUID, instance string) {
+	key := stateKey(rUID)
+	changed := make(chan struct{}, 1)
+	d.coreHandlers = append(d.coreHandlers, func(op string, data []byte, ctx *goproxy.ProxyCtx) {
+		if !strings.HasPrefix(op, "S/") || !d.state.IsLoaded() {
+			return
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	go func() {
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-changed:
+			}
+			state, err := d.state.Snapshot()
+			if err == nil {
+				err = d.store.Put(key+"state", state)
+			}
+			if err == nil {
+				err = d.store.Put(key+"instance", []byte(instance))
+			}
+			if err != nil {
+				d.Warnf("Failed to share gamestate: %s", err)
+			}
+		}
+	}()
+}
+
+// restoreUser replaces the user's dispatch with one resumed from the state.
+// The dispatch is returned even if the state could not be restored, in which
+// case it waits for the user's next sync.
+func (p *Proxy) restoreUser(UID, region string, state []byte) (*dispatch, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.restoreUserLocked(UID, region, state)
+}
+
+// restoreUserLocked is restoreUser for callers holding p.mutex.
+func (p *Proxy) restoreUserLocked(UID, region string, state []byte) (*dispatch, error) {
+	d, err := p.addUserLocked(UID, region, nil)
+	if err != nil {
+		return nil, err
+	}
+	return d, d.state.Restore(state)
+}
+
+// findUser returns the user's dispatch like getUser. If the state is shared
+// and another instance has handled the user since, the user is resumed from
+// the state it saved instead. Whether another instance did is checked at most
+// every ownerCheckInterval.
+func (p *Proxy) findUser(UID, region string) *dispatch {
+	d := p.getUser(UID, region)
+	if !p.options.ShareState {
+		return d
+	}
+	if d != nil {
+		d.mutex.Lock()
+		checked := d.ownerChecked
+		d.mutex.Unlock()
+		if time.Since(checked) < ownerCheckInterval {
+			return d
+		}
+	}
+	key := stateKey(region + "_" + UID)
+	instance, err := p.store.Get(key + "instance")
+	if err != nil {
+		if err != storage.ErrNotFound {
+			p.Warnf("Failed to read shared gamestate: %s", err)
+		}
+		return d
+	}
+	if d != nil && string(instance) == p.instance {
+		d.mutex.Lock()
+		d.ownerChecked = time.Now()
+		d.mutex.Unlock()
+		return d
+	}
+	state, err := p.store.Get(key + "state")
+	if err != nil {
+		p.Warnf("Failed to read shared gamestate: %s", err)
+		return d
+	}
+	p.mutex.Lock()
+	if current := p.dispatches[region+"_"+UID]; current != d {
+		// Resumed by a concurrent request.
+		p.mutex.Unlock()
+		return current
+	}
+	p.Printf("Resuming %s_%s from the shared gamestate", region, UID)
+	d, err = p.restoreUserLocked(UID, region, state)
+	p.mutex.Unlock()
+	if err != nil {
+		p.Warnf("Failed to restore shared gamestate: %s", err)
+	}
+	// Claim the user so that it isn't resumed again before its state changes.
+	if err := p.store.Put(key+"instance", []byte(p.instance)); err != nil {
+		p.Warnf("Failed to share gamestate: %s", err)
+	}
+	return d
+}
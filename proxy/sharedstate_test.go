@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/storage"
+
+	"github.com/elazarl/goproxy"
+)
+
+func newSharingProxy(store storage.Store, instance string) *Proxy {
+	p := newTestProxy()
+	p.options.ShareState = true
+	p.store = store
+	p.instance = instance
+	p.dispatches = make(map[string]*dispatch)
+	return p
+}
+
+func TestSharedState(t *testing.T) {
+	syncData, err := ioutil.ReadFile("gamestate/testdata/syncdata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemoryStore()
+	a := newSharingProxy(store, "a")
+	d, err := a.addUser("1", "GL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := benchRequest("gs.arknights.global:8443", "/account/syncData")
+	d.dispatch("S/account/syncData", syncData, &goproxy.ProxyCtx{Req: req})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if instance, _ := store.Get(stateKey("GL_1") + "instance"); string(instance) == "a" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Gamestate was not shared")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b := newSharingProxy(store, "b")
+	req = benchRequest("gs.arknights.global:8443", "/building/sync")
+	b.HandleReq(req, &goproxy.ProxyCtx{Req: req})
+	resumed := b.getUser("1", "GL")
+	if resumed == nil || !resumed.state.IsLoaded() {
+		t.Fatal("Expected the user to be resumed from the shared gamestate")
+	}
+	if instance, _ := store.Get(stateKey("GL_1") + "instance"); string(instance) != "b" {
+		t.Fatalf("Expected the resuming instance to claim the user, got %q", instance)
+	}
+	// a's dispatch is stale now that b has handled the user.
+	if a.findUser("1", "GL") == d {
+		t.Fatal("Expected a stale user to be resumed")
+	}
+}
+
+func TestFindUserCachesOwnership(t *testing.T) {
+	store := storage.NewMemoryStore()
+	p := newSharingProxy(store, "a")
+	d, err := p.addUser("1", "GL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := stateKey("GL_1")
+	_ = store.Put(key+"instance", []byte("a"))
+	if p.findUser("1", "GL") != d {
+		t.Fatal("Expected the owned user's dispatch")
+	}
+	_ = store.Put(key+"instance", []byte("b"))
+	_ = store.Put(key+"state", []byte("{}"))
+	if p.findUser("1", "GL") != d {
+		t.Fatal("Expected the ownership to be cached")
+	}
+	d.mutex.Lock()
+	d.ownerChecked = time.Time{}
+	d.mutex.Unlock()
+	if p.findUser("1", "GL") == d {
+		t.Fatal("Expected the user to be resumed once the ownership is checked again")
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+const (
+	defaultModuleShutdownTimeout = 5 * time.Second
+	defaultShutdownTimeout       = 15 * time.Second
+)
+
+var moduleShutdownFailures = metrics.NewCounter("rhine_module_shutdown_failures_total",
+	"Number of module shutdowns which timed out or panicked.")
+
+// ShutdownOptions bounds the time taken to shut modules down.
+type ShutdownOptions struct {
+	// ModuleTimeout is the time a module's shutdown callback may take before
+	// it's abandoned and reported, e.g., "10s". Defaults to 5s.
+	ModuleTimeout string `json:"moduleTimeout"`
+	// Timeout bounds shutting down the modules of every user when the proxy is
+	// shut down, e.g., "30s". Defaults to 15s.
+	Timeout string `json:"timeout"`
+}
+
+func (options *ShutdownOptions) timeouts(logger log.Logger) (module, total time.Duration) {
+	module = parseDuration("shutdown.moduleTimeout", options.ModuleTimeout, logger)
+	if module <= 0 {
+		module = defaultModuleShutdownTimeout
+	}
+	total = parseDuration("shutdown.timeout", options.Timeout, logger)
+	if total <= 0 {
+		total = defaultShutdownTimeout
+	}
+	return module, total
+}
+
+// moduleStopped is the outcome of shutting down a module.
+type moduleStopped struct {
+	mod   *RhineModule
+	clean bool
+}
+
+// shutdownModules shuts the modules down concurrently, returning the names of
+// those which panicked or didn't stop within timeout. Modules which didn't
+// stop are left running in the background.
+func shutdownModules(mods []*RhineModule, shuttingDown bool, timeout time.Duration, logger log.Logger) []string {
+	if timeout <= 0 {
+		timeout = defaultModuleShutdownTimeout
+	}
+	done := make(chan moduleStopped, len(mods))
+	for _, mod := range mods {
+		go func(mod *RhineModule) {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Warnf("%s panicked while shutting down: %v", mod.name, err)
+					done <- moduleStopped{mod, false}
+				}
+			}()
+			mod.shutdown(shuttingDown)
+			done <- moduleStopped{mod, true}
+		}(mod)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	stopped := make(map[*RhineModule]bool, len(mods))
+wait:
+	for len(stopped) < len(mods) {
+		select {
+		case s := <-done:
+			stopped[s.mod] = s.clean
+		case <-timer.C:
+			break wait
+		}
+	}
+	var failed []string
+	for _, mod := range mods {
+		if clean, ok := stopped[mod]; !ok || !clean {
+			failed = append(failed, mod.name)
+		}
+	}
+	moduleShutdownFailures.Add(uint64(len(failed)))
+	return failed
+}
+
+// shutdownUsers shuts the dispatches down concurrently, waiting at most
+// timeout for their modules to stop.
+func (p *Proxy) shutdownUsers(dispatches []*dispatch, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	var wg sync.WaitGroup
+	for _, d := range dispatches {
+		wg.Add(1)
+		go func(d *dispatch) {
+			defer wg.Done()
+			d.shutdown(true)
+		}(d)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		p.Warnf("Shutting down the users' modules took over %s, forcing shutdown", timeout)
+	}
+}
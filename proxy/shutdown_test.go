@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/notify"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestShutdownModules(t *testing.T) {
+	logger := log.New(false, false, "/dev/null", 0)
+	hang := make(chan struct{})
+	defer close(hang)
+	stopped := false
+	mods := []*RhineModule{
+		{name: "clean", shutdownCB: func(bool) { stopped = true }},
+		{name: "hung", shutdownCB: func(bool) { <-hang }},
+		{name: "broken", shutdownCB: func(bool) { panic("broken shutdown") }},
+	}
+	start := time.Now()
+	failed := shutdownModules(mods, true, 100*time.Millisecond, logger)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected shutdown to be bounded by the timeout, took %s", elapsed)
+	}
+	if !stopped {
+		t.Fatal("Expected the clean module to be shut down")
+	}
+	if len(failed) != 2 || failed[0] != "hung" || failed[1] != "broken" {
+		t.Fatalf("Expected the hung and broken modules to be reported, got %v", failed)
+	}
+}
+
+func TestShutdownUsersTimeout(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	hang := make(chan struct{})
+	defer close(hang)
+	d.moduleTimeout = time.Hour
+	d.modules = append(d.modules, &RhineModule{name: "hung", shutdownCB: func(bool) { <-hang }})
+	start := time.Now()
+	p.shutdownUsers([]*dispatch{d}, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected shutdown to be bounded by the timeout, took %s", elapsed)
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	p := newTestProxy()
+	p.server = goproxy.NewProxyHttpServer()
+	p.notifier = notify.New(p.Logger)
+	p.memory = newMemoryGuard(0, 0, p.Logger)
+	p.options.Address = "127.0.0.1:0"
+	p.shutdownTimeout = time.Second
+	stopped := false
+	d := p.getUser("1", "GL")
+	d.modules = append(d.modules, &RhineModule{name: "test", shutdownCB: func(bool) { stopped = true }})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- p.ListenAndServe(ctx) }()
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ListenAndServe to return once its context is cancelled")
+	}
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("Expected the proxy to be shut down")
+	}
+	if !stopped {
+		t.Fatal("Expected the modules to be shut down")
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// SpilledBody is a read only view of a response body which was too large to be
+// buffered in memory, backed by a temporary file which is removed once the
+// response has been sent to the client.
+type SpilledBody struct {
+	f    *os.File
+	size int64
+}
+
+// ReadAt implements io.ReaderAt.
+func (b *SpilledBody) ReadAt(p []byte, off int64) (int, error) {
+	return b.f.ReadAt(p, off)
+}
+
+// Size returns the size of the body in bytes.
+func (b *SpilledBody) Size() int64 { return b.size }
+
+// NewReader returns a reader over the whole body, independent of other readers.
+func (b *SpilledBody) NewReader() *io.SectionReader {
+	return io.NewSectionReader(b.f, 0, b.size)
+}
+
+// SpilledHandler handles a response which was spilled to disk. The body can't
+// be modified by the handler.
+type SpilledHandler func(op string, body *SpilledBody, pktCtx *goproxy.ProxyCtx)
+
+// spillBody copies r into a temporary file in dir, the OS' temporary directory
+// if dir is empty.
+func spillBody(r io.Reader, dir string) (*SpilledBody, error) {
+	f, err := ioutil.TempFile(dir, "rhine-body-")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &SpilledBody{f: f, size: size}, nil
+}
+
+// spilledReadCloser is the body sent to the client, closing it removes the
+// temporary file.
+type spilledReadCloser struct {
+	*io.SectionReader
+	body *SpilledBody
+}
+
+func (rc *spilledReadCloser) Close() error {
+	err := rc.body.f.Close()
+	os.Remove(rc.body.f.Name())
+	return err
+}
+
+// spills reports whether a response of the given length should be spilled to
+// disk instead of being read into memory.
+func (proxy *Proxy) spills(contentLength int64) bool {
+	threshold := proxy.options.SpillThresholdBytes
+	return threshold > 0 && contentLength > threshold
+}
+
+// dispatchSpilled spills the response body to disk and runs the spilled hooks of
+// the op, the core handlers and regular hooks don't see spilled responses.
+func (d *dispatch) dispatchSpilled(op string, resp *http.Response, dir string, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	body, err := spillBody(resp.Body, dir)
+	resp.Body.Close()
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &spilledReadCloser{body.NewReader(), body}
+	for _, hooks := range [][]*PacketHook{d.hooksOf(d.spilledHooks, "*"), d.hooksOf(d.spilledHooks, op)} {
+		for _, hook := range hooks {
+			d.spilledHookWrapper(hook, op, body, ctx)
+		}
+	}
+	return ctx.Resp, nil
+}
+
+func (d *dispatch) spilledHookWrapper(hook *PacketHook, op string, body *SpilledBody, ctx *goproxy.ProxyCtx) {
+	if d.breaker.open(hook.mod.name, hook.target) {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		err := recover()
+		if err != nil {
+			d.Warnf("Recovered from panic while executing %s:\n%+v", hook.mod.name, err)
+		}
+		d.breaker.record(hook.mod.name, hook.target, time.Since(start), err)
+	}()
+	hook.spilled(op, body, ctx)
+}
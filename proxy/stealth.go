@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// rawReader records the bytes read through it, so that the raw bytes of the
+// HTTP messages parsed from a bufio.Reader over it can be recovered.
+type rawReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (r *rawReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.buf = append(r.buf, b[:n]...)
+	return n, err
+}
+
+// take returns the bytes of the message just parsed, buffered being the bytes
+// the bufio.Reader read ahead, which are kept for the next message.
+func (r *rawReader) take(buffered int) []byte {
+	n := len(r.buf) - buffered
+	msg := r.buf[:n:n]
+	r.buf = append([]byte(nil), r.buf[n:]...)
+	return msg
+}
+
+// stealthMITM serves a MITM'd connection over its own upstream connection,
+// forwarding the raw bytes of each request and response unless the hooks
+// changed the body, in which case the message is written anew by net/http.
+func (p *Proxy) stealthMITM(connect *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	host := connect.URL.Host
+	config, err := p.mitm.TLSConfig(host, ctx)
+	if err != nil {
+		p.Warnf("Failed to create the TLS config of %s: %s", host, err)
+		_ = client.Close()
+		return
+	}
+	conn := tls.Server(client, config)
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		p.Verbosef("TLS handshake with %s for %s failed: %s", client.RemoteAddr(), host, err)
+		return
+	}
+	clientRaw := &rawReader{r: conn}
+	clientBuf := bufio.NewReader(clientRaw)
+	var (
+		upstream    *tls.Conn
+		upstreamRaw *rawReader
+		upstreamBuf *bufio.Reader
+	)
+	defer func() {
+		if upstream != nil {
+			upstream.Close()
+		}
+	}()
+	for {
+		req, err := http.ReadRequest(clientBuf)
+		if err != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		rawReq := clientRaw.take(clientBuf.Buffered())
+		req.URL.Scheme, req.URL.Host = "https", host
+		req.RemoteAddr = client.RemoteAddr().String()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		reqCtx := &goproxy.ProxyCtx{Req: req}
+
+		out, resp := p.HandleReq(req, reqCtx)
+		if resp != nil {
+			// Answered by the proxy, e.g., blocked by the host filter.
+			reqCtx.Resp = resp
+			if err := p.HandleResp(resp, reqCtx).Write(conn); err != nil || req.Close {
+				return
+			}
+			continue
+		}
+		if upstream == nil {
+			if upstream, err = p.dialUpstream(host); err != nil {
+				p.Warnf("Failed to connect to %s: %s", host, err)
+				return
+			}
+			upstreamRaw = &rawReader{r: upstream}
+			upstreamBuf = bufio.NewReader(upstreamRaw)
+		}
+		if err := writeRequest(upstream, rawReq, out, body); err != nil {
+			return
+		}
+
+		resp, err = http.ReadResponse(upstreamBuf, req)
+		if err != nil {
+			return
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return
+		}
+		rawResp := upstreamRaw.take(upstreamBuf.Buffered())
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if _, err := conn.Write(rawResp); err == nil {
+				// The raw readers stop recording, what bufio read ahead is
+				// relayed before the rest of the connections.
+				relayUpgraded(conn, readAhead(clientBuf, conn), upstream, readAhead(upstreamBuf, upstream))
+			}
+			return
+		}
+		if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+			if respBody, err = gunzip(respBody); err != nil {
+				// Not dispatched as the body can't be read.
+				if _, err := conn.Write(rawResp); err != nil || req.Close || resp.Close {
+					return
+				}
+				continue
+			}
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+		reqCtx.Resp = resp
+		final := p.HandleResp(resp, reqCtx)
+		if err := writeResponse(conn, rawResp, resp, final, respBody); err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// writeRequest writes raw, the bytes the request was read from, unless the
+// hooks replaced its body, in which case the request is written anew.
+func writeRequest(w io.Writer, raw []byte, req *http.Request, body []byte) error {
+	final, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(final, body) {
+		_, err := w.Write(raw)
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(final))
+	req.ContentLength, req.TransferEncoding = int64(len(final)), nil
+	return req.Write(w)
+}
+
+// writeResponse writes raw, the bytes the response was read from, unless the
+// hooks replaced the response or its decoded body, in which case the response
+// is written anew, uncompressed if it was gzipped.
+func writeResponse(w io.Writer, raw []byte, original, resp *http.Response, body []byte) error {
+	// The hooks may have replaced the body with a spilled one, whose file is
+	// removed when it's closed.
+	defer resp.Body.Close()
+	final, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == original.StatusCode && bytes.Equal(final, body) {
+		_, err := w.Write(raw)
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(final))
+	resp.ContentLength, resp.TransferEncoding = int64(len(final)), nil
+	resp.Header.Del("Content-Length")
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		resp.Header.Del("Content-Encoding")
+	}
+	return resp.Write(w)
+}
+
+// gunzip decompresses a gzip encoded body.
+func gunzip(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// readAhead returns a reader of the bytes buf read ahead followed by those of
+// r, the reader buf was reading from.
+func readAhead(buf *bufio.Reader, r io.Reader) io.Reader {
+	buffered, _ := buf.Peek(buf.Buffered())
+	return io.MultiReader(bytes.NewReader(buffered), r)
+}
+
+// relayUpgraded copies the bytes of an upgraded connection in both directions
+// until either side closes it.
+func relayUpgraded(client net.Conn, clientBuf io.Reader, upstream net.Conn, upstreamBuf io.Reader) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, clientBuf)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, upstreamBuf)
+		done <- struct{}{}
+	}()
+	<-done
+}
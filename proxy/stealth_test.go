@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestStealthMITM(t *testing.T) {
+	// The upstream server echoes the raw bytes of each request as the body of
+	// a response with unusual header casing.
+	upstreamListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{goproxy.GoproxyCa}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamListener.Close()
+	upstreamConns := make(chan int, 4)
+	go func() {
+		for conns := 1; ; conns++ {
+			conn, err := upstreamListener.Accept()
+			if err != nil {
+				return
+			}
+			upstreamConns <- conns
+			go func() {
+				defer conn.Close()
+				rawReq := &rawReader{r: conn}
+				br := bufio.NewReader(rawReq)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					_, _ = io.Copy(ioutil.Discard, req.Body)
+					raw := rawReq.take(br.Buffered())
+					_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nx-ECHO: yes\r\ncontent-length: "+strconv.Itoa(len(raw))+"\r\n\r\n")
+					_, _ = conn.Write(raw)
+				}
+			}()
+		}
+	}()
+	host := upstreamListener.Addr().String()
+
+	p := newTestProxy()
+	p.server = goproxy.NewProxyHttpServer()
+	p.mitm = mitmConnect(nil, nil, func(string, *tls.ClientHelloInfo) {})
+	p.hijack = &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: p.stealthMITM}
+	p.server.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(p.httpsHandler))
+	proxyServer := httptest.NewServer(p.server)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer client.Close()
+	br := bufio.NewReader(client)
+
+	requests := []string{
+		"GET /a HTTP/1.1\r\nhost: " + host + "\r\nx-lower: 1\r\nAccept-Encoding: gzip\r\nConnection: keep-alive\r\n\r\n",
+		"POST /b HTTP/1.1\r\nHost: " + host + "\r\nTransfer-Encoding: chunked\r\nZ-First: 1\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+	}
+	for _, raw := range requests {
+		if _, err := io.WriteString(client, raw); err != nil {
+			t.Fatal(err)
+		}
+		rawResp := &bytes.Buffer{}
+		resp, err := http.ReadResponse(bufio.NewReader(io.TeeReader(br, rawResp)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != raw {
+			t.Fatalf("Upstream received %q, expected %q", body, raw)
+		}
+		if !bytes.HasPrefix(rawResp.Bytes(), []byte("HTTP/1.1 200 OK\r\nx-ECHO: yes\r\n")) {
+			t.Fatalf("Response headers weren't forwarded as is: %q", rawResp.Bytes())
+		}
+	}
+	if len(upstreamConns) != 1 {
+		t.Fatalf("Expected a single upstream connection, got %d", len(upstreamConns))
+	}
+}
+
+func TestWriteResponseModified(t *testing.T) {
+	original := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{"Content-Encoding": {"gzip"}}}
+	resp := *original
+	resp.Header = http.Header{"Content-Encoding": {"gzip"}}
+	resp.Body = ioutil.NopCloser(bytes.NewReader([]byte("{}")))
+	buf := &bytes.Buffer{}
+	if err := writeResponse(buf, []byte("raw"), original, &resp, []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	written, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(written.Body)
+	if string(body) != "{}" || written.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Unexpected response %+v %q", written.Header, body)
+	}
+
+	buf.Reset()
+	closed := &closeRecorder{Reader: bytes.NewReader([]byte("{}"))}
+	resp.Body = closed
+	if err := writeResponse(buf, []byte("raw"), original, &resp, []byte("{}")); err != nil || buf.String() != "raw" {
+		t.Fatalf("Unmodified response should be written raw, got %q: %v", buf, err)
+	}
+	if !closed.closed {
+		t.Fatal("Expected the body of the final response to be closed")
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
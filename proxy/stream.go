@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/kyoukaya/rhine/metrics"
+	"github.com/kyoukaya/rhine/recorder"
+)
+
+// streamBuffer is the number of packets buffered for each /stream client,
+// packets are dropped for clients which fall further behind.
+const streamBuffer = 1024
+
+var streamDropped = metrics.NewCounter("rhine_stream_dropped_total", "Number of packets dropped for /stream clients which fell behind.")
+
+// packetStream publishes the dispatched packets to the /stream clients.
+type packetStream struct {
+	mutex       sync.Mutex
+	subscribers map[chan *recorder.Packet][]string
+}
+
+func newPacketStream() *packetStream {
+	return &packetStream{subscribers: make(map[chan *recorder.Packet][]string)}
+}
+
+// active reports whether any client follows the stream.
+func (s *packetStream) active() bool {
+	if s == nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.subscribers) > 0
+}
+
+// subscribe returns a chan receiving the packets of users, every user if
+// empty, and a function unsubscribing it.
+func (s *packetStream) subscribe(users []string) (<-chan *recorder.Packet, func()) {
+	c := make(chan *recorder.Packet, streamBuffer)
+	s.mutex.Lock()
+	s.subscribers[c] = users
+	s.mutex.Unlock()
+	return c, func() {
+		s.mutex.Lock()
+		delete(s.subscribers, c)
+		s.mutex.Unlock()
+	}
+}
+
+func (s *packetStream) publish(packet *recorder.Packet) {
+	rUID := packet.Region + "_" + packet.UID
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c, users := range s.subscribers {
+		if len(users) > 0 && !containsString(users, rUID) {
+			continue
+		}
+		select {
+		case c <- packet:
+		default:
+			streamDropped.Inc()
+		}
+	}
+}
+
+// handleStream streams the packets dispatched by the proxy as Server Sent
+// Events until the client disconnects, e.g., for an observer, see
+// Options.Observe. The session of every connected user is sent first, as a
+// "session" event, followed by every packet as a recorder.Packet. "user" may
+// be repeated to only stream the packets of the users, e.g., "GL_1234". Only
+// operators may follow the stream, as it contains the users' account data.
+func (p *Proxy) handleStream(w http.ResponseWriter, r *http.Request) {
+	if AdminRole(r) != RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || p.stream == nil {
+		http.Error(w, "packet streaming is not supported", http.StatusNotImplemented)
+		return
+	}
+	users := r.URL.Query()["user"]
+	// Subscribe before exporting the sessions so that no packet is missed.
+	packets, unsubscribe := p.stream.subscribe(users)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, session := range p.sessions() {
+		if len(users) > 0 && !containsString(users, session.Region+"_"+session.UID) {
+			continue
+		}
+		b, _ := json.Marshal(session)
+		if _, err := fmt.Fprintf(w, "event: session\ndata: %s\n\n", b); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case packet := <-packets:
+			b, _ := json.Marshal(packet)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-p.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+// StrictOptions configures strict mode, in which only the game servers and the
+// allowed hosts are MITM'd, connections to every other host being tunneled
+// untouched, for users who don't want the proxy to decrypt anything else.
+type StrictOptions struct {
+	Enable bool `json:"enable"`
+	// Hosts are MITM'd in addition to the game servers, e.g., "ak.hycdn.cn",
+	// or "ak.hycdn.cn:443" to only MITM the host on one port.
+	Hosts []string `json:"hosts"`
+}
+
+// UnconfiguredHost is a host which was tunneled in strict mode because it
+// isn't allowed, see StrictOptions.
+type UnconfiguredHost struct {
+	Host      string    `json:"host"`
+	Conns     uint64    `json:"conns"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// strictFilter decides which hosts are MITM'd in strict mode, reporting the
+// hosts it tunnels.
+type strictFilter struct {
+	mutex sync.Mutex
+	hosts map[string]bool
+	games *regions
+	seen  map[string]*UnconfiguredHost
+	log.Logger
+}
+
+// newStrictFilter returns the filter of strict mode, nil if it's disabled.
+func newStrictFilter(options *StrictOptions, games *regions, logger log.Logger) *strictFilter {
+	if !options.Enable {
+		return nil
+	}
+	f := &strictFilter{
+		hosts:  make(map[string]bool),
+		games:  games,
+		seen:   make(map[string]*UnconfiguredHost),
+		Logger: logger,
+	}
+	for _, host := range options.Hosts {
+		f.hosts[strings.ToLower(host)] = true
+	}
+	return f
+}
+
+// allow reports whether connections to host, a CONNECT target such as
+// "gs.arknights.global:8443", may be MITM'd, recording the host otherwise.
+func (f *strictFilter) allow(host string) bool {
+	if f == nil {
+		return true
+	}
+	host = strings.ToLower(host)
+	if _, ok := f.games.ofHost(host); ok || f.hosts[host] {
+		return true
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil && f.hosts[name] {
+		return true
+	}
+	now := time.Now()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	seen := f.seen[host]
+	if seen == nil {
+		seen = &UnconfiguredHost{Host: host, FirstSeen: now}
+		f.seen[host] = seen
+		f.Printf("Strict mode: tunneling %s, which isn't allowed", host)
+	}
+	seen.Conns++
+	seen.LastSeen = now
+	return false
+}
+
+// list returns copies of the hosts tunneled, ordered by the number of
+// connections.
+func (f *strictFilter) list() []UnconfiguredHost {
+	ret := []UnconfiguredHost{}
+	if f == nil {
+		return ret
+	}
+	f.mutex.Lock()
+	for _, seen := range f.seen {
+		ret = append(ret, *seen)
+	}
+	f.mutex.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Conns != ret[j].Conns {
+			return ret[i].Conns > ret[j].Conns
+		}
+		return ret[i].Host < ret[j].Host
+	})
+	return ret
+}
+
+// UnconfiguredHosts returns the hosts clients connected to which were tunneled
+// in strict mode because they aren't allowed, none if strict mode is disabled.
+// Hosts which should be MITM'd can be added to StrictOptions.Hosts.
+func (p *Proxy) UnconfiguredHosts() []UnconfiguredHost {
+	return p.strict.list()
+}
+
+// handleUnconfigured lists the hosts tunneled in strict mode.
+func (p *Proxy) handleUnconfigured(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.UnconfiguredHosts())
+}
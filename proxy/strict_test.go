@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/kyoukaya/rhine/log"
+)
+
+func TestStrictFilter(t *testing.T) {
+	logger := log.New(false, false, "/dev/null", 0)
+	if f := newStrictFilter(&StrictOptions{}, nil, logger); !f.allow("example.com:443") {
+		t.Fatal("Expected every host to be allowed with strict mode disabled")
+	}
+	f := newStrictFilter(&StrictOptions{Enable: true, Hosts: []string{"Assets.example", "api.example:443"}}, nil, logger)
+	for _, host := range []string{"gs.arknights.global:8443", "assets.example:443", "assets.example:8443", "api.example:443"} {
+		if !f.allow(host) {
+			t.Errorf("Expected %s to be allowed", host)
+		}
+	}
+	for _, host := range []string{"api.example:8443", "tracker.example:443", "tracker.example:443"} {
+		if f.allow(host) {
+			t.Errorf("Expected %s to be tunneled", host)
+		}
+	}
+	got := f.list()
+	if len(got) != 2 || got[0].Host != "tracker.example:443" || got[0].Conns != 2 || got[1].Host != "api.example:8443" {
+		t.Fatalf("Expected the tunneled hosts to be reported, got %+v", got)
+	}
+}
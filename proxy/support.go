@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/storage"
+	"github.com/kyoukaya/rhine/utils/servertime"
+)
+
+// supportPrefix is the key prefix of the support records in the store, each
+// user's game days are saved under "support/{region_UID}/{date}".
+const supportPrefix = "support/"
+
+// supportDay records the operators a user lent as supports on a game day and
+// the credits earned from friends using them.
+type supportDay struct {
+	Supports []string `json:"supports"`
+	// Rewarded is set once the credits of the day are known, which is on the
+	// first login of the next day.
+	Rewarded bool  `json:"rewarded"`
+	Credits  int64 `json:"credits"`
+}
+
+// updateSupportDay applies update to the user's record of a game day.
+func updateSupportDay(store storage.Store, rUID string, day time.Time, update func(*supportDay)) error {
+	key := supportPrefix + rUID + "/" + day.Format("2006-01-02")
+	record := &supportDay{}
+	b, err := store.Get(key)
+	if err == nil {
+		err = json.Unmarshal(b, record)
+	}
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	update(record)
+	if b, err = json.Marshal(record); err != nil {
+		return err
+	}
+	return store.Put(key, b)
+}
+
+// recordSupports adds the supports of an event at t to the user's record of
+// the day, and on login the credits to the record of the previous day.
+// Supports whose operator is unknown aren't recorded.
+func recordSupports(store storage.Store, region, rUID string, evt *semantic.SupportsSynced, t time.Time) error {
+	today, err := servertime.GameDay(region, t)
+	if err != nil {
+		return err
+	}
+	err = updateSupportDay(store, rUID, today, func(day *supportDay) {
+		for _, support := range evt.Supports {
+			if support.CharID != "" && !containsString(day.Supports, support.CharID) {
+				day.Supports = append(day.Supports, support.CharID)
+			}
+		}
+	})
+	if err != nil || !evt.Login {
+		return err
+	}
+	return updateSupportDay(store, rUID, today.AddDate(0, 0, -1), func(day *supportDay) {
+		day.Rewarded = true
+		day.Credits = evt.AssistCredits
+	})
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportOperatorStats is the usage of one of a user's support operators.
+type SupportOperatorStats struct {
+	CharID string `json:"charId"`
+	// Days is the number of days the operator was lent.
+	Days int `json:"days"`
+	// Credits is the operator's share of the credits earned on those days.
+	Credits float64 `json:"credits"`
+}
+
+// SupportStats is the usage of a user's support operators.
+type SupportStats struct {
+	User string `json:"user"`
+	// Days is the number of days whose credits are known.
+	Days    int   `json:"days"`
+	Credits int64 `json:"credits"`
+	// Operators are ordered by their share of the credits, most first.
+	Operators []SupportOperatorStats `json:"operators"`
+}
+
+// computeSupportStats aggregates the days of a user. The game only reports
+// the credits earned by all of the supports of a day, so they're split evenly
+// between the operators lent that day.
+func computeSupportStats(user string, days []*supportDay) SupportStats {
+	stats := SupportStats{User: user}
+	operators := make(map[string]*SupportOperatorStats)
+	for _, day := range days {
+		for _, charID := range day.Supports {
+			op := operators[charID]
+			if op == nil {
+				op = &SupportOperatorStats{CharID: charID}
+				operators[charID] = op
+			}
+			op.Days++
+			if day.Rewarded {
+				op.Credits += float64(day.Credits) / float64(len(day.Supports))
+			}
+		}
+		if day.Rewarded {
+			stats.Days++
+			stats.Credits += day.Credits
+		}
+	}
+	for _, op := range operators {
+		stats.Operators = append(stats.Operators, *op)
+	}
+	sort.Slice(stats.Operators, func(i, j int) bool {
+		a, b := stats.Operators[i], stats.Operators[j]
+		if a.Credits != b.Credits {
+			return a.Credits > b.Credits
+		}
+		return a.CharID < b.CharID
+	})
+	return stats
+}
+
+// LoadSupportStats returns the support usage of each user in the store,
+// ordered by region_UID. user limits the statistics to a region_UID's.
+func LoadSupportStats(store storage.Store, user string) ([]SupportStats, error) {
+	prefix := supportPrefix
+	if user != "" {
+		prefix += user + "/"
+	}
+	keys, err := store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	days := make(map[string][]*supportDay)
+	var users []string
+	for _, key := range keys {
+		rUID := strings.SplitN(strings.TrimPrefix(key, supportPrefix), "/", 2)[0]
+		b, err := store.Get(key)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		day := &supportDay{}
+		if err := json.Unmarshal(b, day); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		if _, ok := days[rUID]; !ok {
+			users = append(users, rUID)
+		}
+		days[rUID] = append(days[rUID], day)
+	}
+	sort.Strings(users)
+	ret := make([]SupportStats, len(users))
+	for i, rUID := range users {
+		ret[i] = computeSupportStats(rUID, days[rUID])
+	}
+	return ret, nil
+}
+
+// SupportStats returns the support usage of the proxy's users, see
+// LoadSupportStats.
+func (p *Proxy) SupportStats(user string) ([]SupportStats, error) {
+	return LoadSupportStats(p.store, user)
+}
+
+// recordSupportStats records the supports of every user in the store until the
+// proxy is shut down.
+func (p *Proxy) recordSupportStats() {
+	if p.options.DisableSupportStats {
+		return
+	}
+	listener := make(chan events.Event, 8)
+	sub := p.events.Subscribe(semantic.TopicSupportsSynced, listener)
+	go func() {
+		defer sub.Unhook()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case evt := <-listener:
+				synced, ok := evt.Payload.(*semantic.SupportsSynced)
+				if !ok {
+					continue
+				}
+				rUID := fmt.Sprintf("%s_%d", evt.Region, evt.UID)
+				if err := recordSupports(p.store, evt.Region, rUID, synced, time.Now()); err != nil {
+					p.Warnf("Failed to record the supports of %s: %s", rUID, err)
+				}
+			}
+		}
+	}()
+}
+
+// handleSupport serves the support usage for the optional "user" query
+// parameter.
+func (p *Proxy) handleSupport(w http.ResponseWriter, r *http.Request) {
+	stats, err := p.SupportStats(r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
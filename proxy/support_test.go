@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/proxy/semantic"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestSupportStats(t *testing.T) {
+	store := storage.NewMemoryStore()
+	day := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	supports := func(charIDs ...string) []semantic.SquadMember {
+		ret := make([]semantic.SquadMember, len(charIDs))
+		for i, charID := range charIDs {
+			ret[i] = semantic.SquadMember{CharInstID: int64(i + 1), CharID: charID}
+		}
+		return ret
+	}
+	for _, step := range []struct {
+		evt *semantic.SupportsSynced
+		t   time.Time
+	}{
+		{&semantic.SupportsSynced{Supports: supports("char_a", "char_b"), Login: true, AssistCredits: 40}, day},
+		{&semantic.SupportsSynced{Supports: supports("char_a", "char_c")}, day.Add(time.Hour)},
+		{&semantic.SupportsSynced{Supports: supports("char_a"), Login: true, AssistCredits: 90}, day.Add(24 * time.Hour)},
+		{&semantic.SupportsSynced{Supports: supports("char_a"), Login: true, AssistCredits: 30}, day.Add(48 * time.Hour)},
+	} {
+		if err := recordSupports(store, "GL", "GL_1", step.evt, step.t); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := newTestProxy()
+	p.store = store
+	w := httptest.NewRecorder()
+	p.handleSupport(w, httptest.NewRequest("GET", "/support?user=GL_1", nil))
+	var stats []SupportStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	// The 40 credits of the day before the first login are unattributed.
+	if len(stats) != 1 || stats[0].Days != 3 || stats[0].Credits != 160 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	expected := []SupportOperatorStats{{"char_a", 3, 60}, {"char_b", 1, 30}, {"char_c", 1, 30}}
+	if len(stats[0].Operators) != len(expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, stats[0].Operators)
+	}
+	for i, op := range stats[0].Operators {
+		if op != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected, stats[0].Operators)
+		}
+	}
+}
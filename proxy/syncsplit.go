@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/tidwall/gjson"
+)
+
+// syncOp is the op of the account sync packet, containing the whole account.
+const syncOp = "S/account/syncData"
+
+// SyncSectionPrefix prefixes the ops of the sections of the account sync
+// packet, see SyncSectionOp.
+const SyncSectionPrefix = "sync/"
+
+// SyncSectionOp returns the op of a section of the account sync packet, e.g.,
+// "sync/inventory" for "inventory". Once the hooks of S/account/syncData have
+// run, the hooks of each section's op receive the section's JSON, e.g., the
+// value of user.inventory, sparing them from parsing the whole account.
+// Sections are read only, the slices returned by their hooks are discarded.
+func SyncSectionOp(section string) string {
+	return SyncSectionPrefix + section
+}
+
+// runSyncSections runs the hooks of the sections of the account sync packet.
+func (d *dispatch) runSyncSections(data []byte, ctx *goproxy.ProxyCtx) {
+	hooked := false
+	d.hookMutex.RLock()
+	for op := range d.hooks {
+		if strings.HasPrefix(op, SyncSectionPrefix) {
+			hooked = true
+			break
+		}
+	}
+	d.hookMutex.RUnlock()
+	if !hooked {
+		return
+	}
+	gjson.GetBytes(data, "user").ForEach(func(key, value gjson.Result) bool {
+		op := SyncSectionOp(key.String())
+		for _, hook := range d.hooksOf(d.hooks, op) {
+			d.hookWrapper(hook, op, []byte(value.Raw), ctx)
+		}
+		return true
+	})
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestSyncSections(t *testing.T) {
+	p := newTestProxy()
+	d := p.getUser("1", "GL")
+	mod := &RhineModule{name: "test", dispatch: d}
+	var inventory string
+	mod.Hook(SyncSectionOp("inventory"), 0, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+		inventory = string(data)
+		return []byte("{}")
+	})
+	mod.Hook(SyncSectionOp("troop"), 0, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+		t.Fatal("Expected sections absent from the packet to be skipped")
+		return data
+	})
+	data := []byte(`{"user":{"status":{"ap":10},"inventory":{"30012":3}},"ts":0}`)
+	ret, _ := d.run(syncOp, data, nil)
+	if inventory != `{"30012":3}` {
+		t.Fatalf("Expected the inventory section, got %q", inventory)
+	}
+	if string(ret) != string(data) {
+		t.Fatalf("Expected sections to be read only, got %s", ret)
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/notify"
+	"github.com/kyoukaya/rhine/proxy/semantic"
+)
+
+const (
+	// recruitInProgress and recruitFinished are the states of a recruitment slot.
+	recruitInProgress = 2
+	recruitFinished   = 3
+)
+
+// telegramBot answers Telegram commands with the state of the connected users.
+type telegramBot struct {
+	proxy *Proxy
+	mutex sync.Mutex
+	// lastBattle contains the last battle finished by each user, keyed by
+	// region_UID.
+	lastBattle map[string]*semantic.BattleFinished
+	sub        *events.Subscription
+}
+
+// startTelegram adds a Telegram backend to the proxy's notifier and registers
+// its commands if Telegram notifications are configured.
+func (p *Proxy) startTelegram() {
+	options := p.options.Notifications.Telegram
+	if options == nil {
+		return
+	}
+	telegram, err := notify.NewTelegram(*options, p.Logger)
+	if err != nil {
+		p.Warnf("Telegram notifications disabled: %s", err)
+		return
+	}
+	bot := &telegramBot{proxy: p, lastBattle: make(map[string]*semantic.BattleFinished)}
+	listener := make(chan events.Event, 8)
+	bot.sub = p.events.Subscribe(semantic.TopicBattleFinished, listener)
+	go bot.listen(listener)
+	telegram.HandleCommand("users", "lists the connected users", bot.users)
+	telegram.HandleCommand("sanity", "shows the sanity of each user", bot.sanity)
+	telegram.HandleCommand("recruits", "shows the recruitment slots of each user", bot.recruits)
+	telegram.HandleCommand("drops", "shows the drops from each user's last battle", bot.drops)
+	telegram.HandleCommand("stats", "shows the drop rates of a stage, or of the most run stages", bot.stats)
+	p.notifier.Add(telegram)
+	telegram.Start()
+}
+
+func (bot *telegramBot) listen(listener chan events.Event) {
+	for evt := range listener {
+		battle, ok := evt.Payload.(*semantic.BattleFinished)
+		if !ok {
+			continue
+		}
+		bot.mutex.Lock()
+		bot.lastBattle[fmt.Sprintf("%s_%d", evt.Region, evt.UID)] = battle
+		bot.mutex.Unlock()
+	}
+}
+
+// forEachUser calls fn with each connected user whose gamestate is loaded,
+// joining the returned lines in order of the users' region_UID.
+func (bot *telegramBot) forEachUser(fn func(rUID string, d *dispatch) string) string {
+	p := bot.proxy
+	p.mutex.Lock()
+	rUIDs := make([]string, 0, len(p.dispatches))
+	dispatches := make(map[string]*dispatch, len(p.dispatches))
+	for rUID, d := range p.dispatches {
+		rUIDs = append(rUIDs, rUID)
+		dispatches[rUID] = d
+	}
+	p.mutex.Unlock()
+	sort.Strings(rUIDs)
+	lines := make([]string, 0, len(rUIDs))
+	for _, rUID := range rUIDs {
+		d := dispatches[rUID]
+		if d.state == nil || !d.state.IsLoaded() {
+			continue
+		}
+		if line := fn(rUID, d); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return "No users connected."
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (bot *telegramBot) users(string) string {
+	return bot.forEachUser(func(rUID string, d *dispatch) string {
+		name, err := d.state.Get("status.nickName")
+		if err != nil {
+			return rUID
+		}
+		return fmt.Sprintf("%s: %v", rUID, name)
+	})
+}
+
+func (bot *telegramBot) sanity(string) string {
+	return bot.forEachUser(func(rUID string, d *dispatch) string {
+		current, max, fullAt, err := d.state.Sanity()
+		if err != nil {
+			return fmt.Sprintf("%s: %s", rUID, err)
+		}
+		untilFull := time.Until(fullAt)
+		if untilFull <= 0 {
+			return fmt.Sprintf("%s: %d/%d, capped", rUID, current, max)
+		}
+		return fmt.Sprintf("%s: %d/%d, capped in %s", rUID, current, max, untilFull.Round(time.Minute))
+	})
+}
+
+func (bot *telegramBot) recruits(string) string {
+	return bot.forEachUser(func(rUID string, d *dispatch) string {
+		state := d.state.GetStateRef()
+		if state.Recruit == nil || state.Recruit.Normal == nil {
+			return ""
+		}
+		slots := make([]string, 0, len(state.Recruit.Normal.Slots))
+		for id, slot := range state.Recruit.Normal.Slots {
+			switch slot.State {
+			case recruitInProgress:
+				untilDone := time.Until(time.Unix(slot.MaxFinishTs, 0))
+				if untilDone <= 0 {
+					slots = append(slots, fmt.Sprintf("slot %s done", id))
+				} else {
+					slots = append(slots, fmt.Sprintf("slot %s done in %s", id, untilDone.Round(time.Minute)))
+				}
+			case recruitFinished:
+				slots = append(slots, fmt.Sprintf("slot %s done", id))
+			}
+		}
+		if len(slots) == 0 {
+			return rUID + ": no recruitments in progress"
+		}
+		sort.Strings(slots)
+		return rUID + ": " + strings.Join(slots, ", ")
+	})
+}
+
+func (bot *telegramBot) drops(string) string {
+	bot.mutex.Lock()
+	defer bot.mutex.Unlock()
+	return bot.forEachUser(func(rUID string, d *dispatch) string {
+		battle, ok := bot.lastBattle[rUID]
+		if !ok {
+			return ""
+		}
+		drops := make([]string, len(battle.Drops))
+		for i, drop := range battle.Drops {
+			drops[i] = fmt.Sprintf("%s x%d", drop.ID, drop.Count)
+		}
+		if len(drops) == 0 {
+			return fmt.Sprintf("%s: %s, no drops", rUID, battle.StageID)
+		}
+		return fmt.Sprintf("%s: %s, %s", rUID, battle.StageID, strings.Join(drops, ", "))
+	})
+}
+
+// maxStatsStages is the number of stages listed by the stats command if no
+// stage is given.
+const maxStatsStages = 5
+
+func (bot *telegramBot) stats(args string) string {
+	stats, err := bot.proxy.DropStats("", strings.TrimSpace(args))
+	if err != nil {
+		return err.Error()
+	}
+	if len(stats) == 0 {
+		return "No drops recorded."
+	}
+	if len(stats) > maxStatsStages {
+		stats = stats[:maxStatsStages]
+	}
+	lines := make([]string, len(stats))
+	for i := range stats {
+		lines[i] = FormatDropStats(&stats[i])
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+// tenantPrefix namespaces the keys of each tenant in the store.
+const tenantPrefix = "tenants/"
+
+// TenantOptions configures a tenant, a logically separate proxy served by the
+// same process on its own address, e.g., to serve a JP focused and a Global
+// focused configuration from one host. Tenants inherit the other options of
+// the proxy, except that they have their own event bus, their keys are
+// namespaced in the store, and the admin listener, worker, cluster, Redis
+// event sharing, Telegram commands and retention only apply to the proxy
+// they are configured on.
+type TenantOptions struct {
+	// Name identifies the tenant in logs and namespaces its keys in the store,
+	// e.g., "jp".
+	Name string `json:"name"`
+	// Address to listen on, e.g., ":8081".
+	Address string `json:"address"`
+	// Modules contains the names of the optional modules to load, see
+	// Options.Modules.
+	Modules []string `json:"modules"`
+	// EnableHostFilter and RegionHostFilters replace the proxy's, see
+	// Options.EnableHostFilter.
+	EnableHostFilter  bool                `json:"enableHostFilter"`
+	RegionHostFilters map[string][]string `json:"regionHostFilters"`
+}
+
+// tenantOptions returns the options of the tenant of the proxy p.
+func (p *Proxy) tenantOptions(tenant *TenantOptions) *Options {
+	options := *p.options
+	options.Address = tenant.Address
+	options.Modules = tenant.Modules
+	options.EnableHostFilter = tenant.EnableHostFilter
+	options.RegionHostFilters = tenant.RegionHostFilters
+	options.Logger = p.Logger
+	options.Store = storage.Prefixed(p.store, tenantPrefix+tenant.Name+"/")
+	options.EventBus = events.NewBus(p.Logger)
+	options.Notifier = nil
+	options.Notifications.Telegram = nil
+	options.Admin = AdminOptions{}
+	options.Worker = WorkerOptions{}
+	options.Cluster = ClusterOptions{}
+	options.Redis = RedisOptions{}
+	options.Retention = RetentionOptions{}
+	options.Archive = ArchiveOptions{}
+	options.Reverse = ReverseOptions{}
+	options.RecordPath = ""
+	options.Observe = ObserverOptions{}
+	options.Tenants = nil
+	return &options
+}
+
+// newTenants creates the tenants configured in the proxy's options.
+func (p *Proxy) newTenants() error {
+	names := make(map[string]bool)
+	for i := range p.options.Tenants {
+		tenant := &p.options.Tenants[i]
+		if tenant.Name == "" || tenant.Address == "" {
+			return fmt.Errorf("tenant %d: name and address are required", i)
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenant %s: duplicate name", tenant.Name)
+		}
+		names[tenant.Name] = true
+		t, err := New(p.tenantOptions(tenant))
+		if err != nil {
+			return fmt.Errorf("tenant %s: %s", tenant.Name, err)
+		}
+		p.tenants = append(p.tenants, t)
+	}
+	return nil
+}
+
+// serveTenants listens on the address of each tenant, serving them until the
+// proxy is shut down.
+func (p *Proxy) serveTenants() error {
+	for i, t := range p.tenants {
+		l, err := net.Listen("tcp", t.options.Address)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %s", p.options.Tenants[i].Name, err)
+		}
+		name := p.options.Tenants[i].Name
+		p.Printf("Serving tenant %s", name)
+		go func(t *Proxy) {
+			if err := t.Serve(l); err != nil {
+				p.Warnf("Tenant %s stopped: %s", name, err)
+			}
+		}(t)
+	}
+	return nil
+}
+
+// Tenants returns the tenants configured in Options.Tenants, in order.
+func (p *Proxy) Tenants() []*Proxy {
+	return p.tenants
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestTenants(t *testing.T) {
+	registered := modules
+	defer func() { modules = registered }()
+	modules = []initFunc{{name: "A", optional: true}, {name: "B", optional: true}}
+	store := storage.NewMemoryStore()
+	p, err := New(&Options{
+		Logger:   log.New(false, false, "/dev/null", 0),
+		Store:    store,
+		EventBus: events.NewBus(nil),
+		Modules:  []string{"A"},
+		Tenants:  []TenantOptions{{Name: "jp", Address: "127.0.0.1:0", Modules: []string{"B"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if len(p.Tenants()) != 1 {
+		t.Fatalf("Expected 1 tenant, got %d", len(p.Tenants()))
+	}
+	tenant := p.Tenants()[0]
+	if got := tenant.enabledModules(); len(got) != 1 || got[0].name != "B" {
+		t.Fatalf("Expected the tenant to only load its modules, got %+v", got)
+	}
+	if tenant.events == p.events {
+		t.Fatal("Expected the tenant to have its own event bus")
+	}
+	if err := tenant.store.Put("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("tenants/jp/key"); err != nil {
+		t.Fatalf("Expected the tenant's keys to be namespaced: %s", err)
+	}
+	if _, err := p.store.Get("key"); err == nil {
+		t.Fatal("Expected the tenant's keys to be hidden from the proxy")
+	}
+
+	_, err = New(&Options{
+		Logger:   log.New(false, false, "/dev/null", 0),
+		Store:    store,
+		EventBus: events.NewBus(nil),
+		Tenants:  []TenantOptions{{Name: "jp", Address: ":8081"}, {Name: "jp", Address: ":8082"}},
+	})
+	if err == nil {
+		t.Fatal("Expected duplicate tenant names to be rejected")
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/proxy/gamestate"
+	"github.com/tidwall/gjson"
+)
+
+// ErrNoSync is returned by StateAt when no account sync of the user was
+// logged before the requested time.
+var ErrNoSync = errors.New("no account sync logged before the requested time")
+
+// PastState is the gamestate of a user at a point in time, see StateAt.
+type PastState struct {
+	User string `json:"user"`
+	// Synced is the time of the account sync the state was replayed from, and
+	// At the time of the last packet replayed.
+	Synced time.Time       `json:"synced"`
+	At     time.Time       `json:"at"`
+	State  json.RawMessage `json:"state"`
+}
+
+// indexedLog is a packet log with the index of its packets.
+type indexedLog struct {
+	path  string
+	index *packetlog.Index
+}
+
+// StateAt reconstructs the gamestate of the user identified by rUID, e.g.,
+// "GL_1234", as it was at t. The packets logged by the Packet Logger are
+// replayed from the last account sync at or before t, which is the nearest
+// full snapshot of the account, applying the deltas of the packets following
+// it up to t.
+func StateAt(rUID string, t time.Time) (*PastState, error) {
+	sep := strings.Index(rUID, "_")
+	if sep <= 0 || sep == len(rUID)-1 {
+		return nil, fmt.Errorf("invalid user %q, expected region_UID", rUID)
+	}
+	paths, err := packetlog.Logs(packetlog.UserDir(rUID))
+	if err != nil {
+		return nil, err
+	}
+	// Locate the last sync at or before t using the indexes of the logs.
+	var logs []indexedLog
+	startLog, startEntry := -1, 0
+	for _, path := range paths {
+		f, err := packetlog.Open(path)
+		if err != nil {
+			continue
+		}
+		if f.Start().After(t) {
+			f.Close()
+			break
+		}
+		index, err := f.Index()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, indexedLog{path, index})
+		for i, e := range index.Entries {
+			if e.Time.After(t) {
+				break
+			}
+			if e.Op == syncOp {
+				startLog, startEntry = len(logs)-1, i
+			}
+		}
+	}
+	if startLog < 0 {
+		return nil, ErrNoSync
+	}
+
+	past := &PastState{User: rUID}
+	state, handle := gamestate.New(log.New(false, false, "/dev/null", 0), rUID[:sep], false)
+	for i, l := range logs[startLog:] {
+		entries := l.index.Entries
+		if i == 0 {
+			entries = entries[startEntry:]
+			past.Synced = entries[0].Time
+		}
+		f, err := packetlog.Open(l.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Time.After(t) {
+				break
+			}
+			if !strings.HasPrefix(e.Op, "S/") {
+				continue
+			}
+			p, err := f.ReadPacket(e)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			handle(p.Op, p.Data, nil)
+			past.At = e.Time
+		}
+		f.Close()
+	}
+	past.State, err = state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return past, nil
+}
+
+// handleStateAt serves the gamestate of the user given by the user parameter
+// at the RFC 3339 time given by the at parameter, see StateAt. The optional
+// path parameter selects a part of the state with a gjson path, e.g.,
+// "status.ap".
+func (p *Proxy) handleStateAt(w http.ResponseWriter, r *http.Request) {
+	if AdminRole(r) != RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	at := time.Now()
+	if s := query.Get("at"); s != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid at: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	past, err := StateAt(query.Get("user"), at)
+	if err == ErrNoSync {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if path := query.Get("path"); path != "" {
+		result := gjson.GetBytes(past.State, path)
+		if !result.Exists() {
+			http.Error(w, fmt.Sprintf("%s doesn't exist in the state", path), http.StatusNotFound)
+			return
+		}
+		past.State = json.RawMessage(result.Raw)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(past)
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/packetlog"
+	"github.com/kyoukaya/rhine/utils"
+	"github.com/tidwall/gjson"
+)
+
+func TestStateAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-timetravel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := utils.BinDir
+	defer func() { utils.BinDir = binDir }()
+	utils.BinDir = dir
+
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.Local)
+	logDir := packetlog.UserDir("GL_1")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := packetlog.NewWriter(&buf)
+	_ = w.WritePacket(start, syncOp, []byte(`{"user":{"status":{"ap":10}},"ts":0}`))
+	_ = w.WritePacket(start.Add(5*time.Minute), "S/quest/battleStart",
+		[]byte(`{"playerDataDelta":{"modified":{"status":{"ap":4}},"deleted":{}}}`))
+	_ = w.WritePacket(start.Add(10*time.Minute), "S/quest/battleStart",
+		[]byte(`{"playerDataDelta":{"modified":{"status":{"ap":1}},"deleted":{}}}`))
+	if err := ioutil.WriteFile(filepath.Join(logDir, packetlog.FileName(start)), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := StateAt("GL_1", start.Add(-time.Minute)); err != ErrNoSync {
+		t.Fatalf("Expected ErrNoSync before the first sync, got %v", err)
+	}
+	for _, test := range []struct {
+		at time.Duration
+		ap int64
+	}{
+		{0, 10},
+		{7 * time.Minute, 4},
+		{time.Hour, 1},
+	} {
+		past, err := StateAt("GL_1", start.Add(test.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ap := gjson.GetBytes(past.State, "status.ap").Int(); ap != test.ap {
+			t.Fatalf("Expected %d sanity at %s, got %d", test.ap, test.at, ap)
+		}
+		if !past.Synced.Equal(start) {
+			t.Fatalf("Expected the state to be replayed from the sync, got %s", past.Synced)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+
+	"github.com/elazarl/goproxy"
+)
+
+const defaultTicketKeyRotation = 24 * time.Hour
+
+// TLSOptions configures TLS session resumption. Clients resume MITM'd sessions
+// with session tickets, which avoids a full handshake on every short lived
+// connection.
+type TLSOptions struct {
+	// DisableSessionTickets disables session resumption for MITM'd connections.
+	DisableSessionTickets bool `json:"disableSessionTickets"`
+	// TicketKeyRotation is how often the session ticket key is rotated, e.g.,
+	// "12h". Tickets issued with the previous key are still accepted. Defaults
+	// to 24h.
+	TicketKeyRotation string `json:"ticketKeyRotation"`
+	// UpstreamSessionCacheSize is the number of upstream TLS sessions cached
+	// for resumption with game servers, disabled if 0.
+	UpstreamSessionCacheSize int `json:"upstreamSessionCacheSize"`
+}
+
+// ticketKeys are the session ticket keys shared by the TLS configs of every
+// MITM'd connection. goproxy creates a new config for each CONNECT, each
+// of which would otherwise have its own keys, making tickets useless.
+type ticketKeys struct {
+	mutex    sync.Mutex
+	keys     [][32]byte
+	rotated  time.Time
+	interval time.Duration
+}
+
+func newTicketKeys(options *TLSOptions, logger log.Logger) *ticketKeys {
+	if options.DisableSessionTickets {
+		return nil
+	}
+	interval := parseDuration("ticketKeyRotation", options.TicketKeyRotation, logger)
+	if interval <= 0 {
+		interval = defaultTicketKeyRotation
+	}
+	return &ticketKeys{interval: interval}
+}
+
+// current returns the current key followed by the previous key, if any, after
+// rotating the keys if necessary.
+func (t *ticketKeys) current() ([][32]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.keys != nil && time.Since(t.rotated) < t.interval {
+		return t.keys, nil
+	}
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	keys := [][32]byte{key}
+	if len(t.keys) > 0 {
+		keys = append(keys, t.keys[0])
+	}
+	t.keys, t.rotated = keys, time.Now()
+	return keys, nil
+}
+
+// mitmConnect returns the ConnectAction for connections which are MITM'd,
+// sharing session ticket keys between their TLS configs. onHello is called
+// with the ClientHello of each connection. Certificates are signed by the
+// device CA of the client if it has one, see Options.DeviceCAs.
+func mitmConnect(keys *ticketKeys, cas *deviceCAs, onHello func(remoteAddr string, hello *tls.ClientHelloInfo)) *goproxy.ConnectAction {
+	signer := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectMitm,
+		TLSConfig: func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+			remoteAddr := ctx.Req.RemoteAddr
+			var config *tls.Config
+			var err error
+			if ca := cas.match(remoteAddr); ca != nil {
+				config, err = ca.tlsConfig(host)
+			} else {
+				config, err = signer(host, ctx)
+			}
+			if err != nil {
+				return nil, err
+			}
+			config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				onHello(remoteAddr, hello)
+				return nil, nil
+			}
+			if keys == nil {
+				config.SessionTicketsDisabled = true
+				return config, nil
+			}
+			current, err := keys.current()
+			if err != nil {
+				return nil, err
+			}
+			config.SetSessionTicketKeys(current)
+			return config, nil
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+
+	"github.com/elazarl/goproxy"
+)
+
+// TransportOptions tunes the connections made to upstream servers. Durations
+// are strings parsed by time.ParseDuration, e.g., "30s". Zero values keep the
+// defaults of net/http.
+type TransportOptions struct {
+	// MaxIdleConnsPerHost is the number of idle keep-alive connections kept
+	// per host.
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	// IdleConnTimeout is how long an idle connection is kept before it is closed.
+	IdleConnTimeout string `json:"idleConnTimeout"`
+	// KeepAlive is the interval between TCP keep-alive probes, negative to
+	// disable them.
+	KeepAlive string `json:"keepAlive"`
+	// DialTimeout limits how long establishing a TCP connection may take.
+	DialTimeout string `json:"dialTimeout"`
+	// TLSHandshakeTimeout limits how long a TLS handshake may take.
+	TLSHandshakeTimeout string `json:"tlsHandshakeTimeout"`
+	// ResponseHeaderTimeout limits how long to wait for a server's response
+	// headers after the request has been written.
+	ResponseHeaderTimeout string `json:"responseHeaderTimeout"`
+}
+
+// parseDuration returns the duration in s, warning and returning 0 on an
+// invalid duration.
+func parseDuration(name, s string, logger log.Logger) time.Duration {
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		logger.Warnf("Ignoring transport option %s: %s", name, err)
+		return 0
+	}
+	return d
+}
+
+// roundTripperFunc adapts an http.RoundTripper to the goproxy.RoundTripper
+// used for each request.
+func roundTripperFunc(rt http.RoundTripper) goproxy.RoundTripperFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		return rt.RoundTrip(req)
+	}
+}
+
+// apply sets the options on the transport, the transport's dialer is replaced
+// if a dial timeout or keep-alive interval is set.
+func (options *TransportOptions) apply(tr *http.Transport, logger log.Logger) {
+	if options.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	if d := parseDuration("idleConnTimeout", options.IdleConnTimeout, logger); d > 0 {
+		tr.IdleConnTimeout = d
+	}
+	if d := parseDuration("tlsHandshakeTimeout", options.TLSHandshakeTimeout, logger); d > 0 {
+		tr.TLSHandshakeTimeout = d
+	}
+	if d := parseDuration("responseHeaderTimeout", options.ResponseHeaderTimeout, logger); d > 0 {
+		tr.ResponseHeaderTimeout = d
+	}
+	dialTimeout := parseDuration("dialTimeout", options.DialTimeout, logger)
+	keepAlive := parseDuration("keepAlive", options.KeepAlive, logger)
+	if dialTimeout != 0 || keepAlive != 0 {
+		dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}
+		tr.DialContext = dialer.DialContext
+		// goproxy dials tunnelled CONNECT requests with Dial.
+		tr.Dial = dialer.Dial //nolint:staticcheck
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStats are the connections made to a host which wasn't MITM'd, e.g.,
+// because it matched the host filter, letting users check which hosts the
+// filter applies to.
+type TunnelStats struct {
+	Host string `json:"host"`
+	// Conns counts the connections made to the host, including open ones.
+	Conns     uint64 `json:"conns"`
+	OpenConns int    `json:"openConns"`
+	// BytesIn is the number of bytes received from clients on connections to
+	// the host and BytesOut the number sent to them.
+	BytesIn  uint64    `json:"bytesIn"`
+	BytesOut uint64    `json:"bytesOut"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// tunnelTracker sums the closed connections to each host which wasn't MITM'd.
+type tunnelTracker struct {
+	mutex sync.Mutex
+	hosts map[string]*TunnelStats
+}
+
+func newTunnelTracker() *tunnelTracker {
+	return &tunnelTracker{hosts: make(map[string]*TunnelStats)}
+}
+
+// closed adds a closed connection to its host's stats if it wasn't MITM'd.
+func (t *tunnelTracker) closed(c *ConnClosed) {
+	if t == nil || c.MITM || c.Host == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := t.hosts[c.Host]
+	if stats == nil {
+		stats = &TunnelStats{Host: c.Host}
+		t.hosts[c.Host] = stats
+	}
+	stats.Conns++
+	stats.BytesIn += c.BytesIn
+	stats.BytesOut += c.BytesOut
+	stats.LastSeen = time.Now()
+}
+
+// list returns copies of the stats of each host.
+func (t *tunnelTracker) list() map[string]*TunnelStats {
+	ret := make(map[string]*TunnelStats)
+	if t == nil {
+		return ret
+	}
+	t.mutex.Lock()
+	for host, stats := range t.hosts {
+		s := *stats
+		ret[host] = &s
+	}
+	t.mutex.Unlock()
+	return ret
+}
+
+// addOpenTunnels adds the open connections which weren't MITM'd to the stats.
+func (l *connListener) addOpenTunnels(hosts map[string]*TunnelStats) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, conn := range l.conns {
+		conn.mutex.Lock()
+		host, mitm := conn.host, conn.mitm
+		conn.mutex.Unlock()
+		if mitm || host == "" {
+			continue
+		}
+		stats := hosts[host]
+		if stats == nil {
+			stats = &TunnelStats{Host: host}
+			hosts[host] = stats
+		}
+		stats.Conns++
+		stats.OpenConns++
+		stats.BytesIn += atomic.LoadUint64(&conn.bytesIn)
+		stats.BytesOut += atomic.LoadUint64(&conn.bytesOut)
+		stats.LastSeen = now
+	}
+}
+
+// Tunnels returns the stats of each host clients connected to which wasn't
+// MITM'd since the proxy started, ordered by the number of connections.
+func (p *Proxy) Tunnels() []TunnelStats {
+	hosts := p.tunnels.list()
+	p.listener.addOpenTunnels(hosts)
+	ret := make([]TunnelStats, 0, len(hosts))
+	for _, stats := range hosts {
+		ret = append(ret, *stats)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Conns != ret[j].Conns {
+			return ret[i].Conns > ret[j].Conns
+		}
+		return ret[i].Host < ret[j].Host
+	})
+	return ret
+}
+
+// handleTunnels lists the hosts which weren't MITM'd.
+func (p *Proxy) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.Tunnels())
+}
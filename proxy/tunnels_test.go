@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/kyoukaya/rhine/events"
+)
+
+func TestTunnels(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy()
+	p.tunnels = newTunnelTracker()
+	p.listener = newConnListener(l, events.NewBus(nil))
+	p.listener.tunnels = p.tunnels
+	defer p.listener.Close()
+
+	accept := func(host string, mitm bool) net.Conn {
+		go func() {
+			if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+				c.Write([]byte("hello"))
+			}
+		}()
+		c, err := p.listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.listener.connect(c.RemoteAddr().String(), host, mitm)
+		buf := make([]byte, 5)
+		if _, err := c.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	accept("play.googleapis.com:443", false).Close()
+	accept("gs.arknights.global:8443", true).Close()
+	open := accept("play.googleapis.com:443", false)
+	defer open.Close()
+	accept("sdk.example.com:443", false).Close()
+	p.tunnels.closed(&ConnClosed{Host: "other.example.com:443", BytesIn: 1})
+
+	tunnels := p.Tunnels()
+	if len(tunnels) != 3 {
+		t.Fatalf("Unexpected tunnels %+v", tunnels)
+	}
+	play := tunnels[0]
+	if play.Host != "play.googleapis.com:443" || play.Conns != 2 || play.OpenConns != 1 || play.BytesIn != 10 {
+		t.Fatalf("Unexpected stats %+v", play)
+	}
+}
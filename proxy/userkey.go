@@ -0,0 +1,31 @@
+package proxy
+
+import "strings"
+
+// UserKeyFunc resolves the key identifying a user in what Rhine persists for
+// them, such as their modules' stores, schedules and outboxes, from the UID
+// and region they logged in with and the client they logged in from, nil if
+// unknown, e.g., when a session is resumed. Embedders can map several
+// accounts to the same key to track one player across account transfers or
+// re-rolls sharing a device, whose modules then share their data. Game
+// packets are still routed to the user's dispatch by their region and UID.
+type UserKeyFunc func(uid, region string, client *ClientInfo) string
+
+// DefaultUserKey keys users by their region and UID, e.g., "GL_1234".
+func DefaultUserKey(uid, region string, client *ClientInfo) string {
+	return region + "_" + uid
+}
+
+// userKey resolves the key of a user with Options.UserKey, falling back to
+// DefaultUserKey if it returns a key which can't namespace store keys.
+func (p *Proxy) userKey(uid, region string, client *ClientInfo) string {
+	if p.options.UserKey == nil {
+		return DefaultUserKey(uid, region, client)
+	}
+	key := p.options.UserKey(uid, region, client)
+	if key == "" || strings.Contains(key, "/") {
+		p.Warnf("Invalid key %q for %s_%s, keying the user by region and UID", key, region, uid)
+		return DefaultUserKey(uid, region, client)
+	}
+	return key
+}
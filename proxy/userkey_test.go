@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/kyoukaya/rhine/storage"
+)
+
+func TestUserKey(t *testing.T) {
+	registered := modules
+	defer func() { modules = registered }()
+	var key string
+	modules = []initFunc{{name: "A", fun: func(mod *RhineModule) { key = mod.Key }}}
+	p := newTestProxy()
+	if key != "GL_1" {
+		t.Fatalf("Expected users to be keyed by region and UID by default, got %q", key)
+	}
+
+	p.store = storage.NewMemoryStore()
+	p.options.UserKey = func(uid, region string, client *ClientInfo) string {
+		if uid == "3" {
+			return "bad/key"
+		}
+		return "player"
+	}
+	d, err := p.addUser("2", "JP", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "player" || d.key != "player" {
+		t.Fatalf("Expected the user to be keyed by UserKey, got %q", key)
+	}
+	if err := d.modules[0].Store().Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.store.Get("modules/A/player/k"); err != nil {
+		t.Fatalf("Expected the module's store to be namespaced by the key: %s", err)
+	}
+	if _, err := p.addUser("3", "JP", nil); err != nil {
+		t.Fatal(err)
+	}
+	if key != "JP_3" {
+		t.Fatalf("Expected an invalid key to fall back to the default, got %q", key)
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/utils"
+)
+
+// UserLogPath returns the path of the log of the lines concerning a user,
+// written if Options.UserLogs is set.
+func UserLogPath(rUID string) string {
+	return filepath.Join(utils.BinDir, "logs", "users", rUID+".log")
+}
+
+// userLogger returns the logger of a user's dispatch and modules, which also
+// appends to the user's log if Options.UserLogs is set, along with the file
+// to close once the dispatch is shut down, nil if none was opened.
+func (p *Proxy) userLogger(rUID string) (log.Logger, io.Closer) {
+	l, ok := p.Logger.(*log.Log)
+	if !p.options.UserLogs || !ok {
+		return p.Logger, nil
+	}
+	path := UserLogPath(rUID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		p.Warnf("Failed to create the log of %s: %s", rUID, err)
+		return p.Logger, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		p.Warnf("Failed to open the log of %s: %s", rUID, err)
+		return p.Logger, nil
+	}
+	return l.WithOutput(f), f
+}
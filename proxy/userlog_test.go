@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kyoukaya/rhine/utils"
+)
+
+func TestUserLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binDir := utils.BinDir
+	defer func() { utils.BinDir = binDir }()
+	utils.BinDir = dir
+
+	p := newTestProxy()
+	p.options.UserLogs = true
+	d, err := p.addUser("2", "GL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Printf("line for the user")
+	p.Printf("line for the proxy")
+	d.shutdown(true)
+	d.Printf("line after shutdown")
+
+	b, err := ioutil.ReadFile(UserLogPath("GL_2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log := string(b); !strings.Contains(log, "line for the user") || strings.Contains(log, "line for the proxy") {
+		t.Fatalf("Expected only the user's lines in their log, got %q", log)
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+// Gauges of each user's gamestate, labelled with the user's region_UID.
+var (
+	userSanity = metrics.NewGaugeVec("rhine_user_sanity",
+		"Current sanity of the user, including the sanity regenerated since the last sync.", "user")
+	userSanityMax = metrics.NewGaugeVec("rhine_user_sanity_max", "Sanity cap of the user.", "user")
+	userLMD       = metrics.NewGaugeVec("rhine_user_lmd", "LMD held by the user.", "user")
+	userOrundum   = metrics.NewGaugeVec("rhine_user_orundum", "Orundum held by the user.", "user")
+	userRecruits  = metrics.NewGaugeVec("rhine_user_recruits_ongoing",
+		"Number of the user's recruitments in progress or waiting to be collected.", "user")
+	userDrones       = metrics.NewGaugeVec("rhine_user_drones", "Drones in the user's base as of the last sync.", "user")
+	userAnnihilation = metrics.NewGaugeVec("rhine_user_annihilation_orundum",
+		"Orundum earned by the user from annihilation since the weekly reset.", "user")
+	userAnnihilationMax = metrics.NewGaugeVec("rhine_user_annihilation_orundum_max",
+		"Weekly cap of the orundum earned from annihilation.", "user")
+)
+
+var userGauges = []*metrics.GaugeVec{userSanity, userSanityMax, userLMD, userOrundum, userRecruits, userDrones,
+	userAnnihilation, userAnnihilationMax}
+
+// userMetricsMutex serializes the updates of the user gauges.
+var userMetricsMutex sync.Mutex
+
+// updateUserMetrics sets the user gauges to the gamestate of each connected
+// user whose gamestate is loaded, removing the gauges of other users.
+func (p *Proxy) updateUserMetrics() {
+	p.mutex.Lock()
+	dispatches := make(map[string]*dispatch, len(p.dispatches))
+	for rUID, d := range p.dispatches {
+		dispatches[rUID] = d
+	}
+	p.mutex.Unlock()
+	userMetricsMutex.Lock()
+	defer userMetricsMutex.Unlock()
+	for _, gauge := range userGauges {
+		gauge.Reset()
+	}
+	for rUID, d := range dispatches {
+		if d.state == nil || !d.state.IsLoaded() {
+			continue
+		}
+		if current, max, _, err := d.state.Sanity(); err == nil {
+			userSanity.With(rUID).Set(current)
+			userSanityMax.With(rUID).Set(max)
+		}
+		if earned, max, err := d.state.Annihilation(); err == nil {
+			userAnnihilation.With(rUID).Set(earned)
+			userAnnihilationMax.With(rUID).Set(max)
+		}
+		state := d.state.GetStateRef()
+		if state.Status != nil {
+			userLMD.With(rUID).Set(state.Status.Gold)
+			userOrundum.With(rUID).Set(state.Status.DiamondShard)
+		}
+		if state.Recruit != nil && state.Recruit.Normal != nil {
+			var ongoing int64
+			for _, slot := range state.Recruit.Normal.Slots {
+				if slot.State == recruitInProgress || slot.State == recruitFinished {
+					ongoing++
+				}
+			}
+			userRecruits.With(rUID).Set(ongoing)
+		}
+		if state.Building != nil && state.Building.Status != nil {
+			userDrones.With(rUID).Set(state.Building.Status.Labor.Value)
+		}
+	}
+}
+
+// handleMetrics serves the metrics of the Default registry, updating the user
+// gauges first so that they're current as of the scrape.
+func (p *Proxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !p.options.DisableUserMetrics {
+		p.updateUserMetrics()
+	}
+	metrics.Default.ServeHTTP(w, r)
+}
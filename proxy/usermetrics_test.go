@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserMetrics(t *testing.T) {
+	p := newTestProxy()
+	if _, err := p.addUser("2", "GL", nil); err != nil {
+		t.Fatal(err)
+	}
+	state := fmt.Sprintf(`{
+		"status": {"ap": 10, "maxAp": 100, "lastApAddTime": %d, "gold": 12345, "diamondShard": 600},
+		"recruit": {"normal": {"slots": {"0": {"state": 2}, "1": {"state": 3}, "2": {"state": 1}}}},
+		"building": {"status": {"labor": {"value": 42, "maxValue": 180}}}
+	}`, time.Now().Add(-13*time.Minute).Unix())
+	if err := p.getUser("1", "GL").state.Restore([]byte(state)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE rhine_user_sanity gauge\nrhine_user_sanity{user=\"GL_1\"} 12\n",
+		"rhine_user_sanity_max{user=\"GL_1\"} 100\n",
+		"rhine_user_lmd{user=\"GL_1\"} 12345\n",
+		"rhine_user_orundum{user=\"GL_1\"} 600\n",
+		"rhine_user_recruits_ongoing{user=\"GL_1\"} 2\n",
+		"rhine_user_drones{user=\"GL_1\"} 42\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Expected %q in:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "GL_2") {
+		t.Fatalf("Expected no gauges for users without a gamestate:\n%s", body)
+	}
+
+	p.mutex.Lock()
+	delete(p.dispatches, "GL_1")
+	p.mutex.Unlock()
+	w = httptest.NewRecorder()
+	p.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), "GL_1") {
+		t.Fatalf("Expected the gauges of disconnected users to be removed:\n%s", w.Body)
+	}
+}
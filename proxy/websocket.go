@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	stdLog "log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/metrics"
+
+	"github.com/elazarl/goproxy"
+)
+
+// TopicWSMessage is the topic of the WSMessage events published on the proxy's
+// bus when Options.EnableWebSocket is set.
+const TopicWSMessage = "conn/wsMessage"
+
+// maxWSMessageBytes is the size above which WebSocket messages are relayed
+// without being published.
+const maxWSMessageBytes = 4 << 20
+
+// WebSocket opcodes, see RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsControl      = 0x8
+)
+
+// WSMessage is a text or binary message relayed over a WebSocket connection of
+// a MITM'd host. Fragmented messages are reassembled, control frames aren't
+// published.
+type WSMessage struct {
+	RemoteAddr string
+	Host       string
+	Path       string
+	// FromClient is true for messages sent by the client and false for those
+	// sent by the server.
+	FromClient bool
+	Binary     bool
+	Data       []byte
+}
+
+var wsMessages = metrics.NewCounter("rhine_websocket_messages_total", "Number of WebSocket messages relayed.")
+
+// isWebSocketUpgrade reports whether the request asks to upgrade its
+// connection to a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relayWSFrames copies the frames read from src to dst unchanged until either
+// fails, calling onMessage with the opcode and unmasked payload of each text or
+// binary message.
+func relayWSFrames(dst io.Writer, src io.Reader, onMessage func(opcode byte, data []byte)) error {
+	var (
+		header [14]byte
+		opcode byte
+		msg    []byte
+		// skip is set once the message being reassembled is too large.
+		skip bool
+	)
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+		n := 2
+		fin, frameOp, masked := header[0]&0x80 != 0, header[0]&0x0f, header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[n:n+2]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(header[n:]))
+			n += 2
+		case 127:
+			if _, err := io.ReadFull(src, header[n:n+8]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(header[n:])
+			n += 8
+		}
+		var mask []byte
+		if masked {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return err
+			}
+			mask = header[n : n+4]
+			n += 4
+		}
+		if _, err := dst.Write(header[:n]); err != nil {
+			return err
+		}
+
+		control := frameOp&wsControl != 0
+		if !control && frameOp != wsContinuation {
+			opcode, msg, skip = frameOp, msg[:0], false
+		}
+		if control || skip || uint64(len(msg))+length > maxWSMessageBytes {
+			skip = skip || !control
+			if _, err := io.CopyN(dst, src, int64(length)); err != nil {
+				return err
+			}
+		} else {
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(src, payload); err != nil {
+				return err
+			}
+			if _, err := dst.Write(payload); err != nil {
+				return err
+			}
+			if mask != nil {
+				for i := range payload {
+					payload[i] ^= mask[i%4]
+				}
+			}
+			msg = append(msg, payload...)
+		}
+		if fin && !control {
+			if !skip {
+				onMessage(opcode, append([]byte(nil), msg...))
+			}
+			msg, skip = msg[:0], false
+		}
+	}
+}
+
+// onceListener is a net.Listener which accepts a single connection, after
+// which Accept blocks until the connection is closed.
+type onceListener struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newOnceListener(conn net.Conn) *onceListener {
+	l := &onceListener{closed: make(chan struct{})}
+	l.conn = &onceConn{Conn: conn, listener: l}
+	return l
+}
+
+func (l *onceListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mutex.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *onceListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *onceListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// onceConn closes its onceListener when closed.
+type onceConn struct {
+	net.Conn
+	listener *onceListener
+}
+
+func (c *onceConn) Close() error {
+	err := c.Conn.Close()
+	_ = c.listener.Close()
+	return err
+}
+
+// verboseWriter writes the lines of a standard logger to a Logger's verbose
+// output.
+type verboseWriter struct {
+	log.Logger
+}
+
+func (w verboseWriter) Write(b []byte) (int, error) {
+	w.Verbosef("%s", bytes.TrimRight(b, "\n"))
+	return len(b), nil
+}
+
+// hijackMITM serves a MITM'd connection with net/http, which unlike goproxy's
+// MITM loop lets WebSocket upgrades be relayed. Other requests are proxied by
+// goproxy as if the client had sent them to the proxy directly, so they're
+// still dispatched by HandleReq and HandleResp.
+func (p *Proxy) hijackMITM(connect *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	host := connect.URL.Host
+	config, err := p.mitm.TLSConfig(host, ctx)
+	if err != nil {
+		p.Warnf("Failed to create the TLS config of %s: %s", host, err)
+		_ = client.Close()
+		return
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme, r.URL.Host = "https", host
+			if isWebSocketUpgrade(r) {
+				p.relayWebSocket(host, w, r)
+				return
+			}
+			p.server.ServeHTTP(w, r)
+		}),
+		ErrorLog: stdLog.New(verboseWriter{p.Logger}, "[websocket] ", 0),
+	}
+	_ = server.Serve(newOnceListener(tls.Server(client, config)))
+}
+
+// dialUpstream dials a TLS connection to the host of a hijacked MITM'd
+// connection, with the TLS client config of goproxy's transport.
+func (p *Proxy) dialUpstream(host string) (*tls.Conn, error) {
+	config := &tls.Config{}
+	if p.server.Tr.TLSClientConfig != nil {
+		config = p.server.Tr.TLSClientConfig.Clone()
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		config.ServerName = hostname
+	} else {
+		config.ServerName, host = host, host+":443"
+	}
+	return tls.Dial("tcp", host, config)
+}
+
+// relayWebSocket forwards the upgrade request to the host and relays the frames
+// of the upgraded connection, publishing its messages as WSMessage events.
+// Compression extensions are stripped from the request so that messages can be
+// read.
+func (p *Proxy) relayWebSocket(host string, w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	upstream, err := p.dialUpstream(host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	r.RequestURI = ""
+	r.Header.Del("Sec-WebSocket-Extensions")
+	if err := r.Write(upstream); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	upstreamBuf := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upstreamBuf, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		p.Warnf("Failed to hijack the WebSocket connection of %s: %s", r.RemoteAddr, err)
+		return
+	}
+	defer client.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = resp.Write(client)
+		return
+	}
+	fmt.Fprintf(client, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	_ = resp.Header.Write(client)
+	if _, err := io.WriteString(client, "\r\n"); err != nil {
+		return
+	}
+	p.Verbosef("==== WebSocket %s%s for %s", host, r.URL.Path, r.RemoteAddr)
+
+	publish := func(fromClient bool) func(byte, []byte) {
+		return func(opcode byte, data []byte) {
+			wsMessages.Inc()
+			p.events.Publish(events.Event{Topic: TopicWSMessage, Payload: &WSMessage{
+				RemoteAddr: r.RemoteAddr,
+				Host:       host,
+				Path:       r.URL.Path,
+				FromClient: fromClient,
+				Binary:     opcode == wsBinary,
+				Data:       data,
+			}})
+		}
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		_ = relayWSFrames(upstream, clientBuf, publish(true))
+		done <- struct{}{}
+	}()
+	go func() {
+		_ = relayWSFrames(client, upstreamBuf, publish(false))
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+
+	"github.com/elazarl/goproxy"
+)
+
+// wsFrame encodes a WebSocket frame, masking the payload if mask is set.
+func wsFrame(fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestRelayWSFrames(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	long := bytes.Repeat([]byte("a"), 300)
+	var in bytes.Buffer
+	in.Write(wsFrame(false, 0x1, mask, []byte("hel")))
+	in.Write(wsFrame(true, 0x9, mask, []byte("ping")))
+	in.Write(wsFrame(true, wsContinuation, mask, []byte("lo")))
+	in.Write(wsFrame(true, wsBinary, nil, long))
+	want := append([]byte(nil), in.Bytes()...)
+
+	var out bytes.Buffer
+	var msgs []string
+	var opcodes []byte
+	err := relayWSFrames(&out, &in, func(opcode byte, data []byte) {
+		opcodes = append(opcodes, opcode)
+		msgs = append(msgs, string(data))
+	})
+	if err != io.EOF {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatal("Frames weren't relayed unchanged")
+	}
+	if len(msgs) != 2 || msgs[0] != "hello" || msgs[1] != string(long) || opcodes[0] != 0x1 || opcodes[1] != wsBinary {
+		t.Fatalf("Unexpected messages %q %v", msgs, opcodes)
+	}
+}
+
+func TestWebSocketMITM(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain" {
+			_, _ = io.WriteString(w, "plain")
+			return
+		}
+		if !isWebSocketUpgrade(r) || r.Header.Get("Sec-WebSocket-Extensions") != "" {
+			http.Error(w, "bad upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		// Echo the frames back.
+		_ = relayWSFrames(conn, buf, func(byte, []byte) {})
+	}))
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+
+	p := newTestProxy()
+	p.server = goproxy.NewProxyHttpServer()
+	p.mitm = mitmConnect(nil, nil, func(string, *tls.ClientHelloInfo) {})
+	p.hijack = &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: p.hijackMITM}
+	p.server.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(p.httpsHandler))
+	proxyServer := httptest.NewServer(p.server)
+	defer proxyServer.Close()
+	listener := make(chan events.Event, 4)
+	p.events.Subscribe(TopicWSMessage, listener)
+
+	connect := func() *tls.Conn {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT failed: %v", err)
+		}
+		return tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+
+	// Requests which aren't upgrades are still proxied by goproxy.
+	plain := connect()
+	defer plain.Close()
+	_, _ = io.WriteString(plain, "GET /plain HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(plain), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "plain" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+
+	client := connect()
+	defer client.Close()
+	_, _ = io.WriteString(client, "GET /ws HTTP/1.1\r\nHost: "+host+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+	br := bufio.NewReader(client)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected status %s", resp.Status)
+	}
+	frame := wsFrame(true, 0x1, []byte{5, 6, 7, 8}, []byte("hello"))
+	if _, err := client.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(frame))
+	if _, err := io.ReadFull(br, echo); err != nil || !bytes.Equal(echo, frame) {
+		t.Fatalf("Unexpected echo %v: %v", echo, err)
+	}
+	for _, fromClient := range []bool{true, false} {
+		select {
+		case evt := <-listener:
+			msg := evt.Payload.(*WSMessage)
+			if msg.FromClient != fromClient || string(msg.Data) != "hello" || msg.Path != "/ws" || msg.Host != host || msg.Binary {
+				t.Fatalf("Unexpected message %+v", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No message published")
+		}
+	}
+}
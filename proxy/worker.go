@@ -0,0 +1,408 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/utils"
+	"github.com/tidwall/gjson"
+
+	"github.com/elazarl/goproxy"
+)
+
+// WorkerOptions configures splitting the proxy into a front end, which MITMs
+// the client's connections and is started with Start, and a worker running the
+// modules, started with StartWorker. Game packets are passed through untouched
+// while the worker is down, so a crashing module doesn't drop the game
+// connection. The admin listener is served by the worker.
+type WorkerOptions struct {
+	// Address the worker listens on and the front end dispatches game packets
+	// to, e.g., "127.0.0.1:8082". Packets are dispatched in process if empty.
+	// Connections are authenticated both ways with certificates signed by
+	// Rhine's CA, so the front end and the worker must share it.
+	Address string `json:"address"`
+	// Timeout limits how long the front end waits for the worker to handle a
+	// packet, e.g., "2s". Defaults to 5s.
+	Timeout string `json:"timeout"`
+}
+
+// WorkerPacket is a game packet sent by the front end to the worker.
+type WorkerPacket struct {
+	Op     string
+	UID    string // Empty for the login request
+	Region string
+	Method string // Method of the request, defaults to POST
+	URL    string
+	Header http.Header
+	Body   []byte
+	// The following fields are only set for responses.
+	StatusCode    int
+	RequestHeader http.Header
+	RequestData   []byte
+	// Client is set for requests.
+	Client *ClientInfo
+}
+
+// WorkerReply is the worker's reply to a WorkerPacket.
+type WorkerReply struct {
+	// UID of the user the packet was dispatched for, empty if the packet
+	// doesn't belong to a logged in user.
+	UID string
+	// Modified is set if the hooks replaced the packet's body with Body.
+	Modified bool
+	Body     []byte
+	// Dropped is the error of the hook which dropped the packet, empty if it
+	// wasn't dropped, see PacketModifier.
+	Dropped string
+}
+
+var errWorkerTimeout = errors.New("worker timed out")
+
+// workerRetryInterval is how long a worker is skipped after it failed, see
+// workerClient.available.
+const workerRetryInterval = 10 * time.Second
+
+// workerClient dispatches packets to the worker, dialling it as needed.
+type workerClient struct {
+	address string
+	timeout time.Duration
+	mutex   sync.Mutex
+	client  *rpc.Client
+	tls     *tls.Config
+	// failedAt is when the connection to the worker last failed.
+	failedAt time.Time
+	log.Logger
+}
+
+func newWorkerClient(options *WorkerOptions, logger log.Logger) *workerClient {
+	timeout := parseDuration("worker.timeout", options.Timeout, logger)
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &workerClient{address: options.Address, timeout: timeout, Logger: logger}
+}
+
+// dial returns the connection to the worker, establishing it if necessary.
+func (w *workerClient) dial() (*rpc.Client, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.client != nil {
+		return w.client, nil
+	}
+	if w.tls == nil {
+		config, err := workerClientTLSConfig(w.address)
+		if err != nil {
+			return nil, err
+		}
+		w.tls = config
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: w.timeout}, "tcp", w.address, w.tls)
+	if err != nil {
+		w.failedAt = time.Now()
+		return nil, err
+	}
+	w.client = rpc.NewClient(conn)
+	return w.client, nil
+}
+
+// reset drops a broken connection so that the next packet redials the worker.
+func (w *workerClient) reset(client *rpc.Client) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.client == client {
+		w.client.Close()
+		w.client = nil
+		w.failedAt = time.Now()
+	}
+}
+
+// available reports whether the connection to the worker hasn't failed
+// recently.
+func (w *workerClient) available() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return time.Since(w.failedAt) > workerRetryInterval
+}
+
+// dispatch sends the packet to the worker, returning nil if it couldn't be
+// handled, in which case the packet should be passed through.
+func (w *workerClient) dispatch(pkt *WorkerPacket) *WorkerReply {
+	client, err := w.dial()
+	if err != nil {
+		w.Warnf("Passing %s through, worker unreachable: %s", pkt.Op, err)
+		return nil
+	}
+	reply := &WorkerReply{}
+	call := client.Go("Worker.Dispatch", pkt, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(w.timeout):
+		err = errWorkerTimeout
+	}
+	if err == nil {
+		return reply
+	}
+	if _, ok := err.(rpc.ServerError); !ok && err != errWorkerTimeout {
+		w.reset(client)
+	}
+	w.Warnf("Passing %s through: %s", pkt.Op, err)
+	return nil
+}
+
+// forwardReq dispatches a game request to the worker.
+func (proxy *Proxy) forwardReq(worker *workerClient, req *http.Request, reqCtx *RequestContext, op, uid, region string) (*http.Request, *http.Response) {
+	if uid == "" && op != "C/account/login" {
+		return req, nil
+	}
+	body, err := proxy.readReqBody(req)
+	if err != nil {
+		return proxy.readFailed(req, op, err)
+	}
+	reply := worker.dispatch(&WorkerPacket{
+		Op:     op,
+		UID:    uid,
+		Region: region,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: req.Header,
+		Body:   body,
+		Client: proxy.clientInfo(req),
+	})
+	if reply == nil && proxy.options.FailClosed {
+		dispatchFailures.Inc()
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "worker failed to dispatch "+op)
+	}
+	if reply == nil || reply.UID == "" {
+		return req, nil
+	}
+	reqCtx.RequestOp = op
+	reqCtx.RequestData = body
+	reqCtx.uid = reply.UID
+	reqCtx.region = region
+	reqCtx.worker = worker
+	if reply.Dropped != "" {
+		droppedPackets.Inc()
+		reqCtx.RequestIsBlocked = true
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, reply.Dropped)
+	}
+	if reply.Modified {
+		setBody(&req.Body, &req.ContentLength, req.Header, reply.Body)
+	}
+	return req, nil
+}
+
+// forwardResp dispatches the response to a game request to the worker.
+// Responses which would be spilled are passed through.
+func (proxy *Proxy) forwardResp(resp *http.Response, ctx *goproxy.ProxyCtx, reqCtx *RequestContext) *http.Response {
+	op := "S/" + strings.Trim(ctx.Req.URL.Path, "/")
+	if proxy.spills(resp.ContentLength) {
+		proxy.Verbosef("<<<< %s passed through as it would be spilled", op)
+		return resp
+	}
+	body, err := readBody(resp.Body, resp.ContentLength)
+	if err != nil {
+		proxy.Warnf("Failed to read %s: %s", op, err)
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	reply := reqCtx.worker.dispatch(&WorkerPacket{
+		Op:            op,
+		UID:           reqCtx.uid,
+		Region:        reqCtx.region,
+		Method:        ctx.Req.Method,
+		URL:           ctx.Req.URL.String(),
+		Header:        resp.Header,
+		Body:          body,
+		StatusCode:    resp.StatusCode,
+		RequestHeader: ctx.Req.Header,
+		RequestData:   reqCtx.RequestData,
+	})
+	if reply == nil && proxy.options.FailClosed {
+		dispatchFailures.Inc()
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "worker failed to dispatch "+op)
+	}
+	if reply != nil && reply.Dropped != "" {
+		droppedPackets.Inc()
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, reply.Dropped)
+	}
+	if reply != nil && reply.Modified {
+		setBody(&resp.Body, &resp.ContentLength, resp.Header, reply.Body)
+	}
+	return resp
+}
+
+// workerService handles the packets sent by the front end.
+type workerService struct {
+	proxy *Proxy
+}
+
+// Dispatch runs the core handlers and hooks of the user the packet belongs to,
+// logging the user in if the packet is a login request.
+func (s *workerService) Dispatch(pkt *WorkerPacket, reply *WorkerReply) (err error) {
+	proxy := s.proxy
+	defer proxy.Flush()
+	uid := pkt.UID
+	var d *dispatch
+	if uid == "" {
+		if pkt.Op != "C/account/login" {
+			return nil
+		}
+		uid = gjson.GetBytes(pkt.Body, "uid").String()
+		var err error
+		if d, err = proxy.addUser(uid, pkt.Region, pkt.Client); err != nil {
+			return err
+		}
+	} else if strings.HasPrefix(pkt.Op, "C/") {
+		d = proxy.findUser(uid, pkt.Region)
+	} else {
+		d = proxy.getUser(uid, pkt.Region)
+	}
+	if d == nil {
+		return nil
+	}
+	reply.UID = uid
+
+	reqCtx := &RequestContext{StartT: time.Now(), RequestOp: pkt.Op, RequestData: pkt.Body, dispatch: d}
+	reqHeader, reqBody := pkt.Header, pkt.Body
+	isResp := strings.HasPrefix(pkt.Op, "S/")
+	if isResp {
+		reqCtx.RequestOp = "C/" + strings.TrimPrefix(pkt.Op, "S/")
+		reqCtx.RequestData = pkt.RequestData
+		reqHeader, reqBody = pkt.RequestHeader, pkt.RequestData
+	}
+	method := pkt.Method
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, pkt.URL, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header = reqHeader
+	ctx := &goproxy.ProxyCtx{Req: req, UserData: reqCtx}
+	if isResp {
+		ctx.Resp = &http.Response{
+			StatusCode:    pkt.StatusCode,
+			Header:        pkt.Header,
+			Body:          ioutil.NopCloser(bytes.NewReader(pkt.Body)),
+			ContentLength: int64(len(pkt.Body)),
+			Request:       req,
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("dispatch of %s failed: %v", pkt.Op, r)
+		}
+	}()
+	data, dropErr := d.run(pkt.Op, pkt.Body, ctx)
+	if dropErr != nil {
+		reply.Dropped = dropErr.Error()
+		return nil
+	}
+	if !sameBuffer(pkt.Body, data) {
+		reply.Modified = true
+		reply.Body = data
+	}
+	return nil
+}
+
+// StartWorker starts the proxy as the worker of a front end, see WorkerOptions,
+// shutting it down on SIGINT or SIGTERM. It blocks until the proxy is shut
+// down.
+func (p *Proxy) StartWorker() {
+	p.ShutdownOnSignal()
+	for _, cb := range onStartCbs {
+		cb(p.Logger)
+	}
+
+	l, err := net.Listen("tcp", p.options.Worker.Address)
+	if err != nil {
+		p.Warnln(err)
+		panic(err)
+	}
+	p.closeOnShutdown(l)
+	go p.serveAdmin()
+	p.Printf("worker listening on %s", l.Addr())
+	if err := p.serveWorker(l, p.options.Worker.Address); !p.stopping() {
+		p.Warnln(err)
+		panic(err)
+	}
+	<-p.Done()
+}
+
+// workerServerTLSConfig returns the TLS config of the worker protocol's
+// listener on address, which only accepts clients presenting a certificate
+// signed by Rhine's CA.
+func workerServerTLSConfig(address string) (*tls.Config, error) {
+	hosts := append([]string{"localhost", "127.0.0.1", "::1"}, utils.GetOutboundIPs()...)
+	if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	cert, _, _, err := utils.SignCert(&goproxy.GoproxyCa, "Rhine worker", hosts, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(goproxy.GoproxyCa.Leaf)
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// workerClientTLSConfig returns the TLS config used to dial the worker at
+// address, presenting a client certificate signed by Rhine's CA and only
+// trusting workers whose certificate is signed by it.
+func workerClientTLSConfig(address string) (*tls.Config, error) {
+	cert, _, _, err := utils.SignCert(&goproxy.GoproxyCa, "Rhine front end", nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(goproxy.GoproxyCa.Leaf)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      pool,
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// serveWorker handles the front end's connections to l, which listens on
+// address, over mutually authenticated TLS.
+func (p *Proxy) serveWorker(l net.Listener, address string) error {
+	config, err := workerServerTLSConfig(address)
+	if err != nil {
+		return err
+	}
+	l = tls.NewListener(l, config)
+	server := rpc.NewServer()
+	if err := server.RegisterName("Worker", &workerService{proxy: p}); err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
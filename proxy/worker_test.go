@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestWorkerDispatch(t *testing.T) {
+	worker := newTestProxy()
+	d := worker.getUser("1", "GL")
+	var reqData []byte
+	mod := &RhineModule{name: "test", dispatch: d}
+	mod.Hook("C/building/sync", 0,
+		func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte { return []byte("{}") })
+	mod.Hook("S/building/sync", 0, func(op string, data []byte, pktCtx *goproxy.ProxyCtx) []byte {
+		reqData = GetRequestContext(pktCtx).RequestData
+		return []byte("[]")
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go worker.serveWorker(l, l.Addr().String())
+
+	front := newTestProxy()
+	front.worker = newWorkerClient(&WorkerOptions{Address: l.Addr().String()}, front.Logger)
+	req := benchRequest("gs.arknights.global:8443", "/building/sync")
+	ctx := &goproxy.ProxyCtx{Req: req}
+	front.HandleReq(req, ctx)
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != "{}" {
+		t.Fatalf("Expected the worker to replace the request body, got %q", body)
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(benchBody)),
+		ContentLength: int64(len(benchBody)),
+	}
+	ctx.Resp = resp
+	resp = front.HandleResp(resp, ctx)
+	body, _ = ioutil.ReadAll(resp.Body)
+	if string(body) != "[]" {
+		t.Fatalf("Expected the worker to replace the response body, got %q", body)
+	}
+	if !bytes.Equal(reqData, benchBody) {
+		t.Fatal("Response hooks should see the request's body in the request context")
+	}
+
+	// Packets are passed through once the worker is down.
+	l.Close()
+	front.worker.reset(front.worker.client)
+	req = benchRequest("gs.arknights.global:8443", "/building/sync")
+	front.HandleReq(req, &goproxy.ProxyCtx{Req: req})
+	body, _ = ioutil.ReadAll(req.Body)
+	if !bytes.Equal(body, benchBody) {
+		t.Fatal("Expected the request to be passed through while the worker is down")
+	}
+}
+
+func TestWorkerRequiresClientCert(t *testing.T) {
+	worker := newTestProxy()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go worker.serveWorker(l, l.Addr().String())
+
+	config, err := workerClientTLSConfig(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Certificates = nil
+	conn, err := tls.Dial("tcp", l.Addr().String(), config)
+	if err == nil {
+		client := rpc.NewClient(conn)
+		defer client.Close()
+		err = client.Call("Worker.Dispatch", &WorkerPacket{Op: "C/account/login"}, &WorkerReply{})
+	}
+	if err == nil {
+		t.Fatal("Expected the worker to refuse a client without a certificate")
+	}
+}
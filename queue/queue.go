@@ -0,0 +1,158 @@
+// Package queue provides a bounded FIFO queue with a configurable policy for
+// when it is full, so that a slow consumer can't make Rhine buffer an
+// unbounded number of items.
+package queue
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+// Policy decides what happens to an item pushed onto a full queue.
+type Policy int
+
+// Policies for full queues.
+const (
+	// DropNewest discards the item being pushed.
+	DropNewest Policy = iota
+	// DropOldest discards the item at the front of the queue to make room.
+	DropOldest
+	// Block blocks the producer until the consumer makes room.
+	Block
+)
+
+func (p Policy) String() string {
+	switch p {
+	case DropOldest:
+		return "dropOldest"
+	case Block:
+		return "block"
+	}
+	return "dropNewest"
+}
+
+// ParsePolicy returns the Policy named by s, as returned by Policy.String. An
+// empty string is parsed as DropNewest.
+func ParsePolicy(s string) (Policy, error) {
+	if s == "" {
+		return DropNewest, nil
+	}
+	for _, p := range []Policy{DropNewest, DropOldest, Block} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return DropNewest, errors.New("Unknown queue policy " + s)
+}
+
+// Queue is a bounded FIFO queue safe for concurrent use.
+type Queue struct {
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    []interface{}
+	head     int
+	len      int
+	policy   Policy
+	closed   bool
+	dropped  uint64
+	counter  *metrics.Counter
+}
+
+// New returns a queue holding up to size items, dropped items are also counted
+// by counter if it isn't nil.
+func New(size int, policy Policy, counter *metrics.Counter) *Queue {
+	if size < 1 {
+		size = 1
+	}
+	q := &Queue{
+		items:   make([]interface{}, size),
+		policy:  policy,
+		counter: counter,
+	}
+	q.notEmpty = sync.NewCond(&q.mutex)
+	q.notFull = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push adds an item to the back of the queue, handling a full queue according
+// to the queue's policy. Returns false if an item was dropped or the queue is
+// closed.
+func (q *Queue) Push(v interface{}) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for q.policy == Block && q.len == len(q.items) && !q.closed {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return false
+	}
+	ok := true
+	if q.len == len(q.items) {
+		q.drop()
+		if q.policy == DropNewest {
+			return false
+		}
+		// DropOldest
+		q.items[q.head] = nil
+		q.head = (q.head + 1) % len(q.items)
+		q.len--
+		ok = false
+	}
+	q.items[(q.head+q.len)%len(q.items)] = v
+	q.len++
+	q.notEmpty.Signal()
+	return ok
+}
+
+func (q *Queue) drop() {
+	q.dropped++
+	if q.counter != nil {
+		q.counter.Inc()
+	}
+}
+
+// Pop removes and returns the item at the front of the queue, blocking until
+// one is available. Returns false once the queue is closed and empty.
+func (q *Queue) Pop() (interface{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for q.len == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if q.len == 0 {
+		return nil, false
+	}
+	v := q.items[q.head]
+	q.items[q.head] = nil
+	q.head = (q.head + 1) % len(q.items)
+	q.len--
+	q.notFull.Signal()
+	return v, true
+}
+
+// Len returns the number of items in the queue.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.len
+}
+
+// Dropped returns the number of items dropped by the queue.
+func (q *Queue) Dropped() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
+// Close wakes up blocked producers and consumers, items still in the queue can
+// be popped but no more can be pushed.
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/kyoukaya/rhine/metrics"
+)
+
+func TestPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy Policy
+		want   []int
+	}{
+		{DropNewest, []int{0, 1}},
+		{DropOldest, []int{1, 2}},
+	} {
+		counter := metrics.NewRegistry().Counter("dropped", "")
+		q := New(2, tc.policy, counter)
+		for i := 0; i < 3; i++ {
+			q.Push(i)
+		}
+		q.Close()
+		var got []int
+		for v, ok := q.Pop(); ok; v, ok = q.Pop() {
+			got = append(got, v.(int))
+		}
+		if len(got) != 2 || got[0] != tc.want[0] || got[1] != tc.want[1] {
+			t.Errorf("%s: got %v, want %v", tc.policy, got, tc.want)
+		}
+		if q.Dropped() != 1 || counter.Value() != 1 {
+			t.Errorf("%s: expected 1 dropped item, got %d", tc.policy, q.Dropped())
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	q := New(1, Block, nil)
+	q.Push(0)
+	done := make(chan bool)
+	go func() { done <- q.Push(1) }()
+	if v, _ := q.Pop(); v.(int) != 0 {
+		t.Fatal("Unexpected item")
+	}
+	if !<-done {
+		t.Fatal("Blocked push should succeed once there is room")
+	}
+	if v, _ := q.Pop(); v.(int) != 1 || q.Dropped() != 0 {
+		t.Fatal("Block should not drop items")
+	}
+}
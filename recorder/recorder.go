@@ -0,0 +1,137 @@
+// Package recorder reads and writes recordings of the game packets dispatched
+// by Rhine, which the replay package feeds back through the proxy to develop
+// and debug modules offline.
+//
+// A recording is a JSON Lines file with a Packet per line, e.g.,
+//
+//	{"time":"2020-01-02T15:04:05Z","uid":"1234","region":"GL","op":"S/quest/battleStart","direction":"response","body":{...}}
+//
+// Unlike packet logs, a single recording holds the packets of every user.
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of the packets.
+const (
+	Request  = "request"
+	Response = "response"
+)
+
+// Packet is a recorded game packet.
+type Packet struct {
+	Time      time.Time `json:"time"`
+	UID       string    `json:"uid"`
+	Region    string    `json:"region"`
+	Op        string    `json:"op"`
+	Direction string    `json:"direction"`
+	// Body is the packet's body, or Raw if it isn't valid JSON.
+	Body json.RawMessage `json:"body,omitempty"`
+	Raw  []byte          `json:"raw,omitempty"`
+}
+
+// NewPacket returns the packet of op with body, the direction being derived
+// from the op's prefix.
+func NewPacket(t time.Time, uid, region, op string, body []byte) *Packet {
+	p := &Packet{Time: t, UID: uid, Region: region, Op: op, Direction: Request}
+	if strings.HasPrefix(op, "S/") {
+		p.Direction = Response
+	}
+	if json.Valid(body) {
+		p.Body = body
+	} else {
+		p.Raw = body
+	}
+	return p
+}
+
+// Data returns the body of the packet.
+func (p *Packet) Data() []byte {
+	if p.Body != nil {
+		return p.Body
+	}
+	return p.Raw
+}
+
+// Writer writes packets to a recording. It is safe for concurrent use.
+type Writer struct {
+	mutex sync.Mutex
+	w     io.Writer
+	c     io.Closer
+}
+
+// NewWriter returns a writer of packets to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Create opens the recording at path for writing, appending to it if it
+// exists.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: f, c: f}, nil
+}
+
+// WritePacket writes a packet as a line of the recording.
+func (w *Writer) WritePacket(p *Packet) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the file of a writer returned by Create.
+func (w *Writer) Close() error {
+	if w.c == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.c.Close()
+}
+
+// Reader iterates over the packets of a recording.
+type Reader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// NewReader returns a reader of the recording read from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next packet, or io.EOF once the recording is exhausted.
+// Blank lines are skipped.
+func (r *Reader) Next() (*Packet, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return nil, err
+		}
+		r.line++
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		p := &Packet{}
+		if err := json.Unmarshal(line, p); err != nil {
+			return nil, fmt.Errorf("recording line %d: %s", r.line, err)
+		}
+		return p, nil
+	}
+}
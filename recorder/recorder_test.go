@@ -0,0 +1,40 @@
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, p := range []*Packet{
+		NewPacket(now, "1234", "GL", "C/quest/battleStart", []byte(`{"stageId":"main_01-07"}`)),
+		NewPacket(now, "1234", "GL", "S/quest/battleStart", []byte(`{"battleId":`)),
+	} {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.WriteString("\nnot a packet\n")
+
+	r := NewReader(&buf)
+	p, err := r.Next()
+	if err != nil || p.Direction != Request || string(p.Data()) != `{"stageId":"main_01-07"}` || !p.Time.Equal(now) {
+		t.Fatalf("Unexpected request %+v: %v", p, err)
+	}
+	p, err = r.Next()
+	if err != nil || p.Direction != Response || p.Body != nil || string(p.Data()) != `{"battleId":` {
+		t.Fatalf("Expected the malformed body to be kept raw, got %+v: %v", p, err)
+	}
+	if _, err := r.Next(); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("Expected a syntax error on line 4, got %v", err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+}
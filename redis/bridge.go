@@ -0,0 +1,206 @@
+package redis
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+)
+
+// message is an event as published on the bridge's channel.
+type message struct {
+	Instance string          `json:"instance"`
+	Topic    string          `json:"topic"`
+	UID      int             `json:"uid"`
+	Region   string          `json:"region"`
+	Time     time.Time       `json:"time"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// Bridge shares the events of some topics between the buses of instances
+// connected to the same server. Events received from other instances are
+// published with their Origin set, and are not shared again.
+type Bridge struct {
+	client   *Client
+	bus      *events.Bus
+	channel  string
+	instance string
+	log      log.Logger
+	mutex    sync.RWMutex
+	payloads map[string]reflect.Type
+	subs     []*events.Subscription
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewBridge returns a Bridge between bus and the channel, instance identifies
+// the local instance to the others. Start must be called for events to be
+// received from other instances.
+func NewBridge(client *Client, bus *events.Bus, channel, instance string, logger log.Logger) *Bridge {
+	return &Bridge{
+		client:   client,
+		bus:      bus,
+		channel:  channel,
+		instance: instance,
+		log:      logger,
+		payloads: make(map[string]reflect.Type),
+		stop:     make(chan struct{}),
+	}
+}
+
+// RegisterPayload decodes the payloads of the topic received from other
+// instances into values of the same type as payload, e.g.,
+// &semantic.BattleFinished{}. Payloads of other topics are published as a
+// json.RawMessage.
+func (b *Bridge) RegisterPayload(topic string, payload interface{}) {
+	b.mutex.Lock()
+	b.payloads[topic] = reflect.TypeOf(payload)
+	b.mutex.Unlock()
+}
+
+// Share publishes the local events of the topic to the other instances.
+func (b *Bridge) Share(topic string) {
+	listener := make(chan events.Event, 64)
+	sub := b.bus.SubscribeFilter(topic, listener, func(evt events.Event) bool {
+		return evt.Origin == ""
+	})
+	b.mutex.Lock()
+	b.subs = append(b.subs, sub)
+	b.mutex.Unlock()
+	go func() {
+		for {
+			select {
+			case <-b.stop:
+				return
+			case evt := <-listener:
+				if err := b.publish(evt); err != nil {
+					b.log.Warnf("redis: failed to share %s event: %s", evt.Topic, err)
+				}
+			}
+		}
+	}()
+}
+
+func (b *Bridge) publish(evt events.Event) error {
+	payload, err := json.Marshal(evt.Payload)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(&message{
+		Instance: b.instance,
+		Topic:    evt.Topic,
+		UID:      evt.UID,
+		Region:   evt.Region,
+		Time:     evt.Time,
+		Payload:  payload,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Do("PUBLISH", b.channel, string(msg))
+	return err
+}
+
+// Start subscribes to the channel, resubscribing after connection errors until
+// the bridge is closed. It returns once the first subscription is made.
+func (b *Bridge) Start() error {
+	sub, err := b.client.Subscribe(b.channel)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			b.receive(sub)
+			for {
+				select {
+				case <-b.stop:
+					return
+				case <-time.After(time.Second):
+				}
+				if sub, err = b.client.Subscribe(b.channel); err == nil {
+					break
+				}
+				b.log.Warnf("redis: failed to resubscribe: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// receive publishes the events received on sub until it fails or the bridge
+// is closed.
+func (b *Bridge) receive(sub *Subscription) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-b.stop:
+		case <-done:
+		}
+		sub.Close()
+	}()
+	for {
+		data, err := sub.Receive()
+		if err != nil {
+			select {
+			case <-b.stop:
+			default:
+				b.log.Warnf("redis: subscription lost: %s", err)
+			}
+			return
+		}
+		msg := &message{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			b.log.Warnf("redis: invalid event: %s", err)
+			continue
+		}
+		if msg.Instance == b.instance {
+			continue
+		}
+		payload, err := b.decode(msg.Topic, msg.Payload)
+		if err != nil {
+			b.log.Warnf("redis: invalid %s payload: %s", msg.Topic, err)
+			continue
+		}
+		b.bus.Publish(events.Event{
+			Topic:   msg.Topic,
+			UID:     msg.UID,
+			Region:  msg.Region,
+			Time:    msg.Time,
+			Payload: payload,
+			Origin:  msg.Instance,
+		})
+	}
+}
+
+// decode decodes a payload into the type registered for the topic.
+func (b *Bridge) decode(topic string, raw json.RawMessage) (interface{}, error) {
+	b.mutex.RLock()
+	t, ok := b.payloads[topic]
+	b.mutex.RUnlock()
+	if !ok || t == nil {
+		return raw, nil
+	}
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		return v.Interface(), json.Unmarshal(raw, v.Interface())
+	}
+	v := reflect.New(t)
+	err := json.Unmarshal(raw, v.Interface())
+	return v.Elem().Interface(), err
+}
+
+// Close stops sharing and receiving events.
+func (b *Bridge) Close() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+		b.mutex.Lock()
+		for _, sub := range b.subs {
+			sub.Unhook()
+		}
+		b.mutex.Unlock()
+	})
+}
@@ -0,0 +1,211 @@
+// Package redis implements a minimal Redis client, along with a storage.Store
+// and an event bridge backed by it, letting Rhine instances share state and
+// events without embedding a database.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Client sends commands to a Redis server over a single connection, which is
+// established on first use and re-established after network errors. It is
+// safe for concurrent use.
+type Client struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	mutex    sync.Mutex
+	conn     *conn
+}
+
+// New returns a Client for the server at address, password may be empty.
+func New(address, password string, db int) *Client {
+	return &Client{address: address, password: password, db: db, timeout: 10 * time.Second}
+}
+
+// Do sends a command and returns its reply, which is a string for status
+// replies, an int64 for integers, a []byte for bulk strings, an []interface{}
+// for arrays, or nil. Error replies are returned as an Error.
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := c.conn.do(args...)
+	if _, ok := err.(Error); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// Close closes the client's connection, the next command reconnects.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Subscribe opens a dedicated connection subscribed to the channel.
+func (c *Client) Subscribe(channel string) (*Subscription, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := conn.do("SUBSCRIBE", channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &Subscription{conn: conn}, nil
+}
+
+// dial connects to the server, authenticating and selecting the database.
+func (c *Client) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Subscription receives the messages published to a channel.
+type Subscription struct {
+	conn *conn
+}
+
+// Receive blocks until a message is published, returning its payload.
+func (s *Subscription) Receive() ([]byte, error) {
+	for {
+		reply, err := s.conn.readReply()
+		if err != nil {
+			return nil, err
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 {
+			return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+		}
+		if kind, _ := msg[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		payload, _ := msg[2].([]byte)
+		return payload, nil
+	}
+}
+
+// Close closes the subscription's connection, unblocking Receive.
+func (s *Subscription) Close() error {
+	return s.conn.Close()
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do writes a command as an array of bulk strings and reads its reply.
+func (c *conn) do(args ...string) (interface{}, error) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+var errProtocol = errors.New("redis: protocol error")
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *conn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		ret := make([]interface{}, n)
+		for i := range ret {
+			if ret[i], err = c.readReply(); err != nil {
+				// Error replies nested in an array don't break the connection.
+				if _, ok := err.(Error); !ok {
+					return nil, err
+				}
+				ret[i] = err
+			}
+		}
+		return ret, nil
+	}
+	return nil, errProtocol
+}
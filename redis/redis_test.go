@@ -0,0 +1,184 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/events"
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+// fakeServer implements the subset of Redis used by the package.
+type fakeServer struct {
+	l           net.Listener
+	mutex       sync.Mutex
+	values      map[string]string
+	subscribers map[string][]net.Conn
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l, values: make(map[string]string), subscribers: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		s.mutex.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH", "SELECT":
+			fmt.Fprint(nc, "+OK\r\n")
+		case "GET":
+			if v, ok := s.values[args[1]]; ok {
+				fmt.Fprintf(nc, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(nc, "$-1\r\n")
+			}
+		case "SET":
+			s.values[args[1]] = args[2]
+			fmt.Fprint(nc, "+OK\r\n")
+		case "DEL":
+			delete(s.values, args[1])
+			fmt.Fprint(nc, ":1\r\n")
+		case "SCAN":
+			// The package only matches escaped prefixes.
+			prefix := unescaper.Replace(strings.TrimSuffix(args[3], "*"))
+			var keys []string
+			for key := range s.values {
+				if strings.HasPrefix(key, prefix) {
+					keys = append(keys, key)
+				}
+			}
+			fmt.Fprintf(nc, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+			for _, key := range keys {
+				fmt.Fprintf(nc, "$%d\r\n%s\r\n", len(key), key)
+			}
+		case "PUBLISH":
+			subs := s.subscribers[args[1]]
+			for _, sub := range subs {
+				fmt.Fprintf(sub, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+					len(args[1]), args[1], len(args[2]), args[2])
+			}
+			fmt.Fprintf(nc, ":%d\r\n", len(subs))
+		case "SUBSCRIBE":
+			s.subscribers[args[1]] = append(s.subscribers[args[1]], nc)
+			fmt.Fprintf(nc, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		default:
+			fmt.Fprintf(nc, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		s.mutex.Unlock()
+	}
+}
+
+var unescaper = strings.NewReplacer(`\\`, `\`, `\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`)
+
+func TestStore(t *testing.T) {
+	server := newFakeServer(t)
+	defer server.l.Close()
+	client := New(server.l.Addr().String(), "secret", 1)
+	defer client.Close()
+	store := NewStore(client, "rhine:")
+	if _, err := store.Get("missing"); err != storage.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	for _, key := range []string{"a/1", "a/2", "b/1", "a*/1"} {
+		if err := store.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := store.Get("a/1"); err != nil || string(v) != "a/1" {
+		t.Fatalf("Expected a/1, got %q (%v)", v, err)
+	}
+	if err := store.Delete("a/2"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := store.Keys("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a*/1", "a/1"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+	if keys, _ := store.Keys("a*"); !reflect.DeepEqual(keys, []string{"a*/1"}) {
+		t.Fatalf("Expected the prefix to be matched literally, got %v", keys)
+	}
+	if _, err := client.Do("BOGUS"); err == nil {
+		t.Fatal("Expected an error reply")
+	}
+	if _, err := store.Get("a/1"); err != nil {
+		t.Fatal("An error reply should not break the connection")
+	}
+}
+
+type testPayload struct {
+	Value int
+}
+
+func TestBridge(t *testing.T) {
+	server := newFakeServer(t)
+	defer server.l.Close()
+	logger := log.New(false, false, "/dev/null", 0)
+	newBridge := func(instance string) (*Bridge, *events.Bus) {
+		bus := events.NewBus(nil)
+		bridge := NewBridge(New(server.l.Addr().String(), "", 0), bus, "rhine:events", instance, logger)
+		bridge.RegisterPayload("test", &testPayload{})
+		if err := bridge.Start(); err != nil {
+			t.Fatal(err)
+		}
+		bridge.Share("test")
+		return bridge, bus
+	}
+	a, busA := newBridge("a")
+	defer a.Close()
+	b, busB := newBridge("b")
+	defer b.Close()
+	received := make(chan events.Event, 2)
+	busB.Subscribe("test", received)
+	echoed := make(chan events.Event, 2)
+	busA.SubscribeFilter("test", echoed, func(evt events.Event) bool { return evt.Origin != "" })
+
+	busA.Publish(events.Event{Topic: "test", UID: 1, Region: "GL", Payload: &testPayload{Value: 42}})
+	select {
+	case evt := <-received:
+		payload, ok := evt.Payload.(*testPayload)
+		if !ok || payload.Value != 42 || evt.UID != 1 || evt.Origin != "a" {
+			t.Fatalf("Unexpected event %+v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not shared")
+	}
+	select {
+	case evt := <-echoed:
+		t.Fatalf("Shared event echoed back: %+v", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/kyoukaya/rhine/storage"
+)
+
+// Store is a storage.Store keeping every key as a Redis string.
+type Store struct {
+	client *Client
+	prefix string
+}
+
+// NewStore returns a Store prepending prefix to its keys.
+func NewStore(client *Client, prefix string) *Store {
+	return &Store{client: client, prefix: prefix}
+}
+
+// Get implements storage.Store.
+func (s *Store) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, storage.ErrInvalidKey
+	}
+	reply, err := s.client.Do("GET", s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, storage.ErrNotFound
+	}
+	b, _ := reply.([]byte)
+	return b, nil
+}
+
+// Put implements storage.Store.
+func (s *Store) Put(key string, value []byte) error {
+	if key == "" {
+		return storage.ErrInvalidKey
+	}
+	_, err := s.client.Do("SET", s.prefix+key, string(value))
+	return err
+}
+
+// Delete implements storage.Store.
+func (s *Store) Delete(key string) error {
+	_, err := s.client.Do("DEL", s.prefix+key)
+	return err
+}
+
+// globEscaper escapes the characters treated specially by Redis' MATCH.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// Keys implements storage.Store, iterating over the keys with SCAN so that the
+// server isn't blocked.
+func (s *Store) Keys(prefix string) ([]string, error) {
+	var ret []string
+	match := globEscaper.Replace(s.prefix+prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := s.client.Do("SCAN", cursor, "MATCH", match, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, errProtocol
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			b, _ := key.([]byte)
+			ret = append(ret, strings.TrimPrefix(string(b), s.prefix))
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	// SCAN may return a key more than once.
+	sort.Strings(ret)
+	unique := ret[:0]
+	for i, key := range ret {
+		if i == 0 || key != ret[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique, nil
+}
@@ -0,0 +1,59 @@
+// Package replay reads recordings of the recorder package so that
+// Proxy.Replay can feed them back through the modules of their users without
+// a connection to the game, e.g., to develop and debug hooks offline against
+// a captured session.
+package replay
+
+import (
+	"os"
+
+	"github.com/kyoukaya/rhine/recorder"
+)
+
+// Source is a recording whose packets are replayed in the order they were
+// recorded.
+type Source struct {
+	f *os.File
+	r *recorder.Reader
+	// Users are the region_UIDs whose packets are replayed, e.g., "GL_1234",
+	// every user if empty.
+	Users []string
+}
+
+// NewSource opens the recording at path, see Options.RecordPath.
+func NewSource(path string) (*Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{f: f, r: recorder.NewReader(f)}, nil
+}
+
+// Next returns the next packet to replay, or io.EOF once the recording is
+// exhausted.
+func (s *Source) Next() (*recorder.Packet, error) {
+	for {
+		p, err := s.r.Next()
+		if err != nil || s.wants(p) {
+			return p, err
+		}
+	}
+}
+
+func (s *Source) wants(p *recorder.Packet) bool {
+	if len(s.Users) == 0 {
+		return true
+	}
+	rUID := p.Region + "_" + p.UID
+	for _, user := range s.Users {
+		if user == rUID {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the recording.
+func (s *Source) Close() error {
+	return s.f.Close()
+}
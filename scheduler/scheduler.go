@@ -0,0 +1,272 @@
+// Package scheduler provides a job scheduler which runs handlers at a specified
+// time, at an interval, or on a cron expression. Jobs are persisted in a
+// storage.Store so that they survive restarts, and are armed again as soon as
+// their handler is registered with Handle.
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/storage"
+)
+
+// ErrStopped is returned when scheduling a job on a stopped Scheduler.
+var ErrStopped = errors.New("Scheduler is stopped")
+
+// Job is a scheduled job. Exactly one of Interval or Cron is set for recurring
+// jobs, neither is set for one shot jobs.
+type Job struct {
+	Name     string          `json:"name"`
+	Handler  string          `json:"handler"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Next     time.Time       `json:"next"`
+	Interval time.Duration   `json:"interval,omitempty"`
+	Cron     string          `json:"cron,omitempty"`
+
+	cron  *cronExpr
+	timer *time.Timer
+}
+
+// HandlerFunc is called with the job when it is due.
+type HandlerFunc func(job *Job)
+
+// Scheduler runs jobs for a single owner, jobs are stored under a prefix in the
+// store so multiple schedulers can share one store.
+type Scheduler struct {
+	mutex    sync.Mutex
+	store    storage.Store
+	prefix   string
+	loc      *time.Location
+	handlers map[string]HandlerFunc
+	jobs     map[string]*Job
+	stopped  bool
+	log      log.Logger
+}
+
+// New returns a Scheduler persisting its jobs in the store under the prefix.
+// Cron expressions are evaluated in loc, or the local time zone if nil. Jobs
+// previously persisted under the prefix are loaded, and will be armed once
+// their handler is registered.
+func New(store storage.Store, prefix string, loc *time.Location, logger log.Logger) *Scheduler {
+	if loc == nil {
+		loc = time.Local
+	}
+	s := &Scheduler{
+		store:    store,
+		prefix:   prefix,
+		loc:      loc,
+		handlers: make(map[string]HandlerFunc),
+		jobs:     make(map[string]*Job),
+		log:      logger,
+	}
+	s.load()
+	return s
+}
+
+func (s *Scheduler) load() {
+	keys, err := s.store.Keys(s.prefix)
+	if err != nil {
+		s.log.Warnf("scheduler: failed to list jobs: %s", err)
+		return
+	}
+	for _, key := range keys {
+		b, err := s.store.Get(key)
+		if err != nil {
+			s.log.Warnf("scheduler: failed to load %s: %s", key, err)
+			continue
+		}
+		job := &Job{}
+		if err := json.Unmarshal(b, job); err != nil {
+			s.log.Warnf("scheduler: failed to load %s: %s", key, err)
+			continue
+		}
+		if job.Cron != "" {
+			if job.cron, err = parseCron(job.Cron); err != nil {
+				s.log.Warnf("scheduler: failed to load %s: %s", key, err)
+				continue
+			}
+		}
+		s.jobs[job.Name] = job
+	}
+}
+
+// Handle registers the function to be called for jobs with the handler name,
+// arming any persisted jobs for the handler. Jobs which were due while Rhine
+// was not running are run immediately, once.
+func (s *Scheduler) Handle(handler string, fn HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[handler] = fn
+	for _, job := range s.jobs {
+		if job.Handler == handler && job.timer == nil {
+			s.arm(job)
+		}
+	}
+}
+
+// At schedules a one shot job to run at t.
+func (s *Scheduler) At(name, handler string, t time.Time, payload []byte) error {
+	return s.add(&Job{Name: name, Handler: handler, Payload: payload, Next: t})
+}
+
+// Every schedules a job to run every interval, starting one interval from now.
+func (s *Scheduler) Every(name, handler string, interval time.Duration, payload []byte) error {
+	if interval <= 0 {
+		return errors.New("Interval must be positive")
+	}
+	return s.add(&Job{Name: name, Handler: handler, Payload: payload,
+		Interval: interval, Next: time.Now().Add(interval)})
+}
+
+// Cron schedules a job to run whenever the cron expression matches, see
+// parseCron for the supported syntax.
+func (s *Scheduler) Cron(name, handler, expr string, payload []byte) error {
+	c, err := parseCron(expr)
+	if err != nil {
+		return err
+	}
+	next := c.next(time.Now().In(s.loc))
+	if next.IsZero() {
+		return ErrInvalidCron
+	}
+	return s.add(&Job{Name: name, Handler: handler, Payload: payload,
+		Cron: expr, cron: c, Next: next})
+}
+
+// Cancel removes the job with the name, if any.
+func (s *Scheduler) Cancel(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if job, ok := s.jobs[name]; ok {
+		if job.timer != nil {
+			job.timer.Stop()
+		}
+		delete(s.jobs, name)
+		s.remove(job)
+	}
+}
+
+// Jobs returns copies of the scheduled jobs.
+func (s *Scheduler) Jobs() []Job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		j := *job
+		j.timer = nil
+		ret = append(ret, j)
+	}
+	return ret
+}
+
+// Stop disarms all jobs without removing them from the store.
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	for _, job := range s.jobs {
+		if job.timer != nil {
+			job.timer.Stop()
+			job.timer = nil
+		}
+	}
+}
+
+// Unhook stops the scheduler, allowing it to be used as a proxy.Hooker.
+func (s *Scheduler) Unhook() {
+	s.Stop()
+}
+
+// add replaces any job with the same name, persists and arms the job.
+func (s *Scheduler) add(job *Job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	if old, ok := s.jobs[job.Name]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	s.jobs[job.Name] = job
+	if err := s.persist(job); err != nil {
+		return err
+	}
+	if _, ok := s.handlers[job.Handler]; ok {
+		s.arm(job)
+	}
+	return nil
+}
+
+// arm starts the job's timer, must be called with the mutex held.
+func (s *Scheduler) arm(job *Job) {
+	if s.stopped {
+		return
+	}
+	job.timer = time.AfterFunc(time.Until(job.Next), func() { s.run(job) })
+}
+
+func (s *Scheduler) run(job *Job) {
+	s.mutex.Lock()
+	if s.stopped || s.jobs[job.Name] != job {
+		s.mutex.Unlock()
+		return
+	}
+	fn := s.handlers[job.Handler]
+	s.mutex.Unlock()
+	s.call(fn, job)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.jobs[job.Name] != job {
+		// Rescheduled or cancelled by the handler.
+		return
+	}
+	now := time.Now()
+	switch {
+	case job.Interval > 0:
+		for !job.Next.After(now) {
+			job.Next = job.Next.Add(job.Interval)
+		}
+	case job.cron != nil:
+		job.Next = job.cron.next(now.In(s.loc))
+	default:
+		job.Next = time.Time{}
+	}
+	if job.Next.IsZero() {
+		delete(s.jobs, job.Name)
+		s.remove(job)
+		return
+	}
+	if err := s.persist(job); err != nil {
+		s.log.Warnf("scheduler: failed to persist %s: %s", job.Name, err)
+	}
+	s.arm(job)
+}
+
+// call runs the handler, recovering from panics.
+func (s *Scheduler) call(fn HandlerFunc, job *Job) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.log.Warnf("Recovered from panic while running job %s:\n%+v", job.Name, err)
+		}
+	}()
+	fn(job)
+}
+
+func (s *Scheduler) persist(job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(s.prefix+job.Name, b)
+}
+
+func (s *Scheduler) remove(job *Job) {
+	if err := s.store.Delete(s.prefix + job.Name); err != nil {
+		s.log.Warnf("scheduler: failed to remove %s: %s", job.Name, err)
+	}
+}
@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kyoukaya/rhine/storage"
+)
+
+type logShim struct{ t *testing.T }
+
+func (l logShim) Flush()                              {}
+func (l logShim) Println(i ...interface{})            { l.t.Log(i...) }
+func (l logShim) Printf(s string, i ...interface{})   { l.t.Logf(s, i...) }
+func (l logShim) Verboseln(i ...interface{})          { l.t.Log(i...) }
+func (l logShim) Verbosef(s string, i ...interface{}) { l.t.Logf(s, i...) }
+func (l logShim) Warnln(i ...interface{})             { l.t.Error(i...) }
+func (l logShim) Warnf(s string, i ...interface{})    { l.t.Errorf(s, i...) }
+
+func TestCronNext(t *testing.T) {
+	cases := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"0 4 * * *", time.Date(2020, 3, 1, 4, 0, 0, 0, time.UTC), time.Date(2020, 3, 2, 4, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 3, 1, 4, 1, 30, 0, time.UTC), time.Date(2020, 3, 1, 4, 15, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2020, 3, 2, 9, 30, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2020, 3, 8, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		expr, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expr.next(c.from); !got.Equal(c.want) {
+			t.Errorf("%s from %s: expected %s, got %s", c.expr, c.from, c.want, got)
+		}
+	}
+	for _, invalid := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(invalid); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+// TestPersistence schedules a job, stops the scheduler and checks that a new
+// scheduler on the same store runs the job once its handler is registered.
+func TestPersistence(t *testing.T) {
+	store := storage.NewMemoryStore()
+	s := New(store, "test/", nil, logShim{t})
+	if err := s.At("job", "handler", time.Now().Add(time.Hour), []byte(`"payload"`)); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+	s = New(store, "test/", nil, logShim{t})
+	done := make(chan string, 1)
+	s.Handle("handler", func(job *Job) { done <- string(job.Payload) })
+	if jobs := s.Jobs(); len(jobs) != 1 || jobs[0].Name != "job" {
+		t.Fatalf("Expected persisted job, got %#v", jobs)
+	}
+	// Reschedule it to run now.
+	if err := s.At("job", "handler", time.Now(), []byte(`"now"`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-done:
+		if payload != `"now"` {
+			t.Fatalf("Unexpected payload %s", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Job did not run")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if keys, _ := store.Keys("test/"); len(keys) != 0 {
+		t.Fatalf("One shot job should be removed after running, got %v", keys)
+	}
+}
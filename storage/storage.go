@@ -0,0 +1,207 @@
+// Package storage provides a simple key value store interface used by Rhine and
+// its modules to persist data across restarts, along with file and in memory
+// implementations. Keys are slash separated paths, e.g., "schedules/GL_1234/job".
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNotFound is returned by Get when the key does not exist.
+	ErrNotFound = errors.New("Key not found")
+	// ErrInvalidKey is returned when a key is empty or breaks out of the store.
+	ErrInvalidKey = errors.New("Invalid key")
+)
+
+// Store is a key value store. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the value of the key, or ErrNotFound.
+	Get(key string) ([]byte, error)
+	// Put sets the value of the key.
+	Put(key string, value []byte) error
+	// Delete removes the key, deleting a key which doesn't exist is not an error.
+	Delete(key string) error
+	// Keys returns the keys beginning with prefix in lexical order.
+	Keys(prefix string) ([]string, error)
+}
+
+// FileStore is a Store which saves every key as a file in a directory.
+type FileStore struct {
+	mutex sync.RWMutex
+	dir   string
+}
+
+// NewFileStore returns a FileStore saving keys in dir, creating it if it doesn't
+// exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Get implements Store.
+func (s *FileStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+// Put implements Store. Values are written into a temporary file first which
+// is then renamed, so a crash never leaves a partially written value.
+func (s *FileStore) Put(key string, value []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, value, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Delete implements Store.
+func (s *FileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Keys implements Store.
+func (s *FileStore) Keys(prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var ret []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			ret = append(ret, key)
+		}
+		return nil
+	})
+	sort.Strings(ret)
+	return ret, err
+}
+
+// MemoryStore is a Store which keeps all values in memory, useful for tests
+// or when persistence isn't desired.
+type MemoryStore struct {
+	mutex  sync.RWMutex
+	values map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[string][]byte)}
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	v, ok := s.values[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// Put implements Store.
+func (s *MemoryStore) Put(key string, value []byte) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+// Keys implements Store.
+func (s *MemoryStore) Keys(prefix string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var ret []string
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			ret = append(ret, key)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// prefixed is a Store which namespaces all keys of an underlying Store.
+type prefixed struct {
+	store  Store
+	prefix string
+}
+
+// Prefixed returns a Store which transparently prepends prefix to all keys
+// before passing them on to store.
+func Prefixed(store Store, prefix string) Store {
+	return &prefixed{store, prefix}
+}
+
+func (p *prefixed) Get(key string) ([]byte, error)     { return p.store.Get(p.prefix + key) }
+func (p *prefixed) Put(key string, value []byte) error { return p.store.Put(p.prefix+key, value) }
+func (p *prefixed) Delete(key string) error            { return p.store.Delete(p.prefix + key) }
+
+func (p *prefixed) Keys(prefix string) ([]string, error) {
+	keys, err := p.store.Keys(p.prefix + prefix)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, p.prefix)
+	}
+	return keys, err
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Formats the CA can be exported in, see ExportCA.
+const (
+	// FormatPEM is the PEM encoded certificate, as cert.pem.
+	FormatPEM = "pem"
+	// FormatDER is the DER encoded certificate, which Android's settings and
+	// Windows import as a .cer or .crt.
+	FormatDER = "der"
+	// FormatAndroid is the PEM encoded certificate as stored in Android's
+	// system store (/system/etc/security/cacerts), see AndroidCertName.
+	FormatAndroid = "android"
+	// FormatPKCS12 is a PKCS#12 archive of the certificate and its private key
+	// protected by a password.
+	FormatPKCS12 = "p12"
+)
+
+// ExportFormats lists the formats supported by ExportCA.
+var ExportFormats = []string{FormatPEM, FormatDER, FormatAndroid, FormatPKCS12}
+
+// AndroidCertName returns the name of the certificate's file in Android's
+// system store, the old OpenSSL subject hash (openssl x509 -subject_hash_old)
+// followed by ".0".
+func AndroidCertName(cert *x509.Certificate) string {
+	sum := md5.Sum(cert.RawSubject)
+	return fmt.Sprintf("%08x.0", binary.LittleEndian.Uint32(sum[:4]))
+}
+
+// ExportCA encodes the CA in the format along with the file name it's usually
+// saved as. password protects the PKCS#12 archive and is otherwise ignored.
+func ExportCA(ca *tls.Certificate, format, password string) (name string, data []byte, err error) {
+	if len(ca.Certificate) == 0 {
+		return "", nil, errors.New("CA not loaded")
+	}
+	leaf := ca.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return "", nil, err
+		}
+	}
+	switch format {
+	case FormatPEM:
+		return "cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), nil
+	case FormatDER:
+		return "cert.cer", leaf.Raw, nil
+	case FormatAndroid:
+		return AndroidCertName(leaf), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), nil
+	case FormatPKCS12:
+		data, err := EncodePKCS12(ca, leaf.Subject.CommonName, password)
+		return "cert.p12", data, err
+	}
+	return "", nil, fmt.Errorf("unknown format %q", format)
+}
@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -8,18 +11,13 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
-	"os"
+	"strings"
 	"time"
 )
 
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
-
 // helper function to create a cert template with a serial number and other required fields
 func certTemplate() (*x509.Certificate, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
@@ -39,7 +37,6 @@ func certTemplate() (*x509.Certificate, error) {
 		NotAfter:              time.Now().AddDate(5, 0, 0), // CA expires in 5 years
 		NotBefore:             time.Now(),
 		SerialNumber:          serialNumber,
-		SignatureAlgorithm:    x509.SHA256WithRSA,
 		Subject:               issuerName,
 	}
 	return &template, nil
@@ -63,9 +60,86 @@ func createCert(template, parent *x509.Certificate, pub interface{}, parentPriv
 	return
 }
 
-// GenerateCA generates a new key-pair and saves it to the path specified.
+// CAOptions configures the CA generated by GenerateCAWithOptions, zero values
+// keep the defaults.
+type CAOptions struct {
+	// KeyType is either "rsa" or "ecdsa", defaults to "rsa". ECDSA keys make
+	// for faster handshakes, especially on phones.
+	KeyType string `json:"keyType"`
+	// KeySize is the size of RSA keys in bits, defaulting to 2048, or the
+	// curve of ECDSA keys, one of 256, 384 or 521, defaulting to 256.
+	KeySize int `json:"keySize"`
+	// ValidityDays is how long the CA is valid for, defaults to 5 years.
+	ValidityDays int `json:"validityDays"`
+	// Subject fields, defaulting to those of Rhine's CA.
+	CommonName         string `json:"commonName"`
+	Organization       string `json:"organization"`
+	OrganizationalUnit string `json:"organizationalUnit"`
+	Country            string `json:"country"`
+	// KeyStorage is where the private key is kept: "file" stores it in key.pem
+	// in plaintext, "encrypted" in key.pem encrypted with the passphrase read
+	// from PassphraseEnv at startup, and "keychain" in the OS keychain. Defaults
+	// to "file". An existing key is moved to the configured storage when loaded.
+	KeyStorage string `json:"keyStorage"`
+	// PassphraseEnv is the environment variable holding the passphrase of the
+	// encrypted key, defaults to RHINE_CA_PASSPHRASE.
+	PassphraseEnv string `json:"passphraseEnv"`
+}
+
+// generateKey returns a private key as configured by the options along with
+// its PEM encoding.
+func (options *CAOptions) generateKey() (crypto.Signer, []byte, error) {
+	switch strings.ToLower(options.KeyType) {
+	case "", "rsa":
+		size := options.KeySize
+		if size == 0 {
+			size = 2048
+		}
+		if size < 2048 {
+			return nil, nil, fmt.Errorf("RSA keys must be at least 2048 bits, got %d", size)
+		}
+		key, err := rsa.GenerateKey(rand.Reader, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}), nil
+	case "ecdsa", "ec":
+		var curve elliptic.Curve
+		switch options.KeySize {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("unsupported ECDSA key size %d", options.KeySize)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key type %q", options.KeyType)
+}
+
+// GenerateCA generates a new key-pair with the default options and saves it to
+// the path specified.
 func GenerateCA(certPath, keyPath string) error {
-	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	return GenerateCAWithOptions(certPath, keyPath, &CAOptions{})
+}
+
+// GenerateCAWithOptions generates a new key-pair as configured by the options
+// and saves it to the path specified.
+func GenerateCAWithOptions(certPath, keyPath string, options *CAOptions) error {
+	rootKey, rootKeyPEM, err := options.generateKey()
 	if err != nil {
 		return fmt.Errorf("generating random key: %v", err)
 	}
@@ -74,32 +148,36 @@ func GenerateCA(certPath, keyPath string) error {
 	if err != nil {
 		return fmt.Errorf("creating cert template: %v", err)
 	}
+	if options.ValidityDays > 0 {
+		rootCertTmpl.NotAfter = rootCertTmpl.NotBefore.AddDate(0, 0, options.ValidityDays)
+	}
+	if options.CommonName != "" {
+		rootCertTmpl.Subject.CommonName = options.CommonName
+	}
+	if options.Organization != "" {
+		rootCertTmpl.Subject.Organization = []string{options.Organization}
+	}
+	if options.OrganizationalUnit != "" {
+		rootCertTmpl.Subject.OrganizationalUnit = []string{options.OrganizationalUnit}
+	}
+	if options.Country != "" {
+		rootCertTmpl.Subject.Country = []string{options.Country}
+	}
+	rootCertTmpl.Issuer = rootCertTmpl.Subject
 	// describe what the certificate will be used for
 	rootCertTmpl.IsCA = true
 	rootCertTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
 	rootCertTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
-	rootCertTmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
-	_, rootCertPEM, err := createCert(rootCertTmpl, rootCertTmpl, &rootKey.PublicKey, rootKey)
+	rootCertTmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	_, rootCertPEM, err := createCert(rootCertTmpl, rootCertTmpl, rootKey.Public(), rootKey)
 	if err != nil {
 		return fmt.Errorf("error creating cert: %v", err)
 	}
-	rootKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rootKey),
-	})
-	f, err := os.Create(BinDir + certPath)
-	if err != nil {
+	if err := ioutil.WriteFile(BinDir+certPath, rootCertPEM, 0644); err != nil {
 		return fmt.Errorf("error writing cert to file: %v", err)
 	}
-
-	_, err = f.Write(rootCertPEM)
-	check(err)
-
-	f, err = os.Create(BinDir + keyPath)
-	if err != nil {
+	if err := options.writeKey(keyPath, rootKeyPEM); err != nil {
 		return fmt.Errorf("error writing key to file: %v", err)
 	}
-
-	_, err = f.Write(rootKeyPEM)
-	check(err)
 	return nil
 }
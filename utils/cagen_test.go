@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGenerateCAWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(binDir string) { BinDir = binDir }(BinDir)
+	BinDir = dir + "/"
+	tests := []struct {
+		options CAOptions
+		check   func(key interface{}) bool
+	}{
+		{CAOptions{}, func(key interface{}) bool {
+			k, ok := key.(*rsa.PrivateKey)
+			return ok && k.N.BitLen() == 2048
+		}},
+		{CAOptions{KeyType: "ecdsa"}, func(key interface{}) bool {
+			k, ok := key.(*ecdsa.PrivateKey)
+			return ok && k.Curve.Params().BitSize == 256
+		}},
+		{CAOptions{KeyType: "ECDSA", KeySize: 384}, func(key interface{}) bool {
+			k, ok := key.(*ecdsa.PrivateKey)
+			return ok && k.Curve.Params().BitSize == 384
+		}},
+	}
+	for _, test := range tests {
+		certPath, keyPath := "cert.pem", "key.pem"
+		if err := GenerateCAWithOptions(certPath, keyPath, &test.options); err != nil {
+			t.Fatalf("%+v: %s", test.options, err)
+		}
+		ca, err := tls.LoadX509KeyPair(dir+"/cert.pem", dir+"/key.pem")
+		if err != nil {
+			t.Fatalf("%+v: %s", test.options, err)
+		}
+		if !test.check(ca.PrivateKey) {
+			t.Fatalf("%+v: unexpected key %T", test.options, ca.PrivateKey)
+		}
+		if _, _, _, err := SignCert(&ca, "client", nil, x509.ExtKeyUsageClientAuth); err != nil {
+			t.Fatalf("%+v: %s", test.options, err)
+		}
+	}
+
+	options := &CAOptions{ValidityDays: 30, CommonName: "Test CA", Organization: "Test", Country: "JP"}
+	if err := GenerateCAWithOptions("cert.pem", "key.pem", options); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.LoadX509KeyPair(dir+"/cert.pem", dir+"/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "Test CA" || leaf.Subject.Organization[0] != "Test" || leaf.Subject.Country[0] != "JP" {
+		t.Fatalf("Unexpected subject %s", leaf.Subject)
+	}
+	if leaf.NotAfter.After(time.Now().AddDate(0, 0, 31)) {
+		t.Fatalf("Unexpected expiry %s", leaf.NotAfter)
+	}
+
+	for _, options := range []CAOptions{{KeyType: "dsa"}, {KeySize: 1024}, {KeyType: "ecdsa", KeySize: 512}} {
+		if err := GenerateCAWithOptions("cert.pem", "key.pem", &options); err == nil {
+			t.Fatalf("%+v: expected an error", options)
+		}
+	}
+}
+
+func TestEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(binDir string) { BinDir = binDir }(BinDir)
+	BinDir = dir + "/"
+	defer os.Unsetenv("RHINE_TEST_PASSPHRASE")
+	os.Unsetenv("RHINE_TEST_PASSPHRASE")
+
+	// A plaintext key is encrypted once the storage is changed.
+	if err := GenerateCA("cert.pem", "key.pem"); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadFile(dir + "/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := &CAOptions{KeyStorage: KeyStorageEncrypted, PassphraseEnv: "RHINE_TEST_PASSPHRASE"}
+	if err := LoadCAWithOptions("cert.pem", "key.pem", options); err == nil {
+		t.Fatal("Expected an error without a passphrase")
+	}
+	os.Setenv("RHINE_TEST_PASSPHRASE", "hunter2")
+	if err := LoadCAWithOptions("cert.pem", "key.pem", options); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dir + "/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedKey(data) {
+		t.Fatal("Key was not encrypted")
+	}
+	if key, err := DecryptKey(data, "hunter2"); err != nil || string(key) != string(plain) {
+		t.Fatalf("Unexpected decrypted key (%v)", err)
+	}
+	if _, err := DecryptKey(data, "hunter3"); err == nil {
+		t.Fatal("Expected an error with the wrong passphrase")
+	}
+	if err := LoadCAWithOptions("cert.pem", "key.pem", options); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCA("cert.pem", "key.pem"); err == nil {
+		t.Fatal("Expected an error loading an encrypted key without a passphrase")
+	}
+}
+
+func TestExportCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhine-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(binDir string) { BinDir = binDir }(BinDir)
+	BinDir = dir + "/"
+	if err := GenerateCA("cert.pem", "key.pem"); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.LoadX509KeyPair(dir+"/cert.pem", dir+"/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ioutil.ReadFile(dir + "/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := ExportCA(&ca, FormatPEM, ""); err != nil || string(data) != string(certPEM) {
+		t.Fatalf("Unexpected PEM export (%v)", err)
+	}
+	_, der, err := ExportCA(&ca, FormatDER, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// openssl x509 -subject_hash_old of the default subject.
+	if name := AndroidCertName(leaf); name != "9f86713b.0" {
+		t.Fatalf("Expected 9f86713b.0, got %s", name)
+	}
+	name, data, err := ExportCA(&ca, FormatAndroid, "")
+	if err != nil || name != "9f86713b.0" || string(data) != string(certPEM) {
+		t.Fatalf("Unexpected Android export %s (%v)", name, err)
+	}
+	if _, _, err := ExportCA(&ca, FormatPKCS12, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ExportCA(&ca, "jks", ""); err == nil {
+		t.Fatal("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Storage backends of the CA's private key, see CAOptions.KeyStorage.
+const (
+	KeyStorageFile      = "file"
+	KeyStorageEncrypted = "encrypted"
+	KeyStorageKeychain  = "keychain"
+)
+
+// DefaultPassphraseEnv is the environment variable the passphrase of an
+// encrypted CA key is read from by default.
+const DefaultPassphraseEnv = "RHINE_CA_PASSPHRASE"
+
+const (
+	encryptedKeyType = "RHINE ENCRYPTED PRIVATE KEY"
+	keyIterations    = 600000
+	keychainService  = "rhine"
+)
+
+// ErrNoPassphrase is returned when an encrypted CA key is used without its
+// passphrase being set.
+var ErrNoPassphrase = errors.New("CA key passphrase not set")
+
+// pbkdf2 derives a key from the password as specified by RFC 8018 with
+// HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func keyCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptKey encrypts a PEM encoded private key with the passphrase, returning
+// it as a PEM block readable by DecryptKey.
+func EncryptKey(keyPEM []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyCipher(passphrase, salt, keyIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"Cipher":     "AES-256-GCM",
+			"KDF":        "PBKDF2-SHA256",
+			"Iterations": strconv.Itoa(keyIterations),
+			"Salt":       hex.EncodeToString(salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, keyPEM, nil),
+	}), nil
+}
+
+// IsEncryptedKey reports whether data was returned by EncryptKey.
+func IsEncryptedKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedKeyType
+}
+
+// DecryptKey decrypts a key encrypted by EncryptKey.
+func DecryptKey(data []byte, passphrase string) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return nil, errors.New("not an encrypted key")
+	}
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid iterations: %v", err)
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %v", err)
+	}
+	aead, err := keyCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	keyPEM, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted key")
+	}
+	return keyPEM, nil
+}
+
+func (options *CAOptions) storage() string {
+	if options.KeyStorage == "" {
+		return KeyStorageFile
+	}
+	return strings.ToLower(options.KeyStorage)
+}
+
+func (options *CAOptions) passphrase() (string, error) {
+	env := options.PassphraseEnv
+	if env == "" {
+		env = DefaultPassphraseEnv
+	}
+	passphrase := os.Getenv(env)
+	if passphrase == "" {
+		return "", fmt.Errorf("%v, set $%s", ErrNoPassphrase, env)
+	}
+	return passphrase, nil
+}
+
+// CAExists reports whether both the cert and the key of the CA are stored.
+func CAExists(certPath, keyPath string, options *CAOptions) bool {
+	if _, err := os.Stat(BinDir + certPath); err != nil {
+		return false
+	}
+	return options.keyExists(keyPath)
+}
+
+// keyExists reports whether the CA key is stored.
+func (options *CAOptions) keyExists(keyPath string) bool {
+	if options.storage() == KeyStorageKeychain {
+		if _, err := KeychainGet(keychainService, BinDir+keyPath); err == nil {
+			return true
+		}
+	}
+	_, err := os.Stat(BinDir + keyPath)
+	return err == nil
+}
+
+// writeKey stores the PEM encoded CA key.
+func (options *CAOptions) writeKey(keyPath string, keyPEM []byte) error {
+	switch options.storage() {
+	case KeyStorageFile:
+		return ioutil.WriteFile(BinDir+keyPath, keyPEM, 0600)
+	case KeyStorageEncrypted:
+		passphrase, err := options.passphrase()
+		if err != nil {
+			return err
+		}
+		data, err := EncryptKey(keyPEM, passphrase)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(BinDir+keyPath, data, 0600)
+	case KeyStorageKeychain:
+		if err := KeychainSet(keychainService, BinDir+keyPath, keyPEM); err != nil {
+			return err
+		}
+		if err := os.Remove(BinDir + keyPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key storage %q", options.KeyStorage)
+}
+
+// readKey returns the PEM encoded CA key. A plaintext key.pem left over from
+// file storage is moved to the configured storage.
+func (options *CAOptions) readKey(keyPath string) ([]byte, error) {
+	storage := options.storage()
+	if storage == KeyStorageKeychain {
+		if keyPEM, err := KeychainGet(keychainService, BinDir+keyPath); err == nil {
+			return keyPEM, nil
+		} else if _, statErr := os.Stat(BinDir + keyPath); statErr != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadFile(BinDir + keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if IsEncryptedKey(data) {
+		passphrase, err := options.passphrase()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = DecryptKey(data, passphrase); err != nil {
+			return nil, err
+		}
+		if storage == KeyStorageEncrypted {
+			return data, nil
+		}
+	} else if storage == KeyStorageFile {
+		return data, nil
+	}
+	return data, options.writeKey(keyPath, data)
+}
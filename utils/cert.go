@@ -4,44 +4,50 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
-	"os"
 
 	"github.com/elazarl/goproxy"
 )
 
-// LoadCA loads the cert and RSA key pair from the specified paths and configures
+// LoadCA loads the cert and key pair from the specified paths and configures
 // goproxy to use it.
 func LoadCA(certPath, keyPath string) error {
-	var err error
-	certFile, err := os.Open(BinDir + certPath)
-	if err != nil {
-		return err
-	}
-	defer certFile.Close()
-	keyFile, err := os.Open(BinDir + keyPath)
+	return LoadCAWithOptions(certPath, keyPath, &CAOptions{})
+}
+
+// LoadCAWithOptions is LoadCA with the key read from the storage configured
+// by options.
+func LoadCAWithOptions(certPath, keyPath string, options *CAOptions) error {
+	ca, err := ReadCA(certPath, keyPath, options)
 	if err != nil {
 		return err
 	}
-	defer keyFile.Close()
-	caCert, err := ioutil.ReadAll(certFile)
+	goproxyCa := *ca
+	goproxy.GoproxyCa = goproxyCa
+	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	return nil
+}
+
+// ReadCA reads the cert and key pair from the specified paths, with the key
+// read from the storage configured by options, without configuring goproxy to
+// use it.
+func ReadCA(certPath, keyPath string, options *CAOptions) (*tls.Certificate, error) {
+	caCert, err := ioutil.ReadFile(BinDir + certPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	caKey, err := ioutil.ReadAll(keyFile)
+	caKey, err := options.readKey(keyPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	goproxyCa, err := tls.X509KeyPair(caCert, caKey)
+	ca, err := tls.X509KeyPair(caCert, caKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if goproxyCa.Leaf, err = x509.ParseCertificate(goproxyCa.Certificate[0]); err != nil {
-		return err
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, err
 	}
-	goproxy.GoproxyCa = goproxyCa
-	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	return nil
+	return &ca, nil
 }
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// SignCert creates a key pair and a certificate for it signed by the CA. hosts
+// may contain hostnames and IP addresses, usage is what the certificate may be
+// used for, e.g., x509.ExtKeyUsageClientAuth. Returns the PEM encoded cert and
+// key along with the parsed pair.
+func SignCert(ca *tls.Certificate, commonName string, hosts []string, usage x509.ExtKeyUsage) (
+	cert *tls.Certificate, certPEM, keyPEM []byte, err error) {
+	if ca.Leaf == nil {
+		if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tmpl, err := certTemplate()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tmpl.Subject = pkix.Name{CommonName: commonName, Organization: []string{"Rhine Labs"}}
+	tmpl.Issuer = ca.Leaf.Subject
+	tmpl.NotAfter = time.Now().AddDate(1, 0, 0)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	_, certPEM, err = createCert(tmpl, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &pair, certPEM, keyPEM, nil
+}
+
+// GenerateClientCert mints a client certificate for commonName signed by the CA
+// loaded by LoadCA, saving the pair to the paths specified.
+func GenerateClientCert(commonName, certPath, keyPath string) error {
+	if len(goproxy.GoproxyCa.Certificate) == 0 {
+		return errors.New("CA not loaded")
+	}
+	_, certPEM, keyPEM, err := SignCert(&goproxy.GoproxyCa, commonName, nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath, keyPEM, 0600)
+}
@@ -0,0 +1,29 @@
+package activitytable
+
+import "encoding/json"
+
+func Unmarshal(data []byte) (ActivityTable, error) {
+	var r ActivityTable
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *ActivityTable) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// ActivityTable contains the events of the game, only the fields Rhine uses
+// are decoded.
+type ActivityTable struct {
+	BasicInfo map[string]BasicInfo `json:"basicInfo"`
+}
+
+// BasicInfo describes an event, times are unix timestamps.
+type BasicInfo struct {
+	ID            string `json:"id"`
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	StartTime     int64  `json:"startTime"`
+	EndTime       int64  `json:"endTime"`
+	RewardEndTime int64  `json:"rewardEndTime"`
+}
@@ -0,0 +1,92 @@
+package buildingtable
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+func Unmarshal(data []byte) (BuildingData, error) {
+	var r BuildingData
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *BuildingData) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// BuildingData contains the base skills of operators, only the fields Rhine
+// uses are decoded.
+type BuildingData struct {
+	Chars map[string]Char `json:"chars"`
+	Buffs map[string]Buff `json:"buffs"`
+}
+
+// Char lists the base skills of an operator. Each entry of BuffChar is a skill
+// slot whose later BuffData replace the earlier ones once unlocked.
+type Char struct {
+	CharID   string `json:"charId"`
+	BuffChar []struct {
+		BuffData []BuffData `json:"buffData"`
+	} `json:"buffChar"`
+}
+
+type BuffData struct {
+	BuffID string `json:"buffId"`
+	Cond   Cond   `json:"cond"`
+}
+
+// Cond is the elite phase and level at which a base skill is unlocked.
+type Cond struct {
+	Phase Phase `json:"phase"`
+	Level int64 `json:"level"`
+}
+
+// Unlocked reports whether an operator of the elite phase and level has
+// unlocked the skill.
+func (c Cond) Unlocked(phase, level int64) bool {
+	return phase > int64(c.Phase) || (phase == int64(c.Phase) && level >= c.Level)
+}
+
+// Phase is an elite phase. Newer game data encodes it as a string, e.g.,
+// "PHASE_2", which is decoded the same way.
+type Phase int64
+
+func (p *Phase) UnmarshalJSON(b []byte) error {
+	var phase string
+	if err := json.Unmarshal(b, &phase); err != nil {
+		return json.Unmarshal(b, (*int64)(p))
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(phase, "PHASE_"), 10, 64)
+	if err != nil {
+		return err
+	}
+	*p = Phase(n)
+	return nil
+}
+
+type Buff struct {
+	BuffID      string `json:"buffId"`
+	BuffName    string `json:"buffName"`
+	RoomType    string `json:"roomType"`
+	Description string `json:"description"`
+}
+
+// ActiveBuffs returns the IDs of the base skills an operator of the elite
+// phase and level has unlocked, in the order of their slots.
+func (r *BuildingData) ActiveBuffs(charID string, phase, level int64) []string {
+	var ret []string
+	for _, slot := range r.Chars[charID].BuffChar {
+		var active string
+		for _, buff := range slot.BuffData {
+			if buff.Cond.Unlocked(phase, level) {
+				active = buff.BuffID
+			}
+		}
+		if active != "" {
+			ret = append(ret, active)
+		}
+	}
+	return ret
+}
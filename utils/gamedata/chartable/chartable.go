@@ -0,0 +1,51 @@
+package chartable
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+func Unmarshal(data []byte) (CharTable, error) {
+	var r CharTable
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *CharTable) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// CharTable maps charIds to their characters, only the fields Rhine uses are
+// decoded.
+type CharTable map[string]Char
+
+type Char struct {
+	Name            string `json:"name"`
+	Appellation     string `json:"appellation"`
+	Profession      string `json:"profession"`
+	Rarity          Rarity `json:"rarity"`
+	IsNotObtainable bool   `json:"isNotObtainable"`
+}
+
+// Rarity is a character's rarity, 0 for 1★ up to 5 for 6★. Newer game data
+// encodes it as a string, e.g., "TIER_6", which is decoded the same way.
+type Rarity int64
+
+func (r *Rarity) UnmarshalJSON(b []byte) error {
+	var tier string
+	if err := json.Unmarshal(b, &tier); err != nil {
+		return json.Unmarshal(b, (*int64)(r))
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(tier, "TIER_"), 10, 64)
+	if err != nil {
+		return err
+	}
+	*r = Rarity(n - 1)
+	return nil
+}
+
+// Stars returns the number of stars of the rarity.
+func (r Rarity) Stars() int {
+	return int(r) + 1
+}
@@ -0,0 +1,136 @@
+package gamedata
+
+import (
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kyoukaya/rhine/events"
+
+	"github.com/tidwall/gjson"
+)
+
+// UpdateTopic is the events topic on which an UpdateSummary is published for
+// every region with new content after the gamedata is refreshed, see
+// SetEventBus.
+const UpdateTopic = "gamedata/updated"
+
+var (
+	busMutex sync.Mutex
+	bus      = events.Default
+)
+
+// SetEventBus sets the bus on which UpdateSummary events are published,
+// defaults to events.Default.
+func SetEventBus(b *events.Bus) {
+	busMutex.Lock()
+	bus = b
+	busMutex.Unlock()
+}
+
+// UpdateSummary lists the IDs of the content added to a region's gamedata by
+// an update.
+type UpdateSummary struct {
+	Region       string
+	NewOperators []string
+	NewItems     []string
+	NewStages    []string
+}
+
+// Empty checks if the update did not add any content.
+func (s *UpdateSummary) Empty() bool {
+	return len(s.NewOperators) == 0 && len(s.NewItems) == 0 && len(s.NewStages) == 0
+}
+
+// diffedTables maps the tables which are diffed on update to the path of the
+// object whose keys are the IDs of the table's entries.
+var diffedTables = map[string]string{
+	"character_table": "@this",
+	"item_table":      "items",
+	"stage_table":     "stages",
+}
+
+// tableDiff contains the keys added to a table by an update.
+type tableDiff struct {
+	region string
+	table  string
+	added  []string
+}
+
+// diffTable returns the keys added to the table at reqPath if the table is
+// tracked and an older version of it exists at fileName. Must be called before
+// the file is overwritten.
+func diffTable(reqPath, fileName string, newData []byte) *tableDiff {
+	table := strings.TrimSuffix(path.Base(reqPath), ".json")
+	keyPath, tracked := diffedTables[table]
+	if !tracked {
+		return nil
+	}
+	oldData, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		// Nothing to compare against on the first download.
+		return nil
+	}
+	oldKeys := make(map[string]struct{})
+	gjson.GetBytes(oldData, keyPath).ForEach(func(k, _ gjson.Result) bool {
+		oldKeys[k.String()] = struct{}{}
+		return true
+	})
+	var added []string
+	gjson.GetBytes(newData, keyPath).ForEach(func(k, _ gjson.Result) bool {
+		if _, exists := oldKeys[k.String()]; !exists {
+			added = append(added, k.String())
+		}
+		return true
+	})
+	if len(added) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+	return &tableDiff{regionFromPath(reqPath), table, added}
+}
+
+// regionFromPath returns the region of a path in the form "{locale}/...".
+func regionFromPath(reqPath string) string {
+	locale := strings.SplitN(reqPath, "/", 2)[0]
+	for region, l := range regionMap {
+		if l == locale {
+			return region
+		}
+	}
+	return ""
+}
+
+// publishDiffs aggregates the diffs by region and publishes a summary for
+// each region with new content.
+func publishDiffs(diffs []*tableDiff) map[string]*UpdateSummary {
+	summaries := make(map[string]*UpdateSummary)
+	for _, diff := range diffs {
+		s, ok := summaries[diff.region]
+		if !ok {
+			s = &UpdateSummary{Region: diff.region}
+			summaries[diff.region] = s
+		}
+		switch diff.table {
+		case "character_table":
+			s.NewOperators = append(s.NewOperators, diff.added...)
+		case "item_table":
+			s.NewItems = append(s.NewItems, diff.added...)
+		case "stage_table":
+			s.NewStages = append(s.NewStages, diff.added...)
+		}
+	}
+	busMutex.Lock()
+	b := bus
+	busMutex.Unlock()
+	for region, s := range summaries {
+		b.Publish(events.Event{
+			Topic:   UpdateTopic,
+			Region:  region,
+			Payload: s,
+		})
+	}
+	return summaries
+}
@@ -0,0 +1,146 @@
+package gamedata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// Mirrors is the list of base URLs mirroring the ArknightsGameData repository.
+	// Mirrors are tried in order, falling through to the next mirror only when
+	// all retries on the current one have failed.
+	Mirrors = []string{
+		rawBaseURL,
+		"https://cdn.jsdelivr.net/gh/Kengxxiao/ArknightsGameData@master/",
+	}
+	// MaxRetries is the number of times a request to a single mirror is retried
+	// on network errors, 429s or 5xx responses.
+	MaxRetries = 3
+	// RetryBackoff is the delay before the first retry, doubling on every
+	// subsequent retry unless the server specifies a Retry-After.
+	RetryBackoff = time.Second
+	// RequestInterval is the minimum interval between any two requests made by
+	// the package, shared among all workers.
+	RequestInterval = 250 * time.Millisecond
+
+	limiter = &rateLimiter{}
+)
+
+// rateLimiter spaces out calls to wait by at least RequestInterval.
+type rateLimiter struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+func (r *rateLimiter) wait() {
+	r.mutex.Lock()
+	now := time.Now()
+	t := r.next
+	if t.Before(now) {
+		t = now
+	}
+	r.next = t.Add(RequestInterval)
+	r.mutex.Unlock()
+	time.Sleep(time.Until(t))
+}
+
+// fetchResult is the outcome of a successful fetch.
+type fetchResult struct {
+	body        []byte
+	etag        string
+	notModified bool
+	url         string
+}
+
+// fetch GETs reqPath from the mirrors with etag as a conditional, retrying with
+// backoff and falling back through the mirrors. The error of the last attempt
+// is returned if all mirrors fail. The etag of a file served by a fallback
+// mirror is dropped, as it's only sent to the first mirror.
+func fetch(client *http.Client, reqPath, etag string) (*fetchResult, error) {
+	var lastErr error
+	for i, mirror := range Mirrors {
+		// ETags are only meaningful for the mirror that issued them.
+		mirrorEtag := ""
+		if i == 0 {
+			mirrorEtag = etag
+		}
+		res, err := fetchWithRetry(client, mirror+reqPath, mirrorEtag)
+		if err == nil {
+			if res.notModified {
+				res.etag = etag
+			} else if i > 0 {
+				res.etag = ""
+			}
+			return res, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func fetchWithRetry(client *http.Client, url, etag string) (*fetchResult, error) {
+	backoff := RetryBackoff
+	var err error
+	for attempt := 0; attempt <= MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var res *fetchResult
+		var retryAfter time.Duration
+		res, retryAfter, err = fetchOnce(client, url, etag)
+		if err == nil {
+			return res, nil
+		}
+		if retryAfter < 0 {
+			// Not retryable
+			return nil, err
+		}
+		if retryAfter > backoff {
+			backoff = retryAfter
+		}
+	}
+	return nil, err
+}
+
+// fetchOnce makes a single rate limited request. The returned duration is
+// negative if the error should not be retried, otherwise it is the delay
+// requested by the server, if any.
+func fetchOnce(client *http.Client, url, etag string) (*fetchResult, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	if etag != "" {
+		req.Header.Add("If-None-Match", etag)
+	}
+	limiter.wait()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		return &fetchResult{notModified: true, url: url}, 0, nil
+	case resp.StatusCode == http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, 0, err
+		}
+		return &fetchResult{body: body, etag: resp.Header.Get("ETag"), url: url}, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var retryAfter time.Duration
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		return nil, retryAfter, fmt.Errorf("Unexpected status %d when fetching %s",
+			resp.StatusCode, url)
+	}
+	return nil, -1, fmt.Errorf("Unexpected status %d when fetching %s",
+		resp.StatusCode, url)
+}
@@ -0,0 +1,29 @@
+package gachatable
+
+import "encoding/json"
+
+func Unmarshal(data []byte) (GachaTable, error) {
+	var r GachaTable
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *GachaTable) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// GachaTable contains the headhunting banners of the game, only the fields
+// Rhine uses are decoded.
+type GachaTable struct {
+	GachaPoolClient []GachaPool `json:"gachaPoolClient"`
+}
+
+// GachaPool describes a banner, times are unix timestamps.
+type GachaPool struct {
+	GachaPoolID   string `json:"gachaPoolId"`
+	GachaIndex    int64  `json:"gachaIndex"`
+	OpenTime      int64  `json:"openTime"`
+	EndTime       int64  `json:"endTime"`
+	GachaPoolName string `json:"gachaPoolName"`
+	GachaRuleType string `json:"gachaRuleType"`
+}
@@ -2,53 +2,81 @@
 // https://github.com/Kengxxiao/ArknightsGameData.
 // The package will automatically query the ArknightsGameData github repository
 // will update the local files if the files are different from the local files.
+//
+// Tables are loaded lazily on first use and are reference counted per GameData
+// handle, so only the tables used by active modules are resident in memory.
+// Calling Close on a GameData handle releases the tables it has acquired.
+// Tables placed in OverrideDir take precedence over the downloaded ones.
 package gamedata
 
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/kyoukaya/rhine/log"
+	"github.com/kyoukaya/rhine/utils/gamedata/activitytable"
+	"github.com/kyoukaya/rhine/utils/gamedata/buildingtable"
+	"github.com/kyoukaya/rhine/utils/gamedata/chartable"
+	"github.com/kyoukaya/rhine/utils/gamedata/gachatable"
 	"github.com/kyoukaya/rhine/utils/gamedata/itemtable"
 	"github.com/kyoukaya/rhine/utils/gamedata/stagetable"
 )
 
+// tableKey identifies a single table for a single region.
+type tableKey struct {
+	region string
+	table  string
+}
+
+// loadedTable is a resident table and the number of GameData handles holding it.
+type loadedTable struct {
+	value interface{}
+	refs  int
+}
+
 type gameDataState struct {
-	stageTableMap map[string]*stagetable.StageTable
-	itemTableMap  map[string]*itemtable.ItemTable
+	tables map[tableKey]*loadedTable
 }
 
 // GameData provides methods to get data structures that contain game related
 // data.
 type GameData struct {
 	region string
+	// held contains the tables acquired by this handle.
+	held map[tableKey]bool
 }
 
 var (
 	// ErrInvalidRegion is returned if the specified region is invalid.
 	ErrInvalidRegion = errors.New("Invalid region")
-	state            *gameDataState
-	stateMutex       sync.Mutex
-	updated          bool
-	regionMap        = map[string]string{
+	// ErrClosed is returned when a table is requested from a closed GameData.
+	ErrClosed  = errors.New("GameData is closed")
+	state      *gameDataState
+	stateMutex sync.Mutex
+	updated    bool
+	regionMap  = map[string]string{
 		"GL": "en_US",
 		"JP": "ja_JP",
 		"KR": "ko_KR",
+		"CN": "zh_CN",
+		"TW": "zh_TW",
 	}
 )
 
 // New creates a new GameData struct, may return an error if an invalid region
-// is provided. Refer to proxy.regionMap for valid region strings.
+// is provided. Refer to Regions for valid region strings. Tables are kept
+// separately for every region, the region of the GameData is used for all
+// lookups unless another region is explicitly requested.
 func New(region string, logger log.Logger) (*GameData, error) {
-	if region != "GL" && region != "JP" && region != "KR" {
+	if _, exists := regionMap[region]; !exists {
 		return nil, ErrInvalidRegion
 	}
 	stateMutex.Lock()
 	if state == nil {
 		state = &gameDataState{
-			stageTableMap: make(map[string]*stagetable.StageTable),
-			itemTableMap:  make(map[string]*itemtable.ItemTable),
+			tables: make(map[tableKey]*loadedTable),
 		}
 	}
 	stateMutex.Unlock()
@@ -59,7 +87,22 @@ func New(region string, logger log.Logger) (*GameData, error) {
 	} else {
 		fileMutex.Unlock()
 	}
-	return &GameData{region}, nil
+	return &GameData{region: region, held: make(map[tableKey]bool)}, nil
+}
+
+// Region returns the region that the GameData looks up tables for by default.
+func (d *GameData) Region() string {
+	return d.region
+}
+
+// Regions returns the regions which gamedata is available for.
+func Regions() []string {
+	ret := make([]string, 0, len(regionMap))
+	for region := range regionMap {
+		ret = append(ret, region)
+	}
+	sort.Strings(ret)
+	return ret
 }
 
 // GetStageInfo provides a reference to the StageTable struct which contains
@@ -67,21 +110,14 @@ func New(region string, logger log.Logger) (*GameData, error) {
 // been loaded yet. Region is an optional argument, by default it will
 // use the region associated with the GameData receiver.
 func (d *GameData) GetStageInfo(region ...string) (*stagetable.StageTable, error) {
-	var regionName string
-	if len(region) > 0 {
-		if _, exists := regionMap[region[0]]; !exists {
-			return nil, ErrInvalidRegion
-		}
-		regionName = region[0]
-	} else {
-		regionName = d.region
-	}
-	stateMutex.Lock()
-	defer stateMutex.Unlock()
-	if _, exists := state.stageTableMap[regionName]; !exists {
-		d.loadStageTable(regionName)
+	v, err := d.acquire("stage_table", region, func(b []byte) (interface{}, error) {
+		table, err := stagetable.Unmarshal(b)
+		return &table, err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return state.stageTableMap[regionName], nil
+	return v.(*stagetable.StageTable), nil
 }
 
 // GetItemInfo provides a reference to the ItemTable struct which contains
@@ -89,6 +125,100 @@ func (d *GameData) GetStageInfo(region ...string) (*stagetable.StageTable, error
 // been loaded yet. Region is an optional argument, by default it will
 // use the region associated with the GameData receiver.
 func (d *GameData) GetItemInfo(region ...string) (*itemtable.ItemTable, error) {
+	v, err := d.acquire("item_table", region, func(b []byte) (interface{}, error) {
+		table, err := itemtable.Unmarshal(b)
+		return &table, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*itemtable.ItemTable), nil
+}
+
+// GetCharInfo provides a reference to the CharTable which contains information
+// about operators. This call will block if the gamedata has not been loaded
+// yet. Region is an optional argument, by default it will use the region
+// associated with the GameData receiver.
+func (d *GameData) GetCharInfo(region ...string) (*chartable.CharTable, error) {
+	v, err := d.acquire("character_table", region, func(b []byte) (interface{}, error) {
+		table, err := chartable.Unmarshal(b)
+		return &table, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*chartable.CharTable), nil
+}
+
+// GetBuildingInfo provides a reference to the BuildingData struct which
+// contains the base skills of operators. This call will block if the gamedata
+// has not been loaded yet. Region is an optional argument, by default it will
+// use the region associated with the GameData receiver.
+func (d *GameData) GetBuildingInfo(region ...string) (*buildingtable.BuildingData, error) {
+	v, err := d.acquire("building_data", region, func(b []byte) (interface{}, error) {
+		table, err := buildingtable.Unmarshal(b)
+		return &table, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*buildingtable.BuildingData), nil
+}
+
+// GetActivityInfo provides a reference to the ActivityTable struct which
+// contains information about events. This call will block if the gamedata has
+// not been loaded yet. Region is an optional argument, by default it will use
+// the region associated with the GameData receiver.
+func (d *GameData) GetActivityInfo(region ...string) (*activitytable.ActivityTable, error) {
+	v, err := d.acquire("activity_table", region, func(b []byte) (interface{}, error) {
+		table, err := activitytable.Unmarshal(b)
+		return &table, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*activitytable.ActivityTable), nil
+}
+
+// GetGachaInfo provides a reference to the GachaTable struct which contains
+// information about headhunting banners. This call will block if the gamedata
+// has not been loaded yet. Region is an optional argument, by default it will
+// use the region associated with the GameData receiver.
+func (d *GameData) GetGachaInfo(region ...string) (*gachatable.GachaTable, error) {
+	v, err := d.acquire("gacha_table", region, func(b []byte) (interface{}, error) {
+		table, err := gachatable.Unmarshal(b)
+		return &table, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*gachatable.GachaTable), nil
+}
+
+// Close releases all the tables acquired by the GameData handle. Tables which
+// are no longer held by any handle are dropped from memory. References to
+// tables previously returned remain valid but will not be shared with tables
+// loaded after they are dropped.
+func (d *GameData) Close() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	for key := range d.held {
+		t, ok := state.tables[key]
+		if !ok {
+			continue
+		}
+		t.refs--
+		if t.refs <= 0 {
+			delete(state.tables, key)
+		}
+	}
+	d.held = nil
+}
+
+// acquire returns the table for the region, loading it with unmarshal if it is
+// not yet resident, and records that the handle holds a reference to it.
+func (d *GameData) acquire(table string, region []string,
+	unmarshal func([]byte) (interface{}, error)) (interface{}, error) {
 	var regionName string
 	if len(region) > 0 {
 		if _, exists := regionMap[region[0]]; !exists {
@@ -98,12 +228,46 @@ func (d *GameData) GetItemInfo(region ...string) (*itemtable.ItemTable, error) {
 	} else {
 		regionName = d.region
 	}
+	key := tableKey{regionName, table}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if d.held == nil {
+		return nil, ErrClosed
+	}
+	t, exists := state.tables[key]
+	if !exists {
+		b, release, err := loadExcelJSON(regionName, table)
+		if err != nil {
+			return nil, err
+		}
+		v, err := unmarshal(b)
+		release()
+		if err != nil {
+			return nil, err
+		}
+		t = &loadedTable{value: v}
+		state.tables[key] = t
+	}
+	if !d.held[key] {
+		d.held[key] = true
+		t.refs++
+	}
+	return t.value, nil
+}
+
+// Resident returns the names of the tables currently held in memory in the
+// form "{region}/{table}".
+func Resident() []string {
 	stateMutex.Lock()
 	defer stateMutex.Unlock()
-	if _, exists := state.itemTableMap[regionName]; !exists {
-		d.loadItemTable(regionName)
+	if state == nil {
+		return nil
+	}
+	ret := make([]string, 0, len(state.tables))
+	for key := range state.tables {
+		ret = append(ret, key.region+"/"+key.table)
 	}
-	return state.itemTableMap[regionName], nil
+	return ret
 }
 
 // ErrPathOutOfBounds is returned when the fileName specified breaks out the directory.
@@ -2,9 +2,12 @@ package gamedata
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/kyoukaya/rhine/events"
 	"github.com/kyoukaya/rhine/utils"
 )
 
@@ -57,3 +60,48 @@ func TestItemTable(t *testing.T) {
 	}
 	t.Log(item)
 }
+
+func TestFetchFallbackDropsEtag(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer down.Close()
+	var gotEtag string
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEtag = r.Header.Get("If-None-Match")
+		w.Header().Set("ETag", `"fallback"`)
+		w.Write([]byte("{}"))
+	}))
+	defer fallback.Close()
+	mirrors := Mirrors
+	defer func() { Mirrors = mirrors }()
+	Mirrors = []string{down.URL + "/", fallback.URL + "/"}
+
+	res, err := fetch(http.DefaultClient, "table.json", `"primary"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotEtag != "" {
+		t.Fatalf("Expected the first mirror's etag not to be sent to the fallback, got %s", gotEtag)
+	}
+	if res.etag != "" {
+		t.Fatalf("Expected the fallback's etag to be dropped, got %s", res.etag)
+	}
+}
+
+func TestPublishDiffs(t *testing.T) {
+	b := events.NewBus(logShim{t})
+	SetEventBus(b)
+	defer SetEventBus(events.Default)
+	listener := make(chan events.Event, 1)
+	b.Subscribe(UpdateTopic, listener)
+	publishDiffs([]*tableDiff{{"JP", "item_table", []string{"1stact"}}})
+	select {
+	case evt := <-listener:
+		if s := evt.Payload.(*UpdateSummary); evt.Region != "JP" || len(s.NewItems) != 1 {
+			t.Fatalf("Unexpected summary %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the summary to be published on the bus")
+	}
+}
@@ -0,0 +1,153 @@
+package gamedata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kyoukaya/rhine/utils"
+)
+
+// indexEntry describes a table file available on the disk.
+type indexEntry struct {
+	path     string
+	size     int64
+	override bool
+}
+
+var (
+	// OverrideDir is the directory in which modified or unreleased tables can
+	// be placed to take precedence over the downloaded gamedata. It follows
+	// the same layout as the data directory, e.g.,
+	// "{OverrideDir}/en_US/gamedata/excel/item_table.json", and is relative
+	// to utils.BinDir unless absolute. Set to "" to disable overrides.
+	OverrideDir = "data/override"
+	// tableIndex maps every table available on the disk to its file. It is
+	// rebuilt after every update so that table lookups don't touch the
+	// filesystem until the table is actually loaded.
+	tableIndex      map[tableKey]indexEntry
+	tableIndexMutex sync.Mutex
+)
+
+// buildIndex scans the excel directories of every region for table files,
+// tables found in OverrideDir take precedence over the downloaded tables.
+func buildIndex() map[tableKey]indexEntry {
+	index := make(map[tableKey]indexEntry)
+	scanTables(index, utils.BinDir+"/data", false)
+	if OverrideDir != "" {
+		dir := OverrideDir
+		if !filepath.IsAbs(dir) {
+			dir = utils.BinDir + "/" + dir
+		}
+		scanTables(index, dir, true)
+	}
+	return index
+}
+
+// scanTables adds the tables found under root into the index, overwriting
+// existing entries.
+func scanTables(index map[tableKey]indexEntry, root string, override bool) {
+	for region, locale := range regionMap {
+		dir := fmt.Sprintf("%s/%s/gamedata/excel", root, locale)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range files {
+			name := fi.Name()
+			if fi.IsDir() || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			key := tableKey{region, strings.TrimSuffix(name, ".json")}
+			index[key] = indexEntry{filepath.Join(dir, name), fi.Size(), override}
+		}
+	}
+}
+
+// Overrides returns the names of the tables for a region which are loaded
+// from the override directory, sorted alphabetically.
+func Overrides(region string) ([]string, error) {
+	if _, exists := regionMap[region]; !exists {
+		return nil, ErrInvalidRegion
+	}
+	tableIndexMutex.Lock()
+	defer tableIndexMutex.Unlock()
+	if tableIndex == nil {
+		tableIndex = buildIndex()
+	}
+	var ret []string
+	for key, entry := range tableIndex {
+		if key.region == region && entry.override {
+			ret = append(ret, key.table)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// refreshIndex rebuilds the table index.
+func refreshIndex() {
+	index := buildIndex()
+	tableIndexMutex.Lock()
+	tableIndex = index
+	tableIndexMutex.Unlock()
+}
+
+// lookupIndex returns the file for a table, building the index if it has not
+// been built yet.
+func lookupIndex(key tableKey) (indexEntry, bool) {
+	tableIndexMutex.Lock()
+	defer tableIndexMutex.Unlock()
+	if tableIndex == nil {
+		tableIndex = buildIndex()
+	}
+	entry, ok := tableIndex[key]
+	return entry, ok
+}
+
+// Tables returns the names of the tables available on the disk for a region,
+// sorted alphabetically.
+func Tables(region string) ([]string, error) {
+	if _, exists := regionMap[region]; !exists {
+		return nil, ErrInvalidRegion
+	}
+	tableIndexMutex.Lock()
+	defer tableIndexMutex.Unlock()
+	if tableIndex == nil {
+		tableIndex = buildIndex()
+	}
+	var ret []string
+	for key := range tableIndex {
+		if key.region == region {
+			ret = append(ret, key.table)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// readTable reads the file at path, memory mapping it if UseMmap is set. The
+// release function returned must be called once the caller is done with the
+// returned slice.
+func readTable(path string, size int64) ([]byte, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	if UseMmap && size > 0 {
+		b, err := mmapFile(f, size)
+		if err == nil {
+			return b, func() { munmapFile(b) }, nil
+		}
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, func() {}, nil
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
@@ -14,8 +13,6 @@ import (
 
 	"github.com/kyoukaya/rhine/log"
 	"github.com/kyoukaya/rhine/utils"
-	"github.com/kyoukaya/rhine/utils/gamedata/itemtable"
-	"github.com/kyoukaya/rhine/utils/gamedata/stagetable"
 
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/json"
@@ -33,17 +30,25 @@ var (
 		"%s/gamedata/excel/item_table.json",
 		"%s/gamedata/excel/character_table.json",
 		"%s/gamedata/excel/gacha_table.json",
+		"%s/gamedata/excel/building_data.json",
+		"%s/gamedata/excel/activity_table.json",
 	}
 	updateChecked = false
 	// fileMutex is locked on program init
 	fileMutex            sync.Mutex
 	versionFileDelimiter = []byte(" ")
+	// UseMmap makes tables be memory mapped from the disk while they are being
+	// unmarshalled instead of being read into the heap. Only supported on
+	// unix-like systems, the file is read normally otherwise.
+	UseMmap = false
 )
 
-// updateGameData sends parallel GET requests to each individual file in fileList for all regions in regionMap.
-// The number of parallel connections is limited by maxConnections which defaults to 4,
-// ETags are sent with the GET requests where possible, which are read from the
-// data/.version file, to minimize network traffic.
+// updateGameData sends parallel GET requests to each individual file in
+// fileList for all regions in regionMap. The number of parallel connections is
+// limited by maxConnections which defaults to 4, and requests across all
+// connections are spaced by RequestInterval. ETags are sent with the GET
+// requests where possible, which are read from the data/.version file, to
+// minimize network traffic.
 func updateGameData(l log.Logger) {
 	var err error
 	defer fileMutex.Unlock()
@@ -62,9 +67,11 @@ func updateGameData(l log.Logger) {
 	errs := make(chan error, nFiles)
 	// Return channel for the resulting path + etag string
 	etags := make(chan string, nFiles)
+	// Return channel for the content added to updated tables
+	diffs := make(chan *tableDiff, nFiles)
 	for i := 0; i < maxConnections; i++ {
 		wg.Add(1)
-		go getAndUpdate(&wg, jobs, etags, errs, verMap)
+		go getAndUpdate(&wg, jobs, etags, diffs, errs, verMap)
 	}
 	// Send jobs to workers
 	for _, region := range regionMap {
@@ -76,6 +83,7 @@ func updateGameData(l log.Logger) {
 	wg.Wait()
 	close(errs)
 	close(etags)
+	close(diffs)
 
 	for err := range errs {
 		l.Warnln(err)
@@ -106,47 +114,42 @@ func updateGameData(l log.Logger) {
 		}
 	}
 	updateChecked = true
+	refreshIndex()
+	var tableDiffs []*tableDiff
+	for diff := range diffs {
+		tableDiffs = append(tableDiffs, diff)
+	}
+	for region, summary := range publishDiffs(tableDiffs) {
+		l.Printf("New gamedata for %s: %d operators, %d items, %d stages", region,
+			len(summary.NewOperators), len(summary.NewItems), len(summary.NewStages))
+	}
+	for region := range regionMap {
+		if tables, _ := Overrides(region); len(tables) > 0 {
+			l.Printf("Using override gamedata for %s: %v", region, tables)
+		}
+	}
 	l.Println("Game data updated.")
 }
 
-// getAndUpdate is the worker thread spawned by updateGameData, it concatenates
-// the raw base URL with the path sent in the jobs channel and GETs it with the
-// corresponding etag from the verMap if it is available. If the response code is
-// 200, the worker minifies the json and saves it to the disk.
+// getAndUpdate is the worker thread spawned by updateGameData, it GETs the path
+// sent in the jobs channel from the configured Mirrors with the corresponding
+// etag from the verMap if it is available. If the file has been modified, the
+// worker minifies the json and saves it to the disk.
 func getAndUpdate(wg *sync.WaitGroup, jobs chan string, etags chan string,
-	errs chan error, verMap map[string]string) {
+	diffs chan *tableDiff, errs chan error, verMap map[string]string) {
 	client := http.DefaultClient
 	defer wg.Done()
 	m := minify.New()
 	m.AddFuncRegexp(regexp.MustCompile("[/+]json$"), json.Minify)
 	for reqPath := range jobs {
-		// do job
-		req, err := http.NewRequest(http.MethodGet, rawBaseURL+reqPath, nil)
-		if err != nil {
-			errs <- err
-			continue
-		}
 		etag := verMap[reqPath]
-		if etag != "" {
-			req.Header.Add("If-None-Match", etag)
-		}
-		resp, err := client.Do(req)
+		res, err := fetch(client, reqPath, etag)
 		if err != nil {
 			errs <- err
 			continue
 		}
-		if etag != "" && resp.StatusCode == 304 {
-			etags <- reqPath + string(versionFileDelimiter) + etag
-			continue
-		}
-		if resp.StatusCode != 200 {
-			errs <- fmt.Errorf("Unexpected status %d when fetching %s",
-				resp.StatusCode, rawBaseURL+reqPath)
-			return
-		}
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			errs <- err
+		if res.notModified {
+			etags <- reqPath + string(versionFileDelimiter) + res.etag
 			continue
 		}
 		fileName := utils.BinDir + "/data/" + reqPath
@@ -155,21 +158,30 @@ func getAndUpdate(wg *sync.WaitGroup, jobs chan string, etags chan string,
 			errs <- err
 			continue
 		}
+		if diff := diffTable(reqPath, fileName, res.body); diff != nil {
+			diffs <- diff
+		}
 		f, err := os.Create(fileName)
 		if err != nil {
 			errs <- err
 			continue
 		}
-		err = m.Minify("application/json", f, bytes.NewBuffer(body))
+		err = m.Minify("application/json", f, bytes.NewBuffer(res.body))
+		f.Close()
 		if err != nil {
 			errs <- err
 			continue
 		}
-		etag = resp.Header.Get("ETag")
-		etags <- reqPath + string(versionFileDelimiter) + etag
+		etags <- reqPath + string(versionFileDelimiter) + res.etag
 	}
 }
 
+// Versions returns the etags of the downloaded gamedata files by path, which
+// identify the version of the gamedata.
+func Versions() map[string]string {
+	return loadVersionFile()
+}
+
 // loadVersionFile loads the version file from the data folder and returns a map
 // of the files to their etags.
 func loadVersionFile() map[string]string {
@@ -199,28 +211,19 @@ func loadVersionFile() map[string]string {
 	return ret
 }
 
-func loadExcelJSON(region, table string) []byte {
+// loadExcelJSON returns the raw bytes of a table from the index. The release
+// function must be called once the bytes are no longer in use.
+func loadExcelJSON(region, table string) ([]byte, func(), error) {
 	fileMutex.Lock()
 	defer fileMutex.Unlock()
-	f, err := os.Open(fmt.Sprintf(
-		excelPathFmt, utils.BinDir, regionMap[region], table))
-	utils.Check(err)
-	defer f.Close()
-	b, err := ioutil.ReadAll(f)
-	utils.Check(err)
-	return b
-}
-
-func (d *GameData) loadStageTable(region string) {
-	b := loadExcelJSON(region, "stage_table")
-	stageTable, err := stagetable.Unmarshal(b)
-	utils.Check(err)
-	state.stageTableMap[region] = &stageTable
-}
-
-func (d *GameData) loadItemTable(region string) {
-	b := loadExcelJSON(region, "item_table")
-	itemTable, err := itemtable.Unmarshal(b)
-	utils.Check(err)
-	state.itemTableMap[region] = &itemTable
+	entry, ok := lookupIndex(tableKey{region, table})
+	if !ok {
+		entry.path = fmt.Sprintf(excelPathFmt, utils.BinDir, regionMap[region], table)
+		fi, err := os.Stat(entry.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.size = fi.Size()
+	}
+	return readTable(entry.path, entry.size)
 }
@@ -0,0 +1,30 @@
+package gamedata
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Verify checks that every table of the region is on the disk and is valid
+// JSON, returning the error of the first table which isn't.
+func Verify(region string) error {
+	if _, exists := regionMap[region]; !exists {
+		return ErrInvalidRegion
+	}
+	refreshIndex()
+	for _, file := range fileList {
+		table := strings.TrimSuffix(path.Base(file), ".json")
+		b, release, err := loadExcelJSON(region, table)
+		if err != nil {
+			return fmt.Errorf("%s: %s", table, err)
+		}
+		valid := json.Valid(b)
+		release()
+		if !valid {
+			return fmt.Errorf("%s: not valid JSON", table)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ErrKeychainUnsupported is returned by the keychain functions on platforms
+// without a supported keychain.
+var ErrKeychainUnsupported = errors.New("keychain is not supported on " + runtime.GOOS)
+
+// KeychainGet returns the secret stored under the service and account in the
+// OS keychain, the login keychain on macOS and the Secret Service (e.g., GNOME
+// Keyring or KWallet, through secret-tool) on Linux and BSDs.
+func KeychainGet(service, account string) ([]byte, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "linux", "freebsd", "openbsd", "netbsd", "dragonfly":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	default:
+		return nil, ErrKeychainUnsupported
+	}
+	out, err := output(cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Secrets are stored base64 encoded as macOS mangles non-printable ones.
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+// KeychainSet stores the secret under the service and account in the OS
+// keychain, replacing any existing one.
+func KeychainSet(service, account string, secret []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(secret)
+	var cmd *exec.Cmd
+	var stdin []byte
+	switch runtime.GOOS {
+	case "darwin":
+		// security only reads the password from its arguments or a terminal,
+		// so the command is read from stdin in interactive mode instead, which
+		// keeps the secret out of the process list.
+		cmd = exec.Command("security", "-i")
+		stdin = []byte(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+			securityQuote(service), securityQuote(account), securityQuote(encoded)))
+	case "linux", "freebsd", "openbsd", "netbsd", "dragonfly":
+		cmd = exec.Command("secret-tool", "store", "--label", service+" "+account, "service", service, "account", account)
+		stdin = []byte(encoded)
+	default:
+		return ErrKeychainUnsupported
+	}
+	if _, err := output(cmd, stdin); err != nil {
+		return err
+	}
+	if runtime.GOOS == "darwin" {
+		// Failed commands don't fail security's interactive mode, the secret
+		// is read back to find whether it was stored.
+		stored, err := KeychainGet(service, account)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(stored, secret) {
+			return errors.New("security: failed to store the secret")
+		}
+	}
+	return nil
+}
+
+// securityQuote quotes an argument of a command of security's interactive
+// mode.
+func securityQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// output runs cmd with stdin, including its stderr in the returned error.
+func output(cmd *exec.Cmd, stdin []byte) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", cmd.Args[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", cmd.Args[0], err)
+	}
+	return out, nil
+}
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"unicode/utf16"
+)
+
+// The subset of PKCS#12 (RFC 7292) needed to export a certificate and its key
+// readable by OpenSSL, Java, Windows, macOS, iOS and Android. The key is
+// encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and the archive authenticated
+// with HMAC-SHA1, the most widely supported algorithms.
+
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidShroudedKeyBag    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBEWithSHAAnd3DES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const (
+	pkcs12Iterations = 2048
+	tagBMPString     = 30
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data asn1.RawValue
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// explicit wraps der in a [0] EXPLICIT tag.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// bmpString encodes s as a null terminated UTF-16BE string.
+func bmpString(s string) []byte {
+	var ret []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		ret = append(ret, byte(r>>8), byte(r))
+	}
+	return append(ret, 0, 0)
+}
+
+// pkcs12KDF derives size bytes of key material from the password and salt
+// as specified by RFC 7292 appendix B.2 with SHA-1, id being 1 for keys, 2 for
+// IVs and 3 for MAC keys.
+func pkcs12KDF(password, salt []byte, iterations int, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		ret := make([]byte, v*((len(b)+v-1)/v))
+		for i := range ret {
+			ret[i] = b[i%len(b)]
+		}
+		return ret
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	in := append(fill(salt), fill(password)...)
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(in)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v byte block of I.
+		b := new(big.Int).SetBytes(fill(a[:u])[:v])
+		for j := 0; j < len(in); j += v {
+			sum := new(big.Int).SetBytes(in[j : j+v])
+			sum.Add(sum, b)
+			sum.Add(sum, one)
+			bytes := sum.Bytes()
+			if len(bytes) > v {
+				bytes = bytes[len(bytes)-v:]
+			}
+			block := in[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(bytes):], bytes)
+		}
+	}
+	return out[:size]
+}
+
+// encryptKey returns the PKCS#8 encoding of key encrypted with the password.
+func encryptKey(key interface{}, password []byte) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	block, err := des.NewTripleDESCipher(pkcs12KDF(password, salt, pkcs12Iterations, 1, 24))
+	if err != nil {
+		return nil, err
+	}
+	iv := pkcs12KDF(password, salt, pkcs12Iterations, 2, block.BlockSize())
+	padding := block.BlockSize() - len(pkcs8)%block.BlockSize()
+	for i := 0; i < padding; i++ {
+		pkcs8 = append(pkcs8, byte(padding))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(pkcs8, pkcs8)
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3DES, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: pkcs8,
+	})
+}
+
+// EncodePKCS12 returns a PKCS#12 archive of the certificate and its private
+// key, encrypted with the password, friendlyName naming them in keystores.
+func EncodePKCS12(cert *tls.Certificate, friendlyName, password string) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	if cert.PrivateKey == nil {
+		return nil, errors.New("no private key")
+	}
+	pw := bmpString(password)
+	localKeyID := sha1.Sum(cert.Certificate[0])
+	name := bmpString(friendlyName)
+	nameDER, err := asn1.Marshal(asn1.RawValue{Tag: tagBMPString, Bytes: name[:len(name)-2]})
+	if err != nil {
+		return nil, err
+	}
+	attributes := []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: nameDER}},
+		{ID: oidLocalKeyID, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: mustOctetString(localKeyID[:])}},
+	}
+
+	certDER, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: explicit(mustOctetString(cert.Certificate[0]))})
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := encryptKey(cert.PrivateKey, pw)
+	if err != nil {
+		return nil, err
+	}
+	var safes []contentInfo
+	for _, bag := range []safeBag{
+		{ID: oidCertBag, Value: explicit(certDER), Attributes: attributes},
+		{ID: oidShroudedKeyBag, Value: explicit(keyDER), Attributes: attributes},
+	} {
+		contents, err := asn1.Marshal([]safeBag{bag})
+		if err != nil {
+			return nil, err
+		}
+		safes = append(safes, contentInfo{ContentType: oidData, Content: explicit(mustOctetString(contents))})
+	}
+	authSafe, err := asn1.Marshal(safes)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12KDF(pw, salt, pkcs12Iterations, 3, sha1.Size))
+	mac.Write(authSafe)
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidData, Content: explicit(mustOctetString(authSafe))},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// mustOctetString returns the DER encoding of b as an OCTET STRING, which
+// cannot fail.
+func mustOctetString(b []byte) []byte {
+	der, err := asn1.Marshal(b)
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
@@ -0,0 +1,89 @@
+// Package servertime provides the daily and weekly reset instants of the game
+// servers for each region. Servers reset daily at 04:00 and weekly on Monday at
+// 04:00 in their server time, which is a fixed offset from UTC without DST.
+package servertime
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// ResetHour is the hour of the day, in server time, at which servers reset.
+	ResetHour = 4
+	// WeeklyResetDay is the day of the week on which the weekly reset occurs.
+	WeeklyResetDay = time.Monday
+)
+
+// ErrInvalidRegion is returned if the specified region has no known server time.
+var ErrInvalidRegion = errors.New("Invalid region")
+
+// offsets maps the regions to their server time's offset from UTC in hours.
+var offsets = map[string]int{
+	"GL": -7,
+	"JP": 9,
+	"KR": 9,
+	"CN": 8,
+	"TW": 8,
+}
+
+// Location returns the fixed time zone of the region's server time.
+func Location(region string) (*time.Location, error) {
+	offset, ok := offsets[region]
+	if !ok {
+		return nil, ErrInvalidRegion
+	}
+	return time.FixedZone("Server/"+region, offset*60*60), nil
+}
+
+// LastDailyReset returns the latest daily reset at or before t.
+func LastDailyReset(region string, t time.Time) (time.Time, error) {
+	loc, err := Location(region)
+	if err != nil {
+		return time.Time{}, err
+	}
+	st := t.In(loc)
+	reset := time.Date(st.Year(), st.Month(), st.Day(), ResetHour, 0, 0, 0, loc)
+	if reset.After(st) {
+		reset = reset.AddDate(0, 0, -1)
+	}
+	return reset, nil
+}
+
+// NextDailyReset returns the earliest daily reset after t.
+func NextDailyReset(region string, t time.Time) (time.Time, error) {
+	last, err := LastDailyReset(region, t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return last.AddDate(0, 0, 1), nil
+}
+
+// LastWeeklyReset returns the latest weekly reset at or before t.
+func LastWeeklyReset(region string, t time.Time) (time.Time, error) {
+	last, err := LastDailyReset(region, t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	days := (int(last.Weekday()) - int(WeeklyResetDay) + 7) % 7
+	return last.AddDate(0, 0, -days), nil
+}
+
+// NextWeeklyReset returns the earliest weekly reset after t.
+func NextWeeklyReset(region string, t time.Time) (time.Time, error) {
+	last, err := LastWeeklyReset(region, t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return last.AddDate(0, 0, 7), nil
+}
+
+// GameDay returns the date of the server day which t falls on, days begin at
+// the daily reset and not at midnight.
+func GameDay(region string, t time.Time) (time.Time, error) {
+	last, err := LastDailyReset(region, t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, last.Location()), nil
+}
@@ -0,0 +1,49 @@
+package servertime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDailyReset(t *testing.T) {
+	// 2020-03-02 10:59 UTC is 03:59 on a Monday in GL server time.
+	now := time.Date(2020, 3, 2, 10, 59, 0, 0, time.UTC)
+	next, err := NextDailyReset("GL", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 3, 2, 11, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("Expected %s, got %s", want, next)
+	}
+	last, _ := LastDailyReset("GL", now)
+	if want := time.Date(2020, 3, 1, 11, 0, 0, 0, time.UTC); !last.Equal(want) {
+		t.Fatalf("Expected %s, got %s", want, last)
+	}
+	// Exactly on the reset is considered to be after the reset.
+	last, _ = LastDailyReset("JP", time.Date(2020, 3, 1, 19, 0, 0, 0, time.UTC))
+	if want := time.Date(2020, 3, 1, 19, 0, 0, 0, time.UTC); !last.Equal(want) {
+		t.Fatalf("Expected %s, got %s", want, last)
+	}
+}
+
+func TestWeeklyReset(t *testing.T) {
+	// Sunday 2020-03-01 12:00 UTC, is Sunday 21:00 in JP.
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	next, err := NextWeeklyReset("JP", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 3, 1, 19, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("Expected %s, got %s", want, next)
+	}
+	last, _ := LastWeeklyReset("JP", now)
+	if want := time.Date(2020, 2, 23, 19, 0, 0, 0, time.UTC); !last.Equal(want) {
+		t.Fatalf("Expected %s, got %s", want, last)
+	}
+}
+
+func TestInvalidRegion(t *testing.T) {
+	if _, err := NextDailyReset("XX", time.Now()); err != ErrInvalidRegion {
+		t.Fatal("Expected ErrInvalidRegion")
+	}
+}
@@ -3,7 +3,6 @@
 package utils
 
 import (
-	"fmt"
 	"net"
 	"os"
 	"path/filepath"
@@ -25,13 +24,28 @@ func Check(err error) {
 	}
 }
 
-// GetOutboundIP gets preferred outbound ip of this machine.
+// GetOutboundIP gets preferred outbound ip of this machine, the IPv4 address
+// if there is one. Returns an empty string if there is no route to the internet.
 func GetOutboundIP() string {
-	conn, err := net.Dial("udp", "1.1.1.1:80")
-	if err != nil {
-		fmt.Println(err)
+	ips := GetOutboundIPs()
+	if len(ips) == 0 {
+		return ""
+	}
+	return ips[0]
+}
+
+// GetOutboundIPs gets the preferred outbound IPv4 and IPv6 addresses of this
+// machine, in that order, omitting address families without a route.
+func GetOutboundIPs() []string {
+	var ips []string
+	// Dialing UDP doesn't send any packets, it only picks the source address.
+	for _, target := range [][2]string{{"udp4", "1.1.1.1:80"}, {"udp6", "[2606:4700:4700::1111]:80"}} {
+		conn, err := net.Dial(target[0], target[1])
+		if err != nil {
+			continue
+		}
+		ips = append(ips, conn.LocalAddr().(*net.UDPAddr).IP.String())
+		conn.Close()
 	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String()
+	return ips
 }
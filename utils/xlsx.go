@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Sheet is a worksheet of an XLSX workbook, its first row usually being the
+// header.
+type Sheet struct {
+	Name string
+	Rows [][]string
+}
+
+// xlsxPart is a file of the workbook's archive.
+type xlsxPart struct {
+	name    string
+	content string
+}
+
+// xlsxColumn returns the letters of the 0 based column, e.g., "A" or "AB".
+func xlsxColumn(i int) string {
+	var col []byte
+	for i++; i > 0; i = (i - 1) / 26 {
+		col = append([]byte{byte('A' + (i-1)%26)}, col...)
+	}
+	return string(col)
+}
+
+// isXLSXNumber reports whether the cell is written as a number, which excludes
+// values whose formatting would be lost, such as leading zeros.
+func isXLSXNumber(v string) bool {
+	digits := strings.TrimPrefix(v, "-")
+	if digits == "" || len(digits) > 15 || (len(digits) > 1 && digits[0] == '0' && digits[1] != '.') {
+		return false
+	}
+	for i := 0; i < len(digits); i++ {
+		if (digits[i] < '0' || digits[i] > '9') && digits[i] != '.' {
+			return false
+		}
+	}
+	_, err := strconv.ParseFloat(v, 64)
+	return err == nil
+}
+
+func writeXLSXSheet(w io.Writer, rows [][]string) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		fmt.Fprintf(buf, `<row r="%d">`, i+1)
+		for j, v := range row {
+			ref := xlsxColumn(j) + strconv.Itoa(i+1)
+			if isXLSXNumber(v) {
+				fmt.Fprintf(buf, `<c r="%s"><v>%s</v></c>`, ref, v)
+				continue
+			}
+			fmt.Fprintf(buf, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			_ = xml.EscapeText(buf, []byte(v))
+			buf.WriteString(`</t></is></c>`)
+		}
+		buf.WriteString(`</row>`)
+	}
+	buf.WriteString(`</sheetData></worksheet>`)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteXLSX writes the sheets as an XLSX workbook. Cells which parse as
+// numbers are written as numbers, the others as text.
+func WriteXLSX(w io.Writer, sheets []Sheet) error {
+	z := zip.NewWriter(w)
+	parts := []xlsxPart{
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+	}
+	contentTypes := &bytes.Buffer{}
+	contentTypes.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	workbook := &bytes.Buffer{}
+	workbook.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels := &bytes.Buffer{}
+	rels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, sheet := range sheets {
+		fmt.Fprintf(contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" `+
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		workbook.WriteString(`<sheet name="`)
+		_ = xml.EscapeText(workbook, []byte(sheet.Name))
+		fmt.Fprintf(workbook, `" sheetId="%d" r:id="rId%d"/>`, i+1, i+1)
+		fmt.Fprintf(rels, `<Relationship Id="rId%d" `+
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" `+
+			`Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	rels.WriteString(`</Relationships>`)
+	parts = append(parts,
+		xlsxPart{"[Content_Types].xml", contentTypes.String()},
+		xlsxPart{"xl/workbook.xml", workbook.String()},
+		xlsxPart{"xl/_rels/workbook.xml.rels", rels.String()},
+	)
+	for _, part := range parts {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+	for i, sheet := range sheets {
+		f, err := z.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := writeXLSXSheet(f, sheet.Rows); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
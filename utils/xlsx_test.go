@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestWriteXLSX(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WriteXLSX(buf, []Sheet{
+		{Name: "drops", Rows: [][]string{{"item", "count"}, {"30012", "2"}, {"<&>", "007"}}},
+		{Name: "gacha", Rows: [][]string{{"char"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml",
+		"xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml", "xl/worksheets/sheet2.xml"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("Missing %s", name)
+		}
+	}
+	if !strings.Contains(files["xl/workbook.xml"], `<sheet name="gacha" sheetId="2" r:id="rId2"/>`) {
+		t.Fatalf("Unexpected workbook %s", files["xl/workbook.xml"])
+	}
+	sheet := files["xl/worksheets/sheet1.xml"]
+	for _, cell := range []string{
+		`<c r="A2"><v>30012</v></c>`,
+		`<c r="A3" t="inlineStr"><is><t xml:space="preserve">&lt;&amp;&gt;</t></is></c>`,
+		`<c r="B3" t="inlineStr"><is><t xml:space="preserve">007</t></is></c>`,
+	} {
+		if !strings.Contains(sheet, cell) {
+			t.Fatalf("Expected %s in %s", cell, sheet)
+		}
+	}
+	if col := xlsxColumn(27); col != "AB" {
+		t.Fatalf("Expected column AB, got %s", col)
+	}
+}